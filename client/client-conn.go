@@ -6,10 +6,13 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"time"
 	"unicode"
 
 	"github.com/amitbet/vncproxy/common"
 	"github.com/amitbet/vncproxy/logger"
+	"github.com/amitbet/vncproxy/metrics"
 )
 
 // A ServerMessage implements a message sent from the server to the client.
@@ -56,13 +59,18 @@ type ClientConn struct {
 	// Name associated with the desktop, sent from the server.
 	desktopName string
 	sessionId   string
+	accessLevel common.AccessLevel
 
 	// The pixel format associated with the connection. This shouldn't
 	// be modified. If you wish to set a new pixel format, use the
-	// SetPixelFormat method.
-	PixelFormat common.PixelFormat
+	// SetPixelFormat method. Once connected it is read by the connection's
+	// reader goroutine, use CurrentPixelFormat to read it.
+	PixelFormat      common.PixelFormat
+	pixelFormatMutex sync.Mutex
 
 	listeners *common.MultiListener
+
+	log *logger.FieldLogger
 }
 
 // A ClientConfig structure is used to configure a ClientConn. After
@@ -81,6 +89,10 @@ type ClientConfig struct {
 	// This only needs to contain NEW server messages, and doesn't
 	// need to explicitly contain the RFC-required messages.
 	ServerMessages []common.ServerMessage
+
+	// HandshakeTimeout limits the time from connecting to the server-init message, 0 = no limit.
+	// It needs a connection with deadlines (a net.Conn).
+	HandshakeTimeout time.Duration
 }
 
 func NewClientConn(c net.Conn, cfg *ClientConfig) (*ClientConn, error) {
@@ -88,17 +100,30 @@ func NewClientConn(c net.Conn, cfg *ClientConfig) (*ClientConn, error) {
 		conn:      c,
 		config:    cfg,
 		listeners: &common.MultiListener{},
+		log:       common.ConnLogger(logger.FieldTarget, c),
 	}
 	return conn, nil
 }
 
 func (conn *ClientConn) Connect() error {
+	deadlineConn, hasDeadline := conn.conn.(interface{ SetDeadline(time.Time) error })
+	hasDeadline = hasDeadline && conn.config.HandshakeTimeout > 0
+	if hasDeadline {
+		deadlineConn.SetDeadline(time.Now().Add(conn.config.HandshakeTimeout))
+	}
 
 	if err := conn.handshake(); err != nil {
-		logger.Errorf("ClientConn.Connect error: %v", err)
+		conn.log.Errorf("ClientConn.Connect error: %v", err)
 		conn.Close()
 		return err
 	}
+	if hasDeadline {
+		//the handshake may have wrapped the connection (in tls), the wrapper passes the deadline on
+		if wrapped, ok := conn.conn.(interface{ SetDeadline(time.Time) error }); ok {
+			deadlineConn = wrapped
+		}
+		deadlineConn.SetDeadline(time.Time{})
+	}
 
 	go conn.mainLoop()
 
@@ -121,20 +146,44 @@ func (c *ClientConn) SessionId() string {
 	return c.sessionId
 }
 
+func (c *ClientConn) SetAccessLevel(level common.AccessLevel) {
+	c.accessLevel = level
+}
+
+func (c *ClientConn) AccessLevel() common.AccessLevel {
+	return c.accessLevel
+}
+
+// SetLogger sets the logger of the connection, with the fields of the session it serves
+func (c *ClientConn) SetLogger(log *logger.FieldLogger) {
+	c.log = log
+}
+
+func (c *ClientConn) Logger() *logger.FieldLogger {
+	return c.log
+}
+
 func (c *ClientConn) Listeners() *common.MultiListener {
 	return c.listeners
 }
 
+// CurrentPixelFormat returns a copy of the pixel format the server's messages are parsed with
 func (c *ClientConn) CurrentPixelFormat() *common.PixelFormat {
-	return &c.PixelFormat
+	c.pixelFormatMutex.Lock()
+	defer c.pixelFormatMutex.Unlock()
+	pixelFormat := c.PixelFormat
+	return &pixelFormat
 }
 
+var proxiedBytes = metrics.NewCounterVec("vncproxy_proxied_bytes_total", "Bytes read from (from_server) and written to (to_server) vnc-servers.", "direction")
+
 func (c *ClientConn) Write(bytes []byte) (n int, err error) {
-	return c.conn.Write(bytes)
+	n, err = c.conn.Write(bytes)
+	proxiedBytes.With("to_server").Add(uint64(n))
+	return n, err
 }
 func (c *ClientConn) WriteMessage(messageType int, buf []byte) (int, error) {
-
-	return c.conn.Write(buf)
+	return c.Write(buf)
 }
 
 func (c *ClientConn) Reader() (io.Reader, error) {
@@ -144,7 +193,9 @@ func (c *ClientConn) NextReader() (io.Reader, error) {
 	return c, nil
 }
 func (c *ClientConn) Read(bytes []byte) (n int, err error) {
-	return c.conn.Read(bytes)
+	n, err = c.conn.Read(bytes)
+	proxiedBytes.With("from_server").Add(uint64(n))
+	return n, err
 }
 
 func (c *ClientConn) Run() error {
@@ -325,10 +376,13 @@ func (c *ClientConn) SetEncodings(encs []common.EncodingType) error {
 }
 
 // SetPixelFormat sets the format in which pixel values should be sent
-// in FramebufferUpdate messages from the server.
+// in FramebufferUpdate messages from the server, the messages that follow are parsed with it.
 //
 // See RFC 6143 Section 7.5.1
 func (c *ClientConn) SetPixelFormat(format *common.PixelFormat) error {
+	c.pixelFormatMutex.Lock()
+	defer c.pixelFormatMutex.Unlock()
+
 	var keyEvent [20]byte
 	keyEvent[0] = 0
 
@@ -344,6 +398,7 @@ func (c *ClientConn) SetPixelFormat(format *common.PixelFormat) error {
 	if _, err := c.conn.Write(keyEvent[:]); err != nil {
 		return err
 	}
+	c.PixelFormat = *format
 
 	// Reset the color map as according to RFC.
 	var newColorMap common.ColorMap
@@ -438,7 +493,14 @@ FindAuth:
 		return err
 	}
 
-	if err = auth.Handshake(c.conn); err != nil {
+	if wrapper, ok := auth.(ClientAuthWrapper); ok {
+		// the rest of the session goes through the secure channel
+		conn, err := wrapper.HandshakeWrap(c.conn)
+		if err != nil {
+			return err
+		}
+		c.conn = conn
+	} else if err = auth.Handshake(c.conn); err != nil {
 		return err
 	}
 
@@ -487,6 +549,8 @@ FindAuth:
 	}
 
 	c.SetDesktopName(string(nameBytes))
+	c.SetWidth(c.FrameBufferWidth)
+	c.SetHeight(c.FrameBufferHeight)
 	srvInit := common.ServerInit{
 		NameLength:  nameLength,
 		NameText:    nameBytes,
@@ -526,7 +590,7 @@ func (c *ClientConn) mainLoop() {
 	}
 
 	defer func() {
-		logger.Warn("ClientConn.MainLoop: exiting!")
+		c.log.Warn("ClientConn.MainLoop: exiting!")
 		c.Listeners().Consume(&common.RfbSegment{
 			SegmentType: common.SegmentConnectionClosed,
 		})
@@ -536,17 +600,17 @@ func (c *ClientConn) mainLoop() {
 		var messageType uint8
 		r, _ := c.Reader()
 		if err := binary.Read(r, binary.BigEndian, &messageType); err != nil {
-			logger.Errorf("ClientConn.MainLoop: error reading messagetype, %s", err)
+			c.log.Errorf("ClientConn.MainLoop: error reading messagetype, %s", err)
 			break
 		}
 
 		msg, ok := typeMap[messageType]
 		if !ok {
-			logger.Errorf("ClientConn.MainLoop: bad message type, %d", messageType)
+			c.log.Errorf("ClientConn.MainLoop: bad message type, %d", messageType)
 			// Unsupported message type! Bad!
 			break
 		}
-		logger.Debugf("ClientConn.MainLoop: got ServerMessage:%s", common.ServerMessageType(messageType))
+		c.log.Debugf("ClientConn.MainLoop: got ServerMessage:%s", common.ServerMessageType(messageType))
 
 		reader := &common.RfbReadHelper{Reader: r, Listeners: c.Listeners()}
 		reader.SendMessageStart(common.ServerMessageType(messageType))
@@ -554,10 +618,23 @@ func (c *ClientConn) mainLoop() {
 
 		parsedMsg, err := msg.Read(c, reader)
 		if err != nil {
-			logger.Errorf("ClientConn.MainLoop: error parsing message, %s", err)
+			c.log.Errorf("ClientConn.MainLoop: error parsing message, %s", err)
 			break
 		}
-		logger.Debugf("ClientConn.MainLoop: read & parsed ServerMessage:%d, %s", parsedMsg.Type(), parsedMsg)
+		c.log.Debugf("ClientConn.MainLoop: read & parsed ServerMessage:%d, %s", parsedMsg.Type(), parsedMsg)
+
+		if fbUpdate, ok := parsedMsg.(*MsgFramebufferUpdate); ok {
+			if width, height, resized := fbUpdate.DesktopSize(); resized {
+				c.log.Infof("ClientConn.MainLoop: the desktop size changed to %dx%d", width, height)
+				c.SetWidth(width)
+				c.SetHeight(height)
+			}
+		}
+		c.Listeners().Consume(&common.RfbSegment{
+			SegmentType:        common.SegmentFullyParsedServerMessage,
+			UpcomingObjectType: int(messageType),
+			Message:            parsedMsg,
+		})
 	}
 }
 
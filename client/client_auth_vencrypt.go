@@ -0,0 +1,199 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+// VeNCrypt sub-types, see https://www.berrange.com/~dan/vencrypt.txt
+const (
+	VeNCryptPlain     uint32 = 256
+	VeNCryptTLSNone   uint32 = 257
+	VeNCryptTLSVNC    uint32 = 258
+	VeNCryptTLSPlain  uint32 = 259
+	VeNCryptX509None  uint32 = 260
+	VeNCryptX509VNC   uint32 = 261
+	VeNCryptX509Plain uint32 = 262
+)
+
+// ClientAuthWrapper is implemented by authentication methods that wrap the connection in a secure channel,
+// the returned connection is used for the rest of the rfb session.
+type ClientAuthWrapper interface {
+	ClientAuth
+	HandshakeWrap(io.ReadWriteCloser) (io.ReadWriteCloser, error)
+}
+
+// ClientAuthVeNCrypt is VeNCrypt (version 0.2) authentication, used by TigerVNC, libvirt/QEMU and others for tls.
+//
+// The server certificate is verified with TLSConfig (RootCAs, ServerName) for all sub-types: Go's tls doesn't implement
+// the anonymous cipher suites, so TLS* sub-types only work against servers presenting a certificate too.
+// Self-signed servers need their certificate in RootCAs, or TLSConfig.InsecureSkipVerify to turn verification off.
+// Password is used for the *VNC sub-types, Username & Password for the *Plain ones.
+type ClientAuthVeNCrypt struct {
+	// the sub-types we accept, in order of preference. Empty = all sub-types the credentials allow, X509 first.
+	SubTypes  []uint32
+	TLSConfig *tls.Config
+	Username  string
+	Password  string
+}
+
+// NewClientAuthVeNCrypt creates a VeNCrypt authentication that verifies the server against the CA certificates
+// in caFile (PEM), an empty caFile uses the system roots. serverName is the name expected in the server certificate.
+func NewClientAuthVeNCrypt(caFile string, serverName string, username string, password string) (*ClientAuthVeNCrypt, error) {
+	tlsConfig := &tls.Config{ServerName: serverName}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	return &ClientAuthVeNCrypt{TLSConfig: tlsConfig, Username: username, Password: password}, nil
+}
+
+func (*ClientAuthVeNCrypt) SecurityType() uint8 {
+	return 19
+}
+
+func (auth *ClientAuthVeNCrypt) Handshake(c io.ReadWriteCloser) error {
+	_, err := auth.HandshakeWrap(c)
+	return err
+}
+
+func (auth *ClientAuthVeNCrypt) HandshakeWrap(c io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	var version [2]uint8
+	if err := binary.Read(c, binary.BigEndian, &version); err != nil {
+		return nil, err
+	}
+	if version[0] != 0 || version[1] < 2 {
+		return nil, fmt.Errorf("unsupported VeNCrypt version %d.%d", version[0], version[1])
+	}
+	if _, err := c.Write([]byte{0, 2}); err != nil {
+		return nil, err
+	}
+	var status uint8
+	if err := binary.Read(c, binary.BigEndian, &status); err != nil {
+		return nil, err
+	}
+	if status != 0 {
+		return nil, errors.New("server refused VeNCrypt version 0.2")
+	}
+
+	var count uint8
+	if err := binary.Read(c, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	serverSubTypes := make([]uint32, count)
+	if err := binary.Read(c, binary.BigEndian, serverSubTypes); err != nil {
+		return nil, err
+	}
+
+	subType, ok := auth.chooseSubType(serverSubTypes)
+	if !ok {
+		return nil, fmt.Errorf("no suitable VeNCrypt sub-type found. server supported: %v", serverSubTypes)
+	}
+	if err := binary.Write(c, binary.BigEndian, subType); err != nil {
+		return nil, err
+	}
+
+	conn := c
+	switch subType {
+	case VeNCryptTLSNone, VeNCryptTLSVNC, VeNCryptTLSPlain, VeNCryptX509None, VeNCryptX509VNC, VeNCryptX509Plain:
+		tlsConn, err := auth.startTLS(c, subType)
+		if err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	switch subType {
+	case VeNCryptTLSVNC, VeNCryptX509VNC:
+		vncAuth := &PasswordAuth{Password: auth.Password}
+		if err := vncAuth.Handshake(conn); err != nil {
+			return nil, err
+		}
+	case VeNCryptPlain, VeNCryptTLSPlain, VeNCryptX509Plain:
+		if err := auth.plainAuth(conn); err != nil {
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// chooseSubType picks the first of our sub-types the server supports
+func (auth *ClientAuthVeNCrypt) chooseSubType(serverSubTypes []uint32) (uint32, bool) {
+	for _, subType := range auth.preferredSubTypes() {
+		for _, serverSubType := range serverSubTypes {
+			if subType == serverSubType {
+				return subType, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (auth *ClientAuthVeNCrypt) preferredSubTypes() []uint32 {
+	if len(auth.SubTypes) > 0 {
+		return auth.SubTypes
+	}
+	// unencrypted Plain is never chosen by default
+	if auth.Username != "" {
+		return []uint32{VeNCryptX509Plain, VeNCryptTLSPlain}
+	}
+	if auth.Password != "" {
+		return []uint32{VeNCryptX509VNC, VeNCryptTLSVNC}
+	}
+	return []uint32{VeNCryptX509None, VeNCryptTLSNone}
+}
+
+func (auth *ClientAuthVeNCrypt) startTLS(c io.ReadWriteCloser, subType uint32) (*tls.Conn, error) {
+	var ack uint8
+	if err := binary.Read(c, binary.BigEndian, &ack); err != nil {
+		return nil, err
+	}
+	if ack != 1 {
+		return nil, errors.New("server failed to start the VeNCrypt tls session")
+	}
+
+	netConn, ok := c.(net.Conn)
+	if !ok {
+		return nil, errors.New("VeNCrypt tls needs a network connection")
+	}
+
+	var tlsConfig *tls.Config
+	if auth.TLSConfig != nil {
+		tlsConfig = auth.TLSConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" && !tlsConfig.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(netConn.RemoteAddr().String())
+		if err == nil {
+			tlsConfig.ServerName = host
+		}
+	}
+
+	tlsConn := tls.Client(netConn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (auth *ClientAuthVeNCrypt) plainAuth(c io.ReadWriter) error {
+	lengths := []uint32{uint32(len(auth.Username)), uint32(len(auth.Password))}
+	if err := binary.Write(c, binary.BigEndian, lengths); err != nil {
+		return err
+	}
+	_, err := c.Write([]byte(auth.Username + auth.Password))
+	return err
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/internal/testutil"
+	"github.com/amitbet/vncproxy/wsserver"
+)
+
+// runVeNCryptServer authenticates one connection with the proxy's server side VeNCrypt implementation
+func runVeNCryptServer(t *testing.T, nc net.Conn, cert tls.Certificate, subTypes ...wsserver.SecuritySubType) chan error {
+	result := make(chan error, 1)
+	go func() {
+		conn, _ := wsserver.NewServerConnIO(nc, &wsserver.ServerConfig{ClientMessages: wsserver.DefaultClientMessages})
+		auth := &wsserver.ServerAuthVeNCrypt{
+			SubTypes:   subTypes,
+			TLSConfig:  &tls.Config{Certificates: []tls.Certificate{cert}},
+			VNCAuth:    &wsserver.ServerAuthVNC{Pass: "secret"},
+			PlainUsers: map[string]string{"admin": "secret"},
+		}
+		err := auth.Auth(conn)
+		if err == nil && conn.AccessLevel() != common.AccessLevelFull {
+			t.Errorf("unexpected access level: %s", conn.AccessLevel())
+		}
+		result <- err
+		io.Copy(io.Discard, conn.Conn())
+	}()
+	return result
+}
+
+func TestClientAuthVeNCrypt(t *testing.T) {
+	cert, roots := testutil.SelfSignedCert(t, "vnc.test")
+
+	tests := []struct {
+		name    string
+		auth    *ClientAuthVeNCrypt
+		subType wsserver.SecuritySubType
+		fail    bool
+	}{
+		{"x509 vnc", &ClientAuthVeNCrypt{TLSConfig: &tls.Config{RootCAs: roots, ServerName: "vnc.test"}, Password: "secret"}, wsserver.SecSubTypeVeNCrypt02X509VNC, false},
+		{"x509 plain", &ClientAuthVeNCrypt{TLSConfig: &tls.Config{RootCAs: roots, ServerName: "vnc.test"}, Username: "admin", Password: "secret"}, wsserver.SecSubTypeVeNCrypt02X509Plain, false},
+		{"tls vnc", &ClientAuthVeNCrypt{TLSConfig: &tls.Config{RootCAs: roots, ServerName: "vnc.test"}, Password: "secret"}, wsserver.SecSubTypeVeNCrypt02TLSVNC, false},
+		{"tls vnc without ca", &ClientAuthVeNCrypt{TLSConfig: &tls.Config{ServerName: "vnc.test"}, Password: "secret"}, wsserver.SecSubTypeVeNCrypt02TLSVNC, true},
+		{"tls vnc skipping verification", &ClientAuthVeNCrypt{TLSConfig: &tls.Config{InsecureSkipVerify: true}, Password: "secret"}, wsserver.SecSubTypeVeNCrypt02TLSVNC, false},
+		{"untrusted certificate", &ClientAuthVeNCrypt{TLSConfig: &tls.Config{ServerName: "vnc.test"}, Password: "secret"}, wsserver.SecSubTypeVeNCrypt02X509VNC, true},
+	}
+
+	for _, tt := range tests {
+		serverSide, clientSide := net.Pipe()
+		serverResult := runVeNCryptServer(t, serverSide, cert, tt.subType)
+
+		conn, err := tt.auth.HandshakeWrap(clientSide)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%s: expected the handshake to fail", tt.name)
+			}
+			clientSide.Close()
+			serverSide.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			clientSide.Close()
+			continue
+		}
+		if _, ok := conn.(*tls.Conn); !ok {
+			t.Errorf("%s: connection was not wrapped in tls", tt.name)
+		}
+		if err := <-serverResult; err != nil {
+			t.Errorf("%s: server side failed: %s", tt.name, err)
+		}
+		conn.Close()
+	}
+}
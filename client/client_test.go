@@ -1,9 +1,14 @@
 package client
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"net"
 	"testing"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/encodings"
 )
 
 func newMockServer(t *testing.T, version string) string {
@@ -93,3 +98,44 @@ func TestParseProtocolVersion(t *testing.T) {
 		}
 	}
 }
+
+func TestFramebufferUpdateDesktopSize(t *testing.T) {
+	conn, _ := NewClientConn(nil, &ClientConfig{})
+	update := &bytes.Buffer{}
+	//padding & number of rectangles
+	update.Write([]byte{0, 0, 3})
+	//a server initiated ExtendedDesktopSize with a single screen
+	binary.Write(update, binary.BigEndian, []uint16{common.DesktopSizeReasonServer, common.DesktopSizeStatusOK, 1280, 720})
+	binary.Write(update, binary.BigEndian, int32(common.EncExtendedDesktopSizePseudo))
+	update.Write([]byte{1, 0, 0, 0})
+	common.WriteScreens(update, []common.Screen{{ID: 7, Width: 1280, Height: 720}})
+	//a failed resize request doesn't change the size
+	binary.Write(update, binary.BigEndian, []uint16{common.DesktopSizeReasonClient, 3, 1280, 720})
+	binary.Write(update, binary.BigEndian, int32(common.EncExtendedDesktopSizePseudo))
+	update.Write([]byte{0, 0, 0, 0})
+	//the last rectangle is read after the screen layout
+	binary.Write(update, binary.BigEndian, []uint16{0, 0, 0, 0})
+	binary.Write(update, binary.BigEndian, int32(common.EncLastRectPseudo))
+
+	msg, err := new(MsgFramebufferUpdate).Read(conn, common.NewRfbReadHelper(update))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbUpdate := msg.(*MsgFramebufferUpdate)
+	width, height, resized := fbUpdate.DesktopSize()
+	if !resized || width != 1280 || height != 720 {
+		t.Errorf("expected a resize to 1280x720, got %dx%d (%v)", width, height, resized)
+	}
+	extended := fbUpdate.Rectangles[0].Enc.(*encodings.EncExtendedDesktopSizePseudo)
+	if len(extended.Screens) != 1 || extended.Screens[0].ID != 7 || extended.Screens[0].Width != 1280 {
+		t.Errorf("unexpected screen layout: %+v", extended.Screens)
+	}
+	if update.Len() != 0 {
+		t.Errorf("%d bytes of the update weren't read", update.Len())
+	}
+
+	failed := &MsgFramebufferUpdate{Rectangles: fbUpdate.Rectangles[1:]}
+	if _, _, resized := failed.DesktopSize(); resized {
+		t.Errorf("a failed resize request changed the size")
+	}
+}
@@ -9,6 +9,12 @@ import (
 	"github.com/amitbet/vncproxy/common"
 	"github.com/amitbet/vncproxy/encodings"
 	"github.com/amitbet/vncproxy/logger"
+	"github.com/amitbet/vncproxy/metrics"
+)
+
+var (
+	framebufferUpdates = metrics.NewCounter("vncproxy_framebuffer_updates_total", "Framebuffer updates read from vnc-servers.")
+	rectangles         = metrics.NewCounterVec("vncproxy_rectangles_total", "Rectangles of framebuffer updates read from vnc-servers, by encoding.", "encoding")
 )
 
 // MsgFramebufferUpdate consists of a sequence of rectangles of
@@ -63,6 +69,12 @@ func (fbm *MsgFramebufferUpdate) Read(c common.IClientConn, r *common.RfbReadHel
 	// We must always support the raw encoding
 	rawEnc := new(encodings.RawEncoding)
 	encMap[rawEnc.Type()] = rawEnc
+	// and read the desktop size pseudo encodings, the extended one carries a screen layout
+	for _, enc := range []common.IEncoding{&encodings.EncDesktopSizePseudo{}, &encodings.EncExtendedDesktopSizePseudo{}} {
+		if _, ok := encMap[enc.Type()]; !ok {
+			encMap[enc.Type()] = enc
+		}
+	}
 	logger.Debugf("MsgFramebufferUpdate.Read: numrects= %d", numRects)
 
 	rects := make([]common.Rectangle, numRects)
@@ -89,6 +101,11 @@ func (fbm *MsgFramebufferUpdate) Read(c common.IClientConn, r *common.RfbReadHel
 		jBytes, _ := json.Marshal(data)
 
 		encType := common.EncodingType(encodingTypeInt)
+		if name := encType.String(); name != "" {
+			rectangles.With(name).Inc()
+		} else {
+			rectangles.With(fmt.Sprint(encodingTypeInt)).Inc()
+		}
 
 		logger.Debugf("MsgFramebufferUpdate.Read: rect# %d, rect hdr data: enctype=%s, data: %s", i, encType, string(jBytes))
 		enc, supported := encMap[encodingTypeInt]
@@ -113,10 +130,26 @@ func (fbm *MsgFramebufferUpdate) Read(c common.IClientConn, r *common.RfbReadHel
 		}
 	}
 	r.SendMessageEnd(common.ServerMessageType(fbm.Type()))
+	framebufferUpdates.Inc()
 
 	return &MsgFramebufferUpdate{rects}, nil
 }
 
+// DesktopSize returns the framebuffer size the update changed to, ok is false when it doesn't change the size
+func (m *MsgFramebufferUpdate) DesktopSize() (width, height uint16, ok bool) {
+	for _, rect := range m.Rectangles {
+		switch enc := rect.Enc.(type) {
+		case *encodings.EncDesktopSizePseudo:
+			width, height, ok = enc.Width, enc.Height, true
+		case *encodings.EncExtendedDesktopSizePseudo:
+			if enc.Resized() {
+				width, height, ok = enc.Width, enc.Height, true
+			}
+		}
+	}
+	return width, height, ok
+}
+
 // MsgSetColorMapEntries is sent by the server to set values into
 // the color map. This message will automatically update the color map
 // for the associated connection, but contains the color change data
@@ -249,7 +282,7 @@ type MsgServerCutText struct {
 }
 
 func (fbm *MsgServerCutText) CopyTo(r io.Reader, w io.Writer, c common.IClientConn) error {
-	reader := &common.RfbReadHelper{Reader: r}
+	reader := common.NewRfbReadHelper(r)
 	writeTo := &WriteTo{w, "MsgServerCutText.CopyTo"}
 	reader.Listeners.AddListener(writeTo)
 	_, err := fbm.Read(c, reader)
@@ -19,13 +19,11 @@ func (p *WriteTo) Consume(seg *common.RfbSegment) error {
 	case common.SegmentMessageStart:
 	case common.SegmentRectSeparator:
 	case common.SegmentBytes:
-		/*_, err := p.Writer.Write(seg.Bytes)
+		_, err := p.Writer.Write(seg.Bytes)
 		if err != nil {
 			logger.Errorf("WriteTo.Consume ("+p.Name+" SegmentBytes): problem writing to port: %s", err)
 		}
-		*/
-		panic("err ....")
-		return nil
+		return err
 	case common.SegmentFullyParsedClientMessage:
 		/*
 			clientMsg := seg.Message.(common.ClientMessage)
@@ -0,0 +1,21 @@
+package common
+
+// AccessLevel is the level of control a vnc-client was granted when it authenticated
+type AccessLevel int
+
+const (
+	// AccessLevelFull lets the vnc-client send input to the vnc-server
+	AccessLevelFull AccessLevel = iota
+	// AccessLevelViewOnly limits the vnc-client to watching the screen, its input is dropped
+	AccessLevelViewOnly
+)
+
+func (a AccessLevel) String() string {
+	switch a {
+	case AccessLevelFull:
+		return "full"
+	case AccessLevelViewOnly:
+		return "viewOnly"
+	}
+	return "unknown"
+}
@@ -14,6 +14,7 @@ const (
 	PointerEventMsgType
 	ClientCutTextMsgType
 	ClientFenceMsgType          = 248
+	SetDesktopSizeMsgType       = 251
 	QEMUExtendedKeyEventMsgType = 255
 )
 
@@ -50,6 +51,8 @@ func (cmt ClientMessageType) String() string {
 		return "PointerEvent"
 	case ClientCutTextMsgType:
 		return "ClientCutText"
+	case SetDesktopSizeMsgType:
+		return "SetDesktopSize"
 	}
 	return ""
 }
@@ -2,6 +2,9 @@ package common
 
 import (
 	"io"
+	"net"
+
+	"github.com/amitbet/vncproxy/logger"
 )
 
 type IServerConn interface {
@@ -9,6 +12,12 @@ type IServerConn interface {
 
 	SetSessionId(string)
 	SessionId() string
+	// the access level granted by the security handler, full unless set otherwise
+	SetAccessLevel(AccessLevel)
+	AccessLevel() AccessLevel
+	// the logger of the connection, its lines carry the vnc-client & session fields
+	SetLogger(*logger.FieldLogger)
+	Logger() *logger.FieldLogger
 	Protocol() string
 	CurrentPixelFormat() *PixelFormat
 	SetPixelFormat(*PixelFormat) error
@@ -62,3 +71,12 @@ type IClientConn interface {
 	//CurrentColorMap() *ColorMap
 	Encodings() []IEncoding
 }
+
+// ConnLogger is the default logger of a connection, with the address of its peer under key
+// when it is a network (or websocket) connection
+func ConnLogger(key string, conn interface{}) *logger.FieldLogger {
+	if netConn, ok := conn.(interface{ RemoteAddr() net.Addr }); ok && netConn.RemoteAddr() != nil {
+		return logger.With(key, netConn.RemoteAddr().String())
+	}
+	return logger.With()
+}
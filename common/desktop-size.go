@@ -0,0 +1,50 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Screen is a screen of the desktop layout, in ExtendedDesktopSize rectangles and SetDesktopSize messages
+type Screen struct {
+	ID     uint32
+	X      uint16
+	Y      uint16
+	Width  uint16
+	Height uint16
+	Flags  uint32
+}
+
+// ExtendedDesktopSize rectangles keep the reason of the change in their x & the status of a resize request in their y
+const (
+	DesktopSizeReasonServer      = 0 // the size was changed by the server
+	DesktopSizeReasonClient      = 1 // this client asked for the change
+	DesktopSizeReasonOtherClient = 2 // another client asked for the change
+
+	DesktopSizeStatusOK = 0 // anything else means the size didn't change
+)
+
+// ReadScreens reads the layout of a number of screens
+func ReadScreens(r io.Reader, count int) ([]Screen, error) {
+	screens := make([]Screen, count)
+	if err := binary.Read(r, binary.BigEndian, screens); err != nil {
+		return nil, err
+	}
+	return screens, nil
+}
+
+// WriteScreens writes the layout of the screens, without their number
+func WriteScreens(w io.Writer, screens []Screen) error {
+	return binary.Write(w, binary.BigEndian, screens)
+}
+
+// DesktopSizeUpdate makes a FramebufferUpdate message with a single DesktopSize pseudo rectangle
+func DesktopSizeUpdate(width, height uint16) []byte {
+	msg := &bytes.Buffer{}
+	//message type, padding & number of rectangles
+	msg.Write([]byte{byte(FramebufferUpdate), 0, 0, 1})
+	binary.Write(msg, binary.BigEndian, []uint16{0, 0, width, height})
+	binary.Write(msg, binary.BigEndian, int32(EncDesktopSizePseudo))
+	return msg.Bytes()
+}
@@ -21,6 +21,28 @@ type IEncoding interface {
 // EncodingType represents a known VNC encoding type.
 type EncodingType int32
 
+// UsesZlibStream returns true for encodings compressed with zlib streams that last for the whole connection,
+// their rectangles can't be decoded without the ones sent before them
+func (enct EncodingType) UsesZlibStream() bool {
+	switch enct {
+	case EncZlib, EncZlibHex, EncTight, EncZRLE:
+		return true
+	}
+	return false
+}
+
+// WithoutZlibStreams returns the encodings that don't use zlib streams, so every update can be decoded on its own.
+// Raw is always supported by vnc-clients, so the vnc-server has an encoding left to use.
+func WithoutZlibStreams(encs []EncodingType) []EncodingType {
+	var filtered []EncodingType
+	for _, enc := range encs {
+		if !enc.UsesZlibStream() {
+			filtered = append(filtered, enc)
+		}
+	}
+	return filtered
+}
+
 func (enct EncodingType) String() string {
 	switch enct {
 	case EncRaw:
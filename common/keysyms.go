@@ -0,0 +1,73 @@
+package common
+
+import (
+	"fmt"
+	"unicode"
+)
+
+// keysymNames names the X11 keysyms of keys that don't type a character
+var keysymNames = map[uint32]string{
+	0xff08: "BackSpace",
+	0xff09: "Tab",
+	0xff0d: "Return",
+	0xff13: "Pause",
+	0xff14: "Scroll_Lock",
+	0xff15: "Sys_Req",
+	0xff1b: "Escape",
+	0xff50: "Home",
+	0xff51: "Left",
+	0xff52: "Up",
+	0xff53: "Right",
+	0xff54: "Down",
+	0xff55: "Page_Up",
+	0xff56: "Page_Down",
+	0xff57: "End",
+	0xff61: "Print",
+	0xff63: "Insert",
+	0xff67: "Menu",
+	0xff7f: "Num_Lock",
+	0xff8d: "KP_Enter",
+	0xffaa: "KP_Multiply",
+	0xffab: "KP_Add",
+	0xffad: "KP_Subtract",
+	0xffae: "KP_Decimal",
+	0xffaf: "KP_Divide",
+	0xffe1: "Shift_L",
+	0xffe2: "Shift_R",
+	0xffe3: "Control_L",
+	0xffe4: "Control_R",
+	0xffe5: "Caps_Lock",
+	0xffe7: "Meta_L",
+	0xffe8: "Meta_R",
+	0xffe9: "Alt_L",
+	0xffea: "Alt_R",
+	0xffeb: "Super_L",
+	0xffec: "Super_R",
+	0xfe03: "ISO_Level3_Shift",
+	0xffff: "Delete",
+}
+
+// KeysymName returns a readable name of an X11 keysym (the key of rfb key events): the character it types,
+// or names like "Return", "Shift_L" & "F5". Unknown keysyms are returned in hex.
+func KeysymName(keysym uint32) string {
+	switch {
+	case keysym == 0x20:
+		return "space"
+	case keysym > 0x20 && keysym < 0x7f, keysym >= 0xa0 && keysym <= 0xff:
+		//latin-1 keysyms are their character
+		return string(rune(keysym))
+	case keysym >= 0x01000100 && keysym <= 0x0110ffff:
+		//unicode keysyms
+		if r := rune(keysym - 0x01000000); unicode.IsPrint(r) {
+			return string(r)
+		}
+	case keysym >= 0xffbe && keysym <= 0xffe0:
+		return fmt.Sprintf("F%d", keysym-0xffbe+1)
+	case keysym >= 0xffb0 && keysym <= 0xffb9:
+		return fmt.Sprintf("KP_%d", keysym-0xffb0)
+	}
+	if name, ok := keysymNames[keysym]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", keysym)
+}
@@ -0,0 +1,50 @@
+package common
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// audit event types
+const (
+	AuditKeyDown   = "keydown"
+	AuditKeyUp     = "keyup"
+	AuditMouseDown = "mousedown"
+	AuditMouseUp   = "mouseup"
+	AuditClipboard = "clipboard"
+)
+
+// clipboard directions
+const (
+	AuditFromClient = "client" // the vnc-client's clipboard sent to the vnc-server
+	AuditFromServer = "server" // the vnc-server's clipboard sent to the vnc-client
+)
+
+// RecordingAuditEvent is a line of a recording's audit log: a key, a mouse button or clipboard text.
+// Timestamp is in ms since the start of the recording file, like the recording's blocks.
+type RecordingAuditEvent struct {
+	Timestamp uint32 `json:"t"`
+	Type      string `json:"type"`
+	Key       string `json:"key,omitempty"`
+	Keysym    uint32 `json:"keysym,omitempty"`
+	Button    int    `json:"button,omitempty"`
+	X         int    `json:"x,omitempty"`
+	Y         int    `json:"y,omitempty"`
+	Direction string `json:"direction,omitempty"`
+	Text      string `json:"text,omitempty"`
+}
+
+// RecordingAuditFileName is the audit log kept next to a recording, with a json line per event
+func RecordingAuditFileName(recordingFileName string) string {
+	return recordingFileName + ".audit.jsonl"
+}
+
+// WriteRecordingAuditEvent appends an event to an audit log, a line at once so a crash can only tear the last event
+func WriteRecordingAuditEvent(w io.Writer, event RecordingAuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
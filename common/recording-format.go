@@ -0,0 +1,184 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The compressed recording format, an alternative to FBS for big recordings:
+//
+//	magic "VNCREC 01.0\n"
+//	uint32 metadata length, metadata json (RecordingMetadata)
+//	blocks of: uint32 compressed length | uint32 uncompressed length | uint32 timestamp (ms since start) | compressed data
+//
+// The uncompressed blocks hold the same rfb stream an FBS file does (starting with the rfb 3.3 session start).
+const CompressedRecordingMagic = "VNCREC 01.0\n"
+
+// CompressedBlockHeaderSize is the size of the block header preceding the compressed data
+const CompressedBlockHeaderSize = 12
+
+const (
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+)
+
+// maxRecordingBlockSize guards readers against allocating garbage sizes from damaged files
+const maxRecordingBlockSize = 64 * 1024 * 1024
+
+var ErrUnknownCompression = errors.New("unknown recording compression")
+
+// RecordingMetadata describes the session of a compressed recording
+type RecordingMetadata struct {
+	Compression string    `json:"compression"`
+	SessionId   string    `json:"sessionId,omitempty"`
+	Target      string    `json:"target,omitempty"`
+	Viewer      string    `json:"viewer,omitempty"`
+	StartTime   time.Time `json:"startTime"`
+	Segment     int       `json:"segment,omitempty"`
+	Width       uint16    `json:"width"`
+	Height      uint16    `json:"height"`
+	DesktopName string    `json:"desktopName,omitempty"`
+}
+
+// WriteCompressedRecordingHeader writes the magic & metadata that start a compressed recording
+func WriteCompressedRecordingHeader(w io.Writer, metadata *RecordingMetadata) (int, error) {
+	jsonData, err := json.Marshal(metadata)
+	if err != nil {
+		return 0, err
+	}
+	header := bytes.Buffer{}
+	header.WriteString(CompressedRecordingMagic)
+	binary.Write(&header, binary.BigEndian, uint32(len(jsonData)))
+	header.Write(jsonData)
+	return w.Write(header.Bytes())
+}
+
+// ReadCompressedRecordingHeader reads the metadata of a compressed recording, the magic must have been read already
+func ReadCompressedRecordingHeader(r io.Reader) (*RecordingMetadata, error) {
+	var jsonLen uint32
+	if err := binary.Read(r, binary.BigEndian, &jsonLen); err != nil {
+		return nil, err
+	}
+	if jsonLen > maxRecordingBlockSize {
+		return nil, fmt.Errorf("recording metadata too big: %d", jsonLen)
+	}
+	jsonData := make([]byte, jsonLen)
+	if _, err := io.ReadFull(r, jsonData); err != nil {
+		return nil, err
+	}
+	metadata := &RecordingMetadata{}
+	if err := json.Unmarshal(jsonData, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// EncodeRecordingBlock compresses data into a complete block (header & data), so it can be written at once
+func EncodeRecordingBlock(compression string, data []byte, timestamp uint32) ([]byte, error) {
+	compressed, err := compressBlock(compression, data)
+	if err != nil {
+		return nil, err
+	}
+	block := make([]byte, CompressedBlockHeaderSize+len(compressed))
+	binary.BigEndian.PutUint32(block, uint32(len(compressed)))
+	binary.BigEndian.PutUint32(block[4:], uint32(len(data)))
+	binary.BigEndian.PutUint32(block[8:], timestamp)
+	copy(block[CompressedBlockHeaderSize:], compressed)
+	return block, nil
+}
+
+// ReadRecordingBlock reads & decompresses the next block of a compressed recording
+func ReadRecordingBlock(r io.Reader, compression string) (data []byte, timestamp uint32, err error) {
+	var header [CompressedBlockHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, 0, err
+	}
+	compressedLen := binary.BigEndian.Uint32(header[:])
+	dataLen := binary.BigEndian.Uint32(header[4:])
+	timestamp = binary.BigEndian.Uint32(header[8:])
+	if compressedLen == 0 || compressedLen > maxRecordingBlockSize || dataLen > maxRecordingBlockSize {
+		return nil, 0, fmt.Errorf("bad recording block size: %d", compressedLen)
+	}
+
+	compressed := make([]byte, compressedLen)
+	if _, err := io.ReadFull(r, compressed); err != nil {
+		return nil, 0, err
+	}
+	data, err = decompressBlock(compression, compressed, int(dataLen))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) != int(dataLen) {
+		return nil, 0, fmt.Errorf("recording block size mismatch: %d != %d", len(data), dataLen)
+	}
+	return data, timestamp, nil
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// the zstd encoder & decoder are safe for concurrent EncodeAll / DecodeAll calls, so all recordings share them
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr == nil {
+			zstdDecoder, zstdErr = zstd.NewReader(nil)
+		}
+	})
+	return zstdErr
+}
+
+func compressBlock(compression string, data []byte) ([]byte, error) {
+	switch compression {
+	case CompressionZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case CompressionGzip:
+		buf := bytes.Buffer{}
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(data); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, ErrUnknownCompression
+}
+
+func decompressBlock(compression string, compressed []byte, dataLen int) ([]byte, error) {
+	switch compression {
+	case CompressionZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(compressed, make([]byte, 0, dataLen))
+	case CompressionGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, dataLen)
+		if _, err := io.ReadFull(gz, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	return nil, ErrUnknownCompression
+}
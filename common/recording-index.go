@@ -0,0 +1,83 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+var ErrNoKeyframe = errors.New("no keyframe before the requested time")
+
+// ErrKeyframeNeedsHistory is returned when seeking to a keyframe of a recording using zlib based encodings (Tight, ZLib, ZRLE)
+var ErrKeyframeNeedsHistory = errors.New("the recording uses zlib based encodings, it can only be played from its start")
+
+// RecordingIndexEntry is a keyframe of a recording: a full screen update starting a block at Offset in the file.
+// Playing the recording from Offset shows the screen as it was at Timestamp (ms since the start of the file).
+type RecordingIndexEntry struct {
+	Timestamp uint32 `json:"t"`
+	Offset    int64  `json:"offset"`
+	// zlib based encodings were recorded before the keyframe, the updates after it continue their zlib streams
+	// so the recording can't be played from it
+	ZlibStreams bool `json:"zlib,omitempty"`
+}
+
+// Time returns the timestamp as a duration since the start of the recording
+func (e RecordingIndexEntry) Time() time.Duration {
+	return time.Duration(e.Timestamp) * time.Millisecond
+}
+
+// RecordingIndexFileName is the index kept next to a recording, with a json line per keyframe
+func RecordingIndexFileName(recordingFileName string) string {
+	return recordingFileName + ".idx"
+}
+
+// WriteRecordingIndexEntry appends a keyframe to an index, a line at once so a crash can only tear the last entry
+func WriteRecordingIndexEntry(w io.Writer, entry RecordingIndexEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+// ReadRecordingIndex loads the keyframes of a recording from its index file, sorted by time.
+// Lines that can't be parsed (the torn end of a crashed recording) are skipped.
+func ReadRecordingIndex(recordingFileName string) ([]RecordingIndexEntry, error) {
+	file, err := os.Open(RecordingIndexFileName(recordingFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []RecordingIndexEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry RecordingIndexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Timestamp < entries[j].Timestamp })
+	return entries, nil
+}
+
+// FindKeyframe returns the last keyframe at or before t, keyframes after zlib based updates can't be played from
+func FindKeyframe(entries []RecordingIndexEntry, t time.Duration) (RecordingIndexEntry, error) {
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].Time() > t })
+	if i == 0 {
+		return RecordingIndexEntry{}, ErrNoKeyframe
+	}
+	if entries[i-1].ZlibStreams {
+		return RecordingIndexEntry{}, ErrKeyframeNeedsHistory
+	}
+	return entries[i-1], nil
+}
@@ -19,6 +19,8 @@ const (
 	SegmentServerInitMessage
 	SegmentConnectionClosed
 	SegmentMessageEnd
+	// the connection was replaced by a new one (a reconnect), its compression streams start over
+	SegmentConnectionReset
 )
 
 type SegmentType int
@@ -41,6 +43,8 @@ func (seg SegmentType) String() string {
 		return "SegmentServerInitMessage"
 	case SegmentConnectionClosed:
 		return "SegmentConnectionClosed"
+	case SegmentConnectionReset:
+		return "SegmentConnectionReset"
 	}
 
 	return ""
@@ -149,7 +153,7 @@ func (r *RfbReadHelper) ReadBytes(count int) ([]byte, error) {
 	//err := binary.Read(r, binary.BigEndian, &buff)
 
 	if err != nil {
-		logger.Errorf("RfbReadHelper.ReadBytes error while reading bytes: ", err)
+		logger.Errorf("RfbReadHelper.ReadBytes error while reading bytes: %s", err)
 		//if err := binary.Read(d.conn, binary.BigEndian, &buff); err != nil {
 		return nil, err
 	}
@@ -0,0 +1,21 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"io"
+)
+
+func (fb *Framebuffer) readCopyRect(r io.Reader, x, y, w, h int) error {
+	var src struct{ X, Y uint16 }
+	if err := binary.Read(r, binary.BigEndian, &src); err != nil {
+		return err
+	}
+	//the source & destination may overlap, so the source is copied out first
+	srcRect := image.Rect(int(src.X), int(src.Y), int(src.X)+w, int(src.Y)+h)
+	tmp := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(tmp, tmp.Bounds(), fb.screen, srcRect.Min, draw.Src)
+	draw.Draw(fb.screen, image.Rect(x, y, x+w, y+h), tmp, image.Point{}, draw.Src)
+	return nil
+}
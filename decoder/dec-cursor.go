@@ -0,0 +1,36 @@
+package decoder
+
+import (
+	"image"
+	"io"
+)
+
+// readCursor decodes the cursor pseudo encoding: the cursor's pixels and a bitmask of its visible pixels,
+// the rectangle's position is the hotspot
+func (fb *Framebuffer) readCursor(r io.Reader, x, y, w, h int) error {
+	if w == 0 || h == 0 {
+		fb.cursor = nil
+		return nil
+	}
+	pixels, err := fb.pixels().read(r, w*h)
+	if err != nil {
+		return err
+	}
+	rowBytes := (w + 7) / 8
+	mask := make([]byte, rowBytes*h)
+	if _, err := io.ReadFull(r, mask); err != nil {
+		return err
+	}
+
+	cursor := image.NewRGBA(image.Rect(0, 0, w, h))
+	for row := 0; row < h; row++ {
+		for col := 0; col < w; col++ {
+			if mask[row*rowBytes+col/8]>>(7-col%8)&1 != 0 {
+				cursor.SetRGBA(col, row, pixels[row*w+col])
+			}
+		}
+	}
+	fb.cursor = cursor
+	fb.cursorHot = image.Pt(x, y)
+	return nil
+}
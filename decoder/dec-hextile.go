@@ -0,0 +1,80 @@
+package decoder
+
+import (
+	"image/color"
+	"io"
+
+	"github.com/amitbet/vncproxy/encodings"
+)
+
+func (fb *Framebuffer) readHextile(r io.Reader, x, y, w, h int) error {
+	pixels := fb.pixels()
+	//the background & foreground colors carry over from one tile to the next
+	var background, foreground color.RGBA
+	oneByte := make([]byte, 1)
+
+	for ty := y; ty < y+h; ty += 16 {
+		th := 16
+		if y+h-ty < 16 {
+			th = y + h - ty
+		}
+		for tx := x; tx < x+w; tx += 16 {
+			tw := 16
+			if x+w-tx < 16 {
+				tw = x + w - tx
+			}
+
+			if _, err := io.ReadFull(r, oneByte); err != nil {
+				return err
+			}
+			subencoding := oneByte[0]
+			if subencoding&encodings.HextileRaw != 0 {
+				tile, err := pixels.read(r, tw*th)
+				if err != nil {
+					return err
+				}
+				fb.drawPixels(tx, ty, tw, th, tile)
+				continue
+			}
+
+			var err error
+			if subencoding&encodings.HextileBackgroundSpecified != 0 {
+				if background, err = pixels.readOne(r); err != nil {
+					return err
+				}
+			}
+			fb.fill(tx, ty, tw, th, background)
+			if subencoding&encodings.HextileForegroundSpecified != 0 {
+				if foreground, err = pixels.readOne(r); err != nil {
+					return err
+				}
+			}
+			if subencoding&encodings.HextileAnySubrects == 0 {
+				continue
+			}
+
+			if _, err := io.ReadFull(r, oneByte); err != nil {
+				return err
+			}
+			numSubRects := int(oneByte[0])
+			coloured := subencoding&encodings.HextileSubrectsColoured != 0
+			for i := 0; i < numSubRects; i++ {
+				c := foreground
+				if coloured {
+					if c, err = pixels.readOne(r); err != nil {
+						return err
+					}
+				}
+				//x,y & width-1,height-1 in 4 bits each
+				coords := make([]byte, 2)
+				if _, err := io.ReadFull(r, coords); err != nil {
+					return err
+				}
+				sx, sy := int(coords[0]>>4), int(coords[0]&0x0F)
+				sw, sh := int(coords[1]>>4)+1, int(coords[1]&0x0F)+1
+				fb.fill(tx+sx, ty+sy, sw, sh, c)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+package decoder
+
+import (
+	"io"
+)
+
+func (fb *Framebuffer) readRaw(r io.Reader, x, y, w, h int) error {
+	pixels, err := fb.pixels().read(r, w*h)
+	if err != nil {
+		return err
+	}
+	fb.drawPixels(x, y, w, h, pixels)
+	return nil
+}
@@ -0,0 +1,46 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// readRRE decodes RRE, or CoRRE (compact) with 8 bit sub-rectangle coordinates
+func (fb *Framebuffer) readRRE(r io.Reader, x, y, w, h int, compact bool) error {
+	var numSubRects uint32
+	if err := binary.Read(r, binary.BigEndian, &numSubRects); err != nil {
+		return err
+	}
+	pixels := fb.pixels()
+	background, err := pixels.readOne(r)
+	if err != nil {
+		return err
+	}
+	fb.fill(x, y, w, h, background)
+
+	coordSize := 8
+	if compact {
+		coordSize = 4
+	}
+	for i := uint32(0); i < numSubRects; i++ {
+		c, err := pixels.readOne(r)
+		if err != nil {
+			return err
+		}
+		coords := make([]byte, coordSize)
+		if _, err := io.ReadFull(r, coords); err != nil {
+			return err
+		}
+		var sx, sy, sw, sh int
+		if compact {
+			sx, sy, sw, sh = int(coords[0]), int(coords[1]), int(coords[2]), int(coords[3])
+		} else {
+			sx = int(binary.BigEndian.Uint16(coords))
+			sy = int(binary.BigEndian.Uint16(coords[2:]))
+			sw = int(binary.BigEndian.Uint16(coords[4:]))
+			sh = int(binary.BigEndian.Uint16(coords[6:]))
+		}
+		fb.fill(x+sx, y+sy, sw, sh, c)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package decoder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg" // jpeg & png rectangles are decoded by image.Decode
+	_ "image/png"
+	"io"
+
+	"github.com/amitbet/vncproxy/encodings"
+)
+
+// tightPngCompression is the compression type of png rectangles in TightPng
+const tightPngCompression = 0x0A
+
+// readTight decodes Tight rectangles, and TightPng ones (fills, jpeg & png only) when png is set
+func (fb *Framebuffer) readTight(r io.Reader, x, y, w, h int, png bool) error {
+	compctl, err := readByte(r)
+	if err != nil {
+		return err
+	}
+	//the low bits ask to reset the zlib streams
+	for i := range fb.tightStreams {
+		if compctl&(1<<i) != 0 {
+			fb.tightStreams[i].reset()
+		}
+	}
+
+	compType := compctl >> 4
+	switch compType {
+	case encodings.TightFill:
+		c, err := fb.tightPixels().readOne(r)
+		if err != nil {
+			return err
+		}
+		fb.fill(x, y, w, h, c)
+		return nil
+	case encodings.TightJpeg, tightPngCompression:
+		if compType == tightPngCompression && !png {
+			return errors.New("png data in a tight rectangle")
+		}
+		return fb.readTightImage(r, x, y, w, h)
+	}
+	if png || compType > encodings.TightJpeg {
+		return fmt.Errorf("bad tight compression control: %d", compctl)
+	}
+
+	stream := &fb.tightStreams[compType&0x03]
+	filter := uint8(encodings.TightFilterCopy)
+	if compType&encodings.TightExplicitFilter != 0 {
+		if filter, err = readByte(r); err != nil {
+			return err
+		}
+	}
+
+	pixels := fb.tightPixels()
+	switch filter {
+	case encodings.TightFilterCopy:
+		data, err := fb.readTightData(r, stream, w*h*pixels.size)
+		if err != nil {
+			return err
+		}
+		fb.drawPixels(x, y, w, h, pixels.decodeAll(data))
+
+	case encodings.TightFilterPalette:
+		numColors, err := readByte(r)
+		if err != nil {
+			return err
+		}
+		palette, err := pixels.read(r, int(numColors)+1)
+		if err != nil {
+			return err
+		}
+		if len(palette) == 2 {
+			//a bit per pixel, every row starts on a byte
+			rowBytes := (w + 7) / 8
+			data, err := fb.readTightData(r, stream, rowBytes*h)
+			if err != nil {
+				return err
+			}
+			tile := make([]color.RGBA, w*h)
+			for row := 0; row < h; row++ {
+				for col := 0; col < w; col++ {
+					bit := data[row*rowBytes+col/8] >> (7 - col%8) & 1
+					tile[row*w+col] = palette[bit]
+				}
+			}
+			fb.drawPixels(x, y, w, h, tile)
+		} else {
+			data, err := fb.readTightData(r, stream, w*h)
+			if err != nil {
+				return err
+			}
+			tile := make([]color.RGBA, w*h)
+			for i, index := range data {
+				if int(index) < len(palette) {
+					tile[i] = palette[index]
+				}
+			}
+			fb.drawPixels(x, y, w, h, tile)
+		}
+
+	case encodings.TightFilterGradient:
+		data, err := fb.readTightData(r, stream, w*h*pixels.size)
+		if err != nil {
+			return err
+		}
+		fb.drawPixels(x, y, w, h, fb.tightGradient(data, w, h, pixels.size))
+
+	default:
+		return fmt.Errorf("bad tight filter: %d", filter)
+	}
+	return nil
+}
+
+// readTightData reads data shorter than 12 bytes as is, longer data is compressed in one of the zlib streams
+func (fb *Framebuffer) readTightData(r io.Reader, stream *zlibStream, size int) ([]byte, error) {
+	data := make([]byte, size)
+	if size < encodings.TightMinToCompress {
+		_, err := io.ReadFull(r, data)
+		return data, err
+	}
+	length, err := readCompactLen(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.readCompressed(r, length); err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(stream, data)
+	return data, err
+}
+
+// readTightImage decodes a jpeg or png rectangle, image.Decode picks the format
+func (fb *Framebuffer) readTightImage(r io.Reader, x, y, w, h int) error {
+	length, err := readCompactLen(r)
+	if err != nil {
+		return err
+	}
+	if length > maxCompressedLength {
+		return fmt.Errorf("image data too long: %d", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	draw.Draw(fb.screen, image.Rect(x, y, x+w, y+h), img, img.Bounds().Min, draw.Src)
+	return nil
+}
+
+// tightGradient reverses tight's gradient filter: every color component is sent as the difference
+// from its prediction, left + above - above left (clamped)
+func (fb *Framebuffer) tightGradient(data []byte, w, h, pixelSize int) []color.RGBA {
+	var maxes [3]int
+	var shift [3]uint8
+	if fb.isTightPixel() {
+		maxes = [3]int{255, 255, 255}
+	} else {
+		pf := fb.pixelFormat
+		maxes = [3]int{int(pf.RedMax), int(pf.GreenMax), int(pf.BlueMax)}
+		shift = [3]uint8{pf.RedShift, pf.GreenShift, pf.BlueShift}
+	}
+	components := func(b []byte) [3]int {
+		if fb.isTightPixel() {
+			return [3]int{int(b[0]), int(b[1]), int(b[2])}
+		}
+		v := fb.pixelValue(b)
+		return [3]int{int(v>>shift[0]) & maxes[0], int(v>>shift[1]) & maxes[1], int(v>>shift[2]) & maxes[2]}
+	}
+
+	values := make([][3]int, w*h)
+	tile := make([]color.RGBA, w*h)
+	for row := 0; row < h; row++ {
+		for col := 0; col < w; col++ {
+			diff := components(data[(row*w+col)*pixelSize:])
+			var value [3]int
+			for c := 0; c < 3; c++ {
+				var left, above, aboveLeft int
+				if col > 0 {
+					left = values[row*w+col-1][c]
+				}
+				if row > 0 {
+					above = values[(row-1)*w+col][c]
+					if col > 0 {
+						aboveLeft = values[(row-1)*w+col-1][c]
+					}
+				}
+				prediction := left + above - aboveLeft
+				if prediction < 0 {
+					prediction = 0
+				} else if prediction > maxes[c] {
+					prediction = maxes[c]
+				}
+				value[c] = (prediction + diff[c]) & maxes[c]
+			}
+			values[row*w+col] = value
+			tile[row*w+col] = color.RGBA{
+				R: scaleComponent(uint32(value[0]), uint16(maxes[0])),
+				G: scaleComponent(uint32(value[1]), uint16(maxes[1])),
+				B: scaleComponent(uint32(value[2]), uint16(maxes[2])),
+				A: 0xFF,
+			}
+		}
+	}
+	return tile
+}
+
+// readCompactLen reads tight's 1 to 3 byte length
+func readCompactLen(r io.Reader) (int, error) {
+	length := 0
+	for i := 0; i < 3; i++ {
+		b, err := readByte(r)
+		if err != nil {
+			return 0, err
+		}
+		if i == 2 {
+			return length | int(b)<<14, nil
+		}
+		length |= int(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return length, nil
+}
@@ -0,0 +1,71 @@
+package decoder
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// maxCompressedLength guards against allocating garbage sizes from a broken stream
+const maxCompressedLength = 64 * 1024 * 1024
+
+// zlibStream is a zlib stream that continues across rectangles: the vnc-server flushes its deflater after every
+// rectangle and keeps its state, so the compressed data of each rectangle is fed into the same inflater.
+// Only the exact decompressed size of the data fed may be read, reading further would end the stream.
+type zlibStream struct {
+	input  bytes.Buffer
+	reader io.ReadCloser
+}
+
+func (zs *zlibStream) feed(data []byte) {
+	zs.input.Write(data)
+}
+
+func (zs *zlibStream) Read(p []byte) (int, error) {
+	if zs.reader == nil {
+		//bytes.Buffer is an io.ByteReader, so the inflater doesn't read ahead of the data fed so far
+		reader, err := zlib.NewReader(&zs.input)
+		if err != nil {
+			return 0, err
+		}
+		zs.reader = reader
+	}
+	return zs.reader.Read(p)
+}
+
+// reset starts a new stream (tight's compression control asks for it)
+func (zs *zlibStream) reset() {
+	zs.input.Reset()
+	zs.reader = nil
+}
+
+// readCompressed reads length bytes of compressed data into the stream
+func (zs *zlibStream) readCompressed(r io.Reader, length int) error {
+	if length > maxCompressedLength {
+		return fmt.Errorf("compressed data too long: %d", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	zs.feed(data)
+	return nil
+}
+
+func (fb *Framebuffer) readZlib(r io.Reader, x, y, w, h int) error {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return err
+	}
+	if err := fb.zlibStream.readCompressed(r, int(length)); err != nil {
+		return err
+	}
+	pixels, err := fb.pixels().read(&fb.zlibStream, w*h)
+	if err != nil {
+		return err
+	}
+	fb.drawPixels(x, y, w, h, pixels)
+	return nil
+}
@@ -0,0 +1,166 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image/color"
+	"io"
+)
+
+const zrleTileSize = 64
+
+func (fb *Framebuffer) readZRLE(r io.Reader, x, y, w, h int) error {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return err
+	}
+	if err := fb.zrleStream.readCompressed(r, int(length)); err != nil {
+		return err
+	}
+
+	for ty := y; ty < y+h; ty += zrleTileSize {
+		th := zrleTileSize
+		if y+h-ty < zrleTileSize {
+			th = y + h - ty
+		}
+		for tx := x; tx < x+w; tx += zrleTileSize {
+			tw := zrleTileSize
+			if x+w-tx < zrleTileSize {
+				tw = x + w - tx
+			}
+			if err := fb.readZRLETile(&fb.zrleStream, tx, ty, tw, th); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (fb *Framebuffer) readZRLETile(r io.Reader, x, y, w, h int) error {
+	pixels := fb.compactPixels()
+	subencoding, err := readByte(r)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case subencoding == 0:
+		tile, err := pixels.read(r, w*h)
+		if err != nil {
+			return err
+		}
+		fb.drawPixels(x, y, w, h, tile)
+
+	case subencoding == 1:
+		c, err := pixels.readOne(r)
+		if err != nil {
+			return err
+		}
+		fb.fill(x, y, w, h, c)
+
+	case subencoding <= 16:
+		//packed palette: indexes of 1, 2 or 4 bits, every row starts on a byte
+		palette, err := pixels.read(r, int(subencoding))
+		if err != nil {
+			return err
+		}
+		bits := 4
+		if subencoding == 2 {
+			bits = 1
+		} else if subencoding <= 4 {
+			bits = 2
+		}
+		rowBytes := (w*bits + 7) / 8
+		packed := make([]byte, rowBytes*h)
+		if _, err := io.ReadFull(r, packed); err != nil {
+			return err
+		}
+		tile := make([]color.RGBA, w*h)
+		for row := 0; row < h; row++ {
+			for col := 0; col < w; col++ {
+				bitPos := col * bits
+				b := packed[row*rowBytes+bitPos/8]
+				index := int(b>>(8-bits-bitPos%8)) & (1<<bits - 1)
+				if index < len(palette) {
+					tile[row*w+col] = palette[index]
+				}
+			}
+		}
+		fb.drawPixels(x, y, w, h, tile)
+
+	case subencoding == 128:
+		//plain rle: runs of a color
+		tile := make([]color.RGBA, 0, w*h)
+		for len(tile) < w*h {
+			c, err := pixels.readOne(r)
+			if err != nil {
+				return err
+			}
+			run, err := readRunLength(r)
+			if err != nil {
+				return err
+			}
+			tile = appendRun(tile, c, run, w*h)
+		}
+		fb.drawPixels(x, y, w, h, tile)
+
+	case subencoding >= 130:
+		//palette rle: palette indexes, with a run length when the top bit is set
+		palette, err := pixels.read(r, int(subencoding)-128)
+		if err != nil {
+			return err
+		}
+		tile := make([]color.RGBA, 0, w*h)
+		for len(tile) < w*h {
+			index, err := readByte(r)
+			if err != nil {
+				return err
+			}
+			run := 1
+			if index&0x80 != 0 {
+				if run, err = readRunLength(r); err != nil {
+					return err
+				}
+			}
+			if int(index&0x7F) >= len(palette) {
+				return fmt.Errorf("zrle palette index out of range: %d", index&0x7F)
+			}
+			tile = appendRun(tile, palette[index&0x7F], run, w*h)
+		}
+		fb.drawPixels(x, y, w, h, tile)
+
+	default:
+		return fmt.Errorf("bad zrle tile subencoding: %d", subencoding)
+	}
+	return nil
+}
+
+// readRunLength reads a zrle run length: bytes summed up while they're 255, plus one
+func readRunLength(r io.Reader) (int, error) {
+	run := 1
+	for {
+		b, err := readByte(r)
+		if err != nil {
+			return 0, err
+		}
+		run += int(b)
+		if b != 255 {
+			return run, nil
+		}
+	}
+}
+
+func appendRun(tile []color.RGBA, c color.RGBA, run int, size int) []color.RGBA {
+	for i := 0; i < run && len(tile) < size; i++ {
+		tile = append(tile, c)
+	}
+	return tile
+}
+
+func readByte(r io.Reader) (uint8, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
@@ -0,0 +1,345 @@
+package decoder
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/amitbet/vncproxy/common"
+)
+
+var (
+	red   = color.RGBA{0xFF, 0, 0, 0xFF}
+	green = color.RGBA{0, 0xFF, 0, 0xFF}
+	blue  = color.RGBA{0, 0, 0xFF, 0xFF}
+	white = color.RGBA{0xFF, 0xFF, 0xFF, 0xFF}
+)
+
+// updateWriter builds a FramebufferUpdate message
+type updateWriter struct {
+	rects bytes.Buffer
+	count uint16
+}
+
+func (u *updateWriter) rect(x, y, w, h uint16, encoding common.EncodingType, data ...[]byte) {
+	binary.Write(&u.rects, binary.BigEndian, []uint16{x, y, w, h})
+	binary.Write(&u.rects, binary.BigEndian, int32(encoding))
+	for _, d := range data {
+		u.rects.Write(d)
+	}
+	u.count++
+}
+
+func (u *updateWriter) bytes() []byte {
+	msg := &bytes.Buffer{}
+	msg.Write([]byte{byte(common.FramebufferUpdate), 0})
+	binary.Write(msg, binary.BigEndian, u.count)
+	msg.Write(u.rects.Bytes())
+	return msg.Bytes()
+}
+
+// pixel32 is a pixel in common.NewPixelFormat(32): little endian, red at bit 16
+func pixel32(c color.RGBA) []byte {
+	return []byte{c.B, c.G, c.R, 0}
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// zlibWriter compresses the data of rectangles into a single stream, flushing after each one like a vnc-server
+type zlibWriter struct {
+	out    bytes.Buffer
+	writer *zlib.Writer
+}
+
+func (z *zlibWriter) compress(data []byte) []byte {
+	if z.writer == nil {
+		z.writer = zlib.NewWriter(&z.out)
+	}
+	z.writer.Write(data)
+	z.writer.Flush()
+	compressed := append([]byte{}, z.out.Bytes()...)
+	z.out.Reset()
+	return compressed
+}
+
+func compactLen(n int) []byte {
+	b := []byte{byte(n & 0x7F)}
+	if n > 0x7F {
+		b[0] |= 0x80
+		b = append(b, byte(n>>7&0x7F))
+		if n > 0x3FFF {
+			b[1] |= 0x80
+			b = append(b, byte(n>>14))
+		}
+	}
+	return b
+}
+
+func newTestFramebuffer() *Framebuffer {
+	fb, _ := NewFramebuffer(64, 64, common.NewPixelFormat(32))
+	return fb
+}
+
+func decode(t *testing.T, fb *Framebuffer, msg []byte) {
+	t.Helper()
+	r := bytes.NewReader(msg)
+	if _, err := fb.ReadServerMessage(r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 0 {
+		t.Fatalf("%d bytes left after the message", r.Len())
+	}
+}
+
+func expectColor(t *testing.T, img *image.RGBA, x, y int, expected color.RGBA) {
+	t.Helper()
+	if c := img.RGBAAt(x, y); c != expected {
+		t.Errorf("(%d,%d): expected %v, got %v", x, y, expected, c)
+	}
+}
+
+func TestDecodeRawRREAndCopyRect(t *testing.T) {
+	fb := newTestFramebuffer()
+	update := &updateWriter{}
+	update.rect(0, 0, 2, 1, common.EncRaw, pixel32(red), pixel32(green))
+	//a blue 4x4 with a white 2x2 at (1,1)
+	update.rect(10, 10, 4, 4, common.EncRRE, u32(1), pixel32(blue), pixel32(white), []byte{0, 1, 0, 1, 0, 2, 0, 2})
+	update.rect(20, 20, 2, 2, common.EncCoRRE, u32(1), pixel32(green), pixel32(red), []byte{1, 1, 1, 1})
+	update.rect(30, 30, 4, 4, common.EncCopyRect, []byte{0, 10, 0, 10})
+	decode(t, fb, update.bytes())
+
+	img := fb.Image()
+	expectColor(t, img, 0, 0, red)
+	expectColor(t, img, 1, 0, green)
+	expectColor(t, img, 10, 10, blue)
+	expectColor(t, img, 11, 11, white)
+	expectColor(t, img, 20, 20, green)
+	expectColor(t, img, 21, 21, red)
+	expectColor(t, img, 30, 30, blue)
+	expectColor(t, img, 32, 32, white)
+	if fb.Updates() != 1 {
+		t.Errorf("expected 1 update, got %d", fb.Updates())
+	}
+}
+
+func TestDecodeHextile(t *testing.T) {
+	fb := newTestFramebuffer()
+	update := &updateWriter{}
+	//20x16: a 16x16 tile with a background, a foreground & a subrect, then a 4x16 tile reusing the colors
+	tile1 := []byte{2 | 4 | 8}
+	tile1 = append(tile1, pixel32(blue)...)
+	tile1 = append(tile1, pixel32(red)...)
+	tile1 = append(tile1, 1, 0x22, 0x11) //(2,2) 2x2
+	tile2 := []byte{8, 1, 0x00, 0x00}    //(0,0) 1x1 in the foreground color
+	update.rect(0, 0, 20, 16, common.EncHextile, tile1, tile2)
+	decode(t, fb, update.bytes())
+
+	img := fb.Image()
+	expectColor(t, img, 0, 0, blue)
+	expectColor(t, img, 3, 3, red)
+	expectColor(t, img, 16, 0, red)
+	expectColor(t, img, 17, 1, blue)
+}
+
+func TestDecodeZlibStreams(t *testing.T) {
+	fb := newTestFramebuffer()
+	z := &zlibWriter{}
+	update := &updateWriter{}
+	for i, c := range []color.RGBA{red, green} {
+		data := z.compress(bytes.Repeat(pixel32(c), 4))
+		update.rect(uint16(i*2), 0, 2, 2, common.EncZlib, u32(uint32(len(data))), data)
+	}
+	decode(t, fb, update.bytes())
+
+	img := fb.Image()
+	expectColor(t, img, 1, 1, red)
+	expectColor(t, img, 3, 1, green)
+}
+
+func TestDecodeZlibAfterResetStreams(t *testing.T) {
+	fb := newTestFramebuffer()
+	//a reconnected vnc-server starts a new stream
+	for _, c := range []color.RGBA{red, green} {
+		z := &zlibWriter{}
+		data := z.compress(bytes.Repeat(pixel32(c), 4))
+		update := &updateWriter{}
+		update.rect(0, 0, 2, 2, common.EncZlib, u32(uint32(len(data))), data)
+		decode(t, fb, update.bytes())
+		expectColor(t, fb.Image(), 1, 1, c)
+		fb.ResetStreams()
+	}
+}
+
+func TestDecodeTight(t *testing.T) {
+	fb := newTestFramebuffer()
+	z := &zlibWriter{}
+	update := &updateWriter{}
+
+	//fill with a TPIXEL
+	update.rect(0, 0, 4, 4, common.EncTight, []byte{0x80, 0xFF, 0, 0})
+	//basic copy filter, compressed in stream 0 (4*4 TPIXELs)
+	copyData := z.compress(bytes.Repeat([]byte{0, 0xFF, 0}, 16))
+	update.rect(4, 0, 4, 4, common.EncTight, []byte{0x00}, compactLen(len(copyData)), copyData)
+	//2 color palette, 4x1 pixels fit in 1 uncompressed byte
+	update.rect(8, 0, 4, 1, common.EncTight, []byte{0x40, 0x01, 1, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF, 0xA0})
+	//gradient of a flat blue 3x1: only the first pixel differs from its prediction
+	update.rect(12, 0, 3, 1, common.EncTight, []byte{0x40, 0x02, 0, 0, 0xFF, 0, 0, 0, 0, 0, 0})
+	//png
+	pngImg := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	for i := range pngImg.Pix {
+		pngImg.Pix[i] = 0xFF
+	}
+	pngData := &bytes.Buffer{}
+	png.Encode(pngData, pngImg)
+	update.rect(16, 0, 2, 2, common.EncTightPng, []byte{0xA0}, compactLen(pngData.Len()), pngData.Bytes())
+	decode(t, fb, update.bytes())
+
+	img := fb.Image()
+	expectColor(t, img, 3, 3, red)
+	expectColor(t, img, 7, 3, green)
+	expectColor(t, img, 8, 0, white)
+	expectColor(t, img, 9, 0, blue)
+	expectColor(t, img, 10, 0, white)
+	expectColor(t, img, 14, 0, blue)
+	expectColor(t, img, 17, 1, white)
+}
+
+func TestDecodeZRLE(t *testing.T) {
+	fb := newTestFramebuffer()
+	z := &zlibWriter{}
+	update := &updateWriter{}
+
+	cpixel := func(c color.RGBA) []byte { return []byte{c.B, c.G, c.R} }
+	tiles := &bytes.Buffer{}
+	//a 70x2 rect: a solid 64x2 tile, then a 6x2 plain rle tile (5 red, 7 green)
+	tiles.WriteByte(1)
+	tiles.Write(cpixel(blue))
+	tiles.WriteByte(128)
+	tiles.Write(cpixel(red))
+	tiles.WriteByte(4)
+	tiles.Write(cpixel(green))
+	tiles.WriteByte(6)
+	data := z.compress(tiles.Bytes())
+	fb.resize(70, 4)
+	update.rect(0, 0, 70, 2, common.EncZRLE, u32(uint32(len(data))), data)
+
+	//a 4x2 packed palette tile in the same stream: 2 colors, a bit per pixel
+	tiles.Reset()
+	tiles.WriteByte(2)
+	tiles.Write(cpixel(white))
+	tiles.Write(cpixel(red))
+	tiles.Write([]byte{0x50, 0xA0})
+	data = z.compress(tiles.Bytes())
+	update.rect(0, 2, 4, 2, common.EncZRLE, u32(uint32(len(data))), data)
+	decode(t, fb, update.bytes())
+
+	img := fb.Image()
+	expectColor(t, img, 63, 1, blue)
+	expectColor(t, img, 68, 0, red)
+	expectColor(t, img, 69, 1, green)
+	expectColor(t, img, 0, 2, white)
+	expectColor(t, img, 1, 2, red)
+	expectColor(t, img, 0, 3, red)
+}
+
+func TestDecodePseudoEncodings(t *testing.T) {
+	fb := newTestFramebuffer()
+	update := &updateWriter{}
+	//a 2x1 cursor with its hotspot at (1,0), only the left pixel visible
+	update.rect(1, 0, 2, 1, common.EncCursorPseudo, pixel32(red), pixel32(green), []byte{0x80})
+	update.rect(0, 0, 100, 50, common.EncDesktopSizePseudo)
+	update.rect(0, 0, 0, 0, common.EncLastRectPseudo)
+	decode(t, fb, update.bytes())
+
+	if w, h := fb.Size(); w != 100 || h != 50 {
+		t.Errorf("expected a 100x50 screen, got %dx%d", w, h)
+	}
+	cursor, hotspot := fb.Cursor()
+	if cursor == nil || hotspot != image.Pt(1, 0) {
+		t.Fatalf("unexpected cursor, hotspot %v", hotspot)
+	}
+	expectColor(t, cursor, 0, 0, red)
+	if c := cursor.RGBAAt(1, 0); c.A != 0 {
+		t.Errorf("expected a transparent pixel out of the mask, got %v", c)
+	}
+
+	fb.SetPointer(10, 10)
+	expectColor(t, fb.ImageWithCursor(), 9, 10, red)
+}
+
+func TestScreenTooLarge(t *testing.T) {
+	if _, err := NewFramebuffer(65535, 65535, common.NewPixelFormat(32)); !errors.Is(err, ErrScreenTooLarge) {
+		t.Errorf("expected a 65535x65535 screen to be refused, got %v", err)
+	}
+
+	fb := newTestFramebuffer()
+	update := &updateWriter{}
+	update.rect(0, 0, 65535, 65535, common.EncDesktopSizePseudo)
+	if _, err := fb.ReadServerMessage(bytes.NewReader(update.bytes())); !errors.Is(err, ErrScreenTooLarge) {
+		t.Errorf("expected resizing to 65535x65535 to be refused, got %v", err)
+	}
+	if w, h := fb.Size(); w != 64 || h != 64 {
+		t.Errorf("expected the screen to keep its size, got %dx%d", w, h)
+	}
+}
+
+func TestListener(t *testing.T) {
+	listener := NewListener(nil)
+	listener.Consume(&common.RfbSegment{SegmentType: common.SegmentServerInitMessage, Message: &common.ServerInit{
+		FBWidth:     16,
+		FBHeight:    16,
+		PixelFormat: *common.NewPixelFormat(32),
+	}})
+
+	update := &updateWriter{}
+	update.rect(0, 0, 1, 1, common.EncRaw, pixel32(red))
+	msg := update.bytes()
+	//the vnc-server connection publishes messages in parts
+	listener.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageStart, UpcomingObjectType: int(common.FramebufferUpdate)})
+	listener.Consume(&common.RfbSegment{SegmentType: common.SegmentBytes, Bytes: msg[:5]})
+	listener.Consume(&common.RfbSegment{SegmentType: common.SegmentBytes, Bytes: msg[5:]})
+	listener.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageEnd, UpcomingObjectType: int(common.FramebufferUpdate)})
+	listener.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageStart, UpcomingObjectType: int(common.Bell)})
+	listener.Consume(&common.RfbSegment{SegmentType: common.SegmentBytes, Bytes: []byte{byte(common.Bell)}})
+	listener.Consume(&common.RfbSegment{SegmentType: common.SegmentConnectionClosed})
+	<-listener.Done()
+
+	fb := listener.Framebuffer()
+	expectColor(t, fb.Image(), 0, 0, red)
+	if fb.Updates() != 1 {
+		t.Errorf("expected 1 update, got %d", fb.Updates())
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 2; y++ {
+			if x < 2 {
+				img.SetRGBA(x, y, white)
+			} else if y == 0 {
+				img.SetRGBA(x, y, red)
+			}
+		}
+	}
+
+	thumb := Thumbnail(img, 2, 0)
+	if size := thumb.Bounds().Size(); size != image.Pt(2, 1) {
+		t.Fatalf("expected a 2x1 thumbnail, got %v", size)
+	}
+	expectColor(t, thumb, 0, 0, white)
+	//2 red & 2 transparent pixels
+	expectColor(t, thumb, 1, 0, color.RGBA{0x7F, 0, 0, 0x7F})
+	if Thumbnail(img, 10, 10) != img {
+		t.Error("an image that fits shouldn't be scaled")
+	}
+}
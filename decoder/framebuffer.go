@@ -0,0 +1,343 @@
+// Package decoder keeps an in-memory RGBA copy of a vnc screen by decoding the rfb stream sent by the vnc-server,
+// the rest of vncproxy only skips over pixel data. It works on live connections (see Listener) and on recordings
+// (read the session start, then call ReadServerMessage until the end of the file).
+package decoder
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"sync"
+
+	"github.com/amitbet/vncproxy/common"
+)
+
+var ErrUnsupportedEncoding = errors.New("unsupported encoding")
+
+// maxCutTextLength guards against allocating garbage sizes from a broken stream
+const maxCutTextLength = 64 * 1024 * 1024
+
+// MaxScreenPixels is the largest screen decoded (8192x8192, 256MB as RGBA), a vnc-server or a recording
+// asking for a bigger one is refused rather than allocating up to 16GB
+const MaxScreenPixels = 8192 * 8192
+
+var ErrScreenTooLarge = errors.New("screen too large")
+
+// Framebuffer is the decoded screen of a single connection, its methods are safe for concurrent use
+type Framebuffer struct {
+	mutex        sync.RWMutex
+	screen       *image.RGBA
+	pixelFormat  common.PixelFormat
+	colorMap     [256]color.RGBA
+	cursor       *image.RGBA
+	cursorHot    image.Point
+	pointer      image.Point
+	pointerKnown bool
+	updates      int
+
+	//compression streams continue from one rectangle to the next, like on a vnc-client
+	tightStreams [4]zlibStream
+	zrleStream   zlibStream
+	zlibStream   zlibStream
+}
+
+// NewFramebuffer starts with a black screen, like a vnc-client before the first update
+func NewFramebuffer(width, height uint16, pixelFormat *common.PixelFormat) (*Framebuffer, error) {
+	if err := checkScreenSize(int(width), int(height)); err != nil {
+		return nil, err
+	}
+	return &Framebuffer{
+		screen:      blankScreen(int(width), int(height)),
+		pixelFormat: *pixelFormat,
+	}, nil
+}
+
+func checkScreenSize(width, height int) error {
+	if width*height > MaxScreenPixels {
+		return fmt.Errorf("%w: %dx%d", ErrScreenTooLarge, width, height)
+	}
+	return nil
+}
+
+func blankScreen(width, height int) *image.RGBA {
+	screen := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(screen, screen.Bounds(), image.Black, image.Point{}, draw.Src)
+	return screen
+}
+
+// SetPixelFormat changes the pixel format of the updates that follow (after a SetPixelFormat client message)
+func (fb *Framebuffer) SetPixelFormat(pixelFormat *common.PixelFormat) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.pixelFormat = *pixelFormat
+}
+
+// ResetStreams forgets the compression streams, for updates of a new connection to the vnc-server
+func (fb *Framebuffer) ResetStreams() {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.tightStreams = [4]zlibStream{}
+	fb.zrleStream = zlibStream{}
+	fb.zlibStream = zlibStream{}
+}
+
+// Image returns a copy of the screen
+func (fb *Framebuffer) Image() *image.RGBA {
+	fb.mutex.RLock()
+	defer fb.mutex.RUnlock()
+	return copyImage(fb.screen)
+}
+
+// Region returns a copy of a part of the screen, clipped to the screen
+func (fb *Framebuffer) Region(r image.Rectangle) *image.RGBA {
+	fb.mutex.RLock()
+	defer fb.mutex.RUnlock()
+	r = r.Intersect(fb.screen.Bounds())
+	img := image.NewRGBA(r)
+	draw.Draw(img, r, fb.screen, r.Min, draw.Src)
+	return img
+}
+
+// ImageWithCursor returns a copy of the screen with the cursor drawn at the pointer position, when both are known
+func (fb *Framebuffer) ImageWithCursor() *image.RGBA {
+	fb.mutex.RLock()
+	defer fb.mutex.RUnlock()
+	img := copyImage(fb.screen)
+	if fb.cursor != nil && fb.pointerKnown {
+		at := fb.pointer.Sub(fb.cursorHot)
+		draw.Draw(img, fb.cursor.Bounds().Add(at), fb.cursor, image.Point{}, draw.Over)
+	}
+	return img
+}
+
+// Cursor returns a copy of the cursor shape & its hotspot, nil when the server didn't send one
+func (fb *Framebuffer) Cursor() (*image.RGBA, image.Point) {
+	fb.mutex.RLock()
+	defer fb.mutex.RUnlock()
+	if fb.cursor == nil {
+		return nil, image.Point{}
+	}
+	return copyImage(fb.cursor), fb.cursorHot
+}
+
+// SetPointer records the pointer position (from the vnc-client's pointer events), for ImageWithCursor
+func (fb *Framebuffer) SetPointer(x, y int) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.pointer = image.Pt(x, y)
+	fb.pointerKnown = true
+}
+
+// Size returns the current screen size
+func (fb *Framebuffer) Size() (width, height int) {
+	fb.mutex.RLock()
+	defer fb.mutex.RUnlock()
+	size := fb.screen.Bounds().Size()
+	return size.X, size.Y
+}
+
+// Updates returns the number of framebuffer updates decoded so far
+func (fb *Framebuffer) Updates() int {
+	fb.mutex.RLock()
+	defer fb.mutex.RUnlock()
+	return fb.updates
+}
+
+func copyImage(src *image.RGBA) *image.RGBA {
+	img := image.NewRGBA(src.Bounds())
+	copy(img.Pix, src.Pix)
+	return img
+}
+
+// ReadServerMessage reads & applies the next server message (starting with its type byte) from an rfb stream,
+// and returns the message type
+func (fb *Framebuffer) ReadServerMessage(r io.Reader) (uint8, error) {
+	var messageType uint8
+	if err := binary.Read(r, binary.BigEndian, &messageType); err != nil {
+		return 0, err
+	}
+
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	var err error
+	switch messageType {
+	case uint8(common.FramebufferUpdate):
+		err = fb.readFramebufferUpdate(r)
+	case uint8(common.SetColourMapEntries):
+		err = fb.readColorMapEntries(r)
+	case uint8(common.Bell):
+	case uint8(common.ServerCutText):
+		err = fb.readServerCutText(r)
+	case common.ServerFence:
+		err = readServerFence(r)
+	default:
+		err = fmt.Errorf("unknown server message type: %d", messageType)
+	}
+	return messageType, err
+}
+
+func (fb *Framebuffer) readFramebufferUpdate(r io.Reader) error {
+	var header struct {
+		Padding  uint8
+		NumRects uint16
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return err
+	}
+
+	for i := 0; i < int(header.NumRects); i++ {
+		var rect struct {
+			X, Y, Width, Height uint16
+			Encoding            int32
+		}
+		if err := binary.Read(r, binary.BigEndian, &rect); err != nil {
+			return err
+		}
+		if common.EncodingType(rect.Encoding) == common.EncLastRectPseudo {
+			break
+		}
+		x, y, w, h := int(rect.X), int(rect.Y), int(rect.Width), int(rect.Height)
+		if err := fb.readRect(r, common.EncodingType(rect.Encoding), x, y, w, h); err != nil {
+			return fmt.Errorf("decoding %s rectangle (%d,%d %dx%d): %w", common.EncodingType(rect.Encoding), x, y, w, h, err)
+		}
+	}
+	fb.updates++
+	return nil
+}
+
+func (fb *Framebuffer) readRect(r io.Reader, encoding common.EncodingType, x, y, w, h int) error {
+	switch encoding {
+	case common.EncRaw:
+		return fb.readRaw(r, x, y, w, h)
+	case common.EncCopyRect:
+		return fb.readCopyRect(r, x, y, w, h)
+	case common.EncRRE:
+		return fb.readRRE(r, x, y, w, h, false)
+	case common.EncCoRRE:
+		return fb.readRRE(r, x, y, w, h, true)
+	case common.EncHextile:
+		return fb.readHextile(r, x, y, w, h)
+	case common.EncZlib:
+		return fb.readZlib(r, x, y, w, h)
+	case common.EncTight:
+		return fb.readTight(r, x, y, w, h, false)
+	case common.EncTightPng:
+		return fb.readTight(r, x, y, w, h, true)
+	case common.EncZRLE:
+		return fb.readZRLE(r, x, y, w, h)
+	case common.EncCursorPseudo:
+		return fb.readCursor(r, x, y, w, h)
+	case common.EncDesktopSizePseudo:
+		return fb.resize(w, h)
+	case common.EncExtendedDesktopSizePseudo:
+		return fb.readExtendedDesktopSize(r, x, y, w, h)
+	case common.EncPointerPosPseudo:
+		fb.pointer = image.Pt(x, y)
+		fb.pointerKnown = true
+		return nil
+	case common.EncLedStatePseudo:
+		_, err := io.ReadFull(r, make([]byte, 1))
+		return err
+	}
+	return ErrUnsupportedEncoding
+}
+
+func (fb *Framebuffer) readColorMapEntries(r io.Reader) error {
+	var header struct {
+		Padding    uint8
+		FirstColor uint16
+		NumColors  uint16
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	for i := 0; i < int(header.NumColors); i++ {
+		var c struct{ R, G, B uint16 }
+		if err := binary.Read(r, binary.BigEndian, &c); err != nil {
+			return err
+		}
+		if index := int(header.FirstColor) + i; index < len(fb.colorMap) {
+			fb.colorMap[index] = color.RGBA{uint8(c.R >> 8), uint8(c.G >> 8), uint8(c.B >> 8), 0xFF}
+		}
+	}
+	return nil
+}
+
+func (fb *Framebuffer) readServerCutText(r io.Reader) error {
+	var header struct {
+		Padding [3]uint8
+		Length  uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	if header.Length > maxCutTextLength {
+		return fmt.Errorf("cut text too long: %d", header.Length)
+	}
+	_, err := io.CopyN(io.Discard, r, int64(header.Length))
+	return err
+}
+
+func readServerFence(r io.Reader) error {
+	var header struct {
+		Padding [3]uint8
+		Flags   uint32
+		Length  uint8
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	_, err := io.CopyN(io.Discard, r, int64(header.Length))
+	return err
+}
+
+// resize changes the screen size, keeping the part of the old screen that fits
+func (fb *Framebuffer) resize(width, height int) error {
+	if fb.screen.Bounds().Dx() == width && fb.screen.Bounds().Dy() == height {
+		return nil
+	}
+	if err := checkScreenSize(width, height); err != nil {
+		return err
+	}
+	screen := blankScreen(width, height)
+	draw.Draw(screen, screen.Bounds(), fb.screen, image.Point{}, draw.Src)
+	fb.screen = screen
+	return nil
+}
+
+func (fb *Framebuffer) readExtendedDesktopSize(r io.Reader, x, y, w, h int) error {
+	var header struct {
+		NumScreens uint8
+		Padding    [3]uint8
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	//id, x, y, width, height & flags of every screen
+	if _, err := io.CopyN(io.Discard, r, int64(header.NumScreens)*16); err != nil {
+		return err
+	}
+	//y is the status of a resize request, the size only changed when it's 0
+	if y == 0 {
+		return fb.resize(w, h)
+	}
+	return nil
+}
+
+// fill paints a rectangle of the screen with a single color
+func (fb *Framebuffer) fill(x, y, w, h int, c color.RGBA) {
+	draw.Draw(fb.screen, image.Rect(x, y, x+w, y+h), &image.Uniform{C: c}, image.Point{}, draw.Src)
+}
+
+// drawPixels paints a rectangle of the screen from row-major pixels
+func (fb *Framebuffer) drawPixels(x, y, w, h int, pixels []color.RGBA) {
+	for row := 0; row < h; row++ {
+		for col := 0; col < w; col++ {
+			fb.screen.SetRGBA(x+col, y+row, pixels[row*w+col])
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package decoder
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/logger"
+	"github.com/amitbet/vncproxy/server"
+	"github.com/amitbet/vncproxy/wsserver"
+)
+
+// listenerItem is a complete server message, or a pixel format change applying to the messages after it,
+// or a new connection
+type listenerItem struct {
+	message     []byte
+	pixelFormat *common.PixelFormat
+	reset       bool
+}
+
+// Listener decodes a live connection into a Framebuffer. Add it to the listeners of the vnc-server connection
+// (client.ClientConn) and, to follow pixel format changes & the pointer, of the vnc-client connection.
+// Messages are decoded on the listener's own goroutine, so the proxy isn't slowed down.
+type Listener struct {
+	mutex       sync.Mutex
+	framebuffer *Framebuffer
+	message     *bytes.Buffer //the server message being collected, nil between messages
+	itemChan    chan listenerItem
+	quit        chan struct{}
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewListener starts decoding into fb, or into a framebuffer created from the server init message when fb is nil
+func NewListener(fb *Framebuffer) *Listener {
+	l := &Listener{
+		framebuffer: fb,
+		itemChan:    make(chan listenerItem, 100),
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go l.decodeLoop()
+	return l
+}
+
+// Framebuffer returns the decoded screen, nil until the connection's server init message
+func (l *Listener) Framebuffer() *Framebuffer {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.framebuffer
+}
+
+func (l *Listener) Consume(seg *common.RfbSegment) error {
+	switch seg.SegmentType {
+	case common.SegmentServerInitMessage:
+		initMsg := seg.Message.(*common.ServerInit)
+		l.mutex.Lock()
+		if l.framebuffer == nil {
+			framebuffer, err := NewFramebuffer(initMsg.FBWidth, initMsg.FBHeight, &initMsg.PixelFormat)
+			if err != nil {
+				//nothing is decoded, the screen stays unavailable
+				logger.Errorf("decoder.Listener: %s", err)
+			} else {
+				l.framebuffer = framebuffer
+			}
+		}
+		l.mutex.Unlock()
+	case common.SegmentMessageStart:
+		l.endMessage()
+		l.message = &bytes.Buffer{}
+	case common.SegmentBytes:
+		//bytes before the first message start belong to a message we didn't see start
+		if l.message != nil {
+			l.message.Write(seg.Bytes)
+		}
+	case common.SegmentMessageEnd:
+		l.endMessage()
+	case common.SegmentFullyParsedClientMessage:
+		l.handleClientMessage(seg.Message)
+	case common.SegmentConnectionReset:
+		l.endMessage()
+		l.queue(listenerItem{reset: true})
+	case common.SegmentConnectionClosed:
+		l.endMessage()
+		l.Close()
+	}
+	return nil
+}
+
+func (l *Listener) handleClientMessage(msg interface{}) {
+	//the message type depends on the server package the vnc-client connected through
+	switch msg := msg.(type) {
+	case *server.MsgSetPixelFormat:
+		l.queue(listenerItem{pixelFormat: &msg.PF})
+	case *wsserver.MsgSetPixelFormat:
+		l.queue(listenerItem{pixelFormat: &msg.PF})
+	case *server.MsgPointerEvent:
+		if fb := l.Framebuffer(); fb != nil {
+			fb.SetPointer(int(msg.X), int(msg.Y))
+		}
+	case *wsserver.MsgPointerEvent:
+		if fb := l.Framebuffer(); fb != nil {
+			fb.SetPointer(int(msg.X), int(msg.Y))
+		}
+	}
+}
+
+// endMessage queues the message collected so far for decoding
+func (l *Listener) endMessage() {
+	if l.message != nil && l.message.Len() > 0 {
+		l.queue(listenerItem{message: l.message.Bytes()})
+	}
+	l.message = nil
+}
+
+func (l *Listener) queue(item listenerItem) {
+	select {
+	case l.itemChan <- item:
+	case <-l.quit:
+		//closed, nothing more is decoded
+	}
+}
+
+func (l *Listener) decodeLoop() {
+	defer close(l.done)
+	for {
+		select {
+		case item := <-l.itemChan:
+			l.decode(item)
+		case <-l.quit:
+			//decode what was queued before the end
+			for {
+				select {
+				case item := <-l.itemChan:
+					l.decode(item)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (l *Listener) decode(item listenerItem) {
+	fb := l.Framebuffer()
+	if fb == nil {
+		return
+	}
+	if item.pixelFormat != nil {
+		fb.SetPixelFormat(item.pixelFormat)
+		return
+	}
+	if item.reset {
+		fb.ResetStreams()
+		return
+	}
+	if messageType, err := fb.ReadServerMessage(bytes.NewReader(item.message)); err != nil {
+		logger.Errorf("decoder.Listener: error decoding server message %d: %s", messageType, err)
+	}
+}
+
+// Done is closed when decoding ended: the connection closed or Close was called
+func (l *Listener) Done() <-chan struct{} {
+	return l.done
+}
+
+// Close stops decoding, it is safe to call more than once
+func (l *Listener) Close() {
+	l.closeOnce.Do(func() {
+		close(l.quit)
+	})
+}
@@ -0,0 +1,132 @@
+package decoder
+
+import (
+	"image/color"
+	"io"
+)
+
+// pixelReader decodes pixels of one of the rfb pixel layouts: full pixels, tight's TPIXELs or zrle's CPIXELs
+type pixelReader struct {
+	size   int
+	decode func(b []byte) color.RGBA
+}
+
+func (pr pixelReader) readOne(r io.Reader) (color.RGBA, error) {
+	buf := make([]byte, pr.size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return color.RGBA{}, err
+	}
+	return pr.decode(buf), nil
+}
+
+func (pr pixelReader) read(r io.Reader, count int) ([]color.RGBA, error) {
+	buf := make([]byte, pr.size*count)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return pr.decodeAll(buf), nil
+}
+
+func (pr pixelReader) decodeAll(buf []byte) []color.RGBA {
+	pixels := make([]color.RGBA, len(buf)/pr.size)
+	for i := range pixels {
+		pixels[i] = pr.decode(buf[i*pr.size : (i+1)*pr.size])
+	}
+	return pixels
+}
+
+// pixels reads pixels in the connection's pixel format
+func (fb *Framebuffer) pixels() pixelReader {
+	return pixelReader{size: fb.bytesPerPixel(), decode: func(b []byte) color.RGBA {
+		return fb.pixelColor(fb.pixelValue(b))
+	}}
+}
+
+// tightPixels reads tight's TPIXELs: 3 bytes (r, g, b) for 24 bit true color formats in 32 bits, full pixels otherwise
+func (fb *Framebuffer) tightPixels() pixelReader {
+	if fb.isTightPixel() {
+		return pixelReader{size: 3, decode: func(b []byte) color.RGBA {
+			return color.RGBA{b[0], b[1], b[2], 0xFF}
+		}}
+	}
+	return fb.pixels()
+}
+
+func (fb *Framebuffer) isTightPixel() bool {
+	pf := fb.pixelFormat
+	return pf.TrueColor != 0 && pf.BPP == 32 && pf.Depth == 24 && pf.RedMax == 255 && pf.GreenMax == 255 && pf.BlueMax == 255
+}
+
+// compactPixels reads zrle's CPIXELs: 32 bit true color pixels with at most 24 used bits lose their unused byte
+func (fb *Framebuffer) compactPixels() pixelReader {
+	pf := fb.pixelFormat
+	if pf.TrueColor == 0 || pf.BPP != 32 || pf.Depth > 24 {
+		return fb.pixels()
+	}
+	used := uint32(pf.RedMax)<<pf.RedShift | uint32(pf.GreenMax)<<pf.GreenShift | uint32(pf.BlueMax)<<pf.BlueShift
+	var shift uint
+	switch {
+	case used&0xFF000000 == 0:
+		shift = 0
+	case used&0x000000FF == 0:
+		shift = 8
+	default:
+		return fb.pixels()
+	}
+	bigEndian := pf.BigEndian != 0
+	return pixelReader{size: 3, decode: func(b []byte) color.RGBA {
+		var v uint32
+		if bigEndian {
+			v = uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		} else {
+			v = uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+		}
+		return fb.pixelColor(v << shift)
+	}}
+}
+
+func (fb *Framebuffer) bytesPerPixel() int {
+	if fb.pixelFormat.BPP < 8 {
+		return 1
+	}
+	return int(fb.pixelFormat.BPP) / 8
+}
+
+// pixelValue reads a pixel value in the byte order of the pixel format
+func (fb *Framebuffer) pixelValue(b []byte) uint32 {
+	var v uint32
+	if fb.pixelFormat.BigEndian != 0 {
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+	} else {
+		for i := len(b) - 1; i >= 0; i-- {
+			v = v<<8 | uint32(b[i])
+		}
+	}
+	return v
+}
+
+// pixelColor converts a pixel value to a color, through the color map for non true color formats
+func (fb *Framebuffer) pixelColor(v uint32) color.RGBA {
+	pf := fb.pixelFormat
+	if pf.TrueColor == 0 {
+		return fb.colorMap[v&0xFF]
+	}
+	return color.RGBA{
+		R: scaleComponent(v>>pf.RedShift&uint32(pf.RedMax), pf.RedMax),
+		G: scaleComponent(v>>pf.GreenShift&uint32(pf.GreenMax), pf.GreenMax),
+		B: scaleComponent(v>>pf.BlueShift&uint32(pf.BlueMax), pf.BlueMax),
+		A: 0xFF,
+	}
+}
+
+func scaleComponent(value uint32, max uint16) uint8 {
+	if max == 0 {
+		return 0
+	}
+	if max == 255 {
+		return uint8(value)
+	}
+	return uint8(value * 255 / uint32(max))
+}
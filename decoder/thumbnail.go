@@ -0,0 +1,53 @@
+package decoder
+
+import (
+	"image"
+)
+
+// Thumbnail shrinks img to fit in maxWidth x maxHeight keeping its aspect ratio, averaging the pixels each
+// thumbnail pixel covers. A limit of 0 is ignored, images that already fit are returned as they are.
+func Thumbnail(img *image.RGBA, maxWidth, maxHeight int) *image.RGBA {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	scale := 1.0
+	if maxWidth > 0 && srcW > maxWidth {
+		scale = float64(maxWidth) / float64(srcW)
+	}
+	if maxHeight > 0 && srcH > maxHeight && float64(maxHeight)/float64(srcH) < scale {
+		scale = float64(maxHeight) / float64(srcH)
+	}
+	if scale == 1 {
+		return img
+	}
+	dstW, dstH := int(float64(srcW)*scale), int(float64(srcH)*scale)
+	if dstW < 1 {
+		dstW = 1
+	}
+	if dstH < 1 {
+		dstH = 1
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0, y1 := y*srcH/dstH, (y+1)*srcH/dstH
+		for x := 0; x < dstW; x++ {
+			x0, x1 := x*srcW/dstW, (x+1)*srcW/dstW
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := img.PixOffset(bounds.Min.X+x0, bounds.Min.Y+sy)
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(img.Pix[row+c])
+					}
+					row += 4
+				}
+			}
+			count := (x1 - x0) * (y1 - y0)
+			offset := thumb.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				thumb.Pix[offset+c] = uint8(sum[c] / count)
+			}
+		}
+	}
+	return thumb
+}
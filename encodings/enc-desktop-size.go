@@ -0,0 +1,76 @@
+package encodings
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/amitbet/vncproxy/common"
+)
+
+// EncDesktopSizePseudo tells the client the framebuffer size changed to the size of the rectangle
+type EncDesktopSizePseudo struct {
+	Width  uint16
+	Height uint16
+}
+
+func (pe *EncDesktopSizePseudo) Type() int32 {
+	return int32(common.EncDesktopSizePseudo)
+}
+func (pe *EncDesktopSizePseudo) WriteTo(w io.Writer) (n int, err error) {
+	return 0, nil
+}
+func (pe *EncDesktopSizePseudo) Read(pf *common.PixelFormat, rect *common.Rectangle, r *common.RfbReadHelper) (common.IEncoding, error) {
+	return &EncDesktopSizePseudo{Width: rect.Width, Height: rect.Height}, nil
+}
+
+// EncExtendedDesktopSizePseudo tells the client the framebuffer size & screen layout, or the result of its SetDesktopSize request.
+// The rectangle's x is the reason of the change & its y the status, the size is only changed when the status is ok.
+type EncExtendedDesktopSizePseudo struct {
+	Reason  uint16
+	Status  uint16
+	Width   uint16
+	Height  uint16
+	Screens []common.Screen
+}
+
+func (pe *EncExtendedDesktopSizePseudo) Type() int32 {
+	return int32(common.EncExtendedDesktopSizePseudo)
+}
+
+// WriteTo writes the screen layout, the rectangle header is written with the rectangle
+func (pe *EncExtendedDesktopSizePseudo) WriteTo(w io.Writer) (n int, err error) {
+	buf := &bytes.Buffer{}
+	//number of screens & padding
+	buf.Write([]byte{uint8(len(pe.Screens)), 0, 0, 0})
+	if err := common.WriteScreens(buf, pe.Screens); err != nil {
+		return 0, err
+	}
+	return w.Write(buf.Bytes())
+}
+
+func (pe *EncExtendedDesktopSizePseudo) Read(pf *common.PixelFormat, rect *common.Rectangle, r *common.RfbReadHelper) (common.IEncoding, error) {
+	var header struct {
+		NumScreens uint8
+		Padding    [3]uint8
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	screens, err := common.ReadScreens(r, int(header.NumScreens))
+	if err != nil {
+		return nil, err
+	}
+	return &EncExtendedDesktopSizePseudo{
+		Reason:  rect.X,
+		Status:  rect.Y,
+		Width:   rect.Width,
+		Height:  rect.Height,
+		Screens: screens,
+	}, nil
+}
+
+// Resized returns true when the framebuffer size changed to the rectangle's size
+func (pe *EncExtendedDesktopSizePseudo) Resized() bool {
+	return pe.Status == common.DesktopSizeStatusOK
+}
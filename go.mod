@@ -1,7 +1,9 @@
 module github.com/amitbet/vncproxy
 
-go 1.18
+go 1.21
 
 require golang.org/x/net v0.0.0-20181129055619-fae4c4e3ad76
 
-require github.com/gorilla/websocket v1.5.3 // indirect
+require github.com/gorilla/websocket v1.5.3
+
+require github.com/klauspost/compress v1.16.7
@@ -145,43 +145,43 @@ func (sl *SimpleLogger) Fatalf(format string, v ...interface{}) {
 }
 
 func Debug(v ...interface{}) {
-	simpleLogger.Debug(v...)
+	output(LogLevelDebug, nil, sprintln(v...))
 }
 func Debugf(format string, v ...interface{}) {
-	simpleLogger.Debugf(format, v...)
+	output(LogLevelDebug, nil, fmt.Sprintf(format, v...))
 }
 
 func Trace(v ...interface{}) {
-	simpleLogger.Trace(v...)
+	output(LogLevelTrace, nil, sprintln(v...))
 }
 func Tracef(format string, v ...interface{}) {
-	simpleLogger.Tracef(format, v...)
+	output(LogLevelTrace, nil, fmt.Sprintf(format, v...))
 }
 
 func Info(v ...interface{}) {
-	simpleLogger.Info(v...)
+	output(LogLevelInfo, nil, sprintln(v...))
 }
 func Infof(format string, v ...interface{}) {
-	simpleLogger.Infof(format, v...)
+	output(LogLevelInfo, nil, fmt.Sprintf(format, v...))
 }
 
 func Warn(v ...interface{}) {
-	simpleLogger.Warn(v...)
+	output(LogLevelWarn, nil, sprintln(v...))
 }
 func Warnf(format string, v ...interface{}) {
-	simpleLogger.Warnf(format, v...)
+	output(LogLevelWarn, nil, fmt.Sprintf(format, v...))
 }
 
 func Error(v ...interface{}) {
-	simpleLogger.Error(v...)
+	output(LogLevelError, nil, sprintln(v...))
 }
 func Errorf(format string, v ...interface{}) {
-	simpleLogger.Errorf(format, v...)
+	output(LogLevelError, nil, fmt.Sprintf(format, v...))
 }
 
 func Fatal(v ...interface{}) {
-	simpleLogger.Fatal(v...)
+	output(LogLevelFatal, nil, sprintln(v...))
 }
 func Fatalf(format string, v ...interface{}) {
-	simpleLogger.Fatalf(format, v...)
+	output(LogLevelFatal, nil, fmt.Sprintf(format, v...))
 }
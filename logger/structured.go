@@ -0,0 +1,225 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the keys of the fields added to the lines of a connection
+const (
+	FieldSession = "session"
+	FieldViewer  = "viewer"
+	FieldTarget  = "target"
+)
+
+// the output formats of SetFormat
+const (
+	FormatText   = "text"
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// slog levels of the levels slog doesn't have
+const (
+	slogLevelTrace = slog.LevelDebug - 4
+	slogLevelFatal = slog.LevelError + 4
+)
+
+var (
+	handlerMutex sync.RWMutex
+	//nil prints the lines as text like the SimpleLogger, with the fields at the end
+	handler slog.Handler
+)
+
+// SetHandler sends all log lines to a slog handler, nil goes back to the text output.
+// Lines below the level of SetLogLevel are dropped before reaching the handler.
+func SetHandler(h slog.Handler) {
+	handlerMutex.Lock()
+	defer handlerMutex.Unlock()
+	handler = h
+}
+
+// SetFormat chooses how log lines are printed to stdout: text (the default), json or logfmt
+func SetFormat(format string) error {
+	switch format {
+	case FormatText, "":
+		SetHandler(nil)
+	case FormatJSON:
+		SetHandler(slog.NewJSONHandler(os.Stdout, handlerOptions()))
+	case FormatLogfmt:
+		SetHandler(slog.NewTextHandler(os.Stdout, handlerOptions()))
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+	return nil
+}
+
+// NewHandler creates a json or logfmt handler writing to w, for handlers wrapping the ones of this package
+func NewHandler(w io.Writer, format string) (slog.Handler, error) {
+	switch format {
+	case FormatJSON:
+		return slog.NewJSONHandler(w, handlerOptions()), nil
+	case FormatLogfmt:
+		return slog.NewTextHandler(w, handlerOptions()), nil
+	}
+	return nil, fmt.Errorf("unknown log format: %s", format)
+}
+
+func handlerOptions() *slog.HandlerOptions {
+	return &slog.HandlerOptions{
+		Level: slogLevelTrace,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			//name the levels slog doesn't know instead of DEBUG-4 & ERROR+4
+			if attr.Key == slog.LevelKey && len(groups) == 0 {
+				switch attr.Value.Any() {
+				case slogLevelTrace:
+					attr.Value = slog.StringValue("TRACE")
+				case slogLevelFatal:
+					attr.Value = slog.StringValue("FATAL")
+				}
+			}
+			return attr
+		},
+	}
+}
+
+// FieldLogger adds fields (e.g. the session of a connection) to every line it logs.
+// A nil FieldLogger logs without fields.
+type FieldLogger struct {
+	attrs []slog.Attr
+}
+
+// With returns a logger with fields given as key, value pairs
+func With(args ...interface{}) *FieldLogger {
+	var l *FieldLogger
+	return l.With(args...)
+}
+
+// With returns a logger with the fields of this one and more, fields with the same key are replaced
+func (l *FieldLogger) With(args ...interface{}) *FieldLogger {
+	added := slog.Group("", args...).Value.Group()
+	attrs := make([]slog.Attr, 0, len(l.fields())+len(added))
+	for _, attr := range l.fields() {
+		replaced := false
+		for _, addedAttr := range added {
+			replaced = replaced || addedAttr.Key == attr.Key
+		}
+		if !replaced {
+			attrs = append(attrs, attr)
+		}
+	}
+	return &FieldLogger{attrs: append(attrs, added...)}
+}
+
+func (l *FieldLogger) fields() []slog.Attr {
+	if l == nil {
+		return nil
+	}
+	return l.attrs
+}
+
+func (l *FieldLogger) Trace(v ...interface{}) {
+	output(LogLevelTrace, l.fields(), sprintln(v...))
+}
+func (l *FieldLogger) Tracef(format string, v ...interface{}) {
+	output(LogLevelTrace, l.fields(), fmt.Sprintf(format, v...))
+}
+
+func (l *FieldLogger) Debug(v ...interface{}) {
+	output(LogLevelDebug, l.fields(), sprintln(v...))
+}
+func (l *FieldLogger) Debugf(format string, v ...interface{}) {
+	output(LogLevelDebug, l.fields(), fmt.Sprintf(format, v...))
+}
+
+func (l *FieldLogger) Info(v ...interface{}) {
+	output(LogLevelInfo, l.fields(), sprintln(v...))
+}
+func (l *FieldLogger) Infof(format string, v ...interface{}) {
+	output(LogLevelInfo, l.fields(), fmt.Sprintf(format, v...))
+}
+
+func (l *FieldLogger) Warn(v ...interface{}) {
+	output(LogLevelWarn, l.fields(), sprintln(v...))
+}
+func (l *FieldLogger) Warnf(format string, v ...interface{}) {
+	output(LogLevelWarn, l.fields(), fmt.Sprintf(format, v...))
+}
+
+func (l *FieldLogger) Error(v ...interface{}) {
+	output(LogLevelError, l.fields(), sprintln(v...))
+}
+func (l *FieldLogger) Errorf(format string, v ...interface{}) {
+	output(LogLevelError, l.fields(), fmt.Sprintf(format, v...))
+}
+
+func (l *FieldLogger) Fatal(v ...interface{}) {
+	output(LogLevelFatal, l.fields(), sprintln(v...))
+}
+func (l *FieldLogger) Fatalf(format string, v ...interface{}) {
+	output(LogLevelFatal, l.fields(), fmt.Sprintf(format, v...))
+}
+
+// sprintln formats like fmt.Println, without the new line
+func sprintln(v ...interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+}
+
+var levelTags = map[LogLevel]string{
+	LogLevelTrace: "[Trace]",
+	LogLevelDebug: "[Debug]",
+	LogLevelInfo:  "[Info ]",
+	LogLevelWarn:  "[Warn ]",
+	LogLevelError: "[Error]",
+	LogLevelFatal: "[Fatal]",
+}
+
+var slogLevels = map[LogLevel]slog.Level{
+	LogLevelTrace: slogLevelTrace,
+	LogLevelDebug: slog.LevelDebug,
+	LogLevelInfo:  slog.LevelInfo,
+	LogLevelWarn:  slog.LevelWarn,
+	LogLevelError: slog.LevelError,
+	LogLevelFatal: slogLevelFatal,
+}
+
+func output(level LogLevel, attrs []slog.Attr, msg string) {
+	if level < simpleLogger.level {
+		return
+	}
+	handlerMutex.RLock()
+	h := handler
+	handlerMutex.RUnlock()
+
+	if h == nil {
+		fmt.Println(levelTags[level] + " " + msg + formatFields(attrs))
+		return
+	}
+	ctx := context.Background()
+	if !h.Enabled(ctx, slogLevels[level]) {
+		return
+	}
+	record := slog.NewRecord(time.Now(), slogLevels[level], msg, 0)
+	record.AddAttrs(attrs...)
+	h.Handle(ctx, record)
+}
+
+// formatFields writes the fields of a text line as " key=value", quoting values that need it
+func formatFields(attrs []slog.Attr) string {
+	var sb strings.Builder
+	for _, attr := range attrs {
+		value := attr.Value.String()
+		if value == "" || strings.ContainsAny(value, " \"=") || strconv.Quote(value) != "\""+value+"\"" {
+			value = strconv.Quote(value)
+		}
+		sb.WriteString(" " + attr.Key + "=" + value)
+	}
+	return sb.String()
+}
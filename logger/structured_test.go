@@ -0,0 +1,59 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestFieldLoggerJSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	h, err := NewHandler(out, FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetHandler(h)
+	SetLogLevel("debug")
+	defer func() {
+		SetHandler(nil)
+		SetLogLevel("info")
+	}()
+
+	log := With(FieldSession, "desk1", FieldViewer, "10.0.0.5:4242").With(FieldViewer, "10.0.0.6:4242", FieldTarget, "vnc:5900")
+	log.Infof("connected %d", 1)
+	log.Trace("dropped below the level")
+	Warn("no", "fields")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got: %s", out.String())
+	}
+	var line map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"level": "INFO", "msg": "connected 1", FieldSession: "desk1", FieldViewer: "10.0.0.6:4242", FieldTarget: "vnc:5900"}
+	for key, value := range expected {
+		if line[key] != value {
+			t.Errorf("expected %s=%v, got %v", key, value, line[key])
+		}
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["msg"] != "no fields" || line["level"] != "WARN" {
+		t.Errorf("unexpected line: %s", lines[1])
+	}
+}
+
+func TestFormatFields(t *testing.T) {
+	log := With(FieldSession, "desk 1", FieldTarget, "vnc:5900", "empty", "")
+	expected := ` session="desk 1" target=vnc:5900 empty=""`
+	if fields := formatFields(log.fields()); fields != expected {
+		t.Errorf("expected %s, got %s", expected, fields)
+	}
+	if fields := formatFields((*FieldLogger)(nil).fields()); fields != "" {
+		t.Errorf("expected no fields, got %s", fields)
+	}
+}
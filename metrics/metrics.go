@@ -0,0 +1,209 @@
+// Package metrics counts what the proxy does and serves it in the prometheus text format. It is a small
+// dependency free subset of a prometheus client: counters (optionally split by a label) and gauges read
+// when the metrics are collected.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metric is anything a Registry can write in the prometheus text format
+type Metric interface {
+	Write(w io.Writer) error
+}
+
+// Counter is a value that only goes up, safe for concurrent use
+type Counter struct {
+	name  string
+	help  string
+	value uint64
+}
+
+// NewCounter creates a counter and registers it in the Default registry
+func NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	Default.Register(c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) Write(w io.Writer) error {
+	if err := writeHeader(w, c.name, c.help, "counter"); err != nil {
+		return err
+	}
+	return writeSample(w, c.name, "", "", float64(c.Value()))
+}
+
+// CounterVec is a family of counters told apart by the value of a label (e.g. the encoding of rectangles)
+type CounterVec struct {
+	name     string
+	help     string
+	label    string
+	mutex    sync.RWMutex
+	counters map[string]*Counter
+}
+
+// NewCounterVec creates a counter family and registers it in the Default registry
+func NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{name: name, help: help, label: label, counters: make(map[string]*Counter)}
+	Default.Register(c)
+	return c
+}
+
+// With returns the counter of a label value, creating it on first use
+func (c *CounterVec) With(value string) *Counter {
+	c.mutex.RLock()
+	counter, ok := c.counters[value]
+	c.mutex.RUnlock()
+	if ok {
+		return counter
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if counter, ok = c.counters[value]; !ok {
+		counter = &Counter{}
+		c.counters[value] = counter
+	}
+	return counter
+}
+
+func (c *CounterVec) Write(w io.Writer) error {
+	values := make(map[string]float64)
+	c.mutex.RLock()
+	for value, counter := range c.counters {
+		values[value] = float64(counter.Value())
+	}
+	c.mutex.RUnlock()
+	return writeFamily(w, c.name, c.help, "counter", c.label, values)
+}
+
+// GaugeFunc is a gauge read when the metrics are collected, split by a label when label isn't empty
+// (collect then returns a value per label value, otherwise a single value under "")
+type GaugeFunc struct {
+	name    string
+	help    string
+	label   string
+	collect func() map[string]float64
+}
+
+// NewGaugeFunc creates a gauge, it is written by the registries it is registered in
+func NewGaugeFunc(name, help, label string, collect func() map[string]float64) *GaugeFunc {
+	return &GaugeFunc{name: name, help: help, label: label, collect: collect}
+}
+
+func (g *GaugeFunc) Write(w io.Writer) error {
+	return writeFamily(w, g.name, g.help, "gauge", g.label, g.collect())
+}
+
+// Registry is a list of metrics served together
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []Metric
+}
+
+// Default holds the metrics of the vncproxy packages
+var Default = &Registry{}
+
+func (r *Registry) Register(metric Metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.metrics = append(r.metrics, metric)
+}
+
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.Lock()
+	metrics := append([]Metric{}, r.metrics...)
+	r.mutex.Unlock()
+	for _, metric := range metrics {
+		if err := metric.Write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves the metrics of the registries in the prometheus text format
+func Handler(registries ...*Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, registry := range registries {
+			if err := registry.Write(w); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func writeHeader(w io.Writer, name, help, metricType string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, metricType)
+	return err
+}
+
+// writeFamily writes the samples of a metric ordered by label value
+func writeFamily(w io.Writer, name, help, metricType, label string, values map[string]float64) error {
+	if err := writeHeader(w, name, help, metricType); err != nil {
+		return err
+	}
+	labelValues := make([]string, 0, len(values))
+	for value := range values {
+		labelValues = append(labelValues, value)
+	}
+	sort.Strings(labelValues)
+	for _, value := range labelValues {
+		if err := writeSample(w, name, label, value, values[value]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSample(w io.Writer, name, label, labelValue string, value float64) error {
+	if label != "" {
+		name = fmt.Sprintf("%s{%s=\"%s\"}", name, label, escapeLabel(labelValue))
+	}
+	_, err := fmt.Fprintf(w, "%s %s\n", name, formatValue(value))
+	return err
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
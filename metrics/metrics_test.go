@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	registry := &Registry{}
+	updates := &Counter{name: "test_updates_total", help: "Updates."}
+	rects := &CounterVec{name: "test_rects_total", help: "Rects by \"encoding\".", label: "encoding", counters: make(map[string]*Counter)}
+	registry.Register(updates)
+	registry.Register(rects)
+	registry.Register(NewGaugeFunc("test_viewers", "Viewers.", "session", func() map[string]float64 {
+		return map[string]float64{"desk\"1": 2}
+	}))
+
+	updates.Add(3)
+	rects.With("EncTight").Inc()
+	rects.With("EncRaw").Add(2)
+
+	out := &bytes.Buffer{}
+	if err := registry.Write(out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP test_updates_total Updates.
+# TYPE test_updates_total counter
+test_updates_total 3
+# HELP test_rects_total Rects by "encoding".
+# TYPE test_rects_total counter
+test_rects_total{encoding="EncRaw"} 2
+test_rects_total{encoding="EncTight"} 1
+# HELP test_viewers Viewers.
+# TYPE test_viewers gauge
+test_viewers{session="desk\"1"} 2
+`
+	if out.String() != expected {
+		t.Errorf("unexpected metrics:\n%s", out.String())
+	}
+
+	recorder := httptest.NewRecorder()
+	Handler(registry).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Body.String() != expected {
+		t.Errorf("unexpected metrics served:\n%s", recorder.Body.String())
+	}
+}
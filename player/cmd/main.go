@@ -1,14 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
-	"github.com/amitbet/vncproxy/common"
-	"github.com/amitbet/vncproxy/encodings"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/amitbet/vncproxy/logger"
 	"github.com/amitbet/vncproxy/player"
-	"github.com/amitbet/vncproxy/server"
 )
 
 func main() {
@@ -16,6 +18,11 @@ func main() {
 	tcpPort := flag.String("tcpPort", "", "tcp port for player to listen to client connections")
 	fbsFile := flag.String("fbsFile", "", "fbs file to serve to all connecting clients")
 	logLevel := flag.String("logLevel", "info", "change logging level")
+	speed := flag.Float64("speed", 1, "playback speed, from 0.25 to 16")
+	skipIdle := flag.Duration("skipIdle", 0, "shorten idle gaps longer than this (e.g. 5s) to it, defaults to playing gaps as recorded")
+	paused := flag.Bool("paused", false, "start paused, use the control api to resume or step")
+	controlPort := flag.String("controlPort", "", "port of the playback control api (GET /playback, POST /playback/pause, resume, step, speed?value=, skip-idle?value=)")
+	seek := flag.Duration("seek", 0, "start playing at this point of the recording (e.g. 5m30s), needs the recording's .idx keyframe index")
 
 	flag.Parse()
 	logger.SetLogLevel(*logLevel)
@@ -36,65 +43,40 @@ func main() {
 		os.Exit(1)
 	}
 
-	//chServer := make(chan common.ClientMessage)
-	//chClient := make(chan common.ServerMessage)
-
-	encs := []common.IEncoding{
-		&encodings.RawEncoding{},
-		&encodings.TightEncoding{},
-		&encodings.EncCursorPseudo{},
-		&encodings.TightPngEncoding{},
-		&encodings.RREEncoding{},
-		&encodings.ZLibEncoding{},
-		&encodings.ZRLEEncoding{},
-		&encodings.CopyRectEncoding{},
-		&encodings.CoRREEncoding{},
-		&encodings.HextileEncoding{},
+	playback := player.NewPlaybackControl()
+	if err := playback.SetSpeed(*speed); err != nil {
+		logger.Error(err)
+		flag.Usage()
+		os.Exit(1)
 	}
-
-	cfg := &server.ServerConfig{
-		//SecurityHandlers: []SecurityHandler{&ServerAuthNone{}, &ServerAuthVNC{}},
-		SecurityHandlers: []server.SecurityHandler{&server.ServerAuthNone{}},
-		Encodings:        encs,
-		PixelFormat:      common.NewPixelFormat(32),
-		ClientMessages:   server.DefaultClientMessages,
-		DesktopName:      []byte("workDesk"),
-		Height:           uint16(768),
-		Width:            uint16(1024),
+	playback.SetSkipIdle(*skipIdle)
+	if *paused {
+		playback.Pause()
 	}
 
-	cfg.NewConnHandler = func(cfg *server.ServerConfig, conn *server.ServerConn) error {
-		//fbs, err := loadFbsFile("/Users/amitbet/Dropbox/recording.rbs", conn)
-		//fbs, err := loadFbsFile("/Users/amitbet/vncRec/recording.rbs", conn)
-		fbs, err := player.ConnectFbsFile(*fbsFile, conn)
-
-		if err != nil {
-			logger.Error("TestServer.NewConnHandler: Error in loading FBS: ", err)
-			return err
-		}
-		conn.Listeners.AddListener(player.NewFBSPlayListener(conn, fbs))
-		return nil
+	playerServer := &player.PlayerServer{FbsFile: *fbsFile, StartAt: *seek, Playback: playback}
+	if *controlPort != "" {
+		playerServer.ControlListeningURL = ":" + *controlPort
+	}
+	if *tcpPort != "" {
+		playerServer.TCPListeningURL = ":" + *tcpPort
+	}
+	if *wsPort != "" {
+		playerServer.WsListeningURL = "http://0.0.0.0:" + *wsPort + "/"
 	}
 
-	if *tcpPort == "" && *wsPort == "" {
-		logger.Error("no listening port defined")
-		flag.Usage()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := playerServer.Start(ctx); err != nil {
+		logger.Errorf("failed to start the player: %s", err)
 		os.Exit(1)
 	}
 
-	url := "http://0.0.0.0:" + *wsPort + "/"
-
-	if *tcpPort != "" && *wsPort != "" {
-		logger.Infof("running two listeners: tcp port: %s, ws url: %s", *tcpPort, url)
-
-		go server.WsServe(url, cfg)
-		server.TcpServe(":"+*tcpPort, cfg)
-	}
-	if *tcpPort == "" && *wsPort != "" {
-		logger.Infof("running ws listener url: %s", url)
-		server.WsServe(url, cfg)
+	<-ctx.Done()
+	logger.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := playerServer.Shutdown(shutdownCtx); err != nil {
+		logger.Errorf("shutdown: %s", err)
 	}
-	logger.Infof("running tcp listener on port: %s", *tcpPort)
-	server.TcpServe(":"+*tcpPort, cfg)
-
 }
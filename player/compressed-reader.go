@@ -0,0 +1,184 @@
+package player
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/encodings"
+	"github.com/amitbet/vncproxy/logger"
+)
+
+// CompressedReader reads recordings in the compressed format (see common.CompressedRecordingMagic)
+type CompressedReader struct {
+	file             *os.File
+	reader           *bufio.Reader
+	index            recordingIndex
+	metadata         *common.RecordingMetadata
+	buffer           bytes.Buffer
+	currentTimestamp int
+	pixelFormat      *common.PixelFormat
+	encodings        []common.IEncoding
+}
+
+func NewCompressedReader(fileName string) (*CompressedReader, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		logger.Error("NewCompressedReader: can't open recording file: ", fileName)
+		return nil, err
+	}
+	reader := bufio.NewReader(file)
+
+	magic := make([]byte, len(common.CompressedRecordingMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != common.CompressedRecordingMagic {
+		file.Close()
+		return nil, errors.New("not a compressed recording: " + fileName)
+	}
+	metadata, err := common.ReadCompressedRecordingHeader(reader)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &CompressedReader{
+		file:     file,
+		reader:   reader,
+		index:    recordingIndex{fileName: fileName},
+		metadata: metadata,
+		encodings: []common.IEncoding{
+			&encodings.CopyRectEncoding{},
+			&encodings.ZLibEncoding{},
+			&encodings.ZRLEEncoding{},
+			&encodings.CoRREEncoding{},
+			&encodings.HextileEncoding{},
+			&encodings.TightEncoding{},
+			&encodings.TightPngEncoding{},
+			&encodings.EncCursorPseudo{},
+			&encodings.EncLedStatePseudo{},
+			&encodings.RawEncoding{},
+			&encodings.RREEncoding{},
+		},
+	}, nil
+}
+
+// Metadata returns the session details saved in the recording's header
+func (cr *CompressedReader) Metadata() *common.RecordingMetadata {
+	return cr.metadata
+}
+
+func (cr *CompressedReader) CurrentTimestamp() int {
+	return cr.currentTimestamp
+}
+
+func (cr *CompressedReader) CurrentPixelFormat() *common.PixelFormat { return cr.pixelFormat }
+
+func (cr *CompressedReader) Encodings() []common.IEncoding { return cr.encodings }
+
+// Read returns the recorded rfb stream, decompressing blocks as needed
+func (cr *CompressedReader) Read(p []byte) (int, error) {
+	for cr.buffer.Len() < len(p) {
+		data, timestamp, err := common.ReadRecordingBlock(cr.reader, cr.metadata.Compression)
+		if err != nil {
+			if cr.buffer.Len() > 0 {
+				break
+			}
+			if err != io.EOF {
+				logger.Error("CompressedReader.Read: error reading block: ", err)
+			}
+			return 0, err
+		}
+		cr.buffer.Write(data)
+		cr.currentTimestamp = int(timestamp)
+	}
+	return cr.buffer.Read(p)
+}
+
+// SeekTo moves the reader to the last keyframe at or before t, using the recording's index
+func (cr *CompressedReader) SeekTo(t time.Duration) error {
+	entry, err := cr.index.findKeyframe(t)
+	if err != nil {
+		return err
+	}
+	if _, err := cr.file.Seek(entry.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	cr.reader.Reset(cr.file)
+	cr.buffer.Reset()
+	cr.currentTimestamp = int(entry.Timestamp)
+	return nil
+}
+
+func (cr *CompressedReader) Close() error {
+	return cr.file.Close()
+}
+
+// ReadStartSession reads the rfb 3.3 session start at the beginning of the stream
+func (cr *CompressedReader) ReadStartSession() (*common.ServerInit, error) {
+	initMsg := &common.ServerInit{}
+
+	version := make([]byte, 12)
+	if _, err := io.ReadFull(cr, version); err != nil {
+		return nil, err
+	}
+	var secType uint32
+	if err := binary.Read(cr, binary.BigEndian, &secType); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(cr, binary.BigEndian, &initMsg.FBWidth); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(cr, binary.BigEndian, &initMsg.FBHeight); err != nil {
+		return nil, err
+	}
+	pixelFormat := &common.PixelFormat{}
+	if err := binary.Read(cr, binary.BigEndian, pixelFormat); err != nil {
+		return nil, err
+	}
+	initMsg.PixelFormat = *pixelFormat
+	cr.pixelFormat = pixelFormat
+	//padding
+	if _, err := io.ReadFull(cr, make([]byte, 3)); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Read(cr, binary.BigEndian, &initMsg.NameLength); err != nil {
+		return nil, err
+	}
+	if initMsg.NameLength > 4096 {
+		return nil, errors.New("CompressedReader.ReadStartSession: bad desktop name length")
+	}
+	initMsg.NameText = make([]byte, initMsg.NameLength)
+	if _, err := io.ReadFull(cr, initMsg.NameText); err != nil {
+		return nil, err
+	}
+	return initMsg, nil
+}
+
+// OpenRecording opens an fbs or compressed recording, detecting the format by the file header
+func OpenRecording(fileName string) (VncStreamFileReader, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, len(common.CompressedRecordingMagic))
+	_, err = io.ReadFull(file, magic)
+	file.Close()
+
+	if err == nil && string(magic) == common.CompressedRecordingMagic {
+		reader, err := NewCompressedReader(fileName)
+		if err != nil {
+			return nil, err
+		}
+		return reader, nil
+	}
+	reader, err := NewFbsReader(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
@@ -2,13 +2,14 @@ package player
 
 import (
 	"encoding/binary"
-
+	"errors"
 	"io"
+	"sync"
 	"time"
+
 	"github.com/amitbet/vncproxy/client"
 	"github.com/amitbet/vncproxy/common"
 	"github.com/amitbet/vncproxy/logger"
-	"github.com/amitbet/vncproxy/server"
 )
 
 type VncStreamFileReader interface {
@@ -20,14 +21,20 @@ type VncStreamFileReader interface {
 }
 
 type FBSPlayListener struct {
-	Conn             *server.ServerConn
+	Conn             common.IServerConn
 	Fbs              VncStreamFileReader
+	Control          *PlaybackControl //speed, pause & steps, can be shared by several listeners
 	serverMessageMap map[uint8]common.ServerMessage
-	firstSegDone     bool
-	startTime        int
+	clock            *playbackClock //started by the first FramebufferUpdateRequest
+	startOffset      int            //ms into the recording the playback starts at
+	interrupt        chan struct{}  //stops waiting for the next message (for seeking)
+	mutex            sync.Mutex
 }
 
-func ConnectFbsFile(filename string, conn *server.ServerConn) (*FbsReader, error) {
+var ErrNotSeekable = errors.New("recording reader doesn't support seeking")
+
+// ConnectFbsFile opens an fbs recording and sets up the connection's server-init values (size, pixel format, name) from it
+func ConnectFbsFile(filename string, conn common.IServerConn) (*FbsReader, error) {
 	fbs, err := NewFbsReader(filename)
 	if err != nil {
 		logger.Error("failed to open fbs reader:", err)
@@ -37,6 +44,7 @@ func ConnectFbsFile(filename string, conn *server.ServerConn) (*FbsReader, error
 	initMsg, err := fbs.ReadStartSession()
 	if err != nil {
 		logger.Error("failed to open read fbs start session:", err)
+		fbs.Close()
 		return nil, err
 	}
 	conn.SetPixelFormat(&initMsg.PixelFormat)
@@ -47,8 +55,31 @@ func ConnectFbsFile(filename string, conn *server.ServerConn) (*FbsReader, error
 	return fbs, nil
 }
 
-func NewFBSPlayListener(conn *server.ServerConn, r *FbsReader) *FBSPlayListener {
-	h := &FBSPlayListener{Conn: conn, Fbs: r}
+// ConnectRecordingFile is ConnectFbsFile for fbs & compressed recordings
+func ConnectRecordingFile(filename string, conn common.IServerConn) (VncStreamFileReader, error) {
+	reader, err := OpenRecording(filename)
+	if err != nil {
+		logger.Error("failed to open recording reader:", err)
+		return nil, err
+	}
+	initMsg, err := reader.ReadStartSession()
+	if err != nil {
+		logger.Error("failed to read recording start session:", err)
+		if closer, ok := reader.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, err
+	}
+	conn.SetPixelFormat(&initMsg.PixelFormat)
+	conn.SetHeight(initMsg.FBHeight)
+	conn.SetWidth(initMsg.FBWidth)
+	conn.SetDesktopName(string(initMsg.NameText))
+
+	return reader, nil
+}
+
+func NewFBSPlayListener(conn common.IServerConn, r VncStreamFileReader) *FBSPlayListener {
+	h := &FBSPlayListener{Conn: conn, Fbs: r, Control: NewPlaybackControl(), interrupt: make(chan struct{}, 1)}
 	cm := client.MsgBell(0)
 	h.serverMessageMap = make(map[uint8]common.ServerMessage)
 	h.serverMessageMap[0] = &client.MsgFramebufferUpdate{}
@@ -67,13 +98,47 @@ func (handler *FBSPlayListener) Consume(seg *common.RfbSegment) error {
 		switch clientMsg.Type() {
 
 		case common.FramebufferUpdateRequestMsgType:
-			if !handler.firstSegDone {
-				handler.firstSegDone = true
-				handler.startTime = int(time.Now().UnixNano() / int64(time.Millisecond))
+			handler.mutex.Lock()
+			if handler.clock == nil {
+				handler.clock = newPlaybackClock(handler.Control, handler.startOffset)
 			}
 			handler.sendFbsMessage()
+			handler.mutex.Unlock()
 		}
 		// server.MsgFramebufferUpdateRequest:
+	case common.SegmentConnectionClosed:
+		if closer, ok := handler.Fbs.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return nil
+}
+
+// Seek continues the playback at t: from the last keyframe before t, with the updates up to t sent without delay
+func (h *FBSPlayListener) Seek(t time.Duration) error {
+	seeker, ok := h.Fbs.(SeekableStreamFileReader)
+	if !ok {
+		return ErrNotSeekable
+	}
+	//a paused playback waits for the next message while holding the mutex
+	select {
+	case h.interrupt <- struct{}{}:
+	default:
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	select {
+	case <-h.interrupt:
+	default:
+	}
+
+	if err := seeker.SeekTo(t); err != nil {
+		return err
+	}
+	if h.clock != nil {
+		h.clock.seek(int(t / time.Millisecond))
+	} else {
+		h.startOffset = int(t / time.Millisecond)
 	}
 	return nil
 }
@@ -88,6 +153,8 @@ func (h *FBSPlayListener) sendFbsMessage() {
 		logger.Error("TestServer.NewConnHandler: Error in reading FBS segment: ", err)
 		return
 	}
+	//wait before writing anything, so a paused client doesn't hold half a message
+	h.clock.waitFor(fbs.CurrentTimestamp(), h.interrupt)
 	//common.IClientConn{}
 	binary.Write(h.Conn, binary.BigEndian, messageType)
 	msg := h.serverMessageMap[messageType]
@@ -95,11 +162,6 @@ func (h *FBSPlayListener) sendFbsMessage() {
 		logger.Error("TestServer.NewConnHandler: Error unknown message type: ", messageType)
 		return
 	}
-	timeSinceStart := int(time.Now().UnixNano()/int64(time.Millisecond)) - h.startTime
-	timeToSleep := fbs.CurrentTimestamp() - timeSinceStart
-	if timeToSleep > 0 {
-		time.Sleep(time.Duration(timeToSleep) * time.Millisecond)
-	}
 
 	err = msg.CopyTo(fbs, h.Conn, fbs)
 	if err != nil {
@@ -3,8 +3,11 @@ package player
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"os"
+	"time"
+
 	"github.com/amitbet/vncproxy/common"
 	"github.com/amitbet/vncproxy/encodings"
 	"github.com/amitbet/vncproxy/logger"
@@ -12,6 +15,7 @@ import (
 
 type FbsReader struct {
 	reader           io.Reader
+	index            recordingIndex
 	buffer           bytes.Buffer
 	currentTimestamp int
 	pixelFormat      *common.PixelFormat
@@ -36,6 +40,32 @@ func (fbs *FbsReader) Read(p []byte) (n int, err error) {
 	return fbs.buffer.Read(p)
 }
 
+// Close releases the underlying recording file
+func (fbs *FbsReader) Close() error {
+	if closer, ok := fbs.reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// SeekTo moves the reader to the last keyframe at or before t, using the recording's index
+func (fbs *FbsReader) SeekTo(t time.Duration) error {
+	entry, err := fbs.index.findKeyframe(t)
+	if err != nil {
+		return err
+	}
+	seeker, ok := fbs.reader.(io.Seeker)
+	if !ok {
+		return errors.New("FbsReader.SeekTo: recording isn't seekable")
+	}
+	if _, err := seeker.Seek(entry.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	fbs.buffer.Reset()
+	fbs.currentTimestamp = int(entry.Timestamp)
+	return nil
+}
+
 func (fbs *FbsReader) CurrentPixelFormat() *common.PixelFormat { return fbs.pixelFormat }
 
 //func (fbs *FbsReader) CurrentColorMap() *common.ColorMap       { return &common.ColorMap{} }
@@ -49,6 +79,7 @@ func NewFbsReader(fbsFile string) (*FbsReader, error) {
 		return nil, err
 	}
 	return &FbsReader{reader: reader,
+		index: recordingIndex{fileName: fbsFile},
 		encodings: []common.IEncoding{
 			&encodings.CopyRectEncoding{},
 			&encodings.ZLibEncoding{},
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"time"
+)
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// apngFrame is a frame encoded by image/png: its image data & how long it shows
+type apngFrame struct {
+	data     []byte //the IDAT chunks' data
+	duration time.Duration
+}
+
+// apngWriter writes an animated png. image/png has no apng support, so each frame is encoded as a png & its
+// image data is moved into the animation's chunks. Frames are kept compressed in memory until Close, since the
+// frame count comes first in the file.
+type apngWriter struct {
+	fileName string
+	encoder  png.Encoder
+	header   []byte //IHDR chunk data of the first frame
+	last     *image.RGBA
+	frames   []apngFrame
+}
+
+func newApngWriter(fileName string) (*apngWriter, error) {
+	if fileName == "" {
+		return nil, errors.New("apng output needs an output file")
+	}
+	return &apngWriter{fileName: fileName, encoder: png.Encoder{CompressionLevel: png.BestSpeed}}, nil
+}
+
+func (w *apngWriter) WriteFrame(img *image.RGBA, duration time.Duration) error {
+	if w.last != nil && bytes.Equal(w.last.Pix, img.Pix) {
+		w.frames[len(w.frames)-1].duration += duration
+		return nil
+	}
+	encoded := &bytes.Buffer{}
+	if err := w.encoder.Encode(encoded, img); err != nil {
+		return err
+	}
+	header, data, err := readPngImage(encoded.Bytes())
+	if err != nil {
+		return err
+	}
+	if w.header == nil {
+		w.header = header
+	} else if !bytes.Equal(w.header, header) {
+		//all frames are opaque & the same size, so they're encoded the same way
+		return errors.New("apng frames must have the same size & color type")
+	}
+	w.last = img
+	w.frames = append(w.frames, apngFrame{data: data, duration: duration})
+	return nil
+}
+
+// readPngImage returns the IHDR chunk data & the concatenated IDAT chunk data of a png
+func readPngImage(encoded []byte) (header, data []byte, err error) {
+	if !bytes.HasPrefix(encoded, []byte(pngSignature)) {
+		return nil, nil, errors.New("not a png")
+	}
+	r := bytes.NewReader(encoded[len(pngSignature):])
+	for {
+		var chunk struct {
+			Length    uint32
+			ChunkType [4]byte
+		}
+		if err := binary.Read(r, binary.BigEndian, &chunk); err != nil {
+			return nil, nil, err
+		}
+		chunkData := make([]byte, chunk.Length)
+		if _, err := io.ReadFull(r, chunkData); err != nil {
+			return nil, nil, err
+		}
+		if _, err := r.Seek(4, io.SeekCurrent); err != nil { //crc
+			return nil, nil, err
+		}
+		switch string(chunk.ChunkType[:]) {
+		case "IHDR":
+			header = chunkData
+		case "IDAT":
+			data = append(data, chunkData...)
+		case "IEND":
+			return header, data, nil
+		}
+	}
+}
+
+func (w *apngWriter) Close() error {
+	if len(w.frames) == 0 {
+		return errors.New("no frames to write")
+	}
+	file, err := os.Create(w.fileName)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(file)
+	err = w.writeAnimation(out)
+	if err == nil {
+		err = out.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (w *apngWriter) writeAnimation(out io.Writer) error {
+	width := binary.BigEndian.Uint32(w.header[0:4])
+	height := binary.BigEndian.Uint32(w.header[4:8])
+
+	if _, err := io.WriteString(out, pngSignature); err != nil {
+		return err
+	}
+	if err := writePngChunk(out, "IHDR", w.header); err != nil {
+		return err
+	}
+	//frame count & 0 plays: loop forever
+	if err := writePngChunk(out, "acTL", chunkData(uint32(len(w.frames)), uint32(0))); err != nil {
+		return err
+	}
+
+	var sequence uint32
+	for i, frame := range w.frames {
+		//frame delays are fractions, in milliseconds here
+		delay := frame.duration.Milliseconds()
+		if delay > 0xFFFF {
+			delay = 0xFFFF
+		}
+		control := chunkData(sequence, width, height, uint32(0), uint32(0), uint16(delay), uint16(1000), uint8(0), uint8(0))
+		if err := writePngChunk(out, "fcTL", control); err != nil {
+			return err
+		}
+		sequence++
+		//the first frame is the png's default image, the rest carry a sequence number before the image data
+		if i == 0 {
+			if err := writePngChunk(out, "IDAT", frame.data); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writePngChunk(out, "fdAT", append(chunkData(sequence), frame.data...)); err != nil {
+			return err
+		}
+		sequence++
+	}
+	return writePngChunk(out, "IEND", nil)
+}
+
+func chunkData(fields ...interface{}) []byte {
+	data := &bytes.Buffer{}
+	for _, field := range fields {
+		binary.Write(data, binary.BigEndian, field)
+	}
+	return data.Bytes()
+}
+
+func writePngChunk(out io.Writer, chunkType string, data []byte) error {
+	header := chunkData(uint32(len(data)))
+	header = append(header, chunkType...)
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(data)
+	for _, b := range [][]byte{header, data, chunkData(crc.Sum32())} {
+		if _, err := out.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"time"
+
+	"github.com/amitbet/vncproxy/logger"
+	"github.com/amitbet/vncproxy/player"
+)
+
+func main() {
+	fps := flag.Float64("fps", 10, "frames per second")
+	format := flag.String("format", "png", "output format: png (a numbered sequence in the -out directory), gif, apng or raw (rgba frames)")
+	out := flag.String("out", "", "output directory for png, output file for gif, apng & raw")
+	execCmd := flag.String("exec", "", "encoder command to pipe raw rgba frames into, {width}, {height} & {fps} are replaced, e.g. \"ffmpeg -f rawvideo -pix_fmt rgba -s {width}x{height} -r {fps} -i - session.mp4\"")
+	start := flag.Duration("start", 0, "start at this point of the recording (e.g. 1m30s)")
+	end := flag.Duration("end", 0, "stop at this point of the recording, defaults to its end")
+	logLevel := flag.String("logLevel", "warn", "change logging level")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] recording.rbs\nrenders an fbs or compressed recording to images or video\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	logger.SetLogLevel(*logLevel)
+
+	if flag.NArg() != 1 || (*out == "" && *execCmd == "") {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *execCmd != "" {
+		*format = "raw"
+	}
+
+	written, err := export(flag.Arg(0), *format, *out, *execCmd, *fps, *start, *end)
+	if err != nil {
+		logger.Errorf("%s: %s", flag.Arg(0), err)
+		os.Exit(1)
+	}
+	logger.Infof("wrote %d frames", written)
+}
+
+func export(fileName, format, out, execCmd string, fps float64, start, end time.Duration) (int, error) {
+	reader, err := player.OpenRecording(fileName)
+	if err != nil {
+		return 0, err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	frames, err := player.NewFrameReader(reader, fps)
+	if err != nil {
+		return 0, err
+	}
+	if start > 0 {
+		if err := frames.SkipTo(start); err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+
+	width, height := frames.Framebuffer().Size()
+	bounds := image.Rect(0, 0, width, height)
+	interval := time.Duration(float64(time.Second) / fps)
+	var writer frameWriter
+	switch format {
+	case "png":
+		writer, err = newPngSequenceWriter(out)
+	case "gif":
+		writer, err = newGifWriter(out)
+	case "apng":
+		writer, err = newApngWriter(out)
+	case "raw":
+		if execCmd != "" {
+			writer, err = newExecWriter(execCmd, width, height, fps)
+		} else {
+			writer, err = newRawWriter(out)
+		}
+	default:
+		err = fmt.Errorf("unknown format: %s", format)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for {
+		img, t, err := frames.NextFrame()
+		if err == io.EOF || (end > 0 && t > end) {
+			break
+		}
+		//frames keep the size the recording started with, a video can't change size midway
+		if err := writer.WriteFrame(normalizeFrame(img, bounds), interval); err != nil {
+			writer.Close()
+			return written, err
+		}
+		written++
+	}
+	return written, writer.Close()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// frameWriter receives the frames of a recording in order, each shown for duration
+type frameWriter interface {
+	WriteFrame(img *image.RGBA, duration time.Duration) error
+	Close() error
+}
+
+// normalizeFrame crops or pads a frame to bounds, padding in black
+func normalizeFrame(img *image.RGBA, bounds image.Rectangle) *image.RGBA {
+	if img.Bounds() == bounds {
+		return img
+	}
+	frame := image.NewRGBA(bounds)
+	draw.Draw(frame, bounds, image.Black, image.Point{}, draw.Src)
+	draw.Draw(frame, bounds, img, image.Point{}, draw.Src)
+	return frame
+}
+
+// pngSequenceWriter writes every frame to a numbered png file
+type pngSequenceWriter struct {
+	dir     string
+	encoder png.Encoder
+	count   int
+}
+
+func newPngSequenceWriter(dir string) (*pngSequenceWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &pngSequenceWriter{dir: dir, encoder: png.Encoder{CompressionLevel: png.BestSpeed}}, nil
+}
+
+func (w *pngSequenceWriter) WriteFrame(img *image.RGBA, duration time.Duration) error {
+	w.count++
+	file, err := os.Create(filepath.Join(w.dir, fmt.Sprintf("frame-%06d.png", w.count)))
+	if err != nil {
+		return err
+	}
+	if err := w.encoder.Encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (w *pngSequenceWriter) Close() error {
+	return nil
+}
+
+// animationFrame is a frame shown for a while, repeated frames of an animation are merged into one
+type animationFrame struct {
+	img      *image.RGBA
+	duration time.Duration
+}
+
+// mergeFrame extends the last frame when img is the same, returns whether it did
+func mergeFrame(frames []animationFrame, img *image.RGBA, duration time.Duration) bool {
+	if len(frames) == 0 {
+		return false
+	}
+	last := &frames[len(frames)-1]
+	if !bytes.Equal(last.img.Pix, img.Pix) {
+		return false
+	}
+	last.duration += duration
+	return true
+}
+
+// gifWriter writes an animated gif, frames are kept in memory until Close
+type gifWriter struct {
+	fileName string
+	frames   []animationFrame
+}
+
+func newGifWriter(fileName string) (*gifWriter, error) {
+	if fileName == "" {
+		return nil, errors.New("gif output needs an output file")
+	}
+	return &gifWriter{fileName: fileName}, nil
+}
+
+func (w *gifWriter) WriteFrame(img *image.RGBA, duration time.Duration) error {
+	if !mergeFrame(w.frames, img, duration) {
+		w.frames = append(w.frames, animationFrame{img: img, duration: duration})
+	}
+	return nil
+}
+
+func (w *gifWriter) Close() error {
+	anim := &gif.GIF{}
+	for _, frame := range w.frames {
+		paletted := image.NewPaletted(frame.img.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), frame.img, image.Point{})
+		anim.Image = append(anim.Image, paletted)
+		//gif delays are in 100ths of a second
+		anim.Delay = append(anim.Delay, int(frame.duration.Round(10*time.Millisecond)/(10*time.Millisecond)))
+	}
+	file, err := os.Create(w.fileName)
+	if err != nil {
+		return err
+	}
+	if err := gif.EncodeAll(file, anim); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// rawWriter writes frames as raw rgba pixels, the input of encoders like ffmpeg's rawvideo
+type rawWriter struct {
+	file   io.WriteCloser
+	writer *bufio.Writer
+}
+
+func newRawWriter(fileName string) (*rawWriter, error) {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &rawWriter{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+func (w *rawWriter) WriteFrame(img *image.RGBA, duration time.Duration) error {
+	_, err := w.writer.Write(img.Pix)
+	return err
+}
+
+func (w *rawWriter) Close() error {
+	err := w.writer.Flush()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// execWriter pipes raw rgba frames into an encoder command
+type execWriter struct {
+	rawWriter
+	cmd *exec.Cmd
+}
+
+func newExecWriter(command string, width, height int, fps float64) (*execWriter, error) {
+	replacer := strings.NewReplacer(
+		"{width}", strconv.Itoa(width),
+		"{height}", strconv.Itoa(height),
+		"{fps}", strconv.FormatFloat(fps, 'f', -1, 64),
+	)
+	args := strings.Fields(replacer.Replace(command))
+	if len(args) == 0 {
+		return nil, errors.New("empty encoder command")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &execWriter{rawWriter: rawWriter{file: stdin, writer: bufio.NewWriter(stdin)}, cmd: cmd}, nil
+}
+
+func (w *execWriter) Close() error {
+	err := w.rawWriter.Close()
+	if waitErr := w.cmd.Wait(); err == nil && waitErr != nil {
+		err = fmt.Errorf("encoder command failed: %w", waitErr)
+	}
+	return err
+}
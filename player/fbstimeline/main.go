@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/decoder"
+	"github.com/amitbet/vncproxy/logger"
+	"github.com/amitbet/vncproxy/player"
+)
+
+const manifestFileName = "timeline.json"
+const sheetFileName = "contact-sheet.png"
+
+// Manifest describes the thumbnails of a recording, written to timeline.json next to them
+type Manifest struct {
+	Recording  string                    `json:"recording"`
+	Metadata   *common.RecordingMetadata `json:"metadata,omitempty"`
+	Interval   float64                   `json:"intervalSeconds"`
+	Duration   int64                     `json:"durationMs"`
+	Sheet      string                    `json:"contactSheet,omitempty"`
+	Thumbnails []Thumbnail               `json:"thumbnails"`
+}
+
+// Thumbnail is a screen of the recording: its file, time & the framebuffer size at that time
+type Thumbnail struct {
+	File        string `json:"file"`
+	Timestamp   int64  `json:"timestampMs"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	ThumbWidth  int    `json:"thumbWidth"`
+	ThumbHeight int    `json:"thumbHeight"`
+}
+
+func main() {
+	interval := flag.Duration("interval", 10*time.Second, "time between thumbnails")
+	out := flag.String("out", "", "output directory for the thumbnails & "+manifestFileName)
+	maxWidth := flag.Int("maxWidth", 320, "thumbnail width limit, 0 = no limit")
+	maxHeight := flag.Int("maxHeight", 0, "thumbnail height limit, 0 = no limit")
+	sheetColumns := flag.Int("sheetColumns", 0, "also combine the thumbnails into "+sheetFileName+" with this many columns, 0 = no contact sheet")
+	logLevel := flag.String("logLevel", "warn", "change logging level")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] -out=dir recording.rbs\nwrites a thumbnail of an fbs or compressed recording every -interval & a json manifest of them\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	logger.SetLogLevel(*logLevel)
+
+	if flag.NArg() != 1 || *out == "" || *interval <= 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	manifest, err := writeTimeline(flag.Arg(0), *out, *interval, *maxWidth, *maxHeight, *sheetColumns)
+	if err != nil {
+		logger.Errorf("%s: %s", flag.Arg(0), err)
+		os.Exit(1)
+	}
+	logger.Infof("wrote %d thumbnails", len(manifest.Thumbnails))
+}
+
+func writeTimeline(fileName, dir string, interval time.Duration, maxWidth, maxHeight, sheetColumns int) (*Manifest, error) {
+	reader, err := player.OpenRecording(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	frames, err := player.NewFrameReader(reader, float64(time.Second)/float64(interval))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{Recording: filepath.Base(fileName), Interval: interval.Seconds()}
+	if compressed, ok := reader.(*player.CompressedReader); ok {
+		manifest.Metadata = compressed.Metadata()
+	}
+	var thumbs []*image.RGBA
+	for {
+		img, t, err := frames.NextFrame()
+		if err == io.EOF {
+			break
+		}
+		thumb := decoder.Thumbnail(img, maxWidth, maxHeight)
+		entry := Thumbnail{
+			File:        fmt.Sprintf("thumb-%05d.png", len(manifest.Thumbnails)),
+			Timestamp:   t.Milliseconds(),
+			Width:       img.Bounds().Dx(),
+			Height:      img.Bounds().Dy(),
+			ThumbWidth:  thumb.Bounds().Dx(),
+			ThumbHeight: thumb.Bounds().Dy(),
+		}
+		if err := writePng(filepath.Join(dir, entry.File), thumb); err != nil {
+			return nil, err
+		}
+		manifest.Thumbnails = append(manifest.Thumbnails, entry)
+		if sheetColumns > 0 {
+			thumbs = append(thumbs, thumb)
+		}
+	}
+	manifest.Duration = int64(reader.CurrentTimestamp())
+
+	if len(thumbs) > 0 {
+		manifest.Sheet = sheetFileName
+		if err := writePng(filepath.Join(dir, sheetFileName), contactSheet(thumbs, sheetColumns)); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.Create(filepath.Join(dir, manifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return manifest, file.Close()
+}
+
+// contactSheet lays the thumbnails out in a grid, row by row, in cells of the biggest thumbnail's size
+func contactSheet(thumbs []*image.RGBA, columns int) *image.RGBA {
+	var cell image.Point
+	for _, thumb := range thumbs {
+		size := thumb.Bounds().Size()
+		if size.X > cell.X {
+			cell.X = size.X
+		}
+		if size.Y > cell.Y {
+			cell.Y = size.Y
+		}
+	}
+	if columns > len(thumbs) {
+		columns = len(thumbs)
+	}
+	rows := (len(thumbs) + columns - 1) / columns
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*cell.X, rows*cell.Y))
+	for i, thumb := range thumbs {
+		at := image.Pt(i%columns*cell.X, i/columns*cell.Y)
+		draw.Draw(sheet, thumb.Bounds().Add(at), thumb, image.Point{}, draw.Src)
+	}
+	return sheet
+}
+
+func writePng(fileName string, img image.Image) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := encoder.Encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,104 @@
+package player
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"time"
+
+	"github.com/amitbet/vncproxy/decoder"
+	"github.com/amitbet/vncproxy/logger"
+)
+
+// FrameReader renders a recording into frames at a fixed rate: the frame at time t shows the screen after
+// all the messages recorded up to t
+type FrameReader struct {
+	reader      VncStreamFileReader
+	framebuffer *decoder.Framebuffer
+	interval    time.Duration
+	next        time.Duration //time of the next frame
+	pending     []byte        //type byte of a message recorded after the next frame
+	pendingTime time.Duration
+	ended       bool
+}
+
+// NewFrameReader reads the session start of a recording & renders it at fps frames per second
+func NewFrameReader(reader VncStreamFileReader, fps float64) (*FrameReader, error) {
+	if fps <= 0 {
+		return nil, errors.New("frame rate must be positive")
+	}
+	initMsg, err := reader.ReadStartSession()
+	if err != nil {
+		return nil, err
+	}
+	framebuffer, err := decoder.NewFramebuffer(initMsg.FBWidth, initMsg.FBHeight, &initMsg.PixelFormat)
+	if err != nil {
+		return nil, err
+	}
+	return &FrameReader{
+		reader:      reader,
+		framebuffer: framebuffer,
+		interval:    time.Duration(float64(time.Second) / fps),
+	}, nil
+}
+
+// Framebuffer returns the decoded screen, as of the last frame
+func (fr *FrameReader) Framebuffer() *decoder.Framebuffer {
+	return fr.framebuffer
+}
+
+// NextFrame returns the next frame & its time, io.EOF after the frame showing the end of the recording
+func (fr *FrameReader) NextFrame() (*image.RGBA, time.Duration, error) {
+	if fr.ended {
+		return nil, 0, io.EOF
+	}
+	frameTime := fr.next
+	if err := fr.readUntil(frameTime); err != nil {
+		if err != io.EOF {
+			logger.Errorf("FrameReader: stopped decoding the recording at %s: %s", frameTime, err)
+		}
+		fr.ended = true
+	}
+	fr.next += fr.interval
+	return fr.framebuffer.Image(), frameTime, nil
+}
+
+// SkipTo decodes the recording up to t without rendering frames, the next frame is the one at t
+func (fr *FrameReader) SkipTo(t time.Duration) error {
+	if t <= fr.next {
+		return nil
+	}
+	fr.next = t
+	if err := fr.readUntil(t); err != nil {
+		fr.ended = true
+		return err
+	}
+	return nil
+}
+
+// readUntil decodes the messages recorded up to t
+func (fr *FrameReader) readUntil(t time.Duration) error {
+	for {
+		if fr.pending == nil {
+			//a message's time is known once its first byte is read
+			messageType := make([]byte, 1)
+			if _, err := io.ReadFull(fr.reader, messageType); err != nil {
+				return err
+			}
+			fr.pending = messageType
+			fr.pendingTime = time.Duration(fr.reader.CurrentTimestamp()) * time.Millisecond
+		}
+		if fr.pendingTime > t {
+			return nil
+		}
+		message := io.MultiReader(bytes.NewReader(fr.pending), fr.reader)
+		fr.pending = nil
+		if _, err := fr.framebuffer.ReadServerMessage(message); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+}
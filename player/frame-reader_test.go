@@ -0,0 +1,95 @@
+package player
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/color"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/amitbet/vncproxy/common"
+)
+
+// memoryRecording is a recording of timestamped blocks, read like an fbs file
+type memoryRecording struct {
+	blocks           [][]byte
+	timestamps       []int
+	buffer           bytes.Buffer
+	currentTimestamp int
+}
+
+func (m *memoryRecording) Read(p []byte) (int, error) {
+	if m.buffer.Len() == 0 {
+		if len(m.blocks) == 0 {
+			return 0, io.EOF
+		}
+		m.buffer.Write(m.blocks[0])
+		m.currentTimestamp = m.timestamps[0]
+		m.blocks, m.timestamps = m.blocks[1:], m.timestamps[1:]
+	}
+	return m.buffer.Read(p)
+}
+
+func (m *memoryRecording) CurrentTimestamp() int { return m.currentTimestamp }
+
+func (m *memoryRecording) ReadStartSession() (*common.ServerInit, error) {
+	return &common.ServerInit{FBWidth: 4, FBHeight: 4, PixelFormat: *common.NewPixelFormat(32)}, nil
+}
+
+func (m *memoryRecording) CurrentPixelFormat() *common.PixelFormat { return common.NewPixelFormat(32) }
+
+func (m *memoryRecording) Encodings() []common.IEncoding { return nil }
+
+func (m *memoryRecording) add(timestamp int, data []byte) {
+	m.blocks = append(m.blocks, data)
+	m.timestamps = append(m.timestamps, timestamp)
+}
+
+// fillUpdate is a FramebufferUpdate painting the whole 4x4 screen in a single color
+func fillUpdate(c color.RGBA) []byte {
+	msg := &bytes.Buffer{}
+	msg.Write([]byte{byte(common.FramebufferUpdate), 0, 0, 1})
+	binary.Write(msg, binary.BigEndian, []uint16{0, 0, 4, 4})
+	binary.Write(msg, binary.BigEndian, int32(common.EncRRE))
+	binary.Write(msg, binary.BigEndian, uint32(0))
+	msg.Write([]byte{c.B, c.G, c.R, 0})
+	return msg.Bytes()
+}
+
+func TestFrameReader(t *testing.T) {
+	red := color.RGBA{0xFF, 0, 0, 0xFF}
+	green := color.RGBA{0, 0xFF, 0, 0xFF}
+	recording := &memoryRecording{}
+	recording.add(0, fillUpdate(red))
+	//a message split over blocks belongs to the time of its first byte
+	update := fillUpdate(green)
+	recording.add(250, update[:6])
+	recording.add(400, update[6:])
+
+	frames, err := NewFrameReader(recording, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var colors []color.RGBA
+	for {
+		img, frameTime, err := frames.NextFrame()
+		if err == io.EOF {
+			break
+		}
+		if frameTime != time.Duration(len(colors))*100*time.Millisecond {
+			t.Fatalf("frame %d at %s", len(colors), frameTime)
+		}
+		colors = append(colors, img.RGBAAt(1, 1))
+	}
+
+	expected := []color.RGBA{red, red, red, green}
+	if len(colors) != len(expected) {
+		t.Fatalf("expected %d frames, got %d", len(expected), len(colors))
+	}
+	for i := range expected {
+		if colors[i] != expected[i] {
+			t.Errorf("frame %d: expected %v, got %v", i, expected[i], colors[i])
+		}
+	}
+}
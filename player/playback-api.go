@@ -0,0 +1,104 @@
+package player
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amitbet/vncproxy/logger"
+)
+
+const playbackPath = "/playback"
+
+// PlaybackAPI is the http control channel of a running player:
+//
+//	GET  /playback                      the current settings
+//	POST /playback/pause                pause all playbacks
+//	POST /playback/resume               resume all playbacks
+//	POST /playback/step                 send the next message of paused playbacks
+//	POST /playback/speed?value=2        set the speed (0.25 - 16)
+//	POST /playback/skip-idle?value=5s   shorten gaps longer than value, 0 = play gaps as recorded
+//
+// Every call returns the settings after the change.
+type PlaybackAPI struct {
+	Control *PlaybackControl
+}
+
+// playbackStateJSON is the api form of PlaybackState
+type playbackStateJSON struct {
+	Speed    float64 `json:"speed"`
+	Paused   bool    `json:"paused"`
+	SkipIdle string  `json:"skipIdle"`
+}
+
+// Register adds the api routes to the given mux
+func (api *PlaybackAPI) Register(mux *http.ServeMux) {
+	mux.Handle(playbackPath, api)
+	mux.Handle(playbackPath+"/", api)
+}
+
+func (api *PlaybackAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	command := strings.Trim(strings.TrimPrefix(r.URL.Path, playbackPath), "/")
+	if command == "" {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		api.writeState(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	value := r.URL.Query().Get("value")
+	switch command {
+	case "pause":
+		api.Control.Pause()
+	case "resume":
+		api.Control.Resume()
+	case "step":
+		api.Control.Step()
+	case "speed":
+		speed, err := strconv.ParseFloat(value, 64)
+		if err == nil {
+			err = api.Control.SetSpeed(speed)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrBadPlaybackSpeed)
+			return
+		}
+	case "skip-idle":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		api.Control.SetSkipIdle(d)
+	default:
+		writeError(w, http.StatusNotFound, errors.New("unknown playback command: "+command))
+		return
+	}
+	api.writeState(w)
+}
+
+func (api *PlaybackAPI) writeState(w http.ResponseWriter) {
+	state := api.Control.State()
+	writeJSON(w, http.StatusOK, playbackStateJSON{Speed: state.Speed, Paused: state.Paused, SkipIdle: state.SkipIdle.String()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.Errorf("PlaybackAPI: error writing response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,181 @@
+package player
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	MinPlaybackSpeed = 0.25
+	MaxPlaybackSpeed = 16
+)
+
+var ErrBadPlaybackSpeed = errors.New("playback speed must be between 0.25 and 16")
+
+// PlaybackState is a snapshot of a PlaybackControl
+type PlaybackState struct {
+	Speed    float64
+	Paused   bool
+	SkipIdle time.Duration // gaps longer than this are shortened to it, 0 = play gaps as recorded
+	Steps    uint64        // single steps requested so far
+}
+
+// PlaybackControl sets the pace of playbacks: speed, pause, single steps & skipping idle gaps.
+// A control can be shared by several play listeners (all the clients of a PlayerServer), changes apply to all of them at once.
+type PlaybackControl struct {
+	mutex   sync.Mutex
+	state   PlaybackState
+	changed chan struct{} // closed & replaced on every change, to wake the waiting listeners
+	stopped chan struct{} // closed when the playbacks end, waits return at once
+}
+
+func NewPlaybackControl() *PlaybackControl {
+	return &PlaybackControl{
+		state:   PlaybackState{Speed: 1},
+		changed: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// State returns the current settings
+func (pc *PlaybackControl) State() PlaybackState {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	return pc.state
+}
+
+// SetSpeed changes the playback speed, 1 = as recorded
+func (pc *PlaybackControl) SetSpeed(speed float64) error {
+	if speed < MinPlaybackSpeed || speed > MaxPlaybackSpeed {
+		return ErrBadPlaybackSpeed
+	}
+	pc.update(func(state *PlaybackState) { state.Speed = speed })
+	return nil
+}
+
+func (pc *PlaybackControl) Pause() {
+	pc.update(func(state *PlaybackState) { state.Paused = true })
+}
+
+func (pc *PlaybackControl) Resume() {
+	pc.update(func(state *PlaybackState) { state.Paused = false })
+}
+
+// Step sends the next message of every paused playback
+func (pc *PlaybackControl) Step() {
+	pc.update(func(state *PlaybackState) { state.Steps++ })
+}
+
+// SetSkipIdle shortens the gaps between messages longer than d to d, 0 = play gaps as recorded
+func (pc *PlaybackControl) SetSkipIdle(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	pc.update(func(state *PlaybackState) { state.SkipIdle = d })
+}
+
+func (pc *PlaybackControl) update(change func(state *PlaybackState)) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	change(&pc.state)
+	close(pc.changed)
+	pc.changed = make(chan struct{})
+}
+
+// watch returns the current settings & a channel closed on the next change
+func (pc *PlaybackControl) watch() (PlaybackState, <-chan struct{}) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	return pc.state, pc.changed
+}
+
+// stop releases the waiting playbacks, so their connections can be closed
+func (pc *PlaybackControl) stop() {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	select {
+	case <-pc.stopped:
+	default:
+		close(pc.stopped)
+	}
+}
+
+// playbackClock is the position of a single playback in recording time, advancing with the speed of its control
+type playbackClock struct {
+	control  *PlaybackControl
+	position float64 //ms since the start of the recording
+	lastTick time.Time
+	state    PlaybackState //the settings the clock advanced with since lastTick
+	steps    uint64        //the control's steps already played
+}
+
+func newPlaybackClock(control *PlaybackControl, position int) *playbackClock {
+	state, _ := control.watch()
+	return &playbackClock{control: control, position: float64(position), lastTick: time.Now(), state: state, steps: state.Steps}
+}
+
+// tick advances the position up to now with the settings seen last, then picks up the current ones
+func (c *playbackClock) tick() <-chan struct{} {
+	now := time.Now()
+	if !c.state.Paused {
+		c.position += float64(now.Sub(c.lastTick)) / float64(time.Millisecond) * c.state.Speed
+	}
+	c.lastTick = now
+	state, changed := c.control.watch()
+	c.state = state
+	return changed
+}
+
+// seek moves the playback to a position (ms), messages recorded before it are sent without waiting
+func (c *playbackClock) seek(position int) {
+	c.tick()
+	c.position = float64(position)
+}
+
+// waitFor blocks until the playback reaches timestamp (ms) or interrupt is signaled
+func (c *playbackClock) waitFor(timestamp int, interrupt <-chan struct{}) {
+	for {
+		changed := c.tick()
+		var timer *time.Timer
+		var timeout <-chan time.Time //nil while paused, waiting for a change
+		if c.state.Paused {
+			if c.state.Steps > c.steps {
+				c.steps++
+				if float64(timestamp) > c.position {
+					c.position = float64(timestamp)
+				}
+				return
+			}
+		} else {
+			//steps only count while paused
+			c.steps = c.state.Steps
+			remaining := float64(timestamp) - c.position
+			if skipIdle := float64(c.state.SkipIdle / time.Millisecond); skipIdle > 0 && remaining > skipIdle {
+				c.position = float64(timestamp) - skipIdle
+				remaining = skipIdle
+			}
+			if remaining <= 0 {
+				return
+			}
+			timer = time.NewTimer(time.Duration(remaining / c.state.Speed * float64(time.Millisecond)))
+			timeout = timer.C
+		}
+
+		interrupted := false
+		select {
+		case <-timeout:
+		case <-changed:
+		case <-interrupt:
+			interrupted = true
+		case <-c.control.stopped:
+			interrupted = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if interrupted {
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package player
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPlaybackSpeed(t *testing.T) {
+	control := NewPlaybackControl()
+	if err := control.SetSpeed(20); err != ErrBadPlaybackSpeed {
+		t.Errorf("expected a speed over 16 to be rejected, got %v", err)
+	}
+	if err := control.SetSpeed(16); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newPlaybackClock(control, 0)
+	start := time.Now()
+	clock.waitFor(1600, nil)
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond || elapsed > time.Second {
+		t.Errorf("1.6s at 16x should take 100ms, took %s", elapsed)
+	}
+}
+
+func TestPlaybackSkipIdle(t *testing.T) {
+	control := NewPlaybackControl()
+	control.SetSkipIdle(50 * time.Millisecond)
+
+	clock := newPlaybackClock(control, 0)
+	start := time.Now()
+	clock.waitFor(10000, nil)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("a 10s gap should be shortened to 50ms, took %s", elapsed)
+	}
+}
+
+func TestPlaybackPauseAndStep(t *testing.T) {
+	control := NewPlaybackControl()
+	control.Pause()
+	clock := newPlaybackClock(control, 0)
+
+	played := make(chan int)
+	go func() {
+		for _, timestamp := range []int{10, 20} {
+			clock.waitFor(timestamp, nil)
+			played <- timestamp
+		}
+		close(played)
+	}()
+
+	select {
+	case <-played:
+		t.Fatal("a paused playback sent a message")
+	case <-time.After(100 * time.Millisecond):
+	}
+	control.Step()
+	if timestamp := <-played; timestamp != 10 {
+		t.Errorf("expected a single step to message 10, got %d", timestamp)
+	}
+	select {
+	case <-played:
+		t.Fatal("a step sent more than one message")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	control.Resume()
+	select {
+	case <-played:
+	case <-time.After(time.Second):
+		t.Fatal("the playback didn't resume")
+	}
+}
+
+func TestPlaybackAPI(t *testing.T) {
+	control := NewPlaybackControl()
+	mux := http.NewServeMux()
+	(&PlaybackAPI{Control: control}).Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		{"/playback/pause", http.StatusOK},
+		{"/playback/speed?value=4", http.StatusOK},
+		{"/playback/speed?value=100", http.StatusBadRequest},
+		{"/playback/skip-idle?value=3s", http.StatusOK},
+		{"/playback/rewind", http.StatusNotFound},
+	} {
+		resp, err := http.Post(server.URL+test.path, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.path, test.status, resp.StatusCode)
+		}
+	}
+
+	state := control.State()
+	if !state.Paused || state.Speed != 4 || state.SkipIdle != 3*time.Second {
+		t.Errorf("unexpected playback state %+v", state)
+	}
+}
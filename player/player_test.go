@@ -40,7 +40,7 @@ func TestServer(t *testing.T) {
 		Width:            uint16(1024),
 	}
 
-	cfg.NewConnHandler = func(cfg *server.ServerConfig, conn *server.ServerConn) error {
+	cfg.NewConnHandler = func(cfg *server.ServerConfig, conn common.IServerConn) error {
 		//fbs, err := loadFbsFile("/Users/amitbet/Dropbox/recording.rbs", conn)
 		//fbs, err := loadFbsFile("/Users/amitbet/vncRec/recording.rbs", conn)
 		fbs, err := ConnectFbsFile("/Users/amitbet/vncRec/recording.rbs", conn)
@@ -49,7 +49,7 @@ func TestServer(t *testing.T) {
 			logger.Error("TestServer.NewConnHandler: Error in loading FBS: ", err)
 			return err
 		}
-		conn.Listeners.AddListener(NewFBSPlayListener(conn, fbs))
+		conn.Listeners().AddListener(NewFBSPlayListener(conn, fbs))
 		return nil
 	}
 
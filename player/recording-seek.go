@@ -0,0 +1,34 @@
+package player
+
+import (
+	"time"
+
+	"github.com/amitbet/vncproxy/common"
+)
+
+// SeekableStreamFileReader is a recording reader that can jump to a point in time, using the keyframe index
+// the recorder writes next to the recording (see common.RecordingIndexFileName)
+type SeekableStreamFileReader interface {
+	VncStreamFileReader
+	// SeekTo moves to the last keyframe at or before t, the next message read is its full screen update
+	SeekTo(t time.Duration) error
+}
+
+// recordingIndex loads the keyframe index of a recording once
+type recordingIndex struct {
+	fileName string
+	entries  []common.RecordingIndexEntry
+	loaded   bool
+}
+
+func (ri *recordingIndex) findKeyframe(t time.Duration) (common.RecordingIndexEntry, error) {
+	if !ri.loaded {
+		entries, err := common.ReadRecordingIndex(ri.fileName)
+		if err != nil {
+			return common.RecordingIndexEntry{}, err
+		}
+		ri.entries = entries
+		ri.loaded = true
+	}
+	return common.FindKeyframe(ri.entries, t)
+}
@@ -0,0 +1,197 @@
+package player
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/encodings"
+	"github.com/amitbet/vncproxy/logger"
+	"github.com/amitbet/vncproxy/server"
+)
+
+// PlayerServer replays a single fbs file to every vnc-client connecting on its tcp and/or websocket listeners
+type PlayerServer struct {
+	FbsFile         string
+	TCPListeningURL string        // empty = not listening, example: ":5904"
+	WsListeningURL  string        // empty = not listening, example: "http://0.0.0.0:7777/"
+	StartAt         time.Duration // play from this point, needs the recording's keyframe index
+	// ControlListeningURL serves the PlaybackAPI, empty = no control api, example: ":7778"
+	ControlListeningURL string
+	// Playback sets the pace of all the clients' playbacks, nil = a new control playing at 1x
+	Playback *PlaybackControl
+
+	mutex     sync.Mutex
+	server    *server.Server
+	apiServer *http.Server
+	done      chan struct{}
+}
+
+// Start opens the listeners and serves clients in the background until ctx ends or Shutdown is called.
+// Listening errors are returned, nothing is left running in that case.
+func (ps *PlayerServer) Start(ctx context.Context) error {
+	if ps.TCPListeningURL == "" && ps.WsListeningURL == "" {
+		return errors.New("no listening url defined")
+	}
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if ps.server != nil {
+		return errors.New("player server already started")
+	}
+
+	var tcpListener, wsListener net.Listener
+	var wsPath string
+	var err error
+	if ps.TCPListeningURL != "" {
+		if tcpListener, err = net.Listen("tcp", ps.TCPListeningURL); err != nil {
+			return err
+		}
+	}
+	if ps.WsListeningURL != "" {
+		wsURL, err := url.Parse(ps.WsListeningURL)
+		if err == nil {
+			wsListener, err = net.Listen("tcp", wsURL.Host)
+			wsPath = wsURL.Path
+		}
+		if err != nil {
+			if tcpListener != nil {
+				tcpListener.Close()
+			}
+			return err
+		}
+	}
+	var controlListener net.Listener
+	if ps.ControlListeningURL != "" {
+		if controlListener, err = net.Listen("tcp", ps.ControlListeningURL); err != nil {
+			for _, ln := range []net.Listener{tcpListener, wsListener} {
+				if ln != nil {
+					ln.Close()
+				}
+			}
+			return err
+		}
+	}
+
+	if ps.Playback == nil {
+		ps.Playback = NewPlaybackControl()
+	}
+	ps.server = server.NewServer(ps.serverConfig())
+	ps.done = make(chan struct{})
+	if tcpListener != nil {
+		logger.Infof("running tcp listener on: %s", tcpListener.Addr())
+		go ps.serve(func() error { return ps.server.ServeTCP(tcpListener) })
+	}
+	if wsListener != nil {
+		logger.Infof("running ws listener on: %s", wsListener.Addr())
+		go ps.serve(func() error { return ps.server.ServeWS(wsListener, wsPath) })
+	}
+	if controlListener != nil {
+		mux := http.NewServeMux()
+		(&PlaybackAPI{Control: ps.Playback}).Register(mux)
+		ps.apiServer = &http.Server{Handler: mux}
+		apiServer := ps.apiServer
+		logger.Infof("running playback control api on: %s", controlListener.Addr())
+		go func() {
+			if err := apiServer.Serve(controlListener); err != nil && err != http.ErrServerClosed {
+				logger.Errorf("PlayerServer: control api failed: %s", err)
+			}
+		}()
+	}
+
+	done := ps.done
+	go func() {
+		select {
+		case <-ctx.Done():
+			ps.Shutdown(context.Background())
+		case <-done:
+		}
+	}()
+	return nil
+}
+
+func (ps *PlayerServer) serve(serveFunc func() error) {
+	if err := serveFunc(); err != nil && err != server.ErrServerClosed {
+		logger.Errorf("PlayerServer: listener failed: %s", err)
+	}
+}
+
+// Shutdown closes the listeners & all client connections, see server.Server.Shutdown
+func (ps *PlayerServer) Shutdown(ctx context.Context) error {
+	ps.mutex.Lock()
+	srv, apiServer, done := ps.server, ps.apiServer, ps.done
+	ps.mutex.Unlock()
+	if srv == nil {
+		return nil
+	}
+
+	if apiServer != nil {
+		apiServer.Shutdown(ctx)
+	}
+	//paused playbacks would keep their connections open
+	ps.Playback.stop()
+	err := srv.Shutdown(ctx)
+	ps.mutex.Lock()
+	select {
+	case <-done:
+	default:
+		close(done)
+	}
+	ps.mutex.Unlock()
+	return err
+}
+
+// Done is closed once the server is shut down
+func (ps *PlayerServer) Done() <-chan struct{} {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return ps.done
+}
+
+func (ps *PlayerServer) serverConfig() *server.ServerConfig {
+	encs := []common.IEncoding{
+		&encodings.RawEncoding{},
+		&encodings.TightEncoding{},
+		&encodings.EncCursorPseudo{},
+		&encodings.TightPngEncoding{},
+		&encodings.RREEncoding{},
+		&encodings.ZLibEncoding{},
+		&encodings.ZRLEEncoding{},
+		&encodings.CopyRectEncoding{},
+		&encodings.CoRREEncoding{},
+		&encodings.HextileEncoding{},
+	}
+
+	cfg := &server.ServerConfig{
+		SecurityHandlers: []server.SecurityHandler{&server.ServerAuthNone{}},
+		Encodings:        encs,
+		PixelFormat:      common.NewPixelFormat(32),
+		ClientMessages:   server.DefaultClientMessages,
+		DesktopName:      []byte("workDesk"),
+		Height:           uint16(768),
+		Width:            uint16(1024),
+	}
+
+	cfg.NewConnHandler = func(cfg *server.ServerConfig, conn common.IServerConn) error {
+		fbs, err := ConnectRecordingFile(ps.FbsFile, conn)
+		if err != nil {
+			logger.Error("PlayerServer.NewConnHandler: Error in loading FBS: ", err)
+			return err
+		}
+		playListener := NewFBSPlayListener(conn, fbs)
+		playListener.Control = ps.Playback
+		if ps.StartAt > 0 {
+			if err := playListener.Seek(ps.StartAt); err != nil {
+				logger.Errorf("PlayerServer.NewConnHandler: can't seek to %s, playing from the start: %s", ps.StartAt, err)
+			}
+		}
+		conn.Listeners().AddListener(playListener)
+		return nil
+	}
+	return cfg
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/amitbet/vncproxy/logger"
 	vncproxy "github.com/amitbet/vncproxy/proxy"
@@ -13,16 +18,63 @@ func main() {
 	//create default session if required
 	var tcpPort = flag.String("tcpPort", "", "tcp port")
 	var wsPort = flag.String("wsPort", "", "websocket port")
+	var longConnPort = flag.String("longConnPort", "5908", "port of the long connection websocket server (on /ws), empty = not listening")
 	var vncPass = flag.String("vncPass", "", "password on incoming vnc connections to the proxy, defaults to no password")
+	var viewOnlyPass = flag.String("viewOnlyPass", "", "second password on incoming vnc connections, clients using it get view-only access (needs -vncPass)")
+	var authFile = flag.String("authFile", "", "json file with the credentials of incoming vnc connections (replaces -vncPass & -viewOnlyPass)")
+	var tlsCert = flag.String("tlsCert", "", "PEM certificate file, enables VeNCrypt tls on incoming vnc connections")
+	var tlsKey = flag.String("tlsKey", "", "PEM private key file for -tlsCert")
+	var tlsRequired = flag.Bool("tlsRequired", false, "reject incoming tcp vnc connections that don't use VeNCrypt tls, and serve the ws listener as wss")
 	var recordDir = flag.String("recDir", "", "path to save FBS recordings WILL NOT RECORD if not defined.")
+	var recordFile = flag.String("recFileTemplate", "", "recording file names in -recDir, placeholders: {session} {viewer} {date} {time} {unix} {segment}, defaults to "+vncproxy.DefaultRecordingFileTemplate)
+	var recordCompression = flag.String("recCompression", "", "write compressed recordings (zstd or gzip) instead of FBS files, the proxy & player replay both")
+	var recordMaxFileMB = flag.Int64("recMaxFileMB", 0, "split recordings into segment files of about this size (MB), defaults to no limit")
+	var recordMaxDuration = flag.Duration("recMaxDuration", 0, "split recordings into segment files of this duration (e.g. 1h), defaults to no limit")
+	var recordMaxAge = flag.Duration("recMaxAge", 0, "delete recordings older than this (e.g. 720h), defaults to keeping them forever")
+	var recordKeyframeInterval = flag.Duration("recKeyframeInterval", time.Minute, "store a full screen update this often & index it in a .idx file, so recordings can be played from any point (0 = no index)")
+	var recordMaxTotalMB = flag.Int64("recMaxTotalMB", 0, "delete the oldest recordings when -recDir grows bigger than this (MB), defaults to no limit")
+	var recordAudit = flag.Bool("recAudit", false, "log the keys, mouse clicks & clipboard text of recorded sessions to a .audit.jsonl file next to each recording")
 	var targetVnc = flag.String("target", "", "target vnc server (host:port or /path/to/unix.socket)")
 	var targetVncPort = flag.String("targPort", "", "target vnc server port (deprecated, use -target)")
 	var targetVncHost = flag.String("targHost", "", "target vnc server host (deprecated, use -target)")
 	var targetVncPass = flag.String("targPass", "", "target vnc password")
+	var targetTLS = flag.Bool("targTLS", false, "connect to the target vnc server with VeNCrypt tls")
+	var targetCA = flag.String("targCA", "", "PEM CA certificates to verify the target's X509 certificate, defaults to the system roots")
+	var targetTLSSkipVerify = flag.Bool("targTLSSkipVerify", false, "don't verify the target's tls certificate")
+	var targetUser = flag.String("targUser", "", "target username for VeNCrypt Plain authentication (used with -targPass)")
+	var dialTimeout = flag.Duration("dialTimeout", vncproxy.DefaultDialTimeout, "timeout of connecting to the target vnc server")
+	var handshakeTimeout = flag.Duration("handshakeTimeout", vncproxy.DefaultHandshakeTimeout, "timeout of the rfb handshake with the target vnc server")
+	var connectRetries = flag.Int("connectRetries", 0, "retry connecting to the target vnc server this many times, waiting 1s, 2s, 4s.. (up to 30s) in between")
+	var reconnect = flag.Bool("reconnect", false, "keep vnc-clients connected when the target vnc server connection is lost (e.g. a VM reboot) and reconnect it")
+	var reconnectTimeout = flag.Duration("reconnectTimeout", vncproxy.DefaultReconnectTimeout, "disconnect vnc-clients when the target vnc server can't be reconnected within this time")
+	var idleTimeout = flag.Duration("idleTimeout", 0, "disconnect vnc-clients without keyboard or mouse input for this long, 0 = no idle timeout")
+	var maxSessionDuration = flag.Duration("maxSessionDuration", 0, "disconnect vnc-clients after they were connected for this long, 0 = no limit")
+	var timeoutWarning = flag.Duration("timeoutWarning", vncproxy.DefaultTimeoutWarning, "warn vnc-clients (through the clipboard) this long before the idle timeout or max session duration disconnects them")
+	var replayFile = flag.String("replayFile", "", "fbs file to replay to incoming connections instead of proxying to a target vnc server")
+	var shared = flag.Bool("shared", false, "let all incoming connections share one connection to the target, the first client controls it and the rest are view-only")
+	var viewOnly = flag.Bool("viewOnly", false, "drop all keyboard, mouse & clipboard input from incoming connections")
 	var logLevel = flag.String("logLevel", "info", "change logging level")
+	var logFormat = flag.String("logFormat", "text", "log line format: text, json or logfmt, lines of vnc connections carry session, viewer & target fields")
+	var apiPort = flag.String("apiPort", "", "port for the http session management api, defaults to no api")
+	var apiHost = flag.String("apiHost", "127.0.0.1", "interface the session management api listens on, use 0.0.0.0 (with -apiToken) to reach it from other machines")
+	var apiToken = flag.String("apiToken", os.Getenv("VNCPROXY_API_TOKEN"), "bearer token required by the session management api (Authorization: Bearer <token>), defaults to $VNCPROXY_API_TOKEN or no authentication")
+	var screenshots = flag.Bool("screenshots", false, "decode the screens of proxied sessions, served by the api as /sessions/{id}/screenshot.png (needs -apiPort)")
+	var metricsPort = flag.String("metricsPort", "", "port serving prometheus metrics on /metrics, defaults to no metrics")
+	var useSessions = flag.Bool("sessions", false, "route incoming ws connections by session id (url path) to sessions registered through the api, instead of a single -target")
+	var tokenFile = flag.String("tokenFile", "", "websockify token file or directory (lines of 'token: host:port'), routes ws connections by ?token= or url path, implies -sessions")
+	var tokenJSON = flag.String("tokenJSON", "", "json token file ({\"token\": {\"target\": \"host:port\", \"password\": \"...\"}}), implies -sessions")
 
 	flag.Parse()
 	logger.SetLogLevel(*logLevel)
+	if err := logger.SetFormat(*logFormat); err != nil {
+		logger.Error(err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *tokenFile != "" || *tokenJSON != "" {
+		*useSessions = true
+	}
 
 	if *tcpPort == "" && *wsPort == "" {
 		logger.Error("no listening port defined")
@@ -30,7 +82,11 @@ func main() {
 		os.Exit(1)
 	}
 
-	if *targetVnc == "" && *targetVncPort == "" {
+	if *useSessions && *apiPort == "" && *tokenFile == "" && *tokenJSON == "" {
+		logger.Warn("using sessions without a session management api, no sessions will be available")
+	}
+
+	if !*useSessions && *replayFile == "" && *targetVnc == "" && *targetVncPort == "" {
 		logger.Error("no target vnc server host/port or socket defined")
 		flag.Usage()
 		os.Exit(1)
@@ -48,20 +104,68 @@ func main() {
 	if *wsPort != "" {
 		wsURL = "http://0.0.0.0:" + string(*wsPort) + "/"
 	}
+	longConnURL := ""
+	if *longConnPort != "" {
+		longConnURL = "http://0.0.0.0:" + *longConnPort + "/ws"
+	}
 	proxy := &vncproxy.VncProxy{
-		WsListeningURL:   wsURL, // empty = not listening on ws
-		TCPListeningURL:  tcpURL,
-		ProxyVncPassword: *vncPass, //empty = no auth
+		WsListeningURL:        wsURL, // empty = not listening on ws
+		LongConnListeningURL:  longConnURL,
+		TCPListeningURL:       tcpURL,
+		ProxyVncPassword:      *vncPass, //empty = no auth
+		ProxyViewOnlyPassword: *viewOnlyPass,
+		TLSCertFile:           *tlsCert,
+		TLSKeyFile:            *tlsKey,
+		TLSRequired:           *tlsRequired,
 		SingleSession: &vncproxy.VncSession{
-			Target:         *targetVnc,
-			TargetHostname: *targetVncHost,
-			TargetPort:     *targetVncPort,
-			TargetPassword: *targetVncPass, //"vncPass",
-			ID:             "dummySession",
-			Status:         vncproxy.SessionStatusInit,
-			Type:           vncproxy.SessionTypeProxyPass,
+			Target:              *targetVnc,
+			TargetHostname:      *targetVncHost,
+			TargetPort:          *targetVncPort,
+			TargetPassword:      *targetVncPass, //"vncPass",
+			TargetTLS:           *targetTLS,
+			TargetCAFile:        *targetCA,
+			TargetTLSSkipVerify: *targetTLSSkipVerify,
+			TargetUsername:      *targetUser,
+			ID:                  "dummySession",
+			Status:              vncproxy.SessionStatusInit,
+			Type:                vncproxy.SessionTypeProxyPass,
 		}, // to be used when not using sessions
-		UsingSessions: false, //false = single session - defined in the var above
+		UsingSessions: *useSessions, //false = single session - defined in the var above
+	}
+
+	if *authFile != "" {
+		authenticator, err := vncproxy.NewFileAuthenticator(*authFile)
+		if err != nil {
+			logger.Error("can't load the auth file: ", err)
+			os.Exit(1)
+		}
+		proxy.Authenticator = authenticator
+	}
+
+	if *tokenFile != "" {
+		proxy.TokenPlugin = &vncproxy.TokenFile{Path: *tokenFile}
+	} else if *tokenJSON != "" {
+		proxy.TokenPlugin = &vncproxy.JSONTokenFile{Path: *tokenJSON}
+	}
+
+	if *apiPort != "" {
+		proxy.APIListeningURL = net.JoinHostPort(*apiHost, *apiPort)
+		proxy.APIToken = *apiToken
+		if *apiToken == "" && !isLoopback(*apiHost) {
+			logger.Warn("the session management api is reachable from other machines without authentication, set -apiToken")
+		}
+	}
+	proxy.Screenshots = *screenshots
+	proxy.DialTimeout = *dialTimeout
+	proxy.HandshakeTimeout = *handshakeTimeout
+	proxy.ConnectRetries = *connectRetries
+	proxy.Reconnect = *reconnect
+	proxy.ReconnectTimeout = *reconnectTimeout
+	proxy.IdleTimeout = *idleTimeout
+	proxy.MaxSessionDuration = *maxSessionDuration
+	proxy.TimeoutWarning = *timeoutWarning
+	if *metricsPort != "" {
+		proxy.MetricsListeningURL = ":" + *metricsPort
 	}
 
 	if *recordDir != "" {
@@ -71,10 +175,56 @@ func main() {
 		}
 		logger.Info("FBS recording is turned on, writing to dir: ", fullPath)
 		proxy.RecordingDir = fullPath
+		proxy.RecordingFileTemplate = *recordFile
+		proxy.RecordingCompression = *recordCompression
+		proxy.RecordingMaxFileBytes = *recordMaxFileMB * 1024 * 1024
+		proxy.RecordingMaxDuration = *recordMaxDuration
+		proxy.RecordingMaxAge = *recordMaxAge
+		proxy.RecordingAuditLog = *recordAudit
+		proxy.RecordingMaxBytes = *recordMaxTotalMB * 1024 * 1024
+		proxy.RecordingKeyframes = *recordKeyframeInterval
 		proxy.SingleSession.Type = vncproxy.SessionTypeRecordingProxy
 	} else {
 		logger.Info("FBS recording is turned off")
 	}
 
-	proxy.StartListening()
+	if *shared {
+		proxy.SingleSession.Shared = true
+	}
+	if *viewOnly {
+		proxy.SingleSession.ViewOnly = true
+	}
+
+	if *replayFile != "" {
+		logger.Info("replaying fbs file to incoming connections: ", *replayFile)
+		proxy.SingleSession.Type = vncproxy.SessionTypeReplayServer
+		proxy.SingleSession.ReplayFilePath = *replayFile
+	} else if *useSessions && *targetVnc == "" && *targetVncPort == "" {
+		//no default session, all targets are registered through the api
+		proxy.SingleSession = nil
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := proxy.Start(ctx); err != nil {
+		logger.Error("failed to start the proxy: ", err)
+		os.Exit(1)
+	}
+
+	<-ctx.Done()
+	logger.Info("shutting down, closing connections & recordings")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := proxy.Shutdown(shutdownCtx); err != nil {
+		logger.Error("shutdown: ", err)
+	}
+}
+
+// isLoopback returns true for hosts only reachable from this machine
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/wsserver"
+)
+
+var ErrAccessDenied = errors.New("access denied")
+
+// AuthEntry is a single credential of the FileAuthenticator, a client matching any entry is let in
+type AuthEntry struct {
+	// a password matches vnc authentication (regardless of the username) and VeNCrypt Plain (together with the username)
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// a token matches the token sent on the websocket upgrade
+	Token    string `json:"token,omitempty"`
+	ViewOnly bool   `json:"viewOnly,omitempty"`
+	// the sessions this credential may connect to, empty = all
+	Sessions []string `json:"sessions,omitempty"`
+	// the networks (CIDR) the client may connect from, empty = any
+	Networks []string `json:"networks,omitempty"`
+}
+
+// FileAuthenticator checks vnc-clients against a list of credentials loaded from a json file:
+//
+//	[
+//	  {"username": "admin", "password": "secret"},
+//	  {"password": "auditor", "viewOnly": true, "sessions": ["desk1"]},
+//	  {"token": "4f2a9c", "networks": ["10.0.0.0/8"]}
+//	]
+type FileAuthenticator struct {
+	Entries []AuthEntry
+}
+
+func NewFileAuthenticator(filename string) (*FileAuthenticator, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	auth := &FileAuthenticator{}
+	if err := json.Unmarshal(data, &auth.Entries); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+func (a *FileAuthenticator) Authenticate(creds *wsserver.Credentials) (common.AccessLevel, error) {
+	for _, entry := range a.Entries {
+		if !entry.matchesCredentials(creds) || !entry.allowsSession(creds.SessionId) || !entry.allowsAddr(creds.RemoteAddr) {
+			continue
+		}
+		if entry.ViewOnly {
+			return common.AccessLevelViewOnly, nil
+		}
+		return common.AccessLevelFull, nil
+	}
+	return common.AccessLevelFull, ErrAccessDenied
+}
+
+func (e *AuthEntry) matchesCredentials(creds *wsserver.Credentials) bool {
+	switch {
+	case creds.Token != "":
+		return e.Token != "" && e.Token == creds.Token
+	case creds.VNCResponse != nil:
+		return e.Password != "" && wsserver.CheckVNCResponse(e.Password, creds.VNCChallenge, creds.VNCResponse)
+	case creds.Username != "":
+		return e.Password != "" && e.Username == creds.Username && e.Password == creds.Password
+	}
+	return false
+}
+
+func (e *AuthEntry) allowsSession(sessionId string) bool {
+	if len(e.Sessions) == 0 {
+		return true
+	}
+	for _, id := range e.Sessions {
+		if id == sessionId {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *AuthEntry) allowsAddr(remoteAddr string) bool {
+	if len(e.Networks) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range e.Networks {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
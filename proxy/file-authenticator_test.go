@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/amitbet/vncproxy/client"
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/wsserver"
+)
+
+// challengeConn feeds a challenge to a vnc-client authentication and keeps its response
+type challengeConn struct {
+	io.Reader
+	bytes.Buffer
+}
+
+func (c *challengeConn) Write(p []byte) (int, error) { return c.Buffer.Write(p) }
+func (c *challengeConn) Read(p []byte) (int, error)  { return c.Reader.Read(p) }
+func (c *challengeConn) Close() error                { return nil }
+
+func vncCredentials(t *testing.T, sessionId string, password string) *wsserver.Credentials {
+	challenge := []byte("0123456789abcdef")
+	conn := &challengeConn{Reader: bytes.NewReader(challenge)}
+	if err := (&client.PasswordAuth{Password: password}).Handshake(conn); err != nil {
+		t.Fatal(err)
+	}
+	return &wsserver.Credentials{SessionId: sessionId, RemoteAddr: "10.1.2.3:51000", VNCChallenge: challenge, VNCResponse: conn.Bytes()}
+}
+
+func TestFileAuthenticator(t *testing.T) {
+	authFile := filepath.Join(t.TempDir(), "auth.json")
+	os.WriteFile(authFile, []byte(`[
+		{"username": "admin", "password": "secret"},
+		{"password": "auditor", "viewOnly": true, "sessions": ["desk1"]},
+		{"token": "4f2a9c", "networks": ["10.0.0.0/8"]}
+	]`), 0644)
+
+	auth, err := NewFileAuthenticator(authFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		creds  *wsserver.Credentials
+		level  common.AccessLevel
+		denied bool
+	}{
+		{"vnc password", vncCredentials(t, "desk2", "secret"), common.AccessLevelFull, false},
+		{"view-only vnc password", vncCredentials(t, "desk1", "auditor"), common.AccessLevelViewOnly, false},
+		{"view-only password on another session", vncCredentials(t, "desk2", "auditor"), 0, true},
+		{"wrong vnc password", vncCredentials(t, "desk1", "guess"), 0, true},
+		{"plain", &wsserver.Credentials{Username: "admin", Password: "secret"}, common.AccessLevelFull, false},
+		{"plain wrong user", &wsserver.Credentials{Username: "root", Password: "secret"}, 0, true},
+		{"token", &wsserver.Credentials{Token: "4f2a9c", RemoteAddr: "10.1.2.3:51000"}, common.AccessLevelFull, false},
+		{"token from outside", &wsserver.Credentials{Token: "4f2a9c", RemoteAddr: "192.168.1.5:51000"}, 0, true},
+		{"no credentials", &wsserver.Credentials{}, 0, true},
+	}
+	for _, tt := range tests {
+		level, err := auth.Authenticate(tt.creds)
+		if tt.denied {
+			if err == nil {
+				t.Errorf("%s: expected access to be denied", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+		} else if level != tt.level {
+			t.Errorf("%s: access level = %s, want %s", tt.name, level, tt.level)
+		}
+	}
+}
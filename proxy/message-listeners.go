@@ -1,50 +1,147 @@
 package proxy
 
 import (
+	"sync"
+
 	"github.com/amitbet/vncproxy/client"
 	"github.com/amitbet/vncproxy/common"
 	"github.com/amitbet/vncproxy/logger"
+	listeners "github.com/amitbet/vncproxy/recorder"
 	"github.com/amitbet/vncproxy/server"
 	"github.com/amitbet/vncproxy/wsserver"
 )
 
 type ClientUpdater struct {
 	conn *client.ClientConn
+	// drops all input (keyboard, mouse & clipboard) so the vnc-client can only watch
+	ViewOnly bool
+	// leaves zlib based encodings out of the vnc-client's SetEncodings, so every recording segment & keyframe can be played on its own
+	NoZlibStreams bool
+	// an upstreamLink replaces lost vnc-server connections, so write errors don't disconnect the vnc-client
+	reconnects bool
+
+	mutex sync.Mutex
+	// the vnc-client's last SetEncodings, sent again to a reconnected vnc-server
+	setEncodings common.ClientMessage
+}
+
+// isInputMessage returns true for client messages that change the state of the remote machine
+func isInputMessage(msgType common.ClientMessageType) bool {
+	switch msgType {
+	case common.KeyEventMsgType, common.PointerEventMsgType, common.ClientCutTextMsgType, common.QEMUExtendedKeyEventMsgType,
+		common.SetDesktopSizeMsgType:
+		return true
+	}
+	return false
+}
+
+// upstream returns the vnc-server connection, nil while it is being reconnected
+func (cc *ClientUpdater) upstream() *client.ClientConn {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return cc.conn
+}
+
+// setUpstream replaces the vnc-server connection, messages of the vnc-client are dropped while it is nil
+func (cc *ClientUpdater) setUpstream(conn *client.ClientConn) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.conn = conn
+}
+
+// avoidZlibStreams leaves zlib based encodings out of the vnc-client's SetEncodings from now on,
+// including the one kept for reconnecting
+func (cc *ClientUpdater) avoidZlibStreams() {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.NoZlibStreams = true
+	if setEncodings, ok := cc.setEncodings.(*wsserver.MsgSetEncodings); ok {
+		cc.setEncodings = &wsserver.MsgSetEncodings{Encodings: common.WithoutZlibStreams(setEncodings.Encodings)}
+	}
+}
+
+func (cc *ClientUpdater) lastSetEncodings() common.ClientMessage {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return cc.setEncodings
 }
 
 // Consume recieves vnc-server-bound messages (Client messages) and updates the server part of the proxy
 func (cc *ClientUpdater) Consume(seg *common.RfbSegment) error {
-	logger.Tracef("ClientUpdater.Consume (vnc-server-bound): got segment type=%s bytes: %v", seg.SegmentType, seg.Bytes)
+	conn := cc.upstream()
+	log := logger.With()
+	if conn != nil {
+		log = conn.Logger()
+	}
+	log.Tracef("ClientUpdater.Consume (vnc-server-bound): got segment type=%s bytes: %v", seg.SegmentType, seg.Bytes)
 	switch seg.SegmentType {
 
 	case common.SegmentFullyParsedClientMessage:
 		clientMsg := seg.Message.(common.ClientMessage)
-		logger.Debugf("ClientUpdater.Consume:(vnc-server-bound) got ClientMessage type=%s", clientMsg.Type())
+		log.Debugf("ClientUpdater.Consume:(vnc-server-bound) got ClientMessage type=%s", clientMsg.Type())
+		if clientMsg.Type() == common.SetEncodingsMsgType {
+			cc.mutex.Lock()
+			if setEncodings, ok := clientMsg.(*wsserver.MsgSetEncodings); ok && cc.NoZlibStreams {
+				clientMsg = &wsserver.MsgSetEncodings{Encodings: common.WithoutZlibStreams(setEncodings.Encodings)}
+			}
+			cc.setEncodings = clientMsg
+			cc.mutex.Unlock()
+		}
+		if cc.ViewOnly && isInputMessage(clientMsg.Type()) {
+			log.Tracef("ClientUpdater.Consume: view-only, dropping %s", clientMsg.Type())
+			return nil
+		}
+		if conn == nil {
+			log.Tracef("ClientUpdater.Consume: reconnecting to the vnc-server, dropping %s", clientMsg.Type())
+			return nil
+		}
+		var err error
 		switch clientMsg.Type() {
 
 		case common.SetPixelFormatMsgType:
-			// update pixel format
-			logger.Debugf("ClientUpdater.Consume: updating pixel format")
+			// update pixel format, in step with the connection parsing the vnc-server's messages
+			log.Debugf("ClientUpdater.Consume: updating pixel format")
 			pixFmtMsg := clientMsg.(*wsserver.MsgSetPixelFormat)
-			cc.conn.PixelFormat = pixFmtMsg.PF
+			err = conn.SetPixelFormat(&pixFmtMsg.PF)
+		default:
+			err = clientMsg.Write(conn)
 		}
-
-		err := clientMsg.Write(cc.conn)
 		if err != nil {
-			logger.Errorf("ClientUpdater.Consume (vnc-server-bound, SegmentFullyParsedClientMessage): problem writing to port: %s", err)
+			log.Errorf("ClientUpdater.Consume (vnc-server-bound, SegmentFullyParsedClientMessage): problem writing to port: %s", err)
+			if cc.reconnects {
+				return nil
+			}
 		}
 		return err
+	case common.SegmentConnectionClosed:
+		//the vnc-client left, drop its vnc-server connection
+		if conn == nil {
+			return nil
+		}
+		return conn.Close()
 	}
 	return nil
 }
 
+// resizeViewer keeps the vnc-client's size in sync with the desktop size changes it gets from the vnc-server
+func resizeViewer(conn common.IServerConn, msg interface{}) {
+	fbUpdate, ok := msg.(*client.MsgFramebufferUpdate)
+	if !ok {
+		return
+	}
+	if width, height, resized := fbUpdate.DesktopSize(); resized {
+		conn.SetWidth(width)
+		conn.SetHeight(height)
+	}
+}
+
 type wsServerUpdater struct {
 	conn common.IServerConn
 }
 
 func (p *wsServerUpdater) Consume(seg *common.RfbSegment) error {
 
-	logger.Debugf("WriteTo.Consume (ServerUpdater): got segment type=%s, object type:%d", seg.SegmentType, seg.UpcomingObjectType)
+	p.conn.Logger().Debugf("WriteTo.Consume (ServerUpdater): got segment type=%s, object type:%d", seg.SegmentType, seg.UpcomingObjectType)
 	switch seg.SegmentType {
 	case common.SegmentMessageStart:
 	case common.SegmentRectSeparator:
@@ -55,22 +152,27 @@ func (p *wsServerUpdater) Consume(seg *common.RfbSegment) error {
 		p.conn.SetDesktopName(string(serverInitMessage.NameText))
 		p.conn.SetPixelFormat(&serverInitMessage.PixelFormat)
 
-		logger.Debugf("WriteTo.Consume (ServerUpdater): serverInitMessage NameText=%s", string(serverInitMessage.NameText))
+		p.conn.Logger().Debugf("WriteTo.Consume (ServerUpdater): serverInitMessage NameText=%s", string(serverInitMessage.NameText))
+	case common.SegmentFullyParsedServerMessage:
+		resizeViewer(p.conn, seg.Message)
+	case common.SegmentConnectionClosed:
+		//the vnc-server connection is gone, disconnect the vnc-client
+		return p.conn.Close()
 
 	case common.SegmentBytes:
-		logger.Debugf("WriteTo.Consume (ServerUpdater SegmentBytes): got bytes len=%d", len(seg.Bytes))
+		p.conn.Logger().Debugf("WriteTo.Consume (ServerUpdater SegmentBytes): got bytes len=%d", len(seg.Bytes))
 		_, err := p.conn.Write(seg.Bytes)
 		if err != nil {
-			logger.Errorf("WriteTo.Consume (ServerUpdater SegmentBytes): problem writing to port: %s", err)
+			p.conn.Logger().Errorf("WriteTo.Consume (ServerUpdater SegmentBytes): problem writing to port: %s", err)
 		}
 		return err
 	case common.SegmentFullyParsedClientMessage:
 
 		clientMsg := seg.Message.(common.ClientMessage)
-		logger.Debugf("WriteTo.Consume (ServerUpdater): got ClientMessage type=%s", clientMsg.Type())
+		p.conn.Logger().Debugf("WriteTo.Consume (ServerUpdater): got ClientMessage type=%s", clientMsg.Type())
 		err := clientMsg.Write(p.conn)
 		if err != nil {
-			logger.Errorf("WriteTo.Consume (ServerUpdater SegmentFullyParsedClientMessage): problem writing to port: %s", err)
+			p.conn.Logger().Errorf("WriteTo.Consume (ServerUpdater SegmentFullyParsedClientMessage): problem writing to port: %s", err)
 		}
 		return err
 	default:
@@ -85,7 +187,7 @@ type ServerUpdater struct {
 
 func (p *ServerUpdater) Consume(seg *common.RfbSegment) error {
 
-	logger.Debugf("WriteTo.Consume (ServerUpdater): got segment type=%s, object type:%d", seg.SegmentType, seg.UpcomingObjectType)
+	p.conn.Logger().Debugf("WriteTo.Consume (ServerUpdater): got segment type=%s, object type:%d", seg.SegmentType, seg.UpcomingObjectType)
 	switch seg.SegmentType {
 	case common.SegmentMessageStart:
 	case common.SegmentRectSeparator:
@@ -95,21 +197,23 @@ func (p *ServerUpdater) Consume(seg *common.RfbSegment) error {
 		p.conn.SetWidth(serverInitMessage.FBWidth)
 		p.conn.SetDesktopName(string(serverInitMessage.NameText))
 		p.conn.SetPixelFormat(&serverInitMessage.PixelFormat)
+	case common.SegmentFullyParsedServerMessage:
+		resizeViewer(p.conn, seg.Message)
 
 	case common.SegmentBytes:
-		logger.Debugf("WriteTo.Consume (ServerUpdater SegmentBytes): got bytes len=%d", len(seg.Bytes))
+		p.conn.Logger().Debugf("WriteTo.Consume (ServerUpdater SegmentBytes): got bytes len=%d", len(seg.Bytes))
 		_, err := p.conn.Write(seg.Bytes)
 		if err != nil {
-			logger.Errorf("WriteTo.Consume (ServerUpdater SegmentBytes): problem writing to port: %s", err)
+			p.conn.Logger().Errorf("WriteTo.Consume (ServerUpdater SegmentBytes): problem writing to port: %s", err)
 		}
 		return err
 	case common.SegmentFullyParsedClientMessage:
 
 		clientMsg := seg.Message.(common.ClientMessage)
-		logger.Debugf("WriteTo.Consume (ServerUpdater): got ClientMessage type=%s", clientMsg.Type())
+		p.conn.Logger().Debugf("WriteTo.Consume (ServerUpdater): got ClientMessage type=%s", clientMsg.Type())
 		err := clientMsg.Write(p.conn)
 		if err != nil {
-			logger.Errorf("WriteTo.Consume (ServerUpdater SegmentFullyParsedClientMessage): problem writing to port: %s", err)
+			p.conn.Logger().Errorf("WriteTo.Consume (ServerUpdater SegmentFullyParsedClientMessage): problem writing to port: %s", err)
 		}
 		return err
 	default:
@@ -117,3 +221,29 @@ func (p *ServerUpdater) Consume(seg *common.RfbSegment) error {
 	}
 	return nil
 }
+
+// sessionClientTracker releases the vnc-client's slot in the session registry when its connection closes
+type sessionClientTracker struct {
+	sessions  *SessionManager
+	sessionId string
+}
+
+func (t *sessionClientTracker) Consume(seg *common.RfbSegment) error {
+	if seg.SegmentType == common.SegmentConnectionClosed {
+		t.sessions.ClientDisconnected(t.sessionId)
+	}
+	return nil
+}
+
+// recorderCloser flushes & closes the recording when the recorded vnc-server connection closes
+type recorderCloser struct {
+	proxy *VncProxy
+	rec   *listeners.Recorder
+}
+
+func (rc *recorderCloser) Consume(seg *common.RfbSegment) error {
+	if seg.SegmentType == common.SegmentConnectionClosed {
+		rc.proxy.closeRecorder(rc.rec)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/amitbet/vncproxy/client"
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/encodings"
+	"github.com/amitbet/vncproxy/wsserver"
+)
+
+// bufferConn is a net.Conn that keeps everything written to it
+type bufferConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *bufferConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func (c *bufferConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+func TestClientUpdaterViewOnly(t *testing.T) {
+	nc := &bufferConn{}
+	cconn, _ := client.NewClientConn(nc, &client.ClientConfig{})
+	updater := &ClientUpdater{conn: cconn, ViewOnly: true}
+
+	consume := func(msg common.ClientMessage) {
+		if err := updater.Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedClientMessage, Message: msg}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	consume(&wsserver.MsgKeyEvent{Down: 1, Key: 'a'})
+	consume(&wsserver.MsgPointerEvent{Mask: 1, X: 10, Y: 10})
+	consume(&wsserver.MsgClientCutText{Length: 4, Text: []byte("text")})
+	consume(&wsserver.MsgSetDesktopSize{Width: 1280, Height: 720, Screens: []common.Screen{{Width: 1280, Height: 720}}})
+	if nc.written.Len() != 0 {
+		t.Fatalf("view-only input reached the vnc-server: %v", nc.written.Bytes())
+	}
+
+	consume(&wsserver.MsgFramebufferUpdateRequest{Inc: 1, Width: 10, Height: 10})
+	if nc.written.Len() == 0 || nc.written.Bytes()[0] != byte(common.FramebufferUpdateRequestMsgType) {
+		t.Errorf("framebuffer update request was not forwarded: %v", nc.written.Bytes())
+	}
+}
+
+func TestClientUpdaterSetDesktopSize(t *testing.T) {
+	nc := &bufferConn{}
+	cconn, _ := client.NewClientConn(nc, &client.ClientConfig{})
+	updater := &ClientUpdater{conn: cconn}
+	msg := &wsserver.MsgSetDesktopSize{Width: 1280, Height: 720, Screens: []common.Screen{{ID: 1, Width: 1280, Height: 720}}}
+	updater.Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedClientMessage, Message: msg})
+
+	expected := []byte{byte(common.SetDesktopSizeMsgType), 0, 5, 0, 2, 208, 1, 0,
+		0, 0, 0, 1, 0, 0, 0, 0, 5, 0, 2, 208, 0, 0, 0, 0}
+	if !bytes.Equal(nc.written.Bytes(), expected) {
+		t.Errorf("SetDesktopSize was forwarded as %v, want %v", nc.written.Bytes(), expected)
+	}
+
+	//the vnc-client follows the size the vnc-server changed to
+	viewer, _ := wsserver.NewServerConnIO(&bufferConn{}, &wsserver.ServerConfig{ClientMessages: wsserver.DefaultClientMessages})
+	update := &client.MsgFramebufferUpdate{Rectangles: []common.Rectangle{
+		{Width: 1280, Height: 720, Enc: &encodings.EncExtendedDesktopSizePseudo{Width: 1280, Height: 720, Status: common.DesktopSizeStatusOK}},
+	}}
+	(&wsServerUpdater{viewer}).Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedServerMessage, Message: update})
+	if viewer.Width() != 1280 || viewer.Height() != 720 {
+		t.Errorf("the vnc-client wasn't resized, got %dx%d", viewer.Width(), viewer.Height())
+	}
+}
+
+func TestClientUpdaterNoZlibStreams(t *testing.T) {
+	nc := &bufferConn{}
+	cconn, _ := client.NewClientConn(nc, &client.ClientConfig{})
+	updater := &ClientUpdater{conn: cconn, NoZlibStreams: true}
+	msg := &wsserver.MsgSetEncodings{Encodings: []common.EncodingType{common.EncTight, common.EncZRLE, common.EncHextile, common.EncZlib, common.EncRaw, common.EncDesktopSizePseudo}}
+	updater.Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedClientMessage, Message: msg})
+
+	expected := &bufferConn{}
+	expectedWriter, _ := wsserver.NewServerConnIO(expected, &wsserver.ServerConfig{ClientMessages: wsserver.DefaultClientMessages})
+	(&wsserver.MsgSetEncodings{Encodings: []common.EncodingType{common.EncHextile, common.EncRaw, common.EncDesktopSizePseudo}}).Write(expectedWriter)
+	if !bytes.Equal(nc.written.Bytes(), expected.written.Bytes()) {
+		t.Errorf("SetEncodings was forwarded as %v, want %v", nc.written.Bytes(), expected.written.Bytes())
+	}
+	//a reconnected vnc-server gets the same encodings
+	if encs := updater.lastSetEncodings().(*wsserver.MsgSetEncodings).Encodings; len(encs) != 3 {
+		t.Errorf("the encodings kept for reconnecting are %v", encs)
+	}
+}
+
+// updateCounter counts the framebuffer updates parsed on a vnc-server connection
+type updateCounter struct {
+	updates int32
+}
+
+func (c *updateCounter) Consume(seg *common.RfbSegment) error {
+	if seg.SegmentType == common.SegmentFullyParsedServerMessage {
+		atomic.AddInt32(&c.updates, 1)
+	}
+	return nil
+}
+
+func TestClientUpdaterPixelFormatWhileUpdating(t *testing.T) {
+	//run with -race: the vnc-client changes the pixel format while the vnc-server connection is parsing updates.
+	//A pipe is used since the race detector takes every socket read to follow every socket write.
+	clientEnd, serverEnd := net.Pipe()
+	server := &fakeVncServer{width: 40, height: 20}
+	go server.handle(serverEnd)
+
+	cconn, _ := client.NewClientConn(clientEnd, &client.ClientConfig{})
+	cconn.Encs = proxyEncodings()
+	counter := &updateCounter{}
+	cconn.Listeners().AddListener(counter)
+	if err := cconn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer cconn.Close()
+	updater := &ClientUpdater{conn: cconn}
+
+	//both formats are 32 bits, so the updates parse the same with either
+	rgb := *common.NewPixelFormat(32)
+	bgr := rgb
+	bgr.RedShift, bgr.BlueShift = rgb.BlueShift, rgb.RedShift
+	const updates = 200
+	update := &bytes.Buffer{}
+	update.Write([]byte{byte(common.FramebufferUpdate), 0, 0, 1})
+	binary.Write(update, binary.BigEndian, []uint16{0, 0, 2, 2})
+	binary.Write(update, binary.BigEndian, int32(common.EncRaw))
+	update.Write(make([]byte, 2*2*4))
+
+	go func() {
+		for i := 0; i < updates; i++ {
+			serverEnd.Write(update.Bytes())
+		}
+	}()
+	for i := 0; i < updates; i++ {
+		pixelFormat := rgb
+		if i%2 == 1 {
+			pixelFormat = bgr
+		}
+		updater.Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedClientMessage, Message: &wsserver.MsgSetPixelFormat{PF: pixelFormat}})
+	}
+
+	waitUntil(t, "the updates to be parsed", func() bool { return atomic.LoadInt32(&counter.updates) == updates })
+	if *cconn.CurrentPixelFormat() != bgr {
+		t.Errorf("the vnc-server connection parses with %v, want the last format set %v", *cconn.CurrentPixelFormat(), bgr)
+	}
+}
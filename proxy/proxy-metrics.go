@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/amitbet/vncproxy/metrics"
+)
+
+// metricsRegistry holds the gauges of this proxy, read from its sessions & recorders when the metrics are collected.
+// The counters of the vncproxy packages (bytes, updates, rectangles, handshake failures...) are in metrics.Default.
+func (vp *VncProxy) metricsRegistry() *metrics.Registry {
+	registry := &metrics.Registry{}
+	registry.Register(metrics.NewGaugeFunc("vncproxy_sessions_active", "Sessions with connected vnc-clients.", "", func() map[string]float64 {
+		active := 0
+		for _, session := range vp.SessionManager().ListSessions() {
+			if session.ConnectedClients > 0 {
+				active++
+			}
+		}
+		return map[string]float64{"": float64(active)}
+	}))
+	registry.Register(metrics.NewGaugeFunc("vncproxy_session_viewers", "Connected vnc-clients per session.", "session", func() map[string]float64 {
+		viewers := make(map[string]float64)
+		for _, session := range vp.SessionManager().ListSessions() {
+			viewers[session.ID] = float64(session.ConnectedClients)
+		}
+		return viewers
+	}))
+	registry.Register(metrics.NewGaugeFunc("vncproxy_recordings_active", "Recordings being written.", "", func() map[string]float64 {
+		vp.recordersMutex.Lock()
+		defer vp.recordersMutex.Unlock()
+		return map[string]float64{"": float64(len(vp.recorders))}
+	}))
+	registry.Register(metrics.NewGaugeFunc("vncproxy_recorder_queue_depth", "Segments waiting to be written by all recorders.", "", func() map[string]float64 {
+		total, _ := vp.recorderQueues()
+		return map[string]float64{"": float64(total)}
+	}))
+	registry.Register(metrics.NewGaugeFunc("vncproxy_recorder_queue_depth_max", "Segments waiting to be written by the most loaded recorder, recorders slow the proxy down at 100.", "", func() map[string]float64 {
+		_, max := vp.recorderQueues()
+		return map[string]float64{"": float64(max)}
+	}))
+	return registry
+}
+
+// recorderQueues returns the total & the longest queue of the active recorders
+func (vp *VncProxy) recorderQueues() (total, max int) {
+	vp.recordersMutex.Lock()
+	defer vp.recordersMutex.Unlock()
+	for rec := range vp.recorders {
+		depth := rec.QueueDepth()
+		total += depth
+		if depth > max {
+			max = depth
+		}
+	}
+	return total, max
+}
+
+// newMetricsServer serves /metrics on its own listener, so monitoring doesn't need access to the session api
+func (vp *VncProxy) newMetricsServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler(metrics.Default, vp.metricsRegistry()))
+	return &http.Server{Handler: mux}
+}
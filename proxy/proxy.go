@@ -1,112 +1,391 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
-	"path"
-	"strconv"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/amitbet/vncproxy/client"
 	"github.com/amitbet/vncproxy/common"
 	"github.com/amitbet/vncproxy/encodings"
 	"github.com/amitbet/vncproxy/logger"
+	"github.com/amitbet/vncproxy/player"
 	listeners "github.com/amitbet/vncproxy/recorder"
 	"github.com/amitbet/vncproxy/wsserver"
 )
 
 type VncProxy struct {
-	TCPListeningURL  string      // empty = not listening on tcp
-	WsListeningURL   string      // empty = not listening on ws
-	RecordingDir     string      // empty = no recording
-	ProxyVncPassword string      //empty = no auth
-	SingleSession    *VncSession // to be used when not using sessions
-	UsingSessions    bool        //false = single session - defined in the var above
-	sessionManager   *SessionManager
+	TCPListeningURL       string                 // empty = not listening on tcp
+	WsListeningURL        string                 // empty = not listening on ws
+	LongConnListeningURL  string                 // url of the long connection websocket server (e.g. http://0.0.0.0:5908/ws), empty = not listening
+	RecordingDir          string                 // empty = no recording
+	RecordingFileTemplate string                 // file name of recordings in RecordingDir, see recordingFileName, empty = DefaultRecordingFileTemplate
+	RecordingCompression  string                 // "" = FBS recordings, "zstd" or "gzip" = compressed recordings (.vncr)
+	RecordingMaxFileBytes int64                  // split recordings into segment files of about this size, 0 = no size limit
+	RecordingMaxDuration  time.Duration          // split recordings into segment files of this duration, 0 = no duration limit
+	RecordingMaxAge       time.Duration          // recordings older than this are deleted, 0 = keep forever
+	RecordingMaxBytes     int64                  // the oldest recordings are deleted when the recording dir grows bigger, 0 = no limit
+	RecordingKeyframes    time.Duration          // index a full screen update this often so recordings can be played from any point, 0 = no index
+	RecordingAuditLog     bool                   // log the keys, clicks & clipboard of recorded sessions to a .audit.jsonl file next to the recording
+	ProxyVncPassword      string                 //empty = no auth
+	ProxyViewOnlyPassword string                 // vnc-clients using this password get view-only access, empty = no view-only password
+	TLSCertFile           string                 // PEM certificate for VeNCrypt, empty = no tls
+	TLSKeyFile            string                 // PEM private key for VeNCrypt
+	TLSRequired           bool                   // true = only VeNCrypt tls connections are accepted on tcp, the ws listener serves wss
+	Authenticator         wsserver.Authenticator // decides which vnc-clients may connect, nil = use the proxy passwords
+	TokenPlugin           TokenPlugin            // resolves unknown session ids as websockify tokens (needs UsingSessions), nil = no token routing
+	SingleSession         *VncSession            // to be used when not using sessions
+	UsingSessions         bool                   //false = single session - defined in the var above
+	APIListeningURL       string                 // host:port, empty = no session management api
+	APIToken              string                 // bearer token required by the session management api, empty = no authentication
+	MetricsListeningURL   string                 // host:port serving prometheus metrics on /metrics, empty = no metrics
+	Screenshots           bool                   // decode the screens of proxied sessions for the api's /sessions/{id}/screenshot.png
+	DialTimeout           time.Duration          // connecting to a vnc-server, 0 = DefaultDialTimeout
+	HandshakeTimeout      time.Duration          // the rfb handshake with a vnc-server, 0 = DefaultHandshakeTimeout
+	ConnectRetries        int                    // connection attempts to a vnc-server after the first one failed, 0 = no retries
+	RetryBackoff          time.Duration          // the wait before the first retry, doubled after each one, 0 = DefaultRetryBackoff
+	MaxRetryBackoff       time.Duration          // the longest wait between retries, 0 = DefaultMaxRetryBackoff
+	Reconnect             bool                   // a lost vnc-server connection is reconnected without disconnecting the vnc-client (not for shared sessions)
+	ReconnectTimeout      time.Duration          // how long to try reconnecting before disconnecting the vnc-client, 0 = DefaultReconnectTimeout
+	IdleTimeout           time.Duration          // vnc-clients without keyboard or mouse input for this long are disconnected, 0 = no idle timeout
+	MaxSessionDuration    time.Duration          // vnc-clients are disconnected after being connected for this long, 0 = no limit
+	TimeoutWarning        time.Duration          // how long before the idle timeout & max duration the vnc-client is warned, 0 = DefaultTimeoutWarning
+	sessionManager        *SessionManager
+	initOnce              sync.Once
+	sharedSessions        map[string]*SharedSession
+	sharedMutex           sync.Mutex
+	lifecycleMutex        sync.Mutex
+	server                *wsserver.Server
+	apiServer             *http.Server
+	metricsServer         *http.Server
+	longConnServer        *wsserver.LongConnServer
+	longConnHTTPServer    *http.Server
+	done                  chan struct{}
+	recorders             map[*listeners.Recorder]struct{}
+	recordersMutex        sync.Mutex
+	screens               *SessionScreens
 }
 
-func (vp *VncProxy) createClientConnection(target string, vncPass string) (*client.ClientConn, error) {
+// SessionManager returns the session registry used to route incoming connections,
+// when not using sessions it holds only the SingleSession.
+func (vp *VncProxy) SessionManager() *SessionManager {
+	vp.initOnce.Do(func() {
+		vp.sessionManager = NewSessionManager()
+		if vp.SingleSession != nil {
+			vp.sessionManager.SetSession(vp.SingleSession.ID, vp.SingleSession)
+		}
+	})
+	return vp.sessionManager
+}
+
+// createClientConnection connects to the session's vnc-server, the connection logs with the fields of log
+func (vp *VncProxy) createClientConnection(session *VncSession, log *logger.FieldLogger) (*client.ClientConn, error) {
 	var (
 		nc  net.Conn
 		err error
 	)
 
+	target := session.TargetAddress()
+	dialer := net.Dialer{Timeout: durationOr(vp.DialTimeout, DefaultDialTimeout)}
 	if target[0] == '/' {
-		nc, err = net.Dial("unix", target)
+		nc, err = dialer.Dial("unix", target)
 	} else {
-		nc, err = net.Dial("tcp", target)
+		nc, err = dialer.Dial("tcp", target)
 	}
 
 	if err != nil {
-		logger.Errorf("error connecting to vnc server: %s", err)
+		log.Errorf("error connecting to vnc server: %s", err)
 		return nil, err
 	}
 
-	var noauth client.ClientAuthNone
-	authArr := []client.ClientAuth{&client.PasswordAuth{Password: vncPass}, &noauth}
+	authArr, err := targetAuth(session, target)
+	if err != nil {
+		log.Errorf("error creating target authentication: %s", err)
+		nc.Close()
+		return nil, err
+	}
 
 	clientConn, err := client.NewClientConn(nc,
 		&client.ClientConfig{
-			Auth:      authArr,
-			Exclusive: true,
+			Auth:             authArr,
+			Exclusive:        true,
+			HandshakeTimeout: durationOr(vp.HandshakeTimeout, DefaultHandshakeTimeout),
 		})
 
 	if err != nil {
-		logger.Errorf("error creating client: %s", err)
+		log.Errorf("error creating client: %s", err)
 		return nil, err
 	}
+	clientConn.SetLogger(log)
 
 	return clientConn, nil
 }
 
+// targetAuth lists the authentication methods used with the target vnc server, when tls is on nothing else is allowed
+func targetAuth(session *VncSession, target string) ([]client.ClientAuth, error) {
+	if session.TargetTLS {
+		serverName, _, err := net.SplitHostPort(target)
+		if err != nil {
+			serverName = ""
+		}
+		vencrypt, err := client.NewClientAuthVeNCrypt(session.TargetCAFile, serverName, session.TargetUsername, session.TargetPassword)
+		if err != nil {
+			return nil, err
+		}
+		vencrypt.TLSConfig.InsecureSkipVerify = session.TargetTLSSkipVerify
+		return []client.ClientAuth{vencrypt}, nil
+	}
+
+	var noauth client.ClientAuthNone
+	return []client.ClientAuth{&client.PasswordAuth{Password: session.TargetPassword}, &noauth}, nil
+}
+
+// proxyEncodings are the encodings the proxy can parse when reading from the target vnc server
+func proxyEncodings() []common.IEncoding {
+	return []common.IEncoding{
+		&encodings.RawEncoding{},
+		&encodings.TightEncoding{},
+		&encodings.EncCursorPseudo{},
+		&encodings.EncLedStatePseudo{},
+		&encodings.TightPngEncoding{},
+		&encodings.RREEncoding{},
+		&encodings.ZLibEncoding{},
+		&encodings.ZRLEEncoding{},
+		&encodings.CopyRectEncoding{},
+		&encodings.CoRREEncoding{},
+		&encodings.HextileEncoding{},
+	}
+}
+
+// createRecorder starts a recording of the vnc-server connection, named after the session & the vnc-client that started it.
+// viewOnly is set when the recorder gets input messages the proxy drops, they are left out of the audit log.
+func (vp *VncProxy) createRecorder(session *VncSession, conn common.IServerConn, upstream upstreamConn, viewOnly bool) (*listeners.Recorder, error) {
+	viewer := ""
+	if addrConn, ok := conn.(interface{ RemoteAddr() string }); ok {
+		viewer = addrConn.RemoteAddr()
+	}
+	start := time.Now()
+	template := vp.recordingFileTemplate()
+	fileName := func(segment int) string {
+		return filepath.Join(vp.RecordingDir, recordingFileName(template, session.ID, viewer, start, segment))
+	}
+
+	recPath := fileName(0)
+	rec, err := listeners.NewRecorderWithConfig(recPath, listeners.RecorderConfig{
+		MaxSegmentBytes:    vp.RecordingMaxFileBytes,
+		MaxSegmentDuration: vp.RecordingMaxDuration,
+		SegmentFileName:    fileName,
+		KeyframeInterval:   vp.RecordingKeyframes,
+		//keyframes & segments start with a full screen, so they can be played on their own
+		RequestKeyframe: func() {
+			upstream.FramebufferUpdateRequest(false, 0, 0, upstream.Width(), upstream.Height())
+		},
+		Compression:    vp.RecordingCompression,
+		AuditLog:       vp.RecordingAuditLog,
+		AuditSkipInput: viewOnly,
+		Logger:         upstream.Logger(),
+		Metadata: common.RecordingMetadata{
+			SessionId: session.ID,
+			Target:    session.TargetAddress(),
+			Viewer:    viewer,
+		},
+	})
+	if err != nil {
+		upstream.Logger().Errorf("Proxy.createRecorder can't open recorder save path: %s", recPath)
+		return nil, err
+	}
+
+	vp.recordersMutex.Lock()
+	defer vp.recordersMutex.Unlock()
+	if vp.recorders == nil {
+		vp.recorders = make(map[*listeners.Recorder]struct{})
+	}
+	vp.recorders[rec] = struct{}{}
+	return rec, nil
+}
+
+// avoidZlibStreams returns true when the session is recorded in segments or with a keyframe index. A vnc-client can't make
+// the vnc-server reset its zlib streams, so zlib based encodings are avoided for segments & keyframes to be playable on their own.
+func (vp *VncProxy) avoidZlibStreams(session *VncSession) bool {
+	return session.Type == SessionTypeRecordingProxy && (vp.RecordingMaxFileBytes > 0 || vp.RecordingMaxDuration > 0 || vp.RecordingKeyframes > 0)
+}
+
+// recordingFileTemplate is the configured template, or the default one for the recording format
+func (vp *VncProxy) recordingFileTemplate() string {
+	if vp.RecordingFileTemplate != "" {
+		return vp.RecordingFileTemplate
+	}
+	if vp.RecordingCompression != "" {
+		return DefaultCompressedRecordingFileTemplate
+	}
+	return DefaultRecordingFileTemplate
+}
+
+// closeRecorder flushes & closes the recording, it is no longer closed on shutdown
+func (vp *VncProxy) closeRecorder(rec *listeners.Recorder) {
+	vp.recordersMutex.Lock()
+	delete(vp.recorders, rec)
+	vp.recordersMutex.Unlock()
+	rec.Close()
+}
+
+// joinSharedSession attaches the vnc-client to the session's shared upstream connection, creating it for the first viewer
+func (vp *VncProxy) joinSharedSession(session *VncSession, conn common.IServerConn, viewOnly bool) error {
+	connect := func(shared *SharedSession) (*client.ClientConn, error) {
+		//the upstream connection outlives its first viewer, it only logs the session's fields
+		link := newUpstreamLink(vp, session, shared.log.With(logger.FieldTarget, session.TargetAddress()))
+
+		var rec *listeners.Recorder
+		if session.Type == SessionTypeRecordingProxy {
+			//the shared session only passes the controller's input on to the recorder
+			var err error
+			rec, err = vp.createRecorder(session, conn, link, false)
+			if err != nil {
+				return nil, err
+			}
+			link.listeners.AddListener(rec)
+			link.listeners.AddListener(&recorderCloser{vp, rec})
+			shared.clientListeners.AddListener(rec)
+		}
+		if vp.screens != nil {
+			vp.screens.Attach(session.ID, link.listeners, shared.clientListeners)
+		}
+		link.listeners.AddListener(shared)
+
+		cconn, err := link.connect()
+		if err != nil {
+			if rec != nil {
+				vp.closeRecorder(rec)
+			}
+			return nil, err
+		}
+		return cconn, nil
+	}
+
+	for {
+		vp.sharedMutex.Lock()
+		if vp.sharedSessions == nil {
+			vp.sharedSessions = make(map[string]*SharedSession)
+		}
+		shared, ok := vp.sharedSessions[session.ID]
+		if !ok {
+			shared = newSharedSession(session.ID)
+			shared.onClose = func() { vp.removeSharedSession(shared) }
+			vp.sharedSessions[session.ID] = shared
+		}
+		vp.sharedMutex.Unlock()
+
+		gate, err := shared.AddViewer(conn, viewOnly, connect)
+		//the shared session might have closed while we were joining, try again with a new one
+		if err == errSharedSessionClosed {
+			continue
+		}
+		if err == nil {
+			vp.limitSession(conn, gate)
+		}
+		return err
+	}
+}
+
+func (vp *VncProxy) removeSharedSession(shared *SharedSession) {
+	vp.sharedMutex.Lock()
+	defer vp.sharedMutex.Unlock()
+	if vp.sharedSessions[shared.ID] == shared {
+		delete(vp.sharedSessions, shared.ID)
+	}
+}
+
 // if sessions not enabled, will always return the configured target server (only one)
 func (vp *VncProxy) getProxySession(sessionId string) (*VncSession, error) {
 
 	if !vp.UsingSessions {
 		if vp.SingleSession == nil {
 			logger.Errorf("SingleSession is empty, use sessions or populate the SingleSession member of the VncProxy struct.")
+			return nil, errors.New("no single session defined")
 		}
-		return vp.SingleSession, nil
+		sessionId = vp.SingleSession.ID
 	}
-	return vp.sessionManager.GetSession(sessionId)
+
+	session, err := vp.SessionManager().GetSession(sessionId)
+	if err == ErrSessionNotFound && vp.TokenPlugin != nil {
+		return vp.getTokenSession(sessionId)
+	}
+	return session, err
+}
+
+// getTokenSession makes a session for a websocket token, with the target given by the token plugin.
+// It isn't registered, so the token is resolved again on every connection and edited or revoked tokens take effect.
+func (vp *VncProxy) getTokenSession(token string) (*VncSession, error) {
+	target, err := vp.TokenPlugin.Lookup(token)
+	if err != nil {
+		logger.Warnf("Proxy.getTokenSession: can't resolve token %s: %s", token, err)
+		return nil, err
+	}
+
+	sessionType := SessionTypeProxyPass
+	if vp.RecordingDir != "" {
+		sessionType = SessionTypeRecordingProxy
+	}
+	return &VncSession{
+		ID:             token,
+		Target:         target.Target,
+		TargetPassword: target.Password,
+		Type:           sessionType,
+		Status:         SessionStatusInit,
+	}, nil
 }
 
 func (vp *VncProxy) newwsServerConnHandler(cfg *wsserver.ServerConfig, conn common.IServerConn) error {
 	var err error
 	session, err := vp.getProxySession(conn.SessionId())
 	if err != nil {
-		logger.Errorf("Proxy.newServerConnHandler can't get session: %d", conn.SessionId())
+		conn.Logger().Errorf("Proxy.newServerConnHandler can't get session: %s", conn.SessionId())
 		return err
 	}
-
-	var rec *listeners.Recorder
-
-	if session.Type == SessionTypeRecordingProxy {
-		recFile := "recording" + strconv.FormatInt(time.Now().Unix(), 10) + ".rbs"
-		recPath := path.Join(vp.RecordingDir, recFile)
-		rec, err = listeners.NewRecorder(recPath)
-		if err != nil {
-			logger.Errorf("Proxy.newServerConnHandler can't open recorder save path: %s", recPath)
-			return err
-		}
-
-		conn.Listeners().AddListener(rec)
+	sessions := vp.SessionManager()
+	viewOnly := session.ViewOnly || conn.AccessLevel() == common.AccessLevelViewOnly
+	isProxySession := session.Type == SessionTypeProxyPass || session.Type == SessionTypeRecordingProxy
+
+	//every line logged for this vnc-client carries its session, address & vnc-server
+	log := conn.Logger().With(logger.FieldSession, session.ID)
+	if isProxySession {
+		log = log.With(logger.FieldTarget, session.TargetAddress())
 	}
+	conn.SetLogger(log)
 
-	session.Status = SessionStatusInit
-	if session.Type == SessionTypeProxyPass || session.Type == SessionTypeRecordingProxy {
-		target := session.Target
-		if session.TargetHostname != "" && session.TargetPort != "" {
-			target = session.TargetHostname + ":" + session.TargetPort
-		}
-
-		cconn, err := vp.createClientConnection(target, session.TargetPassword)
+	sessions.SetStatus(session.ID, SessionStatusInit)
+	if isProxySession && session.Shared {
+		err = vp.joinSharedSession(session, conn, viewOnly)
 		if err != nil {
-			session.Status = SessionStatusError
-			logger.Errorf("Proxy.newServerConnHandler error creating connection: %s", err)
+			sessions.SetStatus(session.ID, SessionStatusError)
+			log.Errorf("Proxy.newServerConnHandler error joining shared session: %s", err)
 			return err
 		}
+	} else if isProxySession {
+		//the link passes the vnc-server's segments on, from a reconnected vnc-server too
+		link := newUpstreamLink(vp, session, log)
+
+		//every vnc-client gets its own recording (shared sessions keep a single one for all viewers)
+		var rec *listeners.Recorder
 		if session.Type == SessionTypeRecordingProxy {
-			cconn.Listeners().AddListener(rec)
+			rec, err = vp.createRecorder(session, conn, link, viewOnly)
+			if err != nil {
+				sessions.SetStatus(session.ID, SessionStatusError)
+				return err
+			}
+			conn.Listeners().AddListener(rec)
+			link.listeners.AddListener(rec)
+			link.listeners.AddListener(&recorderCloser{vp, rec})
+		}
+		if vp.screens != nil {
+			vp.screens.Attach(session.ID, link.listeners, conn.Listeners())
 		}
 
 		//creating cross-listeners between server and client parts to pass messages through the proxy:
@@ -114,99 +393,356 @@ func (vp *VncProxy) newwsServerConnHandler(cfg *wsserver.ServerConfig, conn comm
 		// gets the bytes from the actual vnc server on the env (client part of the proxy)
 		// and writes them through the server socket to the vnc-client
 		serverUpdater := &wsServerUpdater{conn}
-		cconn.Listeners().AddListener(serverUpdater)
+		link.listeners.AddListener(serverUpdater)
+		gate := &messageGate{}
+		link.listeners.AddListener(gate)
 
 		// gets the messages from the server part (from vnc-client),
 		// and write through the client to the actual vnc-server
-		clientUpdater := &ClientUpdater{cconn}
+		clientUpdater := &ClientUpdater{ViewOnly: viewOnly, NoZlibStreams: vp.avoidZlibStreams(session)}
+		if vp.Reconnect {
+			link.reconnectViewer(conn, clientUpdater)
+		}
 		conn.Listeners().AddListener(clientUpdater)
 
-		err = cconn.Connect()
+		cconn, err := link.connect()
 		if err != nil {
-			session.Status = SessionStatusError
-			logger.Errorf("Proxy.newServerConnHandler error connecting to client: %s", err)
+			if rec != nil {
+				vp.closeRecorder(rec)
+			}
+			sessions.SetStatus(session.ID, SessionStatusError)
+			log.Errorf("Proxy.newServerConnHandler error connecting to client: %s", err)
 			return err
 		}
+		clientUpdater.setUpstream(cconn)
+		vp.limitSession(conn, gate)
 
-		encs := []common.IEncoding{
-			&encodings.RawEncoding{},
-			&encodings.TightEncoding{},
-			&encodings.EncCursorPseudo{},
-			&encodings.EncLedStatePseudo{},
-			&encodings.TightPngEncoding{},
-			&encodings.RREEncoding{},
-			&encodings.ZLibEncoding{},
-			&encodings.ZRLEEncoding{},
-			&encodings.CopyRectEncoding{},
-			&encodings.CoRREEncoding{},
-			&encodings.HextileEncoding{},
+	}
+
+	if session.Type == SessionTypeReplayServer {
+		replayPath := session.ReplayFilePath
+		//relative paths are taken from the recording dir, so recorded sessions can be replayed by file name
+		if !filepath.IsAbs(replayPath) && vp.RecordingDir != "" {
+			replayPath = filepath.Join(vp.RecordingDir, replayPath)
 		}
-		cconn.Encs = encs
 
+		fbs, err := player.ConnectRecordingFile(replayPath, conn)
 		if err != nil {
-			session.Status = SessionStatusError
-			logger.Errorf("Proxy.newServerConnHandler error connecting to client: %s", err)
+			sessions.SetStatus(session.ID, SessionStatusError)
+			log.Errorf("Proxy.newServerConnHandler error loading fbs file %s: %s", replayPath, err)
 			return err
 		}
+		conn.Listeners().AddListener(player.NewFBSPlayListener(conn, fbs))
 	}
-	/*
-		if session.Type == SessionTypeReplayServer {
-			fbs, err := player.ConnectFbsFile(session.ReplayFilePath, sconn)
 
-			if err != nil {
-				logger.Error("TestServer.NewConnHandler: Error in loading FBS: ", err)
-				return err
+	sessions.SetStatus(session.ID, SessionStatusActive)
+	sessions.ClientConnected(session.ID)
+	conn.Listeners().AddListener(&sessionClientTracker{sessions, session.ID})
+	return nil
+}
+
+// StartListening runs the proxy until it is shut down, see Start
+func (vp *VncProxy) StartListening() error {
+	if err := vp.Start(context.Background()); err != nil {
+		logger.Errorf("Proxy.StartListening: %s", err)
+		return err
+	}
+	<-vp.Done()
+	return nil
+}
+
+// Start opens the tcp, websocket & api listeners and serves vnc-clients in the background,
+// until ctx ends or Shutdown is called. Listening errors are returned, nothing is left running in that case.
+func (vp *VncProxy) Start(ctx context.Context) error {
+	vp.lifecycleMutex.Lock()
+	defer vp.lifecycleMutex.Unlock()
+	if vp.server != nil {
+		return errors.New("proxy already started")
+	}
+	if vp.TCPListeningURL == "" && vp.WsListeningURL == "" {
+		return errors.New("no listening url defined")
+	}
+	//without sessions every connection goes to the single session, tokens would never be looked up
+	if vp.TokenPlugin != nil && !vp.UsingSessions {
+		return errors.New("token routing needs UsingSessions")
+	}
+
+	tcpSecHandlers, wsSecHandlers, err := vp.securityHandlers()
+	if err != nil {
+		return fmt.Errorf("can't set up authentication: %s", err)
+	}
+	//websocket vnc-clients can't use VeNCrypt, when tls is required they connect with wss
+	var wsTLSConfig *tls.Config
+	if vp.TLSRequired && vp.WsListeningURL != "" {
+		cert, err := tls.LoadX509KeyPair(vp.TLSCertFile, vp.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("can't load the tls certificate: %s", err)
+		}
+		wsTLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	wscfg := &wsserver.ServerConfig{
+		SecurityHandlers:   tcpSecHandlers,
+		WSSecurityHandlers: wsSecHandlers,
+		Encodings:          []common.IEncoding{&encodings.RawEncoding{}, &encodings.TightEncoding{}, &encodings.CopyRectEncoding{}},
+		PixelFormat:        common.NewPixelFormat(32),
+		ClientMessages:     wsserver.DefaultClientMessages,
+		DesktopName:        []byte("workDesk"),
+		Height:             uint16(768),
+		Width:              uint16(1024),
+		NewConnHandler:     vp.newwsServerConnHandler,
+		UseDummySession:    !vp.UsingSessions,
+		Authenticator:      vp.Authenticator,
+	}
+
+	//all listeners are opened before serving, so a bad address fails the start instead of a background goroutine
+	var openListeners []net.Listener
+	listen := func(addr string) (net.Listener, error) {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, opened := range openListeners {
+				opened.Close()
 			}
-			sconn.Listeners.AddListener(player.NewFBSPlayListener(sconn, fbs))
-			return nil
+			return nil, err
+		}
+		openListeners = append(openListeners, ln)
+		return ln, nil
+	}
+
+	var wsURL *url.URL
+	if vp.WsListeningURL != "" {
+		if wsURL, err = url.Parse(vp.WsListeningURL); err != nil {
+			return err
+		}
+	}
+
+	var longConnURL *url.URL
+	if vp.LongConnListeningURL != "" {
+		if longConnURL, err = url.Parse(vp.LongConnListeningURL); err != nil {
+			return err
+		}
+	}
+
+	var tcpListener, wsListener, apiListener, metricsListener, longConnListener net.Listener
+	if vp.TCPListeningURL != "" {
+		if tcpListener, err = listen(vp.TCPListeningURL); err != nil {
+			return err
+		}
+	}
+	if wsURL != nil {
+		if wsListener, err = listen(wsURL.Host); err != nil {
+			return err
+		}
+		if wsTLSConfig != nil {
+			wsListener = tls.NewListener(wsListener, wsTLSConfig)
+		}
+	}
+	if vp.APIListeningURL != "" {
+		if apiListener, err = listen(vp.APIListeningURL); err != nil {
+			return err
+		}
+	}
+	if vp.MetricsListeningURL != "" {
+		if metricsListener, err = listen(vp.MetricsListeningURL); err != nil {
+			return err
+		}
+	}
+	if longConnURL != nil {
+		if longConnListener, err = listen(longConnURL.Host); err != nil {
+			return err
+		}
+	}
+
+	vp.server = wsserver.NewServer(wscfg)
+	vp.done = make(chan struct{})
+	if vp.Screenshots {
+		vp.screens = NewSessionScreens()
+	}
+
+	if tcpListener != nil {
+		logger.Infof("running tcp listener on: %s", tcpListener.Addr())
+		go vp.serve("tcp", func() error { return vp.server.ServeTCP(tcpListener) })
+	}
+	if wsListener != nil {
+		logger.Infof("running ws listener on: %s", wsListener.Addr())
+		go vp.serve("ws", func() error { return vp.server.ServeWS(wsListener, wsURL.Path) })
+	}
+	if apiListener != nil {
+		logger.Infof("running session management api on: %s", apiListener.Addr())
+		vp.apiServer = vp.newAPIServer()
+		go vp.serve("api", func() error { return vp.apiServer.Serve(apiListener) })
+	}
+	if metricsListener != nil {
+		logger.Infof("running metrics on: %s", metricsListener.Addr())
+		vp.metricsServer = vp.newMetricsServer()
+		go vp.serve("metrics", func() error { return vp.metricsServer.Serve(metricsListener) })
+	}
+	if longConnListener != nil {
+		logger.Infof("running long connection ws listener on: %s", longConnListener.Addr())
+		vp.longConnServer = wsserver.NewLongConnServer(&wsserver.LongConnServerConfig{UseDummySession: !vp.UsingSessions})
+		handler, _ := vp.longConnServer.Handler(vp.LongConnListeningURL)
+		vp.longConnHTTPServer = &http.Server{Handler: handler}
+		go vp.serve("long connection", func() error { return vp.longConnHTTPServer.Serve(longConnListener) })
+	}
 
+	done := vp.done
+	go func() {
+		select {
+		case <-ctx.Done():
+			vp.Shutdown(context.Background())
+		case <-done:
 		}
-	*/
-	session.Status = SessionStatusActive
+	}()
+
+	if vp.RecordingDir != "" && (vp.RecordingMaxAge > 0 || vp.RecordingMaxBytes > 0) {
+		go vp.enforceRecordingRetention(done)
+	}
 	return nil
 }
 
-func (vp *VncProxy) StartListening() {
+// recordingRetentionInterval is how often the recording dir is checked against the retention limits
+var recordingRetentionInterval = time.Minute
+
+// enforceRecordingRetention deletes old recordings until done is closed, the files being recorded are kept
+func (vp *VncProxy) enforceRecordingRetention(done chan struct{}) {
+	retention := &RecordingRetention{
+		MaxAge:    vp.RecordingMaxAge,
+		MaxBytes:  vp.RecordingMaxBytes,
+		Extension: filepath.Ext(vp.recordingFileTemplate()),
+	}
 
-	wssecHandlers := []wsserver.SecurityHandler{&wsserver.ServerAuthNone{}}
+	ticker := time.NewTicker(recordingRetentionInterval)
+	defer ticker.Stop()
+	for {
+		inUse := make(map[string]bool)
+		vp.recordersMutex.Lock()
+		for rec := range vp.recorders {
+			inUse[rec.FileName()] = true
+		}
+		vp.recordersMutex.Unlock()
 
-	if vp.ProxyVncPassword != "" {
-		wssecHandlers = []wsserver.SecurityHandler{&wsserver.ServerAuthVNC{vp.ProxyVncPassword}}
+		if err := retention.Enforce(vp.RecordingDir, inUse, time.Now()); err != nil {
+			logger.Errorf("Proxy: enforcing the recording retention: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
 	}
+}
 
-	wscfg := &wsserver.ServerConfig{
-		SecurityHandlers: wssecHandlers,
-		Encodings:        []common.IEncoding{&encodings.RawEncoding{}, &encodings.TightEncoding{}, &encodings.CopyRectEncoding{}},
-		PixelFormat:      common.NewPixelFormat(32),
-		ClientMessages:   wsserver.DefaultClientMessages,
-		DesktopName:      []byte("workDesk"),
-		Height:           uint16(768),
-		Width:            uint16(1024),
-		NewConnHandler:   vp.newwsServerConnHandler,
-		UseDummySession:  !vp.UsingSessions,
+func (vp *VncProxy) serve(name string, serveFunc func() error) {
+	err := serveFunc()
+	if err != nil && err != wsserver.ErrServerClosed && err != http.ErrServerClosed {
+		logger.Errorf("Proxy: %s listener stopped: %s", name, err)
 	}
+}
 
-	{
-		longcfg := wsserver.LongConnServerConfig{UseDummySession: !vp.UsingSessions}
-		go wsserver.WsLongServer("http://0.0.0.0:5908/ws", &longcfg)
+// Shutdown stops the listeners, closes all vnc-client and vnc-server connections and flushes & closes the recordings.
+// It returns when everything is closed or ctx ends.
+func (vp *VncProxy) Shutdown(ctx context.Context) error {
+	vp.lifecycleMutex.Lock()
+	defer vp.lifecycleMutex.Unlock()
+	if vp.server == nil {
+		return nil
+	}
+	select {
+	case <-vp.done:
+		return nil
+	default:
+	}
 
+	var firstErr error
+	if vp.apiServer != nil {
+		firstErr = vp.apiServer.Shutdown(ctx)
+	}
+	if vp.metricsServer != nil {
+		if err := vp.metricsServer.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if vp.longConnHTTPServer != nil {
+		if err := vp.longConnHTTPServer.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		vp.longConnServer.CloseConns()
 	}
+	//closing the vnc-clients closes their vnc-server connections too
+	if err := vp.server.Shutdown(ctx); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	vp.recordersMutex.Lock()
+	recorders := vp.recorders
+	vp.recorders = nil
+	vp.recordersMutex.Unlock()
+	for rec := range recorders {
+		rec.Close()
+	}
+
+	close(vp.done)
+	return firstErr
+}
 
-	if vp.TCPListeningURL != "" && vp.WsListeningURL != "" {
-		logger.Infof("running two listeners: tcp port: %s, ws url: %s", vp.TCPListeningURL, vp.WsListeningURL)
+// Done is closed once the proxy is shut down, it is nil before Start
+func (vp *VncProxy) Done() <-chan struct{} {
+	vp.lifecycleMutex.Lock()
+	defer vp.lifecycleMutex.Unlock()
+	return vp.done
+}
 
-		go wsserver.WsServe(vp.WsListeningURL, wscfg)
-		//go server.WsServe(vp.WsListeningURL, cfg)
-		wsserver.TcpServe(vp.TCPListeningURL, wscfg)
+// securityHandlers lists the authentication types offered to tcp & websocket vnc-clients.
+// VeNCrypt comes first on tcp when tls is configured, it isn't offered on websockets which can't be upgraded to tls.
+func (vp *VncProxy) securityHandlers() (tcpHandlers, wsHandlers []wsserver.SecurityHandler, err error) {
+	var plainHandler wsserver.SecurityHandler = &wsserver.ServerAuthNone{}
+	var vncAuth *wsserver.ServerAuthVNC
+	if vp.Authenticator != nil {
+		vncAuth = &wsserver.ServerAuthVNC{Authenticator: vp.Authenticator}
+		plainHandler = vncAuth
+	} else if vp.ProxyViewOnlyPassword != "" && vp.ProxyVncPassword == "" {
+		return nil, nil, errors.New("a view-only password needs a full-control password too")
+	} else if vp.ProxyVncPassword != "" {
+		vncAuth = &wsserver.ServerAuthVNC{Pass: vp.ProxyVncPassword, ViewOnlyPass: vp.ProxyViewOnlyPassword}
+		plainHandler = vncAuth
 	}
 
-	if vp.WsListeningURL != "" {
-		logger.Infof("running ws listener url: %s", vp.WsListeningURL)
-		wsserver.WsServe(vp.WsListeningURL, wscfg)
-		//server.WsServe(vp.WsListeningURL, cfg)
+	wsHandlers = []wsserver.SecurityHandler{plainHandler}
+	if vp.TLSCertFile == "" {
+		if vp.TLSRequired {
+			return nil, nil, errors.New("tls is required but no certificate was configured")
+		}
+		return []wsserver.SecurityHandler{plainHandler}, wsHandlers, nil
 	}
-	if vp.TCPListeningURL != "" {
-		logger.Infof("running tcp listener on port: %s", vp.TCPListeningURL)
-		wsserver.TcpServe(vp.TCPListeningURL, wscfg)
+
+	subTypes := []wsserver.SecuritySubType{wsserver.SecSubTypeVeNCrypt02X509None, wsserver.SecSubTypeVeNCrypt02TLSNone}
+	if vp.Authenticator != nil {
+		subTypes = []wsserver.SecuritySubType{wsserver.SecSubTypeVeNCrypt02X509Plain, wsserver.SecSubTypeVeNCrypt02X509VNC,
+			wsserver.SecSubTypeVeNCrypt02TLSPlain, wsserver.SecSubTypeVeNCrypt02TLSVNC}
+	} else if vncAuth != nil {
+		subTypes = []wsserver.SecuritySubType{wsserver.SecSubTypeVeNCrypt02X509VNC, wsserver.SecSubTypeVeNCrypt02TLSVNC}
 	}
+	vencrypt, err := wsserver.NewServerAuthVeNCrypt(vp.TLSCertFile, vp.TLSKeyFile, subTypes...)
+	if err != nil {
+		return nil, nil, err
+	}
+	vencrypt.VNCAuth = vncAuth
+	vencrypt.Authenticator = vp.Authenticator
+
+	if vp.TLSRequired {
+		return []wsserver.SecurityHandler{vencrypt}, wsHandlers, nil
+	}
+	return []wsserver.SecurityHandler{vencrypt, plainHandler}, wsHandlers, nil
+}
+
+// newAPIServer serves the session management api on its own mux, so it doesn't collide with the ws listener
+func (vp *VncProxy) newAPIServer() *http.Server {
+	mux := http.NewServeMux()
+	api := NewSessionAPI(vp.SessionManager())
+	api.Screens = vp.screens
+	api.Token = vp.APIToken
+	api.ReplayDir = vp.RecordingDir
+	api.Register(mux)
+	return &http.Server{Handler: mux}
 }
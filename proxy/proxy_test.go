@@ -1,6 +1,19 @@
 package proxy
 
-import "testing"
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amitbet/vncproxy/internal/testutil"
+	"github.com/amitbet/vncproxy/wsserver"
+	"github.com/gorilla/websocket"
+)
 
 func TestProxy(t *testing.T) {
 	//create default session if required
@@ -25,3 +38,200 @@ func TestProxy(t *testing.T) {
 
 	proxy.StartListening()
 }
+
+func TestProxyStartShutdown(t *testing.T) {
+	proxy := &VncProxy{
+		TCPListeningURL: "127.0.0.1:0",
+		WsListeningURL:  "http://127.0.0.1:0/",
+		APIListeningURL: "127.0.0.1:0",
+		SingleSession:   &VncSession{ID: "dummySession", Target: "127.0.0.1:1", Type: SessionTypeProxyPass},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	if err := proxy.Start(ctx); err == nil {
+		t.Error("expected starting twice to fail")
+	}
+
+	//canceling the start context shuts the proxy down
+	cancel()
+	select {
+	case <-proxy.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy didn't shut down")
+	}
+	if err := proxy.Shutdown(context.Background()); err != nil {
+		t.Errorf("second Shutdown: %s", err)
+	}
+}
+
+func TestProxyLongConnServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	proxy := &VncProxy{
+		TCPListeningURL:      "127.0.0.1:0",
+		LongConnListeningURL: "http://" + addr + "/ws",
+		SingleSession:        &VncSession{ID: "dummySession", Target: "127.0.0.1:1", Type: SessionTypeProxyPass},
+	}
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil)
+	if err != nil {
+		proxy.Shutdown(context.Background())
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if _, _, err := ws.ReadMessage(); err != nil {
+		t.Errorf("expected a greeting from the long connection server: %s", err)
+	}
+
+	//shutting down closes the open long connections too
+	if err := proxy.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown: %s", err)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := ws.ReadMessage(); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("expected the long connection to be closed, got %v", err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("expected the long connection listener to be closed")
+	}
+}
+
+func TestProxyStartListenError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	proxy := &VncProxy{
+		TCPListeningURL: "127.0.0.1:0",
+		WsListeningURL:  "http://" + ln.Addr().String() + "/",
+		SingleSession:   &VncSession{ID: "dummySession", Target: "127.0.0.1:1", Type: SessionTypeProxyPass},
+	}
+	if err := proxy.Start(context.Background()); err == nil {
+		proxy.Shutdown(context.Background())
+		t.Fatal("expected Start to fail on a busy port")
+	}
+}
+
+func TestProxyViewOnlyPasswordAlone(t *testing.T) {
+	proxy := &VncProxy{
+		TCPListeningURL:       "127.0.0.1:0",
+		ProxyViewOnlyPassword: "justWatch",
+		SingleSession:         &VncSession{ID: "dummySession", Target: "127.0.0.1:1", Type: SessionTypeProxyPass},
+	}
+	if err := proxy.Start(context.Background()); err == nil {
+		proxy.Shutdown(context.Background())
+		t.Fatal("expected Start to refuse a view-only password without a full-control one")
+	}
+}
+
+func TestProxyMetrics(t *testing.T) {
+	proxy := &VncProxy{UsingSessions: true}
+	proxy.SessionManager().SetSession("desk1", &VncSession{ID: "desk1", Target: "127.0.0.1:1"})
+	proxy.SessionManager().SetSession("desk2", &VncSession{ID: "desk2", Target: "127.0.0.1:1"})
+	proxy.SessionManager().ClientConnected("desk1")
+	proxy.SessionManager().ClientConnected("desk1")
+
+	recorder := httptest.NewRecorder()
+	proxy.newMetricsServer().Handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		"vncproxy_sessions_active 1\n",
+		"vncproxy_session_viewers{session=\"desk1\"} 2\n",
+		"vncproxy_session_viewers{session=\"desk2\"} 0\n",
+		"vncproxy_recorder_queue_depth 0\n",
+		"# TYPE vncproxy_proxied_bytes_total counter\n",
+		"# TYPE vncproxy_handshake_failures_total counter\n",
+		"# TYPE vncproxy_recording_bytes_written_total counter\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("metrics are missing %q", expected)
+		}
+	}
+}
+
+func TestProxyWebsocketSecurityTypes(t *testing.T) {
+	certFile, keyFile := testutil.WriteSelfSignedCert(t, "vncproxy-test")
+	for _, tlsRequired := range []bool{false, true} {
+		wsAddr := freeAddr(t)
+		proxy := &VncProxy{
+			TCPListeningURL:  "127.0.0.1:0",
+			WsListeningURL:   "http://" + wsAddr + "/",
+			ProxyVncPassword: "1234",
+			TLSCertFile:      certFile,
+			TLSKeyFile:       keyFile,
+			TLSRequired:      tlsRequired,
+			SingleSession:    &VncSession{ID: "dummySession", Target: "127.0.0.1:1", Type: SessionTypeProxyPass},
+		}
+		if err := proxy.Start(context.Background()); err != nil {
+			t.Fatalf("Start (tlsRequired=%v): %s", tlsRequired, err)
+		}
+
+		//with tls required the websocket listener serves wss instead of VeNCrypt
+		dialer := &websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		wsURL := "ws://" + wsAddr + "/"
+		if tlsRequired {
+			wsURL = "wss://" + wsAddr + "/"
+		}
+		ws, _, err := dialer.Dial(wsURL, nil)
+		if err != nil {
+			proxy.Shutdown(context.Background())
+			t.Fatalf("dial %s: %s", wsURL, err)
+		}
+		reader := &wsReader{ws: ws}
+		version := make([]byte, 12)
+		if _, err := io.ReadFull(reader, version); err != nil || string(version) != "RFB 003.008\n" {
+			t.Fatalf("version: %q, %v", version, err)
+		}
+		ws.WriteMessage(websocket.BinaryMessage, version)
+
+		secTypes := make([]byte, 2)
+		if _, err := io.ReadFull(reader, secTypes); err != nil {
+			t.Fatalf("security types: %s", err)
+		}
+		if secTypes[0] != 1 || secTypes[1] != byte(wsserver.SecTypeVNC) {
+			t.Errorf("tlsRequired=%v: websocket security types are %v, expected only vnc auth", tlsRequired, secTypes)
+		}
+		ws.Close()
+		proxy.Shutdown(context.Background())
+	}
+}
+
+// wsReader reads the binary messages of a websocket as a stream
+type wsReader struct {
+	ws  *websocket.Conn
+	buf []byte
+}
+
+func (r *wsReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		_, msg, err := r.ws.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = msg
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
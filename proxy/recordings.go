@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/logger"
+)
+
+// DefaultRecordingFileTemplate keeps the original flat naming of recordings
+const DefaultRecordingFileTemplate = "recording{unix}.rbs"
+
+// DefaultCompressedRecordingFileTemplate is the default for compressed recordings
+const DefaultCompressedRecordingFileTemplate = "recording{unix}.vncr"
+
+// recordingFileName expands a recording file name template, relative to the recording dir.
+// The template may contain sub directories and these placeholders:
+//
+//	{session}  the session id
+//	{viewer}   the address of the vnc-client that started the recording
+//	{date}     the recording start date, 2006-01-02
+//	{time}     the recording start time, 150405
+//	{unix}     the recording start as unix seconds
+//	{segment}  the segment number, 000, 001.. (when missing, segments after the first get a -001.. suffix)
+func recordingFileName(template string, sessionId string, viewer string, start time.Time, segment int) string {
+	if template == "" {
+		template = DefaultRecordingFileTemplate
+	}
+	segmentStr := fmt.Sprintf("%03d", segment)
+	if segment > 0 && !strings.Contains(template, "{segment}") {
+		ext := filepath.Ext(template)
+		template = strings.TrimSuffix(template, ext) + "-{segment}" + ext
+	}
+
+	replacer := strings.NewReplacer(
+		"{session}", sanitizeFileNamePart(sessionId),
+		"{viewer}", sanitizeFileNamePart(viewer),
+		"{date}", start.Format("2006-01-02"),
+		"{time}", start.Format("150405"),
+		"{unix}", strconv.FormatInt(start.Unix(), 10),
+		"{segment}", segmentStr,
+	)
+	return filepath.FromSlash(replacer.Replace(template))
+}
+
+// sanitizeFileNamePart keeps ids & addresses from escaping the recording dir or breaking file names
+func sanitizeFileNamePart(part string) string {
+	if part == "" {
+		return "unknown"
+	}
+	sanitized := strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			return '_'
+		}
+		return r
+	}, part)
+	if sanitized == "." || sanitized == ".." {
+		return "_"
+	}
+	return sanitized
+}
+
+// RecordingRetention limits the recordings kept in a directory, the oldest files are removed first
+type RecordingRetention struct {
+	MaxAge   time.Duration // 0 = no age limit
+	MaxBytes int64         // 0 = no size limit
+	// only files with this extension are considered recordings
+	Extension string
+}
+
+type recordingFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Enforce removes the recordings of dir that are too old, then the oldest ones until the total size fits.
+// Files in inUse (being recorded) are never removed, but count towards the total size.
+func (rr *RecordingRetention) Enforce(dir string, inUse map[string]bool, now time.Time) error {
+	if rr.MaxAge <= 0 && rr.MaxBytes <= 0 {
+		return nil
+	}
+
+	var files []recordingFile
+	var total int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || filepath.Ext(path) != rr.Extension {
+			return nil
+		}
+		total += info.Size()
+		files = append(files, recordingFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	emptied := make(map[string]bool)
+	for _, file := range files {
+		tooOld := rr.MaxAge > 0 && now.Sub(file.modTime) > rr.MaxAge
+		tooBig := rr.MaxBytes > 0 && total > rr.MaxBytes
+		if !tooOld && !tooBig {
+			continue
+		}
+		if inUse[file.path] {
+			continue
+		}
+		if err := os.Remove(file.path); err != nil {
+			logger.Errorf("RecordingRetention: can't remove %s: %s", file.path, err)
+			continue
+		}
+		logger.Infof("RecordingRetention: removed %s", file.path)
+		os.Remove(common.RecordingIndexFileName(file.path))
+		os.Remove(common.RecordingAuditFileName(file.path))
+		total -= file.size
+		emptied[filepath.Dir(file.path)] = true
+	}
+
+	//remove the sub directories (of templates like {session}/{date}/...) left empty, os.Remove fails on non-empty ones
+	for d := range emptied {
+		for d != dir && strings.HasPrefix(d, dir) && os.Remove(d) == nil {
+			d = filepath.Dir(d)
+		}
+	}
+	return nil
+}
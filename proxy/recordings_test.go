@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/logger"
+	"github.com/amitbet/vncproxy/player"
+	"github.com/amitbet/vncproxy/wsserver"
+)
+
+func TestRecordingFileName(t *testing.T) {
+	start := time.Date(2024, 3, 5, 14, 30, 15, 0, time.Local)
+	unix := strconv.FormatInt(start.Unix(), 10)
+	tests := []struct {
+		template string
+		segment  int
+		expected string
+	}{
+		{"", 0, "recording" + unix + ".rbs"},
+		{"", 2, "recording" + unix + "-002.rbs"},
+		{"{session}/{date}/{time}-{viewer}.rbs", 0, "desk1/2024-03-05/143015-10.0.0.5_5555.rbs"},
+		{"{session}-{segment}.rbs", 1, "desk1-001.rbs"},
+	}
+	for _, test := range tests {
+		name := recordingFileName(test.template, "desk1", "10.0.0.5:5555", start, test.segment)
+		if name != filepath.FromSlash(test.expected) {
+			t.Errorf("template %q segment %d: expected %s, got %s", test.template, test.segment, test.expected, name)
+		}
+	}
+
+	//ids can't escape the recording dir
+	if name := recordingFileName("{session}.rbs", "../../etc/passwd", "", start, 0); name != ".._.._etc_passwd.rbs" {
+		t.Errorf("session id wasn't sanitized: %s", name)
+	}
+}
+
+func TestRecordingRetention(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writeFile := func(name string, size int, age time.Duration) string {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	expired := writeFile("old/expired.rbs", 10, 48*time.Hour)
+	oldest := writeFile("a.rbs", 100, 3*time.Hour)
+	recording := writeFile("b.rbs", 100, 2*time.Hour)
+	newest := writeFile("c.rbs", 100, time.Hour)
+	other := writeFile("notes.txt", 1000, 72*time.Hour)
+
+	retention := &RecordingRetention{MaxAge: 24 * time.Hour, MaxBytes: 150, Extension: ".rbs"}
+	if err := retention.Enforce(dir, map[string]bool{recording: true}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, kept := range map[string]bool{expired: false, oldest: false, recording: true, newest: false, other: true} {
+		_, err := os.Stat(path)
+		if exists := err == nil; exists != kept {
+			t.Errorf("%s: expected kept=%v", path, kept)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old")); !os.IsNotExist(err) {
+		t.Error("expected the emptied directory to be removed")
+	}
+}
+
+func TestRecordingKeyframesWithTightRequested(t *testing.T) {
+	server := newFakeVncServer(t, 4, 2)
+	defer server.listener.Close()
+	dir := t.TempDir()
+	vp := &VncProxy{RecordingDir: dir, RecordingKeyframes: 20 * time.Millisecond}
+	session := &VncSession{ID: "desk1", Type: SessionTypeRecordingProxy, Target: server.listener.Addr().String()}
+	viewer, _ := wsserver.NewServerConnIO(&bytes.Buffer{}, &wsserver.ServerConfig{ClientMessages: wsserver.DefaultClientMessages})
+
+	//wired like a recordingProxy session
+	link := newUpstreamLink(vp, session, logger.With())
+	rec, err := vp.createRecorder(session, viewer, link, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer.Listeners().AddListener(rec)
+	link.listeners.AddListener(rec)
+	counter := &updateCounter{}
+	link.listeners.AddListener(counter)
+	updater := &ClientUpdater{NoZlibStreams: vp.avoidZlibStreams(session)}
+	viewer.Listeners().AddListener(updater)
+	cconn, err := link.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cconn.Close()
+	updater.setUpstream(cconn)
+
+	//the vnc-client prefers Tight & ZRLE, like noVNC or TigerVNC, the vnc-server gets Raw only
+	setEncodings := &wsserver.MsgSetEncodings{Encodings: []common.EncodingType{common.EncTight, common.EncZRLE, common.EncRaw}}
+	viewer.Listeners().Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedClientMessage, Message: setEncodings})
+	upstream := server.waitFor(t, 0, func(conn *fakeVncConn) bool { return conn.received.Len() >= 8 })
+	server.mutex.Lock()
+	received := append([]byte{}, upstream.received.Bytes()[:8]...)
+	server.mutex.Unlock()
+	if want := []byte{byte(common.SetEncodingsMsgType), 0, 0, 1, 0, 0, 0, 0}; !bytes.Equal(received, want) {
+		t.Fatalf("the vnc-server was asked for %v, want Raw only %v", received, want)
+	}
+
+	//the vnc-server answers with full screen updates, each one a keyframe
+	const updates = 5
+	for i := 0; i < updates; i++ {
+		time.Sleep(30 * time.Millisecond)
+		update := &bytes.Buffer{}
+		update.Write([]byte{byte(common.FramebufferUpdate), 0, 0, 1})
+		binary.Write(update, binary.BigEndian, []uint16{0, 0, 4, 2})
+		binary.Write(update, binary.BigEndian, int32(common.EncRaw))
+		update.Write(bytes.Repeat([]byte{byte(i), 0, 0, 0}, 8))
+		upstream.Write(update.Bytes())
+	}
+	waitUntil(t, "the updates to be recorded", func() bool { return atomic.LoadInt32(&counter.updates) == updates })
+	rec.Close()
+
+	recordings, _ := filepath.Glob(filepath.Join(dir, "*.rbs"))
+	if len(recordings) != 1 {
+		t.Fatalf("expected a single recording, got %v", recordings)
+	}
+	entries, err := common.ReadRecordingIndex(recordings[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) < 3 {
+		t.Fatalf("expected a keyframe for most updates, got %+v", entries)
+	}
+
+	reader, err := player.OpenRecording(recordings[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.(io.Closer).Close()
+	if _, err := reader.ReadStartSession(); err != nil {
+		t.Fatal(err)
+	}
+	middle := entries[len(entries)/2]
+	if err := reader.(player.SeekableStreamFileReader).SeekTo(middle.Time()); err != nil {
+		t.Fatalf("seeking to the middle keyframe %+v: %s", middle, err)
+	}
+	msg := make([]byte, 17)
+	if _, err := io.ReadFull(reader, msg); err != nil || msg[0] != byte(common.FramebufferUpdate) || msg[16] == 0 {
+		t.Errorf("seeking to the middle keyframe didn't start at a later full screen update: %v (%v)", msg, err)
+	}
+}
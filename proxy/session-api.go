@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"image/png"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/amitbet/vncproxy/decoder"
+	"github.com/amitbet/vncproxy/logger"
+)
+
+const sessionsPath = "/sessions"
+
+// SessionAPI exposes the SessionManager as a small http/json control interface:
+//
+//	GET    /sessions       list all sessions
+//	POST   /sessions       create a session (id is taken from the body)
+//	GET    /sessions/{id}  get a single session
+//	PUT    /sessions/{id}  create or update a session
+//	DELETE /sessions/{id}  remove a session
+//	GET    /sessions/{id}/screenshot.png  the current screen, when Screens is set
+//	       (?cursor=true draws the cursor, ?maxWidth= & ?maxHeight= shrink it to a thumbnail)
+//
+// Target passwords are accepted but never returned. Replay files are taken from ReplayDir & CA files can't be set,
+// so api clients can't make the proxy read other files.
+type SessionAPI struct {
+	Sessions  *SessionManager
+	Screens   *SessionScreens // decoded screens of the active sessions, nil = no screenshots
+	Token     string          // required on every request as "Authorization: Bearer <token>", empty = no authentication
+	ReplayDir string          // replayFilePath is relative to this dir (the proxy's recording dir), empty = no replay sessions
+}
+
+func NewSessionAPI(sessions *SessionManager) *SessionAPI {
+	return &SessionAPI{Sessions: sessions}
+}
+
+// Register adds the api routes to the given mux
+func (api *SessionAPI) Register(mux *http.ServeMux) {
+	mux.Handle(sessionsPath, api)
+	mux.Handle(sessionsPath+"/", api)
+}
+
+func (api *SessionAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !api.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("missing or invalid api token"))
+		return
+	}
+
+	sessionId := strings.Trim(strings.TrimPrefix(r.URL.Path, sessionsPath), "/")
+	if sessionId == "" {
+		switch r.Method {
+		case http.MethodGet:
+			api.listSessions(w)
+		case http.MethodPost:
+			api.createSession(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+		return
+	}
+
+	if strings.Contains(sessionId, "/") {
+		if sessionId, resource, _ := strings.Cut(sessionId, "/"); resource == "screenshot.png" && api.Screens != nil {
+			if r.Method != http.MethodGet {
+				writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+				return
+			}
+			api.getScreenshot(w, r, sessionId)
+			return
+		}
+		writeError(w, http.StatusNotFound, ErrSessionNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		api.getSession(w, sessionId)
+	case http.MethodPut:
+		api.putSession(w, r, sessionId)
+	case http.MethodDelete:
+		api.deleteSession(w, sessionId)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// authorized checks the request's bearer token, in constant time so it can't be guessed byte by byte
+func (api *SessionAPI) authorized(r *http.Request) bool {
+	if api.Token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(api.Token)) == 1
+}
+
+func (api *SessionAPI) listSessions(w http.ResponseWriter) {
+	sessions := api.Sessions.ListSessions()
+	for _, session := range sessions {
+		session.TargetPassword = ""
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (api *SessionAPI) getSession(w http.ResponseWriter, sessionId string) {
+	session, err := api.Sessions.GetSession(sessionId)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	session.TargetPassword = ""
+	writeJSON(w, http.StatusOK, session)
+}
+
+func (api *SessionAPI) getScreenshot(w http.ResponseWriter, r *http.Request, sessionId string) {
+	if _, err := api.Sessions.GetSession(sessionId); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	query := r.URL.Query()
+	var maxSize [2]int
+	for i, param := range []string{"maxWidth", "maxHeight"} {
+		if value := query.Get(param); value != "" {
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 0 {
+				writeError(w, http.StatusBadRequest, errors.New("bad "+param))
+				return
+			}
+			maxSize[i] = size
+		}
+	}
+
+	img, err := api.Screens.Screenshot(sessionId, query.Get("cursor") == "true")
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	img = decoder.Thumbnail(img, maxSize[0], maxSize[1])
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := encoder.Encode(w, img); err != nil {
+		logger.Errorf("SessionAPI: error writing screenshot: %s", err)
+	}
+}
+
+func (api *SessionAPI) createSession(w http.ResponseWriter, r *http.Request) {
+	session, err := api.readSession(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if session.ID == "" {
+		writeError(w, http.StatusBadRequest, errors.New("session id is required"))
+		return
+	}
+
+	if err := api.Sessions.CreateSession(session); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	logger.Infof("SessionAPI: created session %s", session.ID)
+	api.getSessionWithStatus(w, session.ID, http.StatusCreated)
+}
+
+func (api *SessionAPI) putSession(w http.ResponseWriter, r *http.Request, sessionId string) {
+	session, err := api.readSession(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if session.ID != "" && session.ID != sessionId {
+		writeError(w, http.StatusBadRequest, errors.New("session id in body does not match the url"))
+		return
+	}
+
+	api.Sessions.SetSession(sessionId, session)
+	logger.Infof("SessionAPI: updated session %s", sessionId)
+	api.getSessionWithStatus(w, sessionId, http.StatusOK)
+}
+
+func (api *SessionAPI) deleteSession(w http.ResponseWriter, sessionId string) {
+	if err := api.Sessions.DeleteSession(sessionId); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	logger.Infof("SessionAPI: deleted session %s", sessionId)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *SessionAPI) getSessionWithStatus(w http.ResponseWriter, sessionId string, status int) {
+	session, err := api.Sessions.GetSession(sessionId)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	session.TargetPassword = ""
+	writeJSON(w, status, session)
+}
+
+// readSession parses a session definition from the request body, runtime fields are ignored
+func (api *SessionAPI) readSession(r *http.Request) (*VncSession, error) {
+	session := &VncSession{}
+	if err := json.NewDecoder(r.Body).Decode(session); err != nil {
+		return nil, err
+	}
+	if session.TargetCAFile != "" {
+		return nil, errors.New("targetCAFile can't be set through the api, api sessions are verified against the system roots")
+	}
+
+	switch session.Type {
+	case SessionTypeReplayServer:
+		if session.ReplayFilePath == "" {
+			return nil, errors.New("replay sessions require a replayFilePath")
+		}
+		if api.ReplayDir == "" {
+			return nil, errors.New("replay sessions need the proxy's recording dir")
+		}
+		//the file name is kept relative, the proxy joins it with the recording dir
+		if !filepath.IsLocal(session.ReplayFilePath) {
+			return nil, errors.New("replayFilePath must be a relative path inside the recording dir")
+		}
+		session.ReplayFilePath = filepath.Clean(session.ReplayFilePath)
+	default:
+		if session.Target == "" && (session.TargetHostname == "" || session.TargetPort == "") {
+			return nil, errors.New("proxy sessions require a target or targetHostname & targetPort")
+		}
+	}
+
+	return &VncSession{
+		ID:                  session.ID,
+		Target:              session.Target,
+		TargetHostname:      session.TargetHostname,
+		TargetPort:          session.TargetPort,
+		TargetPassword:      session.TargetPassword,
+		TargetTLS:           session.TargetTLS,
+		TargetUsername:      session.TargetUsername,
+		Type:                session.Type,
+		ReplayFilePath:      session.ReplayFilePath,
+		Shared:              session.Shared,
+		TargetTLSSkipVerify: session.TargetTLSSkipVerify,
+		ViewOnly:            session.ViewOnly,
+		Status:              SessionStatusInit,
+	}, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.Errorf("SessionAPI: error writing response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
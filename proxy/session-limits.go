@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/logger"
+)
+
+// DefaultTimeoutWarning is how long before an idle or too long session is disconnected the vnc-client is warned
+const DefaultTimeoutWarning = time.Minute
+
+// messageGate is locked while a server message is passed on to the vnc-clients,
+// so messages made by the proxy are only written to them between the vnc-server's messages
+type messageGate struct {
+	mutex     sync.Mutex
+	inMessage bool
+}
+
+func (g *messageGate) Consume(seg *common.RfbSegment) error {
+	switch seg.SegmentType {
+	case common.SegmentMessageStart:
+		g.mutex.Lock()
+		g.inMessage = true
+	case common.SegmentMessageEnd, common.SegmentConnectionClosed:
+		if g.inMessage {
+			g.inMessage = false
+			g.mutex.Unlock()
+		}
+	}
+	return nil
+}
+
+// sessionLimiter disconnects a vnc-client after idleTimeout without keyboard or mouse input, or after maxDuration.
+// The vnc-client is warned with a clipboard (ServerCutText) message warning before it is disconnected.
+type sessionLimiter struct {
+	conn        common.IServerConn
+	gate        *messageGate
+	log         *logger.FieldLogger
+	idleTimeout time.Duration // 0 = no idle timeout
+	maxDuration time.Duration // 0 = no maximum duration
+	warning     time.Duration
+	start       time.Time
+
+	mutex     sync.Mutex
+	lastInput time.Time
+	//the vnc-client sent a message, so it finished its init and messages may be written to it
+	ready bool
+	done  chan struct{}
+	once  sync.Once
+}
+
+// limitSession starts enforcing the proxy's idle timeout & maximum session duration on the vnc-client,
+// gate is the one of the vnc-server connection writing to it
+func (vp *VncProxy) limitSession(conn common.IServerConn, gate *messageGate) {
+	if vp.IdleTimeout <= 0 && vp.MaxSessionDuration <= 0 {
+		return
+	}
+	now := time.Now()
+	limiter := &sessionLimiter{
+		conn:        conn,
+		gate:        gate,
+		log:         conn.Logger(),
+		idleTimeout: vp.IdleTimeout,
+		maxDuration: vp.MaxSessionDuration,
+		warning:     durationOr(vp.TimeoutWarning, DefaultTimeoutWarning),
+		start:       now,
+		lastInput:   now,
+		done:        make(chan struct{}),
+	}
+	conn.Listeners().AddListener(limiter)
+	go limiter.run()
+}
+
+// Consume follows the vnc-client's input, the limiter stops when it leaves
+func (l *sessionLimiter) Consume(seg *common.RfbSegment) error {
+	switch seg.SegmentType {
+	case common.SegmentFullyParsedClientMessage:
+		msgType := seg.Message.(common.ClientMessage).Type()
+		l.mutex.Lock()
+		l.ready = true
+		switch msgType {
+		case common.KeyEventMsgType, common.QEMUExtendedKeyEventMsgType, common.PointerEventMsgType:
+			l.lastInput = time.Now()
+		}
+		l.mutex.Unlock()
+	case common.SegmentConnectionClosed:
+		l.once.Do(func() { close(l.done) })
+	}
+	return nil
+}
+
+// deadline returns when the vnc-client is disconnected and whether that is for being idle
+func (l *sessionLimiter) deadline() (time.Time, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var at time.Time
+	idle := false
+	if l.maxDuration > 0 {
+		at = l.start.Add(l.maxDuration)
+	}
+	if l.idleTimeout > 0 {
+		idleAt := l.lastInput.Add(l.idleTimeout)
+		if at.IsZero() || idleAt.Before(at) {
+			at = idleAt
+			idle = true
+		}
+	}
+	return at, idle
+}
+
+func (l *sessionLimiter) run() {
+	//the deadline the vnc-client was last warned about, input moves the idle deadline and needs a new warning
+	var warned time.Time
+	for {
+		at, idle := l.deadline()
+		now := time.Now()
+		if !now.Before(at) {
+			if idle {
+				l.log.Warnf("Proxy: disconnecting the vnc-client, no keyboard or mouse input for %s", l.idleTimeout)
+			} else {
+				l.log.Warnf("Proxy: disconnecting the vnc-client, the session reached its maximum duration of %s", l.maxDuration)
+			}
+			l.conn.Close()
+			return
+		}
+
+		wait := at.Sub(now)
+		if warnAt := at.Add(-l.warning); now.Before(warnAt) {
+			wait = warnAt.Sub(now)
+		} else if !warned.Equal(at) {
+			warned = at
+			l.warn(at.Sub(now), idle)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-l.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// warn tells the vnc-client it is about to be disconnected, through its clipboard
+func (l *sessionLimiter) warn(left time.Duration, idle bool) {
+	l.mutex.Lock()
+	ready := l.ready
+	l.mutex.Unlock()
+	if !ready {
+		return
+	}
+
+	left = left.Round(time.Second)
+	text := fmt.Sprintf("This session will be disconnected in %s, it reached the maximum duration of %s.", left, l.maxDuration)
+	if idle {
+		text = fmt.Sprintf("This session will be disconnected in %s because of inactivity, press a key or move the mouse to stay connected.", left)
+	}
+	l.log.Infof("Proxy: warning the vnc-client: %s", text)
+
+	l.gate.mutex.Lock()
+	defer l.gate.mutex.Unlock()
+	if _, err := l.conn.Write(serverCutText(text)); err != nil {
+		l.log.Errorf("Proxy: error writing the disconnect warning to the vnc-client: %s", err)
+	}
+}
+
+// serverCutText makes a ServerCutText message, the text is expected to be latin-1
+func serverCutText(text string) []byte {
+	msg := &bytes.Buffer{}
+	//message type & padding
+	msg.Write([]byte{byte(common.ServerCutText), 0, 0, 0})
+	binary.Write(msg, binary.BigEndian, uint32(len(text)))
+	msg.WriteString(text)
+	return msg.Bytes()
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/wsserver"
+)
+
+// closingConn is a vnc-client connection that remembers being closed
+type closingConn struct {
+	syncBufferConn
+	closeMutex sync.Mutex
+	closed     bool
+}
+
+func (c *closingConn) Close() error {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *closingConn) isClosed() bool {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+	return c.closed
+}
+
+func waitUntil(t *testing.T, what string, done func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if done() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestSessionLimiterIdleTimeout(t *testing.T) {
+	viewerConn := &closingConn{}
+	viewer, err := wsserver.NewServerConnIO(viewerConn, &wsserver.ServerConfig{ClientMessages: wsserver.DefaultClientMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate := &messageGate{}
+	vp := &VncProxy{IdleTimeout: 300 * time.Millisecond, TimeoutWarning: 200 * time.Millisecond}
+	start := time.Now()
+	vp.limitSession(viewer, gate)
+	viewer.Listeners().Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedClientMessage, Message: &wsserver.MsgFramebufferUpdateRequest{}})
+
+	//the warning isn't written in the middle of a server message
+	gate.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageStart})
+	time.Sleep(200 * time.Millisecond)
+	if len(viewerConn.Bytes()) != 0 {
+		t.Fatalf("the warning was written in the middle of a server message: %v", viewerConn.Bytes())
+	}
+	gate.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageEnd})
+	waitUntil(t, "the idle warning", func() bool { return len(viewerConn.Bytes()) > 0 })
+
+	written := viewerConn.Bytes()
+	if written[0] != byte(common.ServerCutText) || !bytes.Contains(written, []byte("because of inactivity")) {
+		t.Errorf("expected a ServerCutText idle warning, got %q", written)
+	}
+	if viewerConn.isClosed() {
+		t.Errorf("the vnc-client was disconnected at the warning")
+	}
+
+	waitUntil(t, "the idle disconnect", viewerConn.isClosed)
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("the vnc-client was disconnected after %s, before the idle timeout", elapsed)
+	}
+}
+
+func TestSessionLimiterDeadline(t *testing.T) {
+	start := time.Now()
+	limiter := &sessionLimiter{idleTimeout: time.Minute, maxDuration: time.Hour, start: start, lastInput: start}
+	if at, idle := limiter.deadline(); !idle || !at.Equal(start.Add(time.Minute)) {
+		t.Errorf("expected the idle timeout first, got %s idle=%v", at.Sub(start), idle)
+	}
+
+	//input keeps the session going until the maximum duration
+	limiter.lastInput = start.Add(time.Hour - time.Second)
+	if at, idle := limiter.deadline(); idle || !at.Equal(start.Add(time.Hour)) {
+		t.Errorf("expected the maximum duration, got %s idle=%v", at.Sub(start), idle)
+	}
+
+	viewerConn := &bufferConn{}
+	viewer, _ := wsserver.NewServerConnIO(viewerConn, &wsserver.ServerConfig{ClientMessages: wsserver.DefaultClientMessages})
+	limiter.conn = viewer
+	limiter.lastInput = start.Add(-time.Hour)
+	limiter.Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedClientMessage, Message: &wsserver.MsgPointerEvent{X: 1, Y: 1}})
+	if limiter.lastInput.Before(start) || !limiter.ready {
+		t.Errorf("a pointer event didn't count as input")
+	}
+}
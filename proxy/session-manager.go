@@ -1,19 +1,132 @@
 package proxy
 
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionExists   = errors.New("session already exists")
+)
+
+// SessionManager is a concurrency safe registry of the vnc sessions the proxy can route to.
+// Sessions handed out by the manager are copies, runtime changes should go through the manager methods.
 type SessionManager struct {
+	mutex    sync.RWMutex
 	sessions map[string]*VncSession
 }
 
+func NewSessionManager() *SessionManager {
+	return &SessionManager{sessions: make(map[string]*VncSession)}
+}
+
 func (s *SessionManager) GetSession(sessionId string) (*VncSession, error) {
-	return s.sessions[sessionId], nil
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	session, ok := s.sessions[sessionId]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	sessionCopy := *session
+	return &sessionCopy, nil
+}
+
+// ListSessions returns a copy of all registered sessions, ordered by id
+func (s *SessionManager) ListSessions() []*VncSession {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	list := make([]*VncSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessionCopy := *session
+		list = append(list, &sessionCopy)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// CreateSession registers a new session, failing if the id is already taken
+func (s *SessionManager) CreateSession(session *VncSession) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.sessions[session.ID]; ok {
+		return ErrSessionExists
+	}
+	now := time.Now()
+	session.CreatedAt = now
+	session.UpdatedAt = now
+	s.sessions[session.ID] = session
+	return nil
 }
 
+// SetSession creates or replaces the session stored under sessionId,
+// runtime information (status, timestamps, connected clients) of an existing session is kept.
 func (s *SessionManager) SetSession(sessionId string, session *VncSession) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	session.ID = sessionId
+	session.UpdatedAt = now
+	if existing, ok := s.sessions[sessionId]; ok {
+		session.Status = existing.Status
+		session.CreatedAt = existing.CreatedAt
+		session.LastConnectedAt = existing.LastConnectedAt
+		session.ConnectedClients = existing.ConnectedClients
+	} else {
+		session.CreatedAt = now
+	}
 	s.sessions[sessionId] = session
 	return nil
 }
 
 func (s *SessionManager) DeleteSession(sessionId string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.sessions[sessionId]; !ok {
+		return ErrSessionNotFound
+	}
 	delete(s.sessions, sessionId)
 	return nil
 }
+
+func (s *SessionManager) SetStatus(sessionId string, status SessionStatus) error {
+	return s.update(sessionId, func(session *VncSession) {
+		session.Status = status
+	})
+}
+
+// ClientConnected marks a new vnc-client as attached to the session
+func (s *SessionManager) ClientConnected(sessionId string) error {
+	return s.update(sessionId, func(session *VncSession) {
+		session.ConnectedClients++
+		session.LastConnectedAt = time.Now()
+	})
+}
+
+// ClientDisconnected releases a vnc-client previously counted by ClientConnected
+func (s *SessionManager) ClientDisconnected(sessionId string) error {
+	return s.update(sessionId, func(session *VncSession) {
+		if session.ConnectedClients > 0 {
+			session.ConnectedClients--
+		}
+	})
+}
+
+func (s *SessionManager) update(sessionId string, updateFunc func(*VncSession)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	session, ok := s.sessions[sessionId]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	updateFunc(session)
+	return nil
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSessionManagerConcurrentAccess(t *testing.T) {
+	sessions := NewSessionManager()
+	sessions.SetSession("s1", &VncSession{Target: "localhost:5901"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sessions.ClientConnected("s1")
+			sessions.ListSessions()
+			sessions.ClientDisconnected("s1")
+		}()
+	}
+	wg.Wait()
+
+	session, err := sessions.GetSession("s1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if session.ConnectedClients != 0 {
+		t.Errorf("ConnectedClients = %d, want 0", session.ConnectedClients)
+	}
+	if session.LastConnectedAt.IsZero() {
+		t.Error("LastConnectedAt was not set")
+	}
+}
+
+func TestSessionManagerUpdateKeepsRuntimeInfo(t *testing.T) {
+	sessions := NewSessionManager()
+	if err := sessions.CreateSession(&VncSession{ID: "s1", Target: "localhost:5901"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := sessions.CreateSession(&VncSession{ID: "s1"}); err != ErrSessionExists {
+		t.Fatalf("CreateSession on existing id returned %v, want ErrSessionExists", err)
+	}
+
+	sessions.ClientConnected("s1")
+	sessions.SetStatus("s1", SessionStatusActive)
+	sessions.SetSession("s1", &VncSession{Target: "localhost:5902"})
+
+	session, _ := sessions.GetSession("s1")
+	if session.Target != "localhost:5902" || session.ConnectedClients != 1 || session.Status != SessionStatusActive {
+		t.Errorf("unexpected session after update: %+v", session)
+	}
+
+	if err := sessions.DeleteSession("s1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := sessions.GetSession("s1"); err != ErrSessionNotFound {
+		t.Errorf("GetSession after delete returned %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestSessionAPI(t *testing.T) {
+	mux := http.NewServeMux()
+	NewSessionAPI(NewSessionManager()).Register(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	do := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, bytes.NewBufferString(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %s", method, path, err)
+		}
+		return resp
+	}
+
+	resp := do("POST", "/sessions", `{"id":"desk1","target":"10.0.0.1:5900","targetPassword":"secret","type":"recordingProxy"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create returned %d", resp.StatusCode)
+	}
+	var created VncSession
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if created.TargetPassword != "" {
+		t.Error("target password was returned by the api")
+	}
+	if created.Type != SessionTypeRecordingProxy {
+		t.Errorf("type = %s, want recordingProxy", created.Type)
+	}
+
+	if resp := do("POST", "/sessions", `{"id":"desk1","target":"10.0.0.1:5900"}`); resp.StatusCode != http.StatusConflict {
+		t.Errorf("duplicate create returned %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+	if resp := do("PUT", "/sessions/desk2", `{"type":"proxyPass"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("put without target returned %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if resp := do("PUT", "/sessions/desk2", `{"targetHostname":"10.0.0.2","targetPort":"5901"}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("put returned %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	resp = do("GET", "/sessions", "")
+	var list []VncSession
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 2 || list[0].ID != "desk1" || list[1].ID != "desk2" {
+		t.Errorf("unexpected session list: %+v", list)
+	}
+
+	if resp := do("DELETE", "/sessions/desk1", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("delete returned %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if resp := do("GET", "/sessions/desk1", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("get deleted session returned %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestSessionAPIToken(t *testing.T) {
+	api := NewSessionAPI(NewSessionManager())
+	api.Token = "s3cret"
+	api.Screens = NewSessionScreens()
+
+	for _, path := range []string{"/sessions", "/sessions/desk1", "/sessions/desk1/screenshot.png"} {
+		for _, auth := range []string{"", "Bearer wrong", "s3cret"} {
+			req := httptest.NewRequest("GET", path, nil)
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			recorder := httptest.NewRecorder()
+			api.ServeHTTP(recorder, req)
+			if recorder.Code != http.StatusUnauthorized || recorder.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("GET %s with %q returned %d, want 401", path, auth, recorder.Code)
+			}
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/sessions", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("GET /sessions with the token returned %d", recorder.Code)
+	}
+}
+
+func TestSessionAPIRejectsFiles(t *testing.T) {
+	api := NewSessionAPI(NewSessionManager())
+	api.ReplayDir = t.TempDir()
+
+	put := func(body string) int {
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, httptest.NewRequest("PUT", "/sessions/desk1", bytes.NewBufferString(body)))
+		return recorder.Code
+	}
+	for _, path := range []string{"/etc/passwd", "../secret.rbs", "sub/../../secret.rbs", ""} {
+		if code := put(`{"type":"replayServer","replayFilePath":"` + path + `"}`); code != http.StatusBadRequest {
+			t.Errorf("replayFilePath %q returned %d, want %d", path, code, http.StatusBadRequest)
+		}
+	}
+	if code := put(`{"target":"10.0.0.1:5900","targetTLS":true,"targetCAFile":"/etc/shadow"}`); code != http.StatusBadRequest {
+		t.Errorf("targetCAFile returned %d, want %d", code, http.StatusBadRequest)
+	}
+
+	if code := put(`{"type":"replayServer","replayFilePath":"desk1/./rec.rbs"}`); code != http.StatusOK {
+		t.Fatalf("a replay file inside the recording dir returned %d", code)
+	}
+	session, _ := api.Sessions.GetSession("desk1")
+	if session.ReplayFilePath != filepath.Join("desk1", "rec.rbs") {
+		t.Errorf("replayFilePath = %q", session.ReplayFilePath)
+	}
+
+	//without a recording dir there are no replay sessions
+	api.ReplayDir = ""
+	if code := put(`{"type":"replayServer","replayFilePath":"rec.rbs"}`); code != http.StatusBadRequest {
+		t.Errorf("a replay session without a recording dir returned %d, want %d", code, http.StatusBadRequest)
+	}
+}
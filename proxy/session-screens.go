@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"errors"
+	"image"
+	"sync"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/decoder"
+)
+
+var ErrNoScreen = errors.New("session has no active screen")
+
+// SessionScreens keeps a decoded copy of the screen of every proxied vnc-server connection, for screenshots
+// of active sessions. A session with several exclusive connections shows the latest one.
+type SessionScreens struct {
+	mutex   sync.Mutex
+	screens map[string][]*decoder.Listener
+}
+
+func NewSessionScreens() *SessionScreens {
+	return &SessionScreens{screens: make(map[string][]*decoder.Listener)}
+}
+
+// Attach starts decoding a vnc-server connection: serverListeners are the vnc-server connection's listeners and
+// clientListeners get the messages sent to it (for pixel format changes & the pointer position).
+// The screen is dropped when the vnc-server connection closes.
+func (s *SessionScreens) Attach(sessionId string, serverListeners, clientListeners *common.MultiListener) {
+	screen := decoder.NewListener(nil)
+	serverListeners.AddListener(screen)
+	clientListeners.AddListener(screen)
+
+	s.mutex.Lock()
+	s.screens[sessionId] = append(s.screens[sessionId], screen)
+	s.mutex.Unlock()
+
+	go func() {
+		<-screen.Done()
+		s.remove(sessionId, screen)
+	}()
+}
+
+func (s *SessionScreens) remove(sessionId string, screen *decoder.Listener) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	screens := s.screens[sessionId]
+	for i, other := range screens {
+		if other == screen {
+			screens = append(screens[:i], screens[i+1:]...)
+			break
+		}
+	}
+	if len(screens) == 0 {
+		delete(s.screens, sessionId)
+	} else {
+		s.screens[sessionId] = screens
+	}
+}
+
+// Screenshot returns the current screen of the session, with the cursor drawn when withCursor is set
+func (s *SessionScreens) Screenshot(sessionId string, withCursor bool) (*image.RGBA, error) {
+	s.mutex.Lock()
+	screens := s.screens[sessionId]
+	var screen *decoder.Listener
+	if len(screens) > 0 {
+		screen = screens[len(screens)-1]
+	}
+	s.mutex.Unlock()
+
+	if screen == nil {
+		return nil, ErrNoScreen
+	}
+	fb := screen.Framebuffer()
+	if fb == nil {
+		//connected, but the vnc-server didn't send its init message yet
+		return nil, ErrNoScreen
+	}
+	if withCursor {
+		return fb.ImageWithCursor(), nil
+	}
+	return fb.Image(), nil
+}
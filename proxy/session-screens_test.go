@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/amitbet/vncproxy/common"
+)
+
+func TestSessionScreenshot(t *testing.T) {
+	sessions := NewSessionManager()
+	sessions.SetSession("desk1", &VncSession{ID: "desk1", Target: "10.0.0.1:5900"})
+	screens := NewSessionScreens()
+	api := NewSessionAPI(sessions)
+	api.Screens = screens
+	mux := http.NewServeMux()
+	api.Register(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	if resp, _ := http.Get(srv.URL + "/sessions/desk1/screenshot.png"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("screenshot of an inactive session returned %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	//a vnc-server connection sending a 40x20 screen with a red raw pixel at (0,0)
+	serverListeners, clientListeners := &common.MultiListener{}, &common.MultiListener{}
+	screens.Attach("desk1", serverListeners, clientListeners)
+	serverListeners.Consume(&common.RfbSegment{SegmentType: common.SegmentServerInitMessage, Message: &common.ServerInit{
+		FBWidth:     40,
+		FBHeight:    20,
+		PixelFormat: *common.NewPixelFormat(32),
+	}})
+	update := &bytes.Buffer{}
+	update.Write([]byte{byte(common.FramebufferUpdate), 0, 0, 1})
+	binary.Write(update, binary.BigEndian, []uint16{0, 0, 1, 1})
+	binary.Write(update, binary.BigEndian, int32(common.EncRaw))
+	update.Write([]byte{0, 0, 0xFF, 0})
+	serverListeners.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageStart, UpcomingObjectType: int(common.FramebufferUpdate)})
+	serverListeners.Consume(&common.RfbSegment{SegmentType: common.SegmentBytes, Bytes: update.Bytes()})
+	serverListeners.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageEnd, UpcomingObjectType: int(common.FramebufferUpdate)})
+
+	//the update is decoded in the background
+	var pixel [4]uint32
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		img, err := screens.Screenshot("desk1", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, g, b, a := img.At(0, 0).RGBA()
+		if pixel = [4]uint32{r >> 8, g >> 8, b >> 8, a >> 8}; pixel[0] == 0xFF {
+			break
+		}
+	}
+	if pixel != [4]uint32{0xFF, 0, 0, 0xFF} {
+		t.Errorf("expected a red pixel, got %v", pixel)
+	}
+
+	resp, err := http.Get(srv.URL + "/sessions/desk1/screenshot.png?maxWidth=20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != 20 || size.Y != 10 {
+		t.Errorf("expected a 20x10 thumbnail, got %v", size)
+	}
+
+	serverListeners.Consume(&common.RfbSegment{SegmentType: common.SegmentConnectionClosed})
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := screens.Screenshot("desk1", false); err == ErrNoScreen {
+			return
+		}
+	}
+	t.Error("the screen was kept after the connection closed")
+}
@@ -0,0 +1,523 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"sync"
+
+	"github.com/amitbet/vncproxy/client"
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/decoder"
+	"github.com/amitbet/vncproxy/logger"
+	"github.com/amitbet/vncproxy/wsserver"
+)
+
+var errSharedSessionClosed = errors.New("shared session is closed")
+
+// SharedSession fans out a single upstream vnc connection to many vnc-clients (viewers).
+// The first viewer to join is the controller, the rest are view-only, if the controller leaves
+// the oldest remaining viewer takes its place.
+//
+// The upstream connection ends at the proxy: its updates are decoded into a framebuffer, which is encoded again
+// for every viewer in its own pixel format (Raw or Zlib), so viewers can ask for any format & join at any time.
+// The upstream encodings are chosen by the proxy and never use zlib streams.
+type SharedSession struct {
+	ID string
+
+	mutex       sync.Mutex
+	writeMutex  sync.Mutex
+	upstream    *client.ClientConn
+	serverInit  *common.ServerInit
+	framebuffer *decoder.Framebuffer
+	// the server message being read from the upstream connection, used by its reader goroutine only
+	message    *bytes.Buffer
+	viewers    []*sharedViewer
+	controller *sharedViewer
+	encodings  []common.EncodingType
+	closed     bool
+
+	// receives every client message that was actually sent upstream (used by the recorder)
+	clientListeners *common.MultiListener
+	// called once when the session closes
+	onClose func()
+	log     *logger.FieldLogger
+}
+
+func newSharedSession(id string) *SharedSession {
+	return &SharedSession{ID: id, clientListeners: &common.MultiListener{}, log: logger.With(logger.FieldSession, id)}
+}
+
+// AddViewer attaches a new vnc-client to the session, connect is used to create the upstream connection for the first viewer.
+// Input from view-only viewers is always dropped, even when they are in control.
+// It returns the gate held while messages are written to the viewer.
+func (s *SharedSession) AddViewer(conn common.IServerConn, viewOnly bool, connect func(*SharedSession) (*client.ClientConn, error)) (*messageGate, error) {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil, errSharedSessionClosed
+	}
+
+	if s.upstream == nil {
+		upstream, err := connect(s)
+		if err != nil {
+			s.closeLocked()
+			s.mutex.Unlock()
+			return nil, err
+		}
+		s.upstream = upstream
+	}
+
+	viewer := &sharedViewer{
+		shared:   s,
+		conn:     conn,
+		viewOnly: viewOnly,
+		gate:     &messageGate{},
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	//present the current state of the upstream desktop to the new viewer in its server-init message
+	viewer.pixelFormat = *common.NewPixelFormat(32)
+	if s.serverInit != nil {
+		conn.SetWidth(s.serverInit.FBWidth)
+		conn.SetHeight(s.serverInit.FBHeight)
+		conn.SetDesktopName(string(s.serverInit.NameText))
+		viewer.width, viewer.height = int(s.serverInit.FBWidth), int(s.serverInit.FBHeight)
+		if s.serverInit.PixelFormat.TrueColor != 0 {
+			viewer.pixelFormat = s.serverInit.PixelFormat
+		}
+	}
+	pixelFormat := viewer.pixelFormat
+	conn.SetPixelFormat(&pixelFormat)
+
+	s.viewers = append(s.viewers, viewer)
+	if s.controller == nil {
+		s.controller = viewer
+	}
+	var encMsg common.ClientMessage
+	if s.updateEncodingsLocked() {
+		encMsg = &wsserver.MsgSetEncodings{Encodings: s.encodings}
+	}
+	width, height := s.screenSizeLocked()
+	conn.Listeners().AddListener(viewer)
+	go viewer.run()
+	conn.Logger().Infof("SharedSession %s: viewer joined, %d viewers connected", s.ID, len(s.viewers))
+	s.mutex.Unlock()
+
+	if encMsg != nil {
+		s.writeUpstream(encMsg)
+	}
+	//refresh the whole screen for the new viewer
+	s.writeUpstream(&wsserver.MsgFramebufferUpdateRequest{Inc: 0, Width: uint16(width), Height: uint16(height)})
+	return viewer.gate, nil
+}
+
+// ViewerCount returns the number of vnc-clients attached to the session
+func (s *SharedSession) ViewerCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.viewers)
+}
+
+func (s *SharedSession) screenSizeLocked() (width, height int) {
+	if s.framebuffer != nil {
+		return s.framebuffer.Size()
+	}
+	if s.serverInit != nil {
+		return int(s.serverInit.FBWidth), int(s.serverInit.FBHeight)
+	}
+	return 0, 0
+}
+
+// Consume receives the segments of the upstream connection, decodes its messages & passes them on to the viewers
+func (s *SharedSession) Consume(seg *common.RfbSegment) error {
+	switch seg.SegmentType {
+	case common.SegmentServerInitMessage:
+		// sent from within the upstream handshake, while AddViewer holds the lock
+		s.serverInit = seg.Message.(*common.ServerInit)
+		framebuffer, err := decoder.NewFramebuffer(s.serverInit.FBWidth, s.serverInit.FBHeight, &s.serverInit.PixelFormat)
+		if err != nil {
+			return err
+		}
+		s.framebuffer = framebuffer
+
+	case common.SegmentMessageStart:
+		s.message = &bytes.Buffer{}
+
+	case common.SegmentBytes:
+		if s.message != nil {
+			s.message.Write(seg.Bytes)
+		}
+
+	case common.SegmentFullyParsedServerMessage:
+		return s.serverMessage(seg.Message)
+
+	case common.SegmentConnectionClosed:
+		s.mutex.Lock()
+		viewers := s.viewers
+		s.closeLocked()
+		s.mutex.Unlock()
+
+		s.log.Infof("SharedSession %s: upstream connection closed, disconnecting %d viewers", s.ID, len(viewers))
+		for _, viewer := range viewers {
+			viewer.conn.Close()
+		}
+	}
+	return nil
+}
+
+// serverMessage applies a message of the vnc-server to the framebuffer and tells the viewers what changed
+func (s *SharedSession) serverMessage(msg interface{}) error {
+	s.mutex.Lock()
+	framebuffer := s.framebuffer
+	s.mutex.Unlock()
+	if s.message != nil && framebuffer != nil {
+		if messageType, err := framebuffer.ReadServerMessage(bytes.NewReader(s.message.Bytes())); err != nil {
+			s.log.Errorf("SharedSession %s: error decoding server message %d: %s", s.ID, messageType, err)
+		}
+	}
+	s.message = nil
+
+	var behind []*sharedViewer
+	s.mutex.Lock()
+	switch msg := msg.(type) {
+	case *client.MsgFramebufferUpdate:
+		s.applyUpdateLocked(msg)
+	case *client.MsgBell:
+		behind = s.queueLocked([]byte{byte(common.Bell)})
+	case *client.MsgServerCutText:
+		behind = s.queueLocked(serverCutText(msg.Text))
+	}
+	width, height := s.screenSizeLocked()
+	closed := s.closed
+	s.mutex.Unlock()
+
+	for _, viewer := range behind {
+		viewer.conn.Logger().Errorf("SharedSession %s: the viewer fell too far behind, disconnecting it", s.ID)
+		s.disconnectViewer(viewer)
+	}
+	if _, ok := msg.(*client.MsgFramebufferUpdate); ok && !closed {
+		//keep an update request pending, the viewers' requests are answered by the proxy
+		return s.writeUpstream(&wsserver.MsgFramebufferUpdateRequest{Inc: 1, Width: uint16(width), Height: uint16(height)})
+	}
+	return nil
+}
+
+// applyUpdateLocked marks the parts of the screen changed by a framebuffer update for every viewer
+func (s *SharedSession) applyUpdateLocked(update *client.MsgFramebufferUpdate) {
+	width, height := s.screenSizeLocked()
+	resized := s.serverInit != nil && (width != int(s.serverInit.FBWidth) || height != int(s.serverInit.FBHeight))
+	if resized {
+		//viewers joining later get the new size in their server-init, the old one is shared with the other listeners
+		serverInit := *s.serverInit
+		serverInit.FBWidth = uint16(width)
+		serverInit.FBHeight = uint16(height)
+		s.serverInit = &serverInit
+	}
+
+	cursor := false
+	var changed []image.Rectangle
+	for _, rect := range update.Rectangles {
+		enc := common.EncodingType(rect.Enc.Type())
+		if enc == common.EncCursorPseudo {
+			cursor = true
+		}
+		//pseudo encodings don't change the screen, resizes are handled on their own
+		if enc < 0 {
+			continue
+		}
+		changed = append(changed, image.Rect(int(rect.X), int(rect.Y), int(rect.X)+int(rect.Width), int(rect.Y)+int(rect.Height)))
+	}
+
+	for _, viewer := range s.viewers {
+		if resized && viewer.supportsResize() {
+			viewer.resized = true
+			viewer.width, viewer.height = width, height
+			viewer.conn.SetWidth(uint16(width))
+			viewer.conn.SetHeight(uint16(height))
+			viewer.dirty = viewer.dirty[:0]
+			viewer.markDirtyLocked(image.Rect(0, 0, width, height))
+		}
+		for _, r := range changed {
+			viewer.markDirtyLocked(r)
+		}
+		if cursor && viewer.supports(common.EncCursorPseudo) {
+			viewer.cursorChanged = true
+		}
+		viewer.signal()
+	}
+}
+
+// queueLocked adds a message for every viewer, and returns the viewers that fell too far behind to take it
+func (s *SharedSession) queueLocked(msg []byte) []*sharedViewer {
+	var behind []*sharedViewer
+	for _, viewer := range s.viewers {
+		if !viewer.queueLocked(msg) {
+			behind = append(behind, viewer)
+			continue
+		}
+		viewer.signal()
+	}
+	return behind
+}
+
+// nextMessage returns the next message to write to a viewer, nil when there is nothing to write.
+// Updates are only sent when the viewer asked for one, the screen is encoded outside of the lock.
+func (s *SharedSession) nextMessage(viewer *sharedViewer) []byte {
+	s.mutex.Lock()
+	if viewer.removed || !viewer.ready {
+		s.mutex.Unlock()
+		return nil
+	}
+	if len(viewer.messages) > 0 {
+		msg := viewer.messages[0]
+		viewer.messages = viewer.messages[1:]
+		s.mutex.Unlock()
+		return msg
+	}
+	if !viewer.requested || s.framebuffer == nil || (len(viewer.dirty) == 0 && !viewer.cursorChanged && !viewer.resized) {
+		s.mutex.Unlock()
+		return nil
+	}
+	update := &viewerUpdate{
+		framebuffer: s.framebuffer,
+		rects:       viewer.dirty,
+		cursor:      viewer.cursorChanged,
+		//the vnc-server draws the cursor on the screen while a viewer can't
+		noCursor:    !containsEncoding(s.encodings, common.EncCursorPseudo),
+		resized:     viewer.resized,
+		width:       viewer.width,
+		height:      viewer.height,
+		pixelFormat: viewer.pixelFormat,
+		encodings:   viewer.encodings,
+	}
+	viewer.dirty = nil
+	viewer.cursorChanged = false
+	viewer.resized = false
+	viewer.requested = false
+	s.mutex.Unlock()
+
+	if msg := viewer.encodeUpdate(update); msg != nil {
+		return msg
+	}
+	//nothing left after clipping, the viewer's request stays pending
+	s.mutex.Lock()
+	viewer.requested = true
+	s.mutex.Unlock()
+	return nil
+}
+
+// Consume receives the messages sent by the viewer
+func (v *sharedViewer) Consume(seg *common.RfbSegment) error {
+	switch seg.SegmentType {
+	case common.SegmentFullyParsedClientMessage:
+		return v.shared.handleClientMessage(v, seg.Message.(common.ClientMessage))
+	case common.SegmentConnectionClosed:
+		v.shared.removeViewer(v)
+	}
+	return nil
+}
+
+// handleClientMessage answers the viewer's pixel format, encodings & update requests in the proxy,
+// only the controller's input reaches the vnc-server
+func (s *SharedSession) handleClientMessage(viewer *sharedViewer, msg common.ClientMessage) error {
+	s.mutex.Lock()
+	if viewer.removed {
+		s.mutex.Unlock()
+		return nil
+	}
+	viewer.ready = true
+	isController := s.controller == viewer
+
+	switch msg := msg.(type) {
+	case *wsserver.MsgSetPixelFormat:
+		viewer.pixelFormat = msg.PF
+		pixelFormat := msg.PF
+		viewer.conn.SetPixelFormat(&pixelFormat)
+		if msg.PF.TrueColor == 0 {
+			viewer.queueLocked(colorMapEntries())
+		}
+		viewer.cursorChanged = viewer.supports(common.EncCursorPseudo)
+		viewer.signal()
+		s.mutex.Unlock()
+		return nil
+
+	case *wsserver.MsgSetEncodings:
+		viewer.encodings = msg.Encodings
+		viewer.cursorChanged = viewer.supports(common.EncCursorPseudo)
+		viewer.signal()
+		if !s.updateEncodingsLocked() {
+			s.mutex.Unlock()
+			return nil
+		}
+		encMsg := &wsserver.MsgSetEncodings{Encodings: s.encodings}
+		s.mutex.Unlock()
+		return s.writeUpstream(encMsg)
+
+	case *wsserver.MsgFramebufferUpdateRequest:
+		viewer.requested = true
+		if msg.Inc == 0 {
+			viewer.markDirtyLocked(image.Rect(int(msg.X), int(msg.Y), int(msg.X)+int(msg.Width), int(msg.Y)+int(msg.Height)))
+		}
+		viewer.signal()
+		s.mutex.Unlock()
+		return nil
+	}
+
+	if !isInputMessage(msg.Type()) || !isController || viewer.viewOnly {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.mutex.Unlock()
+	return s.writeUpstream(msg)
+}
+
+// writeUpstream sends a client message to the vnc-server, the session lock must not be held
+// since the upstream reader needs it to progress.
+func (s *SharedSession) writeUpstream(msg common.ClientMessage) error {
+	s.writeMutex.Lock()
+	err := msg.Write(s.upstream)
+	s.writeMutex.Unlock()
+	if err != nil {
+		s.log.Errorf("SharedSession %s: problem writing to upstream: %s", s.ID, err)
+		return err
+	}
+
+	return s.clientListeners.Consume(&common.RfbSegment{
+		SegmentType: common.SegmentFullyParsedClientMessage,
+		Message:     msg,
+	})
+}
+
+// updateEncodingsLocked recalculates the upstream encodings, and returns true if they changed.
+// The proxy decodes them all and none uses a zlib stream, so viewers can join in the middle of the session.
+// The cursor is sent separately when every viewer that sent its encodings draws it, the vnc-server draws it otherwise.
+func (s *SharedSession) updateEncodingsLocked() bool {
+	encs := []common.EncodingType{common.EncHextile, common.EncRRE, common.EncCopyRect, common.EncRaw,
+		common.EncExtendedDesktopSizePseudo, common.EncDesktopSizePseudo}
+	cursor := false
+	for _, viewer := range s.viewers {
+		if viewer.encodings == nil {
+			continue
+		}
+		if !viewer.supports(common.EncCursorPseudo) {
+			cursor = false
+			break
+		}
+		cursor = true
+	}
+	if cursor {
+		encs = append(encs, common.EncCursorPseudo)
+	}
+
+	if equalEncodings(encs, s.encodings) {
+		return false
+	}
+	//viewers drawing the cursor switch between the cursor of the vnc-server & none
+	for _, viewer := range s.viewers {
+		if viewer.supports(common.EncCursorPseudo) {
+			viewer.cursorChanged = true
+			viewer.signal()
+		}
+	}
+	s.encodings = encs
+	return true
+}
+
+func (s *SharedSession) removeViewer(viewer *sharedViewer) {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+
+	found := false
+	for i, v := range s.viewers {
+		if v == viewer {
+			s.viewers = append(s.viewers[:i], s.viewers[i+1:]...)
+			found = true
+			break
+		}
+	}
+	//a disconnected viewer was already removed
+	if !found {
+		s.mutex.Unlock()
+		return
+	}
+	viewer.stopLocked()
+
+	if len(s.viewers) == 0 {
+		s.log.Infof("SharedSession %s: last viewer left, closing upstream connection", s.ID)
+		upstream := s.upstream
+		s.closeLocked()
+		s.mutex.Unlock()
+		if upstream != nil {
+			upstream.Close()
+		}
+		return
+	}
+
+	if s.controller == viewer {
+		s.controller = s.viewers[0]
+		s.log.Infof("SharedSession %s: controller left, passing control to the next viewer", s.ID)
+	}
+	var encMsg common.ClientMessage
+	if s.updateEncodingsLocked() {
+		encMsg = &wsserver.MsgSetEncodings{Encodings: s.encodings}
+	}
+	s.mutex.Unlock()
+
+	if encMsg != nil {
+		s.writeUpstream(encMsg)
+	}
+}
+
+// stopLocked ends the viewer's writer goroutine
+func (v *sharedViewer) stopLocked() {
+	if !v.removed {
+		v.removed = true
+		close(v.done)
+	}
+}
+
+// disconnectViewer stops sending to a viewer and closes its connection
+func (s *SharedSession) disconnectViewer(viewer *sharedViewer) {
+	s.removeViewer(viewer)
+	viewer.conn.Close()
+}
+
+func (s *SharedSession) closeLocked() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for _, viewer := range s.viewers {
+		viewer.stopLocked()
+	}
+	s.viewers = nil
+	s.controller = nil
+	if s.onClose != nil {
+		s.onClose()
+	}
+}
+
+func containsEncoding(encs []common.EncodingType, enc common.EncodingType) bool {
+	for _, e := range encs {
+		if e == enc {
+			return true
+		}
+	}
+	return false
+}
+
+func equalEncodings(a, b []common.EncodingType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
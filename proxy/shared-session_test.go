@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/amitbet/vncproxy/client"
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/encodings"
+	"github.com/amitbet/vncproxy/wsserver"
+)
+
+// rgb565 is a 16 bit true color format
+var rgb565 = common.PixelFormat{BPP: 16, Depth: 16, TrueColor: 1, RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5, BlueShift: 0}
+
+// newTestSharedSession makes a shared session whose upstream connection (with a 32 bit screen) keeps what is written to it
+func newTestSharedSession(width, height uint16) (*SharedSession, *syncBufferConn) {
+	s := newSharedSession("s1")
+	upstreamConn := &syncBufferConn{}
+	s.upstream, _ = client.NewClientConn(upstreamConn, &client.ClientConfig{})
+	s.upstream.PixelFormat = *common.NewPixelFormat(32)
+	s.Consume(&common.RfbSegment{SegmentType: common.SegmentServerInitMessage, Message: &common.ServerInit{
+		FBWidth: width, FBHeight: height, PixelFormat: *common.NewPixelFormat(32),
+	}})
+	return s, upstreamConn
+}
+
+func addTestViewer(t *testing.T, s *SharedSession, nc io.ReadWriteCloser) *sharedViewer {
+	conn, _ := wsserver.NewServerConnIO(nc, &wsserver.ServerConfig{ClientMessages: wsserver.DefaultClientMessages})
+	if _, err := s.AddViewer(conn, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.viewers[len(s.viewers)-1]
+}
+
+// upstreamMessage passes a server message through the session like the upstream connection's reader
+func upstreamMessage(s *SharedSession, data []byte, msg common.ServerMessage) {
+	s.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageStart})
+	s.Consume(&common.RfbSegment{SegmentType: common.SegmentBytes, Bytes: data})
+	s.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageEnd})
+	s.Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedServerMessage, Message: msg})
+}
+
+// upstreamFill sends a raw framebuffer update painting a rectangle in a 32 bit color
+func upstreamFill(s *SharedSession, x, y, w, h uint16, pixel []byte) {
+	data := &bytes.Buffer{}
+	data.Write([]byte{byte(common.FramebufferUpdate), 0, 0, 1})
+	binary.Write(data, binary.BigEndian, []uint16{x, y, w, h})
+	binary.Write(data, binary.BigEndian, int32(common.EncRaw))
+	data.Write(bytes.Repeat(pixel, int(w)*int(h)))
+	update := &client.MsgFramebufferUpdate{Rectangles: []common.Rectangle{{X: x, Y: y, Width: w, Height: h, Enc: &encodings.RawEncoding{}}}}
+	upstreamMessage(s, data.Bytes(), update)
+}
+
+// rawUpdate is the framebuffer update a viewer gets for a single raw rectangle of one pixel value
+func rawUpdate(x, y, w, h uint16, pixel []byte) []byte {
+	data := &bytes.Buffer{}
+	data.Write([]byte{byte(common.FramebufferUpdate), 0, 0, 1})
+	binary.Write(data, binary.BigEndian, []uint16{x, y, w, h})
+	binary.Write(data, binary.BigEndian, int32(common.EncRaw))
+	data.Write(bytes.Repeat(pixel, int(w)*int(h)))
+	return data.Bytes()
+}
+
+func sendViewerMessage(t *testing.T, viewer *sharedViewer, msg common.ClientMessage) {
+	if err := viewer.Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedClientMessage, Message: msg}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// little endian red pixels
+var (
+	red32  = []byte{0, 0, 255, 0}
+	red16  = []byte{0x00, 0xF8}
+	blue32 = []byte{255, 0, 0, 0}
+)
+
+func TestSharedSessionEncodings(t *testing.T) {
+	s, _ := newTestSharedSession(4, 2)
+	controller := addTestViewer(t, s, &closingConn{})
+	viewer := addTestViewer(t, s, &closingConn{})
+	addTestViewer(t, s, &closingConn{})
+
+	//zlib streams are never asked for, whatever the viewers support
+	sendViewerMessage(t, controller, &wsserver.MsgSetEncodings{Encodings: []common.EncodingType{common.EncTight, common.EncZRLE, common.EncRaw, common.EncCursorPseudo}})
+	sendViewerMessage(t, viewer, &wsserver.MsgSetEncodings{Encodings: []common.EncodingType{common.EncZlib, common.EncRaw}})
+	for _, enc := range s.encodings {
+		if enc.UsesZlibStream() {
+			t.Errorf("the upstream encodings %v use zlib streams", s.encodings)
+		}
+	}
+	if containsEncoding(s.encodings, common.EncCursorPseudo) {
+		t.Errorf("the cursor is asked for while a viewer doesn't support it: %v", s.encodings)
+	}
+
+	//the cursor is asked for once every viewer that sent its encodings supports it
+	sendViewerMessage(t, viewer, &wsserver.MsgSetEncodings{Encodings: []common.EncodingType{common.EncZlib, common.EncRaw, common.EncCursorPseudo}})
+	if !containsEncoding(s.encodings, common.EncCursorPseudo) {
+		t.Errorf("the cursor isn't asked for: %v", s.encodings)
+	}
+	s.mutex.Lock()
+	changed := s.updateEncodingsLocked()
+	s.mutex.Unlock()
+	if changed {
+		t.Error("encodings changed without any viewer change")
+	}
+}
+
+func TestSharedSessionControllerLeaves(t *testing.T) {
+	s, _ := newTestSharedSession(4, 2)
+	first := addTestViewer(t, s, &closingConn{})
+	second := addTestViewer(t, s, &closingConn{})
+
+	s.removeViewer(first)
+	if s.controller != second {
+		t.Error("control was not passed to the remaining viewer")
+	}
+	if s.ViewerCount() != 1 {
+		t.Errorf("ViewerCount = %d, want 1", s.ViewerCount())
+	}
+
+	closed := false
+	s.onClose = func() { closed = true }
+	s.removeViewer(second)
+	if !closed {
+		t.Error("session was not closed after the last viewer left")
+	}
+}
+
+func TestSharedSessionViewerPixelFormats(t *testing.T) {
+	s, _ := newTestSharedSession(4, 2)
+	controllerConn, viewerConn := &closingConn{}, &closingConn{}
+	controller := addTestViewer(t, s, controllerConn)
+	viewer := addTestViewer(t, s, viewerConn)
+
+	//every viewer gets the screen in its own format, the vnc-server keeps sending its own
+	sendViewerMessage(t, controller, &wsserver.MsgSetPixelFormat{PF: *common.NewPixelFormat(32)})
+	sendViewerMessage(t, viewer, &wsserver.MsgSetPixelFormat{PF: rgb565})
+	upstreamFill(s, 0, 0, 4, 2, red32)
+	sendViewerMessage(t, controller, &wsserver.MsgFramebufferUpdateRequest{Inc: 0, Width: 4, Height: 2})
+	sendViewerMessage(t, viewer, &wsserver.MsgFramebufferUpdateRequest{Inc: 0, Width: 4, Height: 2})
+
+	want32, want16 := rawUpdate(0, 0, 4, 2, red32), rawUpdate(0, 0, 4, 2, red16)
+	waitUntil(t, "the viewers' updates", func() bool {
+		return len(controllerConn.Bytes()) >= len(want32) && len(viewerConn.Bytes()) >= len(want16)
+	})
+	if !bytes.Equal(controllerConn.Bytes(), want32) {
+		t.Errorf("the controller got %v, want %v", controllerConn.Bytes(), want32)
+	}
+	if !bytes.Equal(viewerConn.Bytes(), want16) {
+		t.Errorf("the 16 bit viewer got %v, want %v", viewerConn.Bytes(), want16)
+	}
+	if *s.upstream.CurrentPixelFormat() != *common.NewPixelFormat(32) {
+		t.Error("a viewer's pixel format reached the vnc-server")
+	}
+
+	//an incremental request is answered with the next change only
+	sendViewerMessage(t, viewer, &wsserver.MsgFramebufferUpdateRequest{Inc: 1, Width: 4, Height: 2})
+	upstreamFill(s, 1, 1, 2, 1, blue32)
+	want := append(want16, rawUpdate(1, 1, 2, 1, []byte{0x1F, 0x00})...)
+	waitUntil(t, "the incremental update", func() bool { return len(viewerConn.Bytes()) >= len(want) })
+	if !bytes.Equal(viewerConn.Bytes(), want) {
+		t.Errorf("the 16 bit viewer got %v, want %v", viewerConn.Bytes(), want)
+	}
+}
+
+func TestSharedSessionZlibViewer(t *testing.T) {
+	s, _ := newTestSharedSession(4, 2)
+	conn := &closingConn{}
+	viewer := addTestViewer(t, s, conn)
+	sendViewerMessage(t, viewer, &wsserver.MsgSetEncodings{Encodings: []common.EncodingType{common.EncZlib, common.EncRaw}})
+	upstreamFill(s, 0, 0, 4, 2, red32)
+	sendViewerMessage(t, viewer, &wsserver.MsgFramebufferUpdateRequest{Inc: 0, Width: 4, Height: 2})
+	waitUntil(t, "the first update", func() bool { return len(conn.Bytes()) > 20 })
+	sendViewerMessage(t, viewer, &wsserver.MsgFramebufferUpdateRequest{Inc: 1, Width: 4, Height: 2})
+	upstreamFill(s, 0, 0, 1, 1, blue32)
+
+	//the rectangles continue a single zlib stream
+	var compressed []byte
+	var rects []int
+	waitUntil(t, "the second update", func() bool {
+		data := conn.Bytes()
+		compressed, rects = nil, nil
+		for len(data) >= 20 {
+			size := int(binary.BigEndian.Uint32(data[16:]))
+			if len(data) < 20+size {
+				break
+			}
+			if common.EncodingType(binary.BigEndian.Uint32(data[12:])) != common.EncZlib {
+				t.Fatalf("expected a zlib rectangle: %v", data)
+			}
+			rects = append(rects, int(binary.BigEndian.Uint16(data[8:]))*int(binary.BigEndian.Uint16(data[10:])))
+			compressed = append(compressed, data[20:20+size]...)
+			data = data[20+size:]
+		}
+		return len(rects) == 2
+	})
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pixels := make([]byte, (rects[0]+rects[1])*4)
+	if _, err := io.ReadFull(zr, pixels); err != nil {
+		t.Fatal(err)
+	}
+	want := append(bytes.Repeat(red32, 8), blue32...)
+	if !bytes.Equal(pixels, want) {
+		t.Errorf("the zlib viewer got %v, want %v", pixels, want)
+	}
+}
+
+func TestSharedSessionLateViewer(t *testing.T) {
+	s, upstreamConn := newTestSharedSession(4, 2)
+	addTestViewer(t, s, &closingConn{})
+	upstreamFill(s, 0, 0, 4, 2, red32)
+	upstreamFill(s, 0, 0, 1, 1, blue32)
+
+	//a viewer joining later asks the vnc-server for the whole screen & gets it from the proxy
+	before := len(upstreamConn.Bytes())
+	lateConn := &closingConn{}
+	late := addTestViewer(t, s, lateConn)
+	request := []byte{byte(common.FramebufferUpdateRequestMsgType), 0, 0, 0, 0, 0, 0, 4, 0, 2}
+	if sent := upstreamConn.Bytes()[before:]; !bytes.Equal(sent, request) {
+		t.Errorf("the vnc-server got %v when a viewer joined, want a full update request %v", sent, request)
+	}
+
+	sendViewerMessage(t, late, &wsserver.MsgFramebufferUpdateRequest{Inc: 0, Width: 4, Height: 2})
+	want := rawUpdate(0, 0, 4, 2, red32)
+	copy(want[16:], blue32)
+	waitUntil(t, "the late viewer's update", func() bool { return len(lateConn.Bytes()) >= len(want) })
+	if !bytes.Equal(lateConn.Bytes(), want) {
+		t.Errorf("the late viewer got %v, want %v", lateConn.Bytes(), want)
+	}
+}
+
+// blockingConn is a vnc-client connection whose writes block until it is closed
+type blockingConn struct {
+	closingConn
+	release chan struct{}
+	once    sync.Once
+}
+
+func (c *blockingConn) Write(p []byte) (int, error) {
+	<-c.release
+	return c.closingConn.Write(p)
+}
+
+func (c *blockingConn) Close() error {
+	c.once.Do(func() { close(c.release) })
+	return c.closingConn.Close()
+}
+
+func TestSharedSessionSlowViewer(t *testing.T) {
+	s, _ := newTestSharedSession(4, 2)
+	fastConn, slowConn := &closingConn{}, &blockingConn{release: make(chan struct{})}
+	fast := addTestViewer(t, s, fastConn)
+	slow := addTestViewer(t, s, slowConn)
+	sendViewerMessage(t, fast, &wsserver.MsgSetEncodings{Encodings: []common.EncodingType{common.EncRaw}})
+	sendViewerMessage(t, slow, &wsserver.MsgSetEncodings{Encodings: []common.EncodingType{common.EncRaw}})
+
+	//the slow viewer doesn't hold up the others, and is disconnected once too many messages wait for it
+	for i := 1; i <= maxViewerMessages+2; i++ {
+		upstreamMessage(s, []byte{byte(common.Bell)}, new(client.MsgBell))
+		waitUntil(t, "the bell to reach the fast viewer", func() bool { return len(fastConn.Bytes()) == i })
+	}
+	waitUntil(t, "the slow viewer to be disconnected", slowConn.isClosed)
+	if s.ViewerCount() != 1 || fastConn.isClosed() {
+		t.Errorf("expected only the slow viewer to be disconnected, %d viewers left", s.ViewerCount())
+	}
+}
+
+func TestSharedSessionPixelFormatWhileUpdating(t *testing.T) {
+	//run with -race: the controller changes its pixel format while updates arrive
+	s, _ := newTestSharedSession(4, 2)
+	conn := &closingConn{}
+	controller := addTestViewer(t, s, conn)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			upstreamFill(s, 0, 0, 4, 2, red32)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		format := *common.NewPixelFormat(32)
+		if i%2 == 1 {
+			format = rgb565
+		}
+		sendViewerMessage(t, controller, &wsserver.MsgSetPixelFormat{PF: format})
+		sendViewerMessage(t, controller, &wsserver.MsgFramebufferUpdateRequest{Inc: 1, Width: 4, Height: 2})
+	}
+	<-done
+
+	sendViewerMessage(t, controller, &wsserver.MsgFramebufferUpdateRequest{Inc: 0, Width: 4, Height: 2})
+	want := rawUpdate(0, 0, 4, 2, red16)
+	waitUntil(t, "the update in the last format", func() bool { return bytes.HasSuffix(conn.Bytes(), want) })
+}
@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/decoder"
+)
+
+// maxViewerMessages is how many bells & clipboard messages may wait for a viewer, one falling further behind is disconnected
+const maxViewerMessages = 64
+
+// maxDirtyRects is how many changed parts of the screen are kept for a viewer, more are merged into their bounding box
+const maxDirtyRects = 32
+
+// sharedViewer is a vnc-client of a shared session, the screen is encoded for it in its own pixel format & encodings.
+// Its messages are written by its own goroutine, so a slow viewer doesn't hold up the session: screen changes
+// are merged until it asks for the next update.
+type sharedViewer struct {
+	shared   *SharedSession
+	conn     common.IServerConn
+	viewOnly bool
+	// held while a message is written to the viewer, so messages made by the proxy aren't written in the middle of one
+	gate *messageGate
+	// wakes up the writer goroutine, which stops when done is closed
+	wake chan struct{}
+	done chan struct{}
+
+	//guarded by the session's mutex
+	removed bool
+	// the viewer sent its first message, so its init sequence is over and messages may be written to it
+	ready     bool
+	encodings []common.EncodingType
+	// the format the viewer expects, from its server-init or its last SetPixelFormat
+	pixelFormat   common.PixelFormat
+	width, height int
+	// the viewer asked for an update that wasn't sent yet
+	requested     bool
+	dirty         []image.Rectangle
+	cursorChanged bool
+	resized       bool
+	messages      [][]byte
+
+	//used by the writer goroutine only
+	zlibBuffer bytes.Buffer
+	zlibWriter *zlib.Writer
+}
+
+// viewerUpdate is what goes into the next framebuffer update of a viewer, taken from its state
+type viewerUpdate struct {
+	framebuffer   *decoder.Framebuffer
+	rects         []image.Rectangle
+	cursor        bool
+	noCursor      bool
+	resized       bool
+	width, height int
+	pixelFormat   common.PixelFormat
+	encodings     []common.EncodingType
+}
+
+func (v *sharedViewer) supports(enc common.EncodingType) bool {
+	return containsEncoding(v.encodings, enc)
+}
+
+func (v *sharedViewer) supportsResize() bool {
+	return v.supports(common.EncDesktopSizePseudo) || v.supports(common.EncExtendedDesktopSizePseudo)
+}
+
+// signal wakes up the writer goroutine, unless it is already due to run
+func (v *sharedViewer) signal() {
+	select {
+	case v.wake <- struct{}{}:
+	default:
+	}
+}
+
+// markDirtyLocked adds a changed part of the screen to the viewer's next update
+func (v *sharedViewer) markDirtyLocked(r image.Rectangle) {
+	r = r.Intersect(image.Rect(0, 0, v.width, v.height))
+	if r.Empty() {
+		return
+	}
+	for _, dirty := range v.dirty {
+		if r.In(dirty) {
+			return
+		}
+	}
+	if len(v.dirty) >= maxDirtyRects {
+		for _, dirty := range v.dirty {
+			r = r.Union(dirty)
+		}
+		v.dirty = v.dirty[:0]
+	}
+	v.dirty = append(v.dirty, r)
+}
+
+// queueLocked adds a message to be written before the next update, it returns false when the viewer fell too far behind
+func (v *sharedViewer) queueLocked(msg []byte) bool {
+	if !v.ready {
+		return true
+	}
+	if len(v.messages) >= maxViewerMessages {
+		return false
+	}
+	v.messages = append(v.messages, msg)
+	return true
+}
+
+// run writes the viewer's messages & updates until it leaves
+func (v *sharedViewer) run() {
+	for {
+		select {
+		case <-v.wake:
+		case <-v.done:
+			return
+		}
+		for {
+			msg := v.shared.nextMessage(v)
+			if msg == nil {
+				break
+			}
+			v.gate.mutex.Lock()
+			_, err := v.conn.Write(msg)
+			v.gate.mutex.Unlock()
+			if err != nil {
+				v.conn.Logger().Errorf("SharedSession %s: error writing to viewer: %s", v.shared.ID, err)
+				v.shared.disconnectViewer(v)
+				return
+			}
+		}
+	}
+}
+
+// encodeUpdate makes a FramebufferUpdate message of the screen's current content
+func (v *sharedViewer) encodeUpdate(update *viewerUpdate) []byte {
+	msg := &bytes.Buffer{}
+	//message type, padding & the number of rectangles, set at the end
+	msg.Write([]byte{byte(common.FramebufferUpdate), 0, 0, 0})
+	count := 0
+	rect := func(x, y, w, h int, enc common.EncodingType) {
+		binary.Write(msg, binary.BigEndian, []uint16{uint16(x), uint16(y), uint16(w), uint16(h)})
+		binary.Write(msg, binary.BigEndian, int32(enc))
+		count++
+	}
+	pf := &update.pixelFormat
+
+	if update.resized {
+		if containsEncoding(update.encodings, common.EncDesktopSizePseudo) {
+			rect(0, 0, update.width, update.height, common.EncDesktopSizePseudo)
+		} else {
+			//x is the reason (a server side change), y the status, followed by a single screen
+			rect(0, 0, update.width, update.height, common.EncExtendedDesktopSizePseudo)
+			msg.Write([]byte{1, 0, 0, 0})
+			binary.Write(msg, binary.BigEndian, uint32(0))
+			binary.Write(msg, binary.BigEndian, []uint16{0, 0, uint16(update.width), uint16(update.height)})
+			binary.Write(msg, binary.BigEndian, uint32(0))
+		}
+	}
+
+	if update.cursor {
+		cursor, hotspot := update.framebuffer.Cursor()
+		if cursor == nil || update.noCursor {
+			rect(0, 0, 0, 0, common.EncCursorPseudo)
+		} else {
+			size := cursor.Bounds().Size()
+			rect(hotspot.X, hotspot.Y, size.X, size.Y, common.EncCursorPseudo)
+			msg.Write(encodePixels(cursor, pf))
+			msg.Write(cursorMask(cursor))
+		}
+	}
+
+	enc := common.EncRaw
+	for _, e := range update.encodings {
+		if e == common.EncRaw || e == common.EncZlib {
+			enc = e
+			break
+		}
+	}
+	bounds := image.Rect(0, 0, update.width, update.height)
+	for _, r := range update.rects {
+		img := update.framebuffer.Region(r.Intersect(bounds))
+		if img.Bounds().Empty() {
+			continue
+		}
+		size := img.Bounds().Size()
+		rect(img.Bounds().Min.X, img.Bounds().Min.Y, size.X, size.Y, enc)
+		pixels := encodePixels(img, pf)
+		if enc == common.EncZlib {
+			pixels = v.compress(pixels)
+			binary.Write(msg, binary.BigEndian, uint32(len(pixels)))
+		}
+		msg.Write(pixels)
+	}
+
+	if count == 0 {
+		return nil
+	}
+	data := msg.Bytes()
+	binary.BigEndian.PutUint16(data[2:], uint16(count))
+	return data
+}
+
+// compress continues the viewer's zlib stream: the Zlib encoding uses a single stream for the whole connection
+func (v *sharedViewer) compress(data []byte) []byte {
+	v.zlibBuffer.Reset()
+	if v.zlibWriter == nil {
+		v.zlibWriter = zlib.NewWriter(&v.zlibBuffer)
+	}
+	v.zlibWriter.Write(data)
+	v.zlibWriter.Flush()
+	return append([]byte{}, v.zlibBuffer.Bytes()...)
+}
+
+// encodePixels converts an image to row-major pixels in a viewer's pixel format
+func encodePixels(img *image.RGBA, pf *common.PixelFormat) []byte {
+	bounds := img.Bounds()
+	bytesPerPixel := int(pf.BPP) / 8
+	if bytesPerPixel == 0 {
+		bytesPerPixel = 1
+	}
+	data := make([]byte, 0, bounds.Dx()*bounds.Dy()*bytesPerPixel)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			value := pixelValue(img.RGBAAt(x, y), pf)
+			for i := 0; i < bytesPerPixel; i++ {
+				shift := uint(8 * i)
+				if pf.BigEndian != 0 {
+					shift = uint(8 * (bytesPerPixel - 1 - i))
+				}
+				data = append(data, byte(value>>shift))
+			}
+		}
+	}
+	return data
+}
+
+// pixelValue converts a color to a pixel value, an index of the colorMap palette for color map formats
+func pixelValue(c color.RGBA, pf *common.PixelFormat) uint32 {
+	if pf.TrueColor == 0 {
+		return uint32(c.R>>5)<<5 | uint32(c.G>>5)<<2 | uint32(c.B>>6)
+	}
+	return scaleColor(c.R, pf.RedMax)<<pf.RedShift | scaleColor(c.G, pf.GreenMax)<<pf.GreenShift | scaleColor(c.B, pf.BlueMax)<<pf.BlueShift
+}
+
+func scaleColor(value uint8, max uint16) uint32 {
+	return (uint32(value)*uint32(max) + 127) / 255
+}
+
+// cursorMask makes the bitmask of the cursor pseudo encoding from the cursor's visible pixels
+func cursorMask(cursor *image.RGBA) []byte {
+	bounds := cursor.Bounds()
+	rowBytes := (bounds.Dx() + 7) / 8
+	mask := make([]byte, rowBytes*bounds.Dy())
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			if cursor.RGBAAt(bounds.Min.X+x, bounds.Min.Y+y).A != 0 {
+				mask[y*rowBytes+x/8] |= 0x80 >> uint(x%8)
+			}
+		}
+	}
+	return mask
+}
+
+// colorMapEntries makes the SetColourMapEntries message of the palette used for viewers with a color map format:
+// 3 bits of red & green and 2 bits of blue
+func colorMapEntries() []byte {
+	msg := &bytes.Buffer{}
+	//message type, padding, first color & number of colors
+	msg.Write([]byte{byte(common.SetColourMapEntries), 0})
+	binary.Write(msg, binary.BigEndian, []uint16{0, 256})
+	for i := 0; i < 256; i++ {
+		binary.Write(msg, binary.BigEndian, []uint16{
+			uint16((i >> 5 & 7) * 0xFFFF / 7),
+			uint16((i >> 2 & 7) * 0xFFFF / 7),
+			uint16((i & 3) * 0xFFFF / 3),
+		})
+	}
+	return msg.Bytes()
+}
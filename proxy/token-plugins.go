@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var ErrTokenNotFound = errors.New("token not found")
+
+// TokenTarget is the vnc server a websocket token leads to
+type TokenTarget struct {
+	Target   string `json:"target"` // host:port or /path/to/unix.socket
+	Password string `json:"password,omitempty"`
+}
+
+// TokenPlugin resolves the token of a websocket connection (?token=... or the url path) to a target vnc server,
+// like the token plugins of websockify.
+type TokenPlugin interface {
+	Lookup(token string) (*TokenTarget, error)
+}
+
+// TokenFile reads websockify token files, a file or a directory of files with lines of "token: host:port".
+// A target password may follow the target, separated by a space. The files are read on every lookup, so they can be edited live.
+type TokenFile struct {
+	Path string
+}
+
+func (tf *TokenFile) Lookup(token string) (*TokenTarget, error) {
+	files := []string{tf.Path}
+	if info, err := os.Stat(tf.Path); err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		files, err = filepath.Glob(filepath.Join(tf.Path, "*"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, file := range files {
+		target, err := lookupTokenFile(file, token)
+		if err != nil || target != nil {
+			return target, err
+		}
+	}
+	return nil, ErrTokenNotFound
+}
+
+func lookupTokenFile(filename string, token string) (*TokenTarget, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != token {
+			continue
+		}
+		fields := strings.Fields(parts[1])
+		if len(fields) == 0 {
+			continue
+		}
+		target := &TokenTarget{Target: fields[0]}
+		if len(fields) > 1 {
+			target.Password = fields[1]
+		}
+		return target, nil
+	}
+	return nil, scanner.Err()
+}
+
+// JSONTokenFile reads a json object of token -> target from a file on every lookup:
+//
+//	{"desk1": {"target": "192.168.0.100:5901", "password": "123456"}}
+type JSONTokenFile struct {
+	Path string
+}
+
+func (jf *JSONTokenFile) Lookup(token string) (*TokenTarget, error) {
+	data, err := os.ReadFile(jf.Path)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]*TokenTarget)
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, err
+	}
+	target, ok := tokens[token]
+	if !ok || target == nil {
+		return nil, ErrTokenNotFound
+	}
+	return target, nil
+}
+
+// MemoryTokens is a token plugin managed from code
+type MemoryTokens struct {
+	mutex  sync.RWMutex
+	tokens map[string]TokenTarget
+}
+
+func NewMemoryTokens() *MemoryTokens {
+	return &MemoryTokens{tokens: make(map[string]TokenTarget)}
+}
+
+func (mt *MemoryTokens) Set(token string, target TokenTarget) {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	mt.tokens[token] = target
+}
+
+func (mt *MemoryTokens) Delete(token string) {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	delete(mt.tokens, token)
+}
+
+func (mt *MemoryTokens) Lookup(token string) (*TokenTarget, error) {
+	mt.mutex.RLock()
+	defer mt.mutex.RUnlock()
+	target, ok := mt.tokens[token]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	return &target, nil
+}
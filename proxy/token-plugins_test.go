@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTokenPlugins(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.cfg"), []byte("# websockify tokens\ndesk1: 192.168.0.10:5901\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "b.cfg"), []byte("desk2: 192.168.0.11:5901 secret\n"), 0644)
+	jsonFile := filepath.Join(t.TempDir(), "tokens.json")
+	os.WriteFile(jsonFile, []byte(`{"desk2": {"target": "192.168.0.11:5901", "password": "secret"}}`), 0644)
+	memory := NewMemoryTokens()
+	memory.Set("desk2", TokenTarget{Target: "192.168.0.11:5901", Password: "secret"})
+
+	plugins := map[string]TokenPlugin{
+		"file":      &TokenFile{Path: filepath.Join(dir, "b.cfg")},
+		"directory": &TokenFile{Path: dir},
+		"json":      &JSONTokenFile{Path: jsonFile},
+		"memory":    memory,
+	}
+	for name, plugin := range plugins {
+		target, err := plugin.Lookup("desk2")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+			continue
+		}
+		if target.Target != "192.168.0.11:5901" || target.Password != "secret" {
+			t.Errorf("%s: unexpected target %+v", name, target)
+		}
+		if _, err := plugin.Lookup("nope"); err != ErrTokenNotFound {
+			t.Errorf("%s: lookup of an unknown token returned %v, want ErrTokenNotFound", name, err)
+		}
+	}
+
+	target, err := plugins["directory"].Lookup("desk1")
+	if err != nil || target.Target != "192.168.0.10:5901" || target.Password != "" {
+		t.Errorf("directory lookup of desk1 returned %+v, %v", target, err)
+	}
+}
+
+func TestProxyTokenSession(t *testing.T) {
+	memory := NewMemoryTokens()
+	memory.Set("desk1", TokenTarget{Target: "192.168.0.10:5901", Password: "secret"})
+	vp := &VncProxy{UsingSessions: true, TokenPlugin: memory, RecordingDir: "/tmp/recordings"}
+
+	session, err := vp.getProxySession("desk1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if session.Target != "192.168.0.10:5901" || session.TargetPassword != "secret" || session.Type != SessionTypeRecordingProxy {
+		t.Errorf("unexpected token session: %+v", session)
+	}
+	if _, err := vp.SessionManager().GetSession("desk1"); err != ErrSessionNotFound {
+		t.Errorf("token session was registered: %v", err)
+	}
+	if _, err := vp.getProxySession("unknown"); err == nil {
+		t.Error("expected an error for an unknown token")
+	}
+
+	//tokens are resolved on every connection, so edits & revokes take effect
+	memory.Set("desk1", TokenTarget{Target: "192.168.0.11:5901"})
+	if session, err := vp.getProxySession("desk1"); err != nil || session.Target != "192.168.0.11:5901" {
+		t.Errorf("edited token returned %+v, %v", session, err)
+	}
+	memory.Delete("desk1")
+	if _, err := vp.getProxySession("desk1"); err == nil {
+		t.Error("expected a revoked token to be refused")
+	}
+}
+
+func TestProxyTokensNeedSessions(t *testing.T) {
+	vp := &VncProxy{
+		TCPListeningURL: "127.0.0.1:0",
+		TokenPlugin:     NewMemoryTokens(),
+		SingleSession:   &VncSession{ID: "dummySession", Target: "127.0.0.1:1", Type: SessionTypeProxyPass},
+	}
+	if err := vp.Start(context.Background()); err == nil {
+		vp.Shutdown(context.Background())
+		t.Fatal("expected Start to refuse token routing without sessions")
+	}
+}
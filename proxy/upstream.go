@@ -0,0 +1,378 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/amitbet/vncproxy/client"
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/encodings"
+	"github.com/amitbet/vncproxy/logger"
+	"github.com/amitbet/vncproxy/wsserver"
+)
+
+// the defaults of the vnc-server connection settings of VncProxy
+const (
+	DefaultDialTimeout      = 10 * time.Second
+	DefaultHandshakeTimeout = 30 * time.Second
+	DefaultRetryBackoff     = time.Second
+	DefaultMaxRetryBackoff  = 30 * time.Second
+	DefaultReconnectTimeout = 5 * time.Minute
+)
+
+var errUpstreamStopped = errors.New("stopped connecting to the vnc-server")
+
+func durationOr(d, defaultDuration time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return defaultDuration
+}
+
+// upstreamConn is the vnc-server connection of a session, as used by its recorder
+type upstreamConn interface {
+	FramebufferUpdateRequest(incremental bool, x, y, width, height uint16) error
+	Width() uint16
+	Height() uint16
+	Logger() *logger.FieldLogger
+}
+
+// connectUpstream connects to the session's vnc-server, attach adds the listeners of every new connection before its handshake.
+// Failed attempts are retried up to retries times (retries < 0 = no limit) with an exponential backoff,
+// until stop is closed or the next attempt would start after deadline (when it isn't zero).
+func (vp *VncProxy) connectUpstream(session *VncSession, log *logger.FieldLogger, attach func(*client.ClientConn), retries int, deadline time.Time, stop <-chan struct{}) (*client.ClientConn, error) {
+	backoff := durationOr(vp.RetryBackoff, DefaultRetryBackoff)
+	maxBackoff := durationOr(vp.MaxRetryBackoff, DefaultMaxRetryBackoff)
+	for attempt := 0; ; attempt++ {
+		cconn, err := vp.createClientConnection(session, log)
+		if err == nil {
+			cconn.Encs = proxyEncodings()
+			attach(cconn)
+			if err = cconn.Connect(); err == nil {
+				return cconn, nil
+			}
+		}
+
+		if retries >= 0 && attempt >= retries {
+			return nil, err
+		}
+		if !deadline.IsZero() && time.Now().Add(backoff).After(deadline) {
+			return nil, err
+		}
+		log.Warnf("Proxy: connecting to the vnc-server failed, retrying in %s: %s", backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return nil, errUpstreamStopped
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// upstreamLink is the vnc-server side of a session: it passes the segments of the current vnc-server connection on to
+// its listeners (the recorder, screens & the vnc-clients), which stay the same when a lost connection is replaced.
+// Reconnecting needs a single vnc-client (viewer), which is kept connected meanwhile.
+type upstreamLink struct {
+	vp        *VncProxy
+	session   *VncSession
+	log       *logger.FieldLogger
+	listeners *common.MultiListener
+	// the vnc-client & the ClientUpdater writing its messages to the vnc-server, nil = no reconnects
+	viewer  common.IServerConn
+	updater *ClientUpdater
+
+	mutex      sync.Mutex
+	conn       *client.ClientConn
+	serverInit *common.ServerInit
+	viewerLeft chan struct{}
+	leftOnce   sync.Once
+}
+
+func newUpstreamLink(vp *VncProxy, session *VncSession, log *logger.FieldLogger) *upstreamLink {
+	return &upstreamLink{
+		vp:         vp,
+		session:    session,
+		log:        log,
+		listeners:  &common.MultiListener{},
+		viewerLeft: make(chan struct{}),
+	}
+}
+
+// reconnectViewer keeps the vnc-client connected when the vnc-server connection is lost, until a new one is made.
+// The link listens to the vnc-client to stop reconnecting when it leaves.
+func (l *upstreamLink) reconnectViewer(viewer common.IServerConn, updater *ClientUpdater) {
+	l.viewer = viewer
+	l.updater = updater
+	updater.reconnects = true
+	viewer.Listeners().AddListener(l)
+}
+
+// connect makes the first vnc-server connection, with the proxy's connection retries
+func (l *upstreamLink) connect() (*client.ClientConn, error) {
+	var forwarder *upstreamForwarder
+	attach := func(cconn *client.ClientConn) {
+		forwarder = l.attach(cconn)
+	}
+	cconn, err := l.vp.connectUpstream(l.session, l.log, attach, l.vp.ConnectRetries, time.Time{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	l.mutex.Lock()
+	l.conn = cconn
+	l.mutex.Unlock()
+	close(forwarder.ready)
+	return cconn, nil
+}
+
+func (l *upstreamLink) attach(cconn *client.ClientConn) *upstreamForwarder {
+	forwarder := &upstreamForwarder{link: l, conn: cconn, ready: make(chan struct{})}
+	cconn.Listeners().AddListener(forwarder)
+	return forwarder
+}
+
+// Consume follows the vnc-client, its vnc-server connection is closed when it leaves
+func (l *upstreamLink) Consume(seg *common.RfbSegment) error {
+	if seg.SegmentType != common.SegmentConnectionClosed {
+		return nil
+	}
+	l.leftOnce.Do(func() { close(l.viewerLeft) })
+	if conn := l.current(); conn != nil {
+		conn.Close()
+	}
+	return nil
+}
+
+func (l *upstreamLink) current() *client.ClientConn {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.conn
+}
+
+func (l *upstreamLink) hasViewerLeft() bool {
+	select {
+	case <-l.viewerLeft:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *upstreamLink) FramebufferUpdateRequest(incremental bool, x, y, width, height uint16) error {
+	if conn := l.current(); conn != nil {
+		return conn.FramebufferUpdateRequest(incremental, x, y, width, height)
+	}
+	return nil
+}
+
+func (l *upstreamLink) Width() uint16 {
+	if conn := l.current(); conn != nil {
+		return conn.Width()
+	}
+	return 0
+}
+
+func (l *upstreamLink) Height() uint16 {
+	if conn := l.current(); conn != nil {
+		return conn.Height()
+	}
+	return 0
+}
+
+func (l *upstreamLink) Logger() *logger.FieldLogger {
+	return l.log
+}
+
+// firstServerInit returns true for the server-init of the first connection, the one the listeners get
+func (l *upstreamLink) firstServerInit(serverInit *common.ServerInit) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.serverInit != nil {
+		return false
+	}
+	l.serverInit = serverInit
+	return true
+}
+
+// lost is called when a vnc-server connection closed, midMessage is set when it closed in the middle of a server message
+func (l *upstreamLink) lost(midMessage bool) error {
+	closed := &common.RfbSegment{SegmentType: common.SegmentConnectionClosed}
+	if l.viewer == nil || l.hasViewerLeft() {
+		return l.listeners.Consume(closed)
+	}
+	if midMessage {
+		//part of the message already reached the vnc-client, it can't continue with another connection
+		l.log.Warnf("Proxy: the vnc-server connection was lost in the middle of a message, disconnecting the vnc-client")
+		return l.listeners.Consume(closed)
+	}
+	go l.reconnect()
+	return nil
+}
+
+// reconnect replaces a lost vnc-server connection, the vnc-client is disconnected if that takes longer than ReconnectTimeout
+func (l *upstreamLink) reconnect() {
+	l.updater.setUpstream(nil)
+	l.mutex.Lock()
+	l.conn = nil
+	l.mutex.Unlock()
+
+	timeout := durationOr(l.vp.ReconnectTimeout, DefaultReconnectTimeout)
+	l.log.Warnf("Proxy: lost the vnc-server connection, reconnecting for up to %s", timeout)
+	var forwarder *upstreamForwarder
+	attach := func(cconn *client.ClientConn) {
+		forwarder = l.attach(cconn)
+	}
+	cconn, err := l.vp.connectUpstream(l.session, l.log, attach, -1, time.Now().Add(timeout), l.viewerLeft)
+	if err != nil {
+		if !l.hasViewerLeft() {
+			l.log.Errorf("Proxy: can't reconnect to the vnc-server, disconnecting the vnc-client: %s", err)
+		}
+		l.listeners.Consume(&common.RfbSegment{SegmentType: common.SegmentConnectionClosed})
+		return
+	}
+
+	//nothing is passed on from the new connection until the vnc-client's state is restored
+	defer close(forwarder.ready)
+	if err := l.resume(cconn); err == errUpstreamStopped {
+		return
+	} else if err != nil {
+		//closing it reconnects again
+		l.log.Errorf("Proxy: error resuming the session on the reconnected vnc-server: %s", err)
+		cconn.Close()
+		return
+	}
+	l.log.Infof("Proxy: reconnected to the vnc-server")
+}
+
+// resume sends the vnc-client's pixel format & encodings to a reconnected vnc-server, tells the vnc-client about a new
+// desktop size and asks for a full screen update.
+// The vnc-client, recorder & screens can't restart the zlib streams of the lost connection along with the new vnc-server,
+// so zlib based encodings are left out from then on & the listeners are told the connection was reset.
+func (l *upstreamLink) resume(cconn *client.ClientConn) error {
+	l.mutex.Lock()
+	l.conn = cconn
+	l.mutex.Unlock()
+	if l.hasViewerLeft() {
+		cconn.Close()
+		return errUpstreamStopped
+	}
+
+	pixelFormat := *l.viewer.CurrentPixelFormat()
+	if err := cconn.SetPixelFormat(&pixelFormat); err != nil {
+		return err
+	}
+	l.updater.avoidZlibStreams()
+	if err := l.listeners.Consume(&common.RfbSegment{SegmentType: common.SegmentConnectionReset}); err != nil {
+		return err
+	}
+	if setEncodings := l.updater.lastSetEncodings(); setEncodings != nil {
+		if err := setEncodings.Write(cconn); err != nil {
+			return err
+		}
+	}
+
+	width, height := cconn.Width(), cconn.Height()
+	if width != l.viewer.Width() || height != l.viewer.Height() {
+		if err := l.resizeViewer(width, height); err != nil {
+			return err
+		}
+	}
+
+	l.updater.setUpstream(cconn)
+	return cconn.FramebufferUpdateRequest(false, 0, 0, width, height)
+}
+
+// resizeViewer passes a DesktopSize pseudo rectangle to the listeners, vnc-clients that don't support it keep their size
+func (l *upstreamLink) resizeViewer(width, height uint16) error {
+	if !l.viewerSupports(common.EncDesktopSizePseudo) {
+		l.log.Warnf("Proxy: the desktop size changed to %dx%d, the vnc-client doesn't support DesktopSize and keeps %dx%d",
+			width, height, l.viewer.Width(), l.viewer.Height())
+		return nil
+	}
+	l.log.Infof("Proxy: the desktop size changed to %dx%d", width, height)
+	l.viewer.SetWidth(width)
+	l.viewer.SetHeight(height)
+	return publishDesktopSize(l.listeners, width, height)
+}
+
+func (l *upstreamLink) viewerSupports(encoding common.EncodingType) bool {
+	setEncodings, ok := l.updater.lastSetEncodings().(*wsserver.MsgSetEncodings)
+	if !ok {
+		return false
+	}
+	for _, enc := range setEncodings.Encodings {
+		if enc == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// publishDesktopSize passes a FramebufferUpdate with a single DesktopSize pseudo rectangle to the listeners,
+// as if it was read from the vnc-server
+func publishDesktopSize(listeners *common.MultiListener, width, height uint16) error {
+	r := &common.RfbReadHelper{Listeners: listeners}
+	//padding & number of rectangles
+	header := []byte{0, 0, 1}
+	rect := &bytes.Buffer{}
+	binary.Write(rect, binary.BigEndian, []uint16{0, 0, width, height})
+	binary.Write(rect, binary.BigEndian, int32(common.EncDesktopSizePseudo))
+
+	steps := []func() error{
+		func() error { return r.SendMessageStart(common.FramebufferUpdate) },
+		func() error { return r.PublishBytes([]byte{byte(common.FramebufferUpdate)}) },
+		func() error { return r.PublishBytes(header) },
+		func() error { return r.SendRectSeparator(-1) },
+		func() error { return r.PublishBytes(rect.Bytes()) },
+		func() error { return r.SendMessageEnd(common.FramebufferUpdate) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	//like the vnc-server connection, the parsed update follows its bytes
+	rects := []common.Rectangle{{Width: width, Height: height, Enc: &encodings.EncDesktopSizePseudo{Width: width, Height: height}}}
+	return listeners.Consume(&common.RfbSegment{
+		SegmentType:        common.SegmentFullyParsedServerMessage,
+		UpcomingObjectType: int(common.FramebufferUpdate),
+		Message:            &client.MsgFramebufferUpdate{Rectangles: rects},
+	})
+}
+
+// upstreamForwarder passes the segments of one vnc-server connection on to the link's listeners
+type upstreamForwarder struct {
+	link *upstreamLink
+	conn *client.ClientConn
+	//closed once the connection's segments may reach the listeners
+	ready     chan struct{}
+	inMessage bool
+}
+
+func (f *upstreamForwarder) Consume(seg *common.RfbSegment) error {
+	if seg.SegmentType == common.SegmentServerInitMessage {
+		//the server-init is part of the handshake, reconnections don't pass it on: the listeners keep the first one
+		if !f.link.firstServerInit(seg.Message.(*common.ServerInit)) {
+			return nil
+		}
+		return f.link.listeners.Consume(seg)
+	}
+
+	<-f.ready
+	switch seg.SegmentType {
+	case common.SegmentMessageStart:
+		f.inMessage = true
+	case common.SegmentMessageEnd:
+		f.inMessage = false
+	case common.SegmentConnectionClosed:
+		return f.link.lost(f.inMessage)
+	}
+	return f.link.listeners.Consume(seg)
+}
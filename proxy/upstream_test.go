@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amitbet/vncproxy/client"
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/logger"
+	"github.com/amitbet/vncproxy/wsserver"
+)
+
+// fakeVncServer accepts vnc-client connections without authentication and keeps the bytes they send
+type fakeVncServer struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	width    uint16
+	height   uint16
+	conns    []*fakeVncConn
+}
+
+type fakeVncConn struct {
+	net.Conn
+	received bytes.Buffer
+	closed   bool
+}
+
+func newFakeVncServer(t *testing.T, width, height uint16) *fakeVncServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeVncServer{listener: listener, width: width, height: height}
+	go s.serve()
+	return s
+}
+
+func (s *fakeVncServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeVncServer) handle(conn net.Conn) {
+	s.mutex.Lock()
+	width, height := s.width, s.height
+	s.mutex.Unlock()
+
+	//version, security type None, security result & the client-init flag
+	conn.Write([]byte("RFB 003.008\n"))
+	version := make([]byte, 12)
+	if _, err := conn.Read(version); err != nil {
+		return
+	}
+	conn.Write([]byte{1, 1})
+	security := make([]byte, 1)
+	conn.Read(security)
+	conn.Write([]byte{0, 0, 0, 0})
+	conn.Read(make([]byte, 1))
+
+	serverInit := &bytes.Buffer{}
+	binary.Write(serverInit, binary.BigEndian, []uint16{width, height})
+	serverInit.Write([]byte{32, 24, 0, 1, 0, 255, 0, 255, 0, 255, 16, 8, 0, 0, 0, 0})
+	binary.Write(serverInit, binary.BigEndian, uint32(4))
+	serverInit.WriteString("desk")
+	conn.Write(serverInit.Bytes())
+
+	fakeConn := &fakeVncConn{Conn: conn}
+	s.mutex.Lock()
+	s.conns = append(s.conns, fakeConn)
+	s.mutex.Unlock()
+
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
+		s.mutex.Lock()
+		fakeConn.received.Write(buf[:n])
+		fakeConn.closed = err != nil
+		s.mutex.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// waitFor waits until connection i (in the order of the handshakes) is in the state checked by done
+func (s *fakeVncServer) waitFor(t *testing.T, i int, done func(*fakeVncConn) bool) *fakeVncConn {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		s.mutex.Lock()
+		ok := len(s.conns) > i && done(s.conns[i])
+		s.mutex.Unlock()
+		if ok {
+			return s.conns[i]
+		}
+	}
+	t.Fatalf("timed out waiting for vnc-server connection %d", i)
+	return nil
+}
+
+// syncBufferConn is a vnc-client connection keeping what the proxy writes to it
+type syncBufferConn struct {
+	bufferConn
+	mutex sync.Mutex
+}
+
+func (c *syncBufferConn) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.written.Write(p)
+}
+
+func (c *syncBufferConn) Close() error {
+	return nil
+}
+
+func (c *syncBufferConn) Bytes() []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]byte{}, c.written.Bytes()...)
+}
+
+// resetCounter counts the SegmentConnectionReset segments it gets
+type resetCounter struct {
+	mutex  sync.Mutex
+	resets int
+}
+
+func (r *resetCounter) Consume(seg *common.RfbSegment) error {
+	if seg.SegmentType == common.SegmentConnectionReset {
+		r.mutex.Lock()
+		r.resets++
+		r.mutex.Unlock()
+	}
+	return nil
+}
+
+func (r *resetCounter) count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.resets
+}
+
+func TestConnectUpstreamRetries(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	vp := &VncProxy{RetryBackoff: 10 * time.Millisecond}
+	session := &VncSession{ID: "desk1", Target: addr}
+	start := time.Now()
+	_, err = vp.connectUpstream(session, logger.With(), func(*client.ClientConn) {}, 2, time.Time{}, nil)
+	if err == nil {
+		t.Fatal("expected connecting to a closed port to fail")
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("expected the retries to back off 10ms then 20ms, took %s", elapsed)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	if _, err = vp.connectUpstream(session, logger.With(), func(*client.ClientConn) {}, -1, time.Time{}, stop); err != errUpstreamStopped {
+		t.Errorf("expected retrying to stop, got %v", err)
+	}
+}
+
+func TestUpstreamReconnect(t *testing.T) {
+	server := newFakeVncServer(t, 40, 20)
+	defer server.listener.Close()
+
+	vp := &VncProxy{Reconnect: true, RetryBackoff: 10 * time.Millisecond}
+	session := &VncSession{ID: "desk1", Target: server.listener.Addr().String()}
+	viewerConn := &syncBufferConn{}
+	viewer, err := wsserver.NewServerConnIO(viewerConn, &wsserver.ServerConfig{ClientMessages: wsserver.DefaultClientMessages, PixelFormat: common.NewPixelFormat(16)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link := newUpstreamLink(vp, session, logger.With())
+	link.listeners.AddListener(&wsServerUpdater{viewer})
+	updater := &ClientUpdater{}
+	link.reconnectViewer(viewer, updater)
+	viewer.Listeners().AddListener(updater)
+	cconn, err := link.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	updater.setUpstream(cconn)
+	if viewer.Width() != 40 || viewer.Height() != 20 {
+		t.Fatalf("the vnc-client didn't get the server-init size, got %dx%d", viewer.Width(), viewer.Height())
+	}
+
+	resets := &resetCounter{}
+	link.listeners.AddListener(resets)
+
+	//the vnc-client asks for a 16 bit pixel format, Tight & DesktopSize support
+	pixelFormat := *common.NewPixelFormat(16)
+	viewer.SetPixelFormat(&pixelFormat)
+	setEncodings := &wsserver.MsgSetEncodings{Encodings: []common.EncodingType{common.EncTight, common.EncRaw, common.EncDesktopSizePseudo}}
+	updater.Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedClientMessage, Message: setEncodings})
+
+	//the vnc-server restarts with a bigger desktop
+	first := server.waitFor(t, 0, func(*fakeVncConn) bool { return true })
+	server.mutex.Lock()
+	server.width, server.height = 80, 30
+	server.mutex.Unlock()
+	first.Close()
+
+	//it gets the vnc-client's pixel format & encodings without the zlib based ones, then a full update request
+	encodingsConn := &bufferConn{}
+	encodingsWriter, _ := wsserver.NewServerConnIO(encodingsConn, &wsserver.ServerConfig{ClientMessages: wsserver.DefaultClientMessages})
+	withoutTight := &wsserver.MsgSetEncodings{Encodings: []common.EncodingType{common.EncRaw, common.EncDesktopSizePseudo}}
+	withoutTight.Write(encodingsWriter)
+	expected := bytes.NewBuffer(encodingsConn.written.Bytes())
+	expected.Write([]byte{byte(common.FramebufferUpdateRequestMsgType), 0})
+	binary.Write(expected, binary.BigEndian, []uint16{0, 0, 80, 30})
+	//SetPixelFormat is 20 bytes
+	expectedLen := 20 + expected.Len()
+	second := server.waitFor(t, 1, func(conn *fakeVncConn) bool { return conn.received.Len() >= expectedLen })
+	server.mutex.Lock()
+	received := append([]byte{}, second.received.Bytes()...)
+	server.mutex.Unlock()
+	if received[0] != byte(common.SetPixelFormatMsgType) || received[4] != 16 {
+		t.Errorf("the reconnected vnc-server didn't get the 16 bit pixel format: %v", received[:20])
+	}
+	if !bytes.Equal(received[20:], expected.Bytes()) {
+		t.Errorf("the reconnected vnc-server got %v, want %v", received[20:], expected.Bytes())
+	}
+
+	desktopSize := &bytes.Buffer{}
+	desktopSize.Write([]byte{byte(common.FramebufferUpdate), 0, 0, 1})
+	binary.Write(desktopSize, binary.BigEndian, []uint16{0, 0, 80, 30})
+	binary.Write(desktopSize, binary.BigEndian, int32(common.EncDesktopSizePseudo))
+	if !bytes.Equal(viewerConn.Bytes(), desktopSize.Bytes()) {
+		t.Errorf("the vnc-client got %v, want a DesktopSize update %v", viewerConn.Bytes(), desktopSize.Bytes())
+	}
+	if viewer.Width() != 80 || viewer.Height() != 30 {
+		t.Errorf("the vnc-client size wasn't updated, got %dx%d", viewer.Width(), viewer.Height())
+	}
+	if resets.count() != 1 {
+		t.Errorf("expected the listeners to be told about the reconnect once, got %d", resets.count())
+	}
+
+	//later SetEncodings of the vnc-client leave out zlib based encodings too
+	updater.Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedClientMessage, Message: setEncodings})
+	if got := updater.lastSetEncodings().(*wsserver.MsgSetEncodings).Encodings; len(got) != 2 || got[0] != common.EncRaw {
+		t.Errorf("expected Tight to be left out after the reconnect, got %v", got)
+	}
+
+	//the vnc-client leaving closes the vnc-server connection
+	viewer.Listeners().Consume(&common.RfbSegment{SegmentType: common.SegmentConnectionClosed})
+	server.waitFor(t, 1, func(conn *fakeVncConn) bool { return conn.closed })
+}
@@ -1,5 +1,10 @@
 package proxy
 
+import (
+	"fmt"
+	"time"
+)
+
 type SessionStatus int
 type SessionType int
 
@@ -15,13 +20,93 @@ const (
 	SessionTypeProxyPass
 )
 
+var sessionStatusNames = map[SessionStatus]string{
+	SessionStatusInit:   "init",
+	SessionStatusActive: "active",
+	SessionStatusError:  "error",
+}
+
+var sessionTypeNames = map[SessionType]string{
+	SessionTypeRecordingProxy: "recordingProxy",
+	SessionTypeReplayServer:   "replayServer",
+	SessionTypeProxyPass:      "proxyPass",
+}
+
+func (s SessionStatus) String() string {
+	return sessionStatusNames[s]
+}
+
+func (s SessionStatus) MarshalText() ([]byte, error) {
+	name, ok := sessionStatusNames[s]
+	if !ok {
+		return nil, fmt.Errorf("unknown session status: %d", int(s))
+	}
+	return []byte(name), nil
+}
+
+func (s *SessionStatus) UnmarshalText(text []byte) error {
+	for status, name := range sessionStatusNames {
+		if name == string(text) {
+			*s = status
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown session status: %s", text)
+}
+
+func (t SessionType) String() string {
+	return sessionTypeNames[t]
+}
+
+func (t SessionType) MarshalText() ([]byte, error) {
+	name, ok := sessionTypeNames[t]
+	if !ok {
+		return nil, fmt.Errorf("unknown session type: %d", int(t))
+	}
+	return []byte(name), nil
+}
+
+func (t *SessionType) UnmarshalText(text []byte) error {
+	for typ, name := range sessionTypeNames {
+		if name == string(text) {
+			*t = typ
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown session type: %s", text)
+}
+
 type VncSession struct {
-	Target         string
-	TargetHostname string
-	TargetPort     string
-	TargetPassword string
-	ID             string
-	Status         SessionStatus
-	Type           SessionType
-	ReplayFilePath string
+	Target         string `json:"target,omitempty"`
+	TargetHostname string `json:"targetHostname,omitempty"`
+	TargetPort     string `json:"targetPort,omitempty"`
+	TargetPassword string `json:"targetPassword,omitempty"`
+	// VeNCrypt tls to the target: the CA file verifies X509 certificates, the username is used for Plain sub-types
+	TargetTLS           bool          `json:"targetTLS,omitempty"`
+	TargetCAFile        string        `json:"targetCAFile,omitempty"`
+	TargetTLSSkipVerify bool          `json:"targetTLSSkipVerify,omitempty"`
+	TargetUsername      string        `json:"targetUsername,omitempty"`
+	ID                  string        `json:"id"`
+	Status              SessionStatus `json:"status"`
+	Type                SessionType   `json:"type"`
+	ReplayFilePath      string        `json:"replayFilePath,omitempty"`
+	// Shared sessions use one connection to the target for all vnc-clients, the first client is in control
+	// and the rest are view-only. Otherwise every client gets its own (exclusive) connection.
+	Shared bool `json:"shared,omitempty"`
+	// ViewOnly sessions drop all keyboard, mouse & clipboard input from the vnc-clients
+	ViewOnly bool `json:"viewOnly,omitempty"`
+
+	// lifecycle information, maintained by the SessionManager
+	CreatedAt        time.Time `json:"createdAt"`
+	UpdatedAt        time.Time `json:"updatedAt"`
+	LastConnectedAt  time.Time `json:"lastConnectedAt"`
+	ConnectedClients int       `json:"connectedClients"`
+}
+
+// TargetAddress returns the vnc server of the session, host:port or /path/to/unix.socket
+func (s *VncSession) TargetAddress() string {
+	if s.TargetHostname != "" && s.TargetPort != "" {
+		return s.TargetHostname + ":" + s.TargetPort
+	}
+	return s.Target
 }
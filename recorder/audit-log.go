@@ -0,0 +1,97 @@
+package recorder
+
+import (
+	"encoding/binary"
+	"os"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/server"
+	"github.com/amitbet/vncproxy/wsserver"
+)
+
+// auditClientMessage logs the input messages of the vnc-client: keys, mouse buttons (not moves) & clipboard text
+func (r *Recorder) auditClientMessage(msg interface{}) {
+	if !r.cfg.AuditLog || r.cfg.AuditSkipInput {
+		return
+	}
+	//the message type depends on the server package the vnc-client connected through
+	switch msg := msg.(type) {
+	case *server.MsgKeyEvent:
+		r.auditKey(uint32(msg.Key), msg.Down != 0)
+	case *wsserver.MsgKeyEvent:
+		r.auditKey(uint32(msg.Key), msg.Down != 0)
+	case *server.MsgClientQemuExtendedKey:
+		r.auditKey(msg.KeySym, msg.IsDown != 0)
+	case *wsserver.MsgClientQemuExtendedKey:
+		r.auditKey(msg.KeySym, msg.IsDown != 0)
+	case *server.MsgPointerEvent:
+		r.auditPointer(msg.Mask, msg.X, msg.Y)
+	case *wsserver.MsgPointerEvent:
+		r.auditPointer(msg.Mask, msg.X, msg.Y)
+	case *server.MsgClientCutText:
+		r.auditClipboard(common.AuditFromClient, msg.Text)
+	case *wsserver.MsgClientCutText:
+		r.auditClipboard(common.AuditFromClient, msg.Text)
+	}
+}
+
+func (r *Recorder) auditKey(keysym uint32, down bool) {
+	eventType := common.AuditKeyUp
+	if down {
+		eventType = common.AuditKeyDown
+	}
+	r.writeAuditEvent(common.RecordingAuditEvent{Type: eventType, Key: common.KeysymName(keysym), Keysym: keysym})
+}
+
+// auditPointer logs the mouse buttons that changed since the last pointer event
+func (r *Recorder) auditPointer(mask uint8, x, y uint16) {
+	changed := mask ^ r.pointerMask
+	r.pointerMask = mask
+	for button := 0; button < 8; button++ {
+		if changed&(1<<button) == 0 {
+			continue
+		}
+		eventType := common.AuditMouseUp
+		if mask&(1<<button) != 0 {
+			eventType = common.AuditMouseDown
+		}
+		r.writeAuditEvent(common.RecordingAuditEvent{Type: eventType, Button: button + 1, X: int(x), Y: int(y)})
+	}
+}
+
+func (r *Recorder) auditClipboard(direction string, text []byte) {
+	r.writeAuditEvent(common.RecordingAuditEvent{Type: common.AuditClipboard, Direction: direction, Text: string(text)})
+}
+
+// auditServerCutText logs the clipboard text of a ServerCutText message collected from the recorded stream
+func (r *Recorder) auditServerCutText(msg []byte) {
+	//type, 3 bytes of padding, length & text
+	if len(msg) < 8 {
+		return
+	}
+	length := binary.BigEndian.Uint32(msg[4:8])
+	text := msg[8:]
+	if uint32(len(text)) > length {
+		text = text[:length]
+	}
+	r.auditClipboard(common.AuditFromServer, text)
+}
+
+func (r *Recorder) writeAuditEvent(event common.RecordingAuditEvent) {
+	if r.writer == nil {
+		return
+	}
+	if r.audit == nil {
+		auditFileName := common.RecordingAuditFileName(r.RBSFileName)
+		audit, err := os.OpenFile(auditFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			r.log.Errorf("Recorder: can't open the audit log %s: %s", auditFileName, err)
+			return
+		}
+		r.audit = audit
+	}
+	event.Timestamp = uint32(getNowMillisec() - r.startTime)
+	if err := common.WriteRecordingAuditEvent(r.audit, event); err != nil {
+		r.log.Errorf("Recorder: error writing the audit log of %s: %s", r.RBSFileName, err)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/amitbet/vncproxy/client"
@@ -18,9 +21,15 @@ func main() {
 	// var wsPort = flag.String("wsPort", "", "websocket port")
 	// var vncPass = flag.String("vncPass", "", "password on incoming vnc connections to the proxy, defaults to no password")
 	var recordDir = flag.String("recFile", "", "FBS file to create, recordings WILL NOT RECORD IF EMPTY.")
+	var recordCompression = flag.String("recCompression", "", "write a compressed recording (zstd or gzip) instead of an FBS file")
+	var keyframeInterval = flag.Duration("keyframeInterval", time.Minute, "store a full screen update this often & index it in a .idx file, so the recording can be played from any point (0 = no index)")
 	var targetVncPort = flag.String("targPort", "", "target vnc server port")
 	var targetVncPass = flag.String("targPass", "", "target vnc password")
 	var targetVncHost = flag.String("targHost", "localhost", "target vnc hostname")
+	var targetTLS = flag.Bool("targTLS", false, "connect to the target vnc server with VeNCrypt tls")
+	var targetCA = flag.String("targCA", "", "PEM CA certificates to verify the target's X509 certificate, defaults to the system roots")
+	var targetTLSSkipVerify = flag.Bool("targTLSSkipVerify", false, "don't verify the target's tls certificate")
+	var targetUser = flag.String("targUser", "", "target username for VeNCrypt Plain authentication (used with -targPass)")
 	var logLevel = flag.String("logLevel", "info", "change logging level")
 
 	flag.Parse()
@@ -52,33 +61,55 @@ func main() {
 
 	if err != nil {
 		logger.Errorf("error connecting to vnc server: %s", err)
+		return
 	}
 	var noauth client.ClientAuthNone
 	authArr := []client.ClientAuth{&client.PasswordAuth{Password: *targetVncPass}, &noauth}
+	if *targetTLS {
+		vencrypt, err := client.NewClientAuthVeNCrypt(*targetCA, *targetVncHost, *targetUser, *targetVncPass)
+		if err != nil {
+			logger.Errorf("error loading tls settings: %s", err)
+			return
+		}
+		vencrypt.TLSConfig.InsecureSkipVerify = *targetTLSSkipVerify
+		authArr = []client.ClientAuth{vencrypt}
+	}
 
 	//vncSrvMessagesChan := make(chan common.ServerMessage)
 
+	var clientConn *client.ClientConn
 	//rec, err := recorder.NewRecorder("c:/Users/betzalel/recording.rbs")
-	rec, err := recorder.NewRecorder(*recordDir) //"/Users/amitbet/vncRec/recording.rbs")
+	rec, err := recorder.NewRecorderWithConfig(*recordDir, recorder.RecorderConfig{ //"/Users/amitbet/vncRec/recording.rbs")
+		Compression:      *recordCompression,
+		Metadata:         common.RecordingMetadata{Target: *targetVncHost + ":" + *targetVncPort},
+		KeyframeInterval: *keyframeInterval,
+		RequestKeyframe: func() {
+			clientConn.FramebufferUpdateRequest(false, 0, 0, clientConn.Width(), clientConn.Height())
+		},
+	})
 	if err != nil {
 		logger.Errorf("error creating recorder: %s", err)
 		return
 	}
 
-	clientConn, err := client.NewClientConn(nc,
+	clientConn, err = client.NewClientConn(nc,
 		&client.ClientConfig{
 			Auth:      authArr,
 			Exclusive: true,
 		})
 
-	clientConn.Listeners.AddListener(rec)
-	clientConn.Listeners.AddListener(&recorder.RfbRequester{Conn: clientConn, Name: "Rfb Requester"})
-	clientConn.Connect()
-
 	if err != nil {
 		logger.Errorf("error creating client: %s", err)
 		return
 	}
+
+	clientConn.Listeners().AddListener(rec)
+	clientConn.Listeners().AddListener(&recorder.RfbRequester{Conn: clientConn, Name: "Rfb Requester"})
+	err = clientConn.Connect()
+	if err != nil {
+		logger.Errorf("error connecting to vnc server: %s", err)
+		return
+	}
 	// err = clientConn.FramebufferUpdateRequest(false, 0, 0, 1024, 768)
 	// if err != nil {
 	// 	logger.Errorf("error requesting fb update: %s", err)
@@ -95,7 +126,11 @@ func main() {
 		&encodings.PseudoEncoding{int32(common.EncJPEGQualityLevelPseudo8)},
 	}
 
-	clientConn.SetEncodings(encs)
+	encTypes := make([]common.EncodingType, len(encs))
+	for i, enc := range encs {
+		encTypes[i] = common.EncodingType(enc.Type())
+	}
+	clientConn.SetEncodings(encTypes)
 	//width := uint16(1280)
 	//height := uint16(800)
 
@@ -130,8 +165,16 @@ func main() {
 	// 	clientConn.Close()
 	// }()
 
-	for {
-		time.Sleep(time.Minute)
+	//record until the vnc server disconnects or we are stopped
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case <-rec.Done():
+		logger.Info("vnc server disconnected, recording saved to: ", *recordDir)
+	case <-ctx.Done():
+		clientConn.Close()
+		rec.Close()
+		logger.Info("stopped, recording saved to: ", *recordDir)
 	}
 }
 func getNowMillisec() int {
@@ -0,0 +1,35 @@
+package recorder
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/amitbet/vncproxy/common"
+)
+
+// compressedWriter writes the compressed recording format (see common.CompressedRecordingMagic),
+// the rfb stream is the same as in FBS files, compressed block by block with zstd or gzip
+type compressedWriter struct {
+	compression string
+	metadata    common.RecordingMetadata
+}
+
+func (w *compressedWriter) header(initMsg *common.ServerInit, segment int, startTime time.Time) ([]byte, error) {
+	metadata := w.metadata
+	metadata.Compression = w.compression
+	metadata.StartTime = startTime
+	metadata.Segment = segment
+	metadata.Width = initMsg.FBWidth
+	metadata.Height = initMsg.FBHeight
+	metadata.DesktopName = string(initMsg.NameText)
+
+	buf := bytes.Buffer{}
+	if _, err := common.WriteCompressedRecordingHeader(&buf, &metadata); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (w *compressedWriter) block(data []byte, timestamp uint32) ([]byte, error) {
+	return common.EncodeRecordingBlock(w.compression, data, timestamp)
+}
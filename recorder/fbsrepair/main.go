@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/amitbet/vncproxy/logger"
+	"github.com/amitbet/vncproxy/recorder"
+)
+
+func main() {
+	checkOnly := flag.Bool("check", false, "only report damaged recordings, don't change them")
+	logLevel := flag.String("logLevel", "info", "change logging level")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-check] recording.rbs...\ntrims the damaged tail of fbs recordings after their last complete block\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	logger.SetLogLevel(*logLevel)
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, fileName := range flag.Args() {
+		if err := repair(fileName, *checkOnly); err != nil {
+			logger.Errorf("%s: %s", fileName, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func repair(fileName string, checkOnly bool) error {
+	if !checkOnly {
+		trimmed, err := recorder.RepairFbsFile(fileName)
+		if err != nil {
+			return err
+		}
+		if trimmed > 0 {
+			fmt.Printf("%s: trimmed %d bytes\n", fileName, trimmed)
+		} else {
+			fmt.Printf("%s: ok\n", fileName)
+		}
+		return nil
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	validSize, blocks, err := recorder.ScanFbsFile(file)
+	if err != nil {
+		return err
+	}
+	if validSize < info.Size() {
+		fmt.Printf("%s: damaged, %d bytes after %d complete blocks\n", fileName, info.Size()-validSize, blocks)
+	} else {
+		fmt.Printf("%s: ok, %d blocks\n", fileName, blocks)
+	}
+	return nil
+}
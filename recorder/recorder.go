@@ -3,13 +3,82 @@ package recorder
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/amitbet/vncproxy/client"
 	"github.com/amitbet/vncproxy/common"
 	"github.com/amitbet/vncproxy/logger"
+	"github.com/amitbet/vncproxy/metrics"
 	"github.com/amitbet/vncproxy/server"
+	"github.com/amitbet/vncproxy/wsserver"
 )
 
+// RecorderConfig sets how a recording is split into segments, every segment is a complete fbs file
+// (header, server init & timestamps starting from 0). A new segment starts at the next server message
+// after a limit was reached.
+//
+// Note that zlib based encodings (Tight, ZLib, ZRLE) keep their compression state across segments,
+// so such segments can only be decoded in order. Ask the vnc-server for other encodings (see common.WithoutZlibStreams)
+// for every segment to be playable on its own.
+type RecorderConfig struct {
+	// start a new segment once the current file reaches this size, 0 = no size limit
+	MaxSegmentBytes int64
+	// start a new segment once the current one is this long, 0 = no duration limit
+	MaxSegmentDuration time.Duration
+	// the file name of segment n (n > 0), nil = the save path with -001, -002.. added before the extension
+	SegmentFileName func(segment int) string
+	// called on the recorder's goroutine after a new segment was started,
+	// e.g. to request a full screen update so the segment can be played on its own
+	OnNewSegment func()
+	// "" = FBS files (playable by the tightvnc player), common.CompressionZstd or common.CompressionGzip = compressed recordings
+	Compression string
+	// session details saved in the header of compressed recordings
+	Metadata common.RecordingMetadata
+	// store a keyframe (a full screen update starting a new block) this often and index it in a .idx file next to
+	// the recording, so it can be played from any point. 0 = no keyframes & no index
+	KeyframeInterval time.Duration
+	// asks the vnc-server for a full screen update (a non-incremental FramebufferUpdateRequest), called on the
+	// recorder's goroutine for every keyframe and new segment
+	RequestKeyframe func()
+	// write a .audit.jsonl file next to every segment, with the vnc-client's keys, mouse clicks & clipboard text and
+	// the vnc-server's clipboard text, timestamped like the segment's blocks
+	AuditLog bool
+	// the vnc-client's input doesn't reach the vnc-server (view-only), only the vnc-server's clipboard is logged
+	AuditSkipInput bool
+	// logs the recorder's lines with the fields of the recorded session, nil = no fields
+	Logger *logger.FieldLogger
+}
+
+// recordingWriter frames the recorded rfb stream in a file format
+type recordingWriter interface {
+	// header returns the start of a new file, written before its first block
+	header(initMsg *common.ServerInit, segment int, startTime time.Time) ([]byte, error)
+	// block returns the rfb bytes recorded at timestamp (ms since the start of the file) as a complete block
+	block(data []byte, timestamp uint32) ([]byte, error)
+}
+
+// fbsWriter writes the FBS 001.000 format of the tightvnc recorder
+type fbsWriter struct{}
+
+func (fbsWriter) header(*common.ServerInit, int, time.Time) ([]byte, error) {
+	return []byte("FBS 001.000\n"), nil
+}
+
+func (fbsWriter) block(data []byte, timestamp uint32) ([]byte, error) {
+	//[size|data padded to 32bit|timestamp]
+	paddedSize := (len(data) + 3) & 0x7FFFFFFC
+	block := make([]byte, 4+paddedSize+4)
+	binary.BigEndian.PutUint32(block, uint32(len(data)))
+	copy(block[4:], data)
+	binary.BigEndian.PutUint32(block[4+paddedSize:], timestamp)
+	return block, nil
+}
+
 type Recorder struct {
 	//common.BytesListener
 	RBSFileName string
@@ -21,41 +90,242 @@ type Recorder struct {
 	sessionStartWritten bool
 	segmentChan         chan *common.RfbSegment
 	maxWriteSize        int
+	quit                chan struct{}
+	done                chan struct{}
+	closeOnce           sync.Once
+	cfg                 RecorderConfig
+	firstFileName       string
+	segment             int
+	segmentBytes        int64
+	fileMutex           sync.Mutex
+	format              recordingWriter
+	index               *os.File
+	keyframePending     bool
+	keyframeRequested   int
+	keyframe            *common.RecordingIndexEntry //the update that may be the requested keyframe, indexed once it is parsed
+	lastKeyframe        int
+	zlibStreams         bool //zlib based rectangles were recorded, the updates after them can't be decoded on their own
+	audit               *os.File
+	pointerMask         uint8
+	serverCutText       *bytes.Buffer //the ServerCutText message being recorded, for the audit log
+	resized             bool          //the desktop size changed since the start of the segment
+	log                 *logger.FieldLogger
 }
 
+var recordingBytes = metrics.NewCounter("vncproxy_recording_bytes_written_total", "Bytes written to recording files.")
+
 func getNowMillisec() int {
 	return int(time.Now().UnixNano() / int64(time.Millisecond))
 }
 
 func NewRecorder(saveFilePath string) (*Recorder, error) {
-	//delete file if it exists
-	if _, err := os.Stat(saveFilePath); err == nil {
-		os.Remove(saveFilePath)
-	}
+	return NewRecorderWithConfig(saveFilePath, RecorderConfig{})
+}
 
-	rec := Recorder{RBSFileName: saveFilePath, startTime: getNowMillisec()}
+// NewRecorderWithConfig creates a recorder that splits the recording into segments, saveFilePath is the first segment
+func NewRecorderWithConfig(saveFilePath string, cfg RecorderConfig) (*Recorder, error) {
+	rec := Recorder{RBSFileName: saveFilePath, firstFileName: saveFilePath, startTime: getNowMillisec(), cfg: cfg}
+	rec.log = cfg.Logger
 	var err error
 
+	switch cfg.Compression {
+	case "":
+		rec.format = fbsWriter{}
+	case common.CompressionZstd, common.CompressionGzip:
+		rec.format = &compressedWriter{compression: cfg.Compression, metadata: cfg.Metadata}
+	default:
+		return nil, common.ErrUnknownCompression
+	}
+
 	rec.maxWriteSize = 65535
 
-	rec.writer, err = os.OpenFile(saveFilePath, os.O_RDWR|os.O_CREATE, 0644)
+	rec.writer, err = openRecordingFile(saveFilePath)
 	if err != nil {
-		logger.Errorf("unable to open file: %s, error: %v", saveFilePath, err)
 		return nil, err
 	}
+	//the first screen update of a recording is a full one, requested by the vnc-client
+	rec.keyframePending = true
+	rec.keyframeRequested = rec.startTime
 
 	//buffer the channel so we don't halt the proxying flow for slow writes when under pressure
 	rec.segmentChan = make(chan *common.RfbSegment, 100)
-	go func() {
-		for {
-			data := <-rec.segmentChan
-			rec.HandleRfbSegment(data)
-		}
-	}()
+	rec.quit = make(chan struct{})
+	rec.done = make(chan struct{})
+	go rec.writeLoop()
 
 	return &rec, nil
 }
 
+func openRecordingFile(saveFilePath string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(saveFilePath), 0755); err != nil {
+		logger.Errorf("unable to create the directory of: %s, error: %v", saveFilePath, err)
+		return nil, err
+	}
+	//replace the file (and its index & audit log) if it exists
+	writer, err := os.OpenFile(saveFilePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		logger.Errorf("unable to open file: %s, error: %v", saveFilePath, err)
+		return nil, err
+	}
+	os.Remove(common.RecordingIndexFileName(saveFilePath))
+	os.Remove(common.RecordingAuditFileName(saveFilePath))
+	return writer, nil
+}
+
+// FileName returns the file of the segment being recorded
+func (r *Recorder) FileName() string {
+	r.fileMutex.Lock()
+	defer r.fileMutex.Unlock()
+	return r.RBSFileName
+}
+
+// segmentFileName is the file name of segment n when no SegmentFileName is configured: name-001.rbs, name-002.rbs...
+func (r *Recorder) segmentFileName(segment int) string {
+	if r.cfg.SegmentFileName != nil {
+		return r.cfg.SegmentFileName(segment)
+	}
+	ext := filepath.Ext(r.firstFileName)
+	return fmt.Sprintf("%s-%03d%s", strings.TrimSuffix(r.firstFileName, ext), segment, ext)
+}
+
+// segmentFull returns true when the current segment reached one of its limits
+func (r *Recorder) segmentFull() bool {
+	if r.cfg.MaxSegmentBytes > 0 && r.segmentBytes+int64(r.buffer.Len()) >= r.cfg.MaxSegmentBytes {
+		return true
+	}
+	if r.cfg.MaxSegmentDuration > 0 && time.Duration(getNowMillisec()-r.startTime)*time.Millisecond >= r.cfg.MaxSegmentDuration {
+		return true
+	}
+	return false
+}
+
+// checkKeyframe is called at the start of every screen update: while a full screen update is awaited the update
+// starts a block & is indexed once parsed (see indexKeyframe), a full screen update is requested when the last
+// keyframe is old enough
+func (r *Recorder) checkKeyframe() {
+	if r.cfg.KeyframeInterval <= 0 {
+		return
+	}
+	now := getNowMillisec()
+	if r.keyframePending {
+		//the keyframe starts a block, so the player can start reading the file at its offset
+		r.writeToDisk()
+		r.keyframe = &common.RecordingIndexEntry{Timestamp: uint32(now - r.startTime), Offset: r.segmentBytes, ZlibStreams: r.zlibStreams}
+		if r.resized {
+			//playing from the keyframe starts with the size of the segment's header, tell it about the current one
+			r.buffer.Write(common.DesktopSizeUpdate(r.serverInitMessage.FBWidth, r.serverInitMessage.FBHeight))
+		}
+		//incremental updates may keep coming instead of the full one, ask again
+		if time.Duration(now-r.keyframeRequested)*time.Millisecond >= r.cfg.KeyframeInterval {
+			r.requestKeyframe()
+		}
+		return
+	}
+	if time.Duration(now-r.lastKeyframe)*time.Millisecond >= r.cfg.KeyframeInterval {
+		r.requestKeyframe()
+	}
+}
+
+func (r *Recorder) requestKeyframe() {
+	if r.cfg.RequestKeyframe == nil {
+		return
+	}
+	r.cfg.RequestKeyframe()
+	r.keyframePending = true
+	r.keyframeRequested = getNowMillisec()
+}
+
+// indexKeyframe is called with every parsed screen update, it is indexed when it is the awaited full screen update
+func (r *Recorder) indexKeyframe(update *client.MsgFramebufferUpdate) {
+	keyframe := r.keyframe
+	r.keyframe = nil
+	for _, rect := range update.Rectangles {
+		if rect.Enc != nil && common.EncodingType(rect.Enc.Type()).UsesZlibStream() {
+			r.zlibStreams = true
+		}
+	}
+	if keyframe == nil || r.serverInitMessage == nil || !coversScreen(update, r.serverInitMessage.FBWidth, r.serverInitMessage.FBHeight) {
+		return
+	}
+	r.writeIndexEntry(*keyframe)
+	r.keyframePending = false
+	r.lastKeyframe = getNowMillisec()
+}
+
+// coversScreen returns true when the update's rectangles fill the framebuffer without copying from it.
+// The rectangles of an update don't overlap, so their areas are added up.
+func coversScreen(update *client.MsgFramebufferUpdate, width, height uint16) bool {
+	area := 0
+	for _, rect := range update.Rectangles {
+		if rect.Enc == nil || rect.Enc.Type() < 0 || common.EncodingType(rect.Enc.Type()) == common.EncCopyRect {
+			continue
+		}
+		if rect.X >= width || rect.Y >= height {
+			continue
+		}
+		w, h := int(rect.Width), int(rect.Height)
+		if int(rect.X)+w > int(width) {
+			w = int(width) - int(rect.X)
+		}
+		if int(rect.Y)+h > int(height) {
+			h = int(height) - int(rect.Y)
+		}
+		area += w * h
+	}
+	return area >= int(width)*int(height)
+}
+
+func (r *Recorder) writeIndexEntry(entry common.RecordingIndexEntry) {
+	if r.writer == nil {
+		return
+	}
+	if r.index == nil {
+		indexFileName := common.RecordingIndexFileName(r.RBSFileName)
+		index, err := os.OpenFile(indexFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			r.log.Errorf("Recorder: can't open the index %s: %s", indexFileName, err)
+			return
+		}
+		r.index = index
+	}
+	if err := common.WriteRecordingIndexEntry(r.index, entry); err != nil {
+		r.log.Errorf("Recorder: error writing the index of %s: %s", r.RBSFileName, err)
+	}
+}
+
+// startNewSegment closes the current file and opens the next segment, the session start is written with the next message
+func (r *Recorder) startNewSegment() {
+	r.writeToDisk()
+	r.closeFile()
+
+	fileName := r.segmentFileName(r.segment + 1)
+	writer, err := openRecordingFile(fileName)
+	if err != nil {
+		//keep appending to the current segment rather than losing the recording
+		r.log.Errorf("Recorder: can't start a new segment, continuing %s", r.RBSFileName)
+		r.writer, err = os.OpenFile(r.RBSFileName, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			r.log.Errorf("Recorder: can't reopen %s: %s", r.RBSFileName, err)
+			r.writer = nil
+		}
+		r.cfg.MaxSegmentBytes = 0
+		r.cfg.MaxSegmentDuration = 0
+		return
+	}
+
+	r.fileMutex.Lock()
+	r.segment++
+	r.RBSFileName = fileName
+	r.fileMutex.Unlock()
+	r.writer = writer
+	r.segmentBytes = 0
+	r.startTime = getNowMillisec()
+	r.sessionStartWritten = false
+	r.resized = false
+	r.keyframe = nil
+	r.log.Infof("Recorder: started recording segment %s", fileName)
+}
+
 const versionMsg_3_3 = "RFB 003.003\n"
 const versionMsg_3_7 = "RFB 003.007\n"
 const versionMsg_3_8 = "RFB 003.008\n"
@@ -80,8 +350,16 @@ func (r *Recorder) writeStartSession(initMsg *common.ServerInit) error {
 	framebufferWidth := initMsg.FBWidth
 	framebufferHeight := initMsg.FBHeight
 
-	//write rfb header information (the only part done without the [size|data|timestamp] block wrapper)
-	r.writer.WriteString("FBS 001.000\n")
+	//write the file header (the only part done without the block wrapper)
+	header, err := r.format.header(initMsg, r.segment, time.UnixMilli(int64(r.startTime)))
+	if err != nil {
+		return err
+	}
+	if r.writer != nil {
+		n, _ := r.writer.Write(header)
+		recordingBytes.Add(uint64(n))
+	}
+	r.segmentBytes += int64(len(header))
 
 	//push the version message into the buffer so it will be written in the first rbs block
 	r.buffer.WriteString(versionMsg_3_3)
@@ -116,60 +394,178 @@ func (r *Recorder) Consume(data *common.RfbSegment) error {
 	case r.segmentChan <- data:
 		// default:
 		// 	logger.Error("error: recorder queue is full")
+	case <-r.quit:
+		//closed, nothing more is recorded
 	}
 
 	return nil
 }
 
+// flushInterval is the longest time recorded data waits in memory, so a crash loses at most that much of the recording
+var flushInterval = time.Second
+
+// writeLoop writes the queued segments until the recorded connection closes or the recorder is closed,
+// then writes whatever is left and closes the file
+func (r *Recorder) writeLoop() {
+	defer close(r.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case data := <-r.segmentChan:
+			r.HandleRfbSegment(data)
+			if data.SegmentType == common.SegmentConnectionClosed {
+				//the recording is over, stop accepting segments
+				r.closeOnce.Do(func() {
+					close(r.quit)
+				})
+				r.finish()
+				return
+			}
+		case <-ticker.C:
+			r.writeToDisk()
+		case <-r.quit:
+			r.finish()
+			return
+		}
+	}
+}
+
+// finish writes the segments still queued and closes the file
+func (r *Recorder) finish() {
+	for {
+		select {
+		case data := <-r.segmentChan:
+			r.HandleRfbSegment(data)
+		default:
+			r.writeToDisk()
+			r.closeFile()
+			return
+		}
+	}
+}
+
+// closeFile syncs the current file to disk before closing it, so a finished segment survives a crash
+func (r *Recorder) closeFile() {
+	if r.index != nil {
+		r.index.Sync()
+		r.index.Close()
+		r.index = nil
+	}
+	if r.audit != nil {
+		r.audit.Sync()
+		r.audit.Close()
+		r.audit = nil
+	}
+	if r.writer == nil {
+		return
+	}
+	if err := r.writer.Sync(); err != nil {
+		r.log.Errorf("Recorder: error syncing %s: %s", r.RBSFileName, err)
+	}
+	if err := r.writer.Close(); err != nil {
+		r.log.Errorf("Recorder: error closing %s: %s", r.RBSFileName, err)
+	}
+	r.writer = nil
+}
+
 func (r *Recorder) HandleRfbSegment(data *common.RfbSegment) error {
 	defer func() {
-		if r := recover(); r != nil {
-			logger.Error("Recovered in HandleRfbSegment: ", r)
+		if err := recover(); err != nil {
+			r.log.Error("Recovered in HandleRfbSegment: ", err)
 		}
 	}()
 
 	switch data.SegmentType {
 	case common.SegmentMessageStart:
+		newSegment := r.sessionStartWritten && r.segmentFull()
+		if newSegment {
+			r.startNewSegment()
+		}
 		if !r.sessionStartWritten {
-			logger.Debugf("Recorder.HandleRfbSegment: writing start session segment: %v", r.serverInitMessage)
+			r.log.Debugf("Recorder.HandleRfbSegment: writing start session segment: %v", r.serverInitMessage)
 			r.writeStartSession(r.serverInitMessage)
 		}
 
+		r.serverCutText = nil
 		switch common.ServerMessageType(data.UpcomingObjectType) {
 		case common.FramebufferUpdate:
-			logger.Debugf("Recorder.HandleRfbSegment: saving FramebufferUpdate segment")
-			//r.writeToDisk()
+			r.log.Debugf("Recorder.HandleRfbSegment: saving FramebufferUpdate segment")
+			r.checkKeyframe()
 		case common.SetColourMapEntries:
 		case common.Bell:
 		case common.ServerCutText:
+			if r.cfg.AuditLog {
+				r.serverCutText = &bytes.Buffer{}
+			}
 		default:
-			logger.Warn("Recorder.HandleRfbSegment: unknown message type:" + string(data.UpcomingObjectType))
+			r.log.Warnf("Recorder.HandleRfbSegment: unknown message type: %d", data.UpcomingObjectType)
+		}
+		if newSegment && r.cfg.OnNewSegment != nil {
+			r.cfg.OnNewSegment()
+		}
+		if newSegment {
+			r.requestKeyframe()
 		}
 	case common.SegmentConnectionClosed:
 		r.writeToDisk()
+	case common.SegmentConnectionReset:
+		//the new vnc-server connection starts without zlib streams, the full screen update it is asked for is a keyframe
+		r.zlibStreams = false
+		r.keyframe = nil
+		r.keyframePending = true
+		r.keyframeRequested = getNowMillisec()
 	case common.SegmentRectSeparator:
-		logger.Debugf("Recorder.HandleRfbSegment: writing rect")
+		r.log.Debugf("Recorder.HandleRfbSegment: writing rect")
 		//r.writeToDisk()
 	case common.SegmentBytes:
-		logger.Debug("Recorder.HandleRfbSegment: writing bytes, len:", len(data.Bytes))
+		r.log.Debug("Recorder.HandleRfbSegment: writing bytes, len:", len(data.Bytes))
 		if r.buffer.Len()+len(data.Bytes) > r.maxWriteSize-4 {
 			r.writeToDisk()
 		}
+		if r.serverCutText != nil {
+			r.serverCutText.Write(data.Bytes)
+		}
 		_, err := r.buffer.Write(data.Bytes)
 		return err
+	case common.SegmentMessageEnd:
+		if r.serverCutText != nil && common.ServerMessageType(data.UpcomingObjectType) == common.ServerCutText {
+			r.auditServerCutText(r.serverCutText.Bytes())
+			r.serverCutText = nil
+		}
 	case common.SegmentServerInitMessage:
 		r.serverInitMessage = data.Message.(*common.ServerInit)
+	case common.SegmentFullyParsedServerMessage:
+		if fbUpdate, ok := data.Message.(*client.MsgFramebufferUpdate); ok {
+			if width, height, resized := fbUpdate.DesktopSize(); resized && r.serverInitMessage != nil {
+				r.log.Infof("Recorder: the desktop size changed to %dx%d", width, height)
+				//new segments start with the new size, the server-init is shared with the other listeners
+				serverInit := *r.serverInitMessage
+				serverInit.FBWidth = width
+				serverInit.FBHeight = height
+				r.serverInitMessage = &serverInit
+				r.resized = true
+			}
+			r.indexKeyframe(fbUpdate)
+		}
 	case common.SegmentFullyParsedClientMessage:
 		clientMsg := data.Message.(common.ClientMessage)
 
 		switch clientMsg.Type() {
 		case common.SetPixelFormatMsgType:
-			clientMsg := data.Message.(*server.MsgSetPixelFormat)
-			logger.Debugf("Recorder.HandleRfbSegment: client message %v", *clientMsg)
-			r.serverInitMessage.PixelFormat = clientMsg.PF
+			//the message type depends on the server package the vnc-client connected through
+			switch clientMsg := data.Message.(type) {
+			case *server.MsgSetPixelFormat:
+				r.log.Debugf("Recorder.HandleRfbSegment: client message %v", *clientMsg)
+				r.serverInitMessage.PixelFormat = clientMsg.PF
+			case *wsserver.MsgSetPixelFormat:
+				r.log.Debugf("Recorder.HandleRfbSegment: client message %v", *clientMsg)
+				r.serverInitMessage.PixelFormat = clientMsg.PF
+			}
 		default:
 			//return errors.New("unknown client message type:" + string(data.UpcomingObjectType))
 		}
+		r.auditClientMessage(data.Message)
 
 	default:
 		//return errors.New("undefined RfbSegment type")
@@ -182,24 +578,25 @@ func (r *Recorder) writeToDisk() error {
 	if r.buffer.Len() == 0 {
 		return nil
 	}
+	if r.writer == nil {
+		r.buffer.Reset()
+		return os.ErrClosed
+	}
 
-	//write buff length
-	bytesLen := r.buffer.Len()
-	binary.Write(r.writer, binary.BigEndian, uint32(bytesLen))
-	paddedSize := (bytesLen + 3) & 0x7FFFFFFC
-	paddingSize := paddedSize - bytesLen
-
-	//logger.Debugf("paddedSize=%d paddingSize=%d bytesLen=%d", paddedSize, paddingSize, bytesLen)
-	//write buffer padded to 32bit
-	_, err := r.buffer.WriteTo(r.writer)
-	padding := make([]byte, paddingSize)
-	//logger.Debugf("padding=%v ", padding)
-
-	binary.Write(r.writer, binary.BigEndian, padding)
-
-	//write timestamp
-	binary.Write(r.writer, binary.BigEndian, uint32(timeSinceStart))
+	//the block is written at once, so a crash can only tear the last block
+	block, err := r.format.block(r.buffer.Bytes(), uint32(timeSinceStart))
 	r.buffer.Reset()
+	if err != nil {
+		r.log.Errorf("Recorder: error encoding a block of %s: %s", r.RBSFileName, err)
+		return err
+	}
+
+	n, err := r.writer.Write(block)
+	recordingBytes.Add(uint64(n))
+	if err != nil {
+		r.log.Errorf("Recorder: error writing to %s: %s", r.RBSFileName, err)
+	}
+	r.segmentBytes += int64(len(block))
 	return err
 }
 
@@ -209,6 +606,20 @@ func (r *Recorder) writeToDisk() error {
 // 	return r.Write(buf)
 // }
 
+// QueueDepth returns the number of segments waiting to be written, the queue holds 100 before slowing the proxy down
+func (r *Recorder) QueueDepth() int {
+	return len(r.segmentChan)
+}
+
+// Done is closed when the recording is finished: the recorded connection closed or Close was called
+func (r *Recorder) Done() <-chan struct{} {
+	return r.done
+}
+
+// Close writes the queued segments and closes the file, it is safe to call more than once
 func (r *Recorder) Close() {
-	r.writer.Close()
+	r.closeOnce.Do(func() {
+		close(r.quit)
+	})
+	<-r.done
 }
@@ -0,0 +1,593 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amitbet/vncproxy/client"
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/encodings"
+	"github.com/amitbet/vncproxy/player"
+	"github.com/amitbet/vncproxy/wsserver"
+)
+
+func TestRecorderSegments(t *testing.T) {
+	dir := t.TempDir()
+	newSegments := 0
+	rec, err := NewRecorderWithConfig(filepath.Join(dir, "rec.rbs"), RecorderConfig{
+		MaxSegmentBytes: 150,
+		OnNewSegment:    func() { newSegments++ },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentServerInitMessage, Message: &common.ServerInit{
+		FBWidth:     800,
+		FBHeight:    600,
+		PixelFormat: *common.NewPixelFormat(32),
+		NameText:    []byte("desk"),
+	}})
+	//every message is bigger than the segment limit, so each one starts a new segment
+	var messages [][]byte
+	for i := 0; i < 3; i++ {
+		msg := append([]byte{byte(common.FramebufferUpdate), 0, 0, 0}, bytes.Repeat([]byte{byte(i)}, 150)...)
+		messages = append(messages, msg)
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageStart, UpcomingObjectType: int(common.FramebufferUpdate)})
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentBytes, Bytes: msg})
+	}
+	rec.Close()
+
+	if newSegments != 2 {
+		t.Errorf("expected 2 new segments, got %d", newSegments)
+	}
+	for i, name := range []string{"rec.rbs", "rec-001.rbs", "rec-002.rbs"} {
+		fbs, err := player.NewFbsReader(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		initMsg, err := fbs.ReadStartSession()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if initMsg.FBWidth != 800 || initMsg.FBHeight != 600 || string(initMsg.NameText) != "desk" {
+			t.Errorf("%s: unexpected session start %+v", name, initMsg)
+		}
+		msg := make([]byte, len(messages[i]))
+		if _, err := fbs.Read(msg); err != nil || !bytes.Equal(msg, messages[i]) {
+			t.Errorf("%s: expected message %d, got %v (%v)", name, i, msg[:8], err)
+		}
+		fbs.Close()
+	}
+}
+
+// rawUpdate is a FramebufferUpdate with a single Raw rectangle of one color, in the 32 bit little endian pixel format
+func rawUpdate(x, y, w, h uint16, c color.RGBA) []byte {
+	msg := &bytes.Buffer{}
+	msg.Write([]byte{byte(common.FramebufferUpdate), 0, 0, 1})
+	binary.Write(msg, binary.BigEndian, []uint16{x, y, w, h})
+	binary.Write(msg, binary.BigEndian, int32(common.EncRaw))
+	for i := 0; i < int(w)*int(h); i++ {
+		msg.Write([]byte{c.B, c.G, c.R, 0})
+	}
+	return msg.Bytes()
+}
+
+func TestRecorderRotatedSegmentPlaysAlone(t *testing.T) {
+	dir := t.TempDir()
+	keyframeRequests := make(chan struct{}, 1)
+	rec, err := NewRecorderWithConfig(filepath.Join(dir, "rec.rbs"), RecorderConfig{
+		MaxSegmentBytes: 100,
+		RequestKeyframe: func() { keyframeRequests <- struct{}{} },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentServerInitMessage, Message: &common.ServerInit{
+		FBWidth:     4,
+		FBHeight:    2,
+		PixelFormat: *common.NewPixelFormat(32),
+		NameText:    []byte("desk"),
+	}})
+	consumeUpdate := func(msg []byte) {
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageStart, UpcomingObjectType: int(common.FramebufferUpdate)})
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentBytes, Bytes: msg})
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageEnd, UpcomingObjectType: int(common.FramebufferUpdate)})
+	}
+
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	green := color.RGBA{0, 255, 0, 255}
+	consumeUpdate(rawUpdate(0, 0, 4, 2, red))
+	//the first segment is full, an incremental update starts the next one & a full update is requested
+	consumeUpdate(rawUpdate(0, 0, 1, 1, blue))
+	select {
+	case <-keyframeRequests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no full screen update was requested for the new segment")
+	}
+	consumeUpdate(rawUpdate(0, 0, 4, 2, green))
+	rec.Close()
+
+	fbs, err := player.NewFbsReader(filepath.Join(dir, "rec-001.rbs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fbs.Close()
+	frames, err := player.NewFrameReader(fbs, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frame *image.RGBA
+	for {
+		img, _, err := frames.NextFrame()
+		if err != nil {
+			break
+		}
+		frame = img
+	}
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 4; x++ {
+			if got := frame.RGBAAt(x, y); got != green {
+				t.Errorf("the rotated segment played alone shows %v at %d,%d, want %v", got, x, y, green)
+			}
+		}
+	}
+	if updates := frames.Framebuffer().Updates(); updates != 2 {
+		t.Errorf("decoded %d updates of the rotated segment, want 2", updates)
+	}
+}
+
+// record writes a short recording and ends it like a disconnecting vnc server would
+func record(t *testing.T, fileName string, messages int) {
+	rec, err := NewRecorder(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentServerInitMessage, Message: &common.ServerInit{
+		FBWidth:     800,
+		FBHeight:    600,
+		PixelFormat: *common.NewPixelFormat(32),
+		NameText:    []byte("desk"),
+	}})
+	for i := 0; i < messages; i++ {
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageStart, UpcomingObjectType: int(common.Bell)})
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentBytes, Bytes: []byte{byte(common.Bell)}})
+	}
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentConnectionClosed})
+
+	select {
+	case <-rec.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the recorder didn't finish after the connection closed")
+	}
+	//segments after the end are dropped without blocking
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentBytes, Bytes: []byte{1}})
+	rec.Close()
+}
+
+func TestRecorderClosesOnConnectionClosed(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "rec.rbs")
+	record(t, fileName, 3)
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	info, _ := file.Stat()
+	validSize, blocks, err := ScanFbsFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validSize != info.Size() || blocks == 0 {
+		t.Errorf("expected a complete recording, valid %d of %d bytes in %d blocks", validSize, info.Size(), blocks)
+	}
+}
+
+func TestRepairFbsFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "rec.rbs")
+	record(t, fileName, 3)
+	info, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a block torn by a crash: a length and only part of the data
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0, 0, 0, 100, 0, 1, 2})
+	file.Close()
+
+	trimmed, err := RepairFbsFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trimmed != 7 {
+		t.Errorf("expected 7 bytes trimmed, got %d", trimmed)
+	}
+	repaired, _ := os.Stat(fileName)
+	if repaired.Size() != info.Size() {
+		t.Errorf("expected the original size %d, got %d", info.Size(), repaired.Size())
+	}
+
+	fbs, err := player.NewFbsReader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fbs.Close()
+	if _, err := fbs.ReadStartSession(); err != nil {
+		t.Errorf("the repaired recording can't be played: %s", err)
+	}
+
+	if trimmed, err := RepairFbsFile(fileName); err != nil || trimmed != 0 {
+		t.Errorf("repairing a valid file trimmed %d bytes (%v)", trimmed, err)
+	}
+}
+
+func TestCompressedRecording(t *testing.T) {
+	for _, compression := range []string{common.CompressionZstd, common.CompressionGzip} {
+		fileName := filepath.Join(t.TempDir(), "rec.vncr")
+		rec, err := NewRecorderWithConfig(fileName, RecorderConfig{
+			Compression: compression,
+			Metadata:    common.RecordingMetadata{SessionId: "desk1", Target: "10.0.0.1:5900"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentServerInitMessage, Message: &common.ServerInit{
+			FBWidth:     800,
+			FBHeight:    600,
+			PixelFormat: *common.NewPixelFormat(32),
+			NameText:    []byte("desk"),
+		}})
+		//a raw screen compresses well
+		msg := append([]byte{byte(common.FramebufferUpdate), 0, 0, 0}, bytes.Repeat([]byte{1, 2, 3, 4}, 100000)...)
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageStart, UpcomingObjectType: int(common.FramebufferUpdate)})
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentBytes, Bytes: msg})
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentConnectionClosed})
+		rec.Close()
+
+		if info, err := os.Stat(fileName); err != nil || info.Size() > int64(len(msg))/10 {
+			t.Errorf("%s: expected a small file, got %v (%v)", compression, info.Size(), err)
+		}
+
+		reader, err := player.OpenRecording(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed, ok := reader.(*player.CompressedReader)
+		if !ok {
+			t.Fatalf("%s: opened as %T", compression, reader)
+		}
+		metadata := compressed.Metadata()
+		if metadata.Compression != compression || metadata.SessionId != "desk1" || metadata.Width != 800 || metadata.DesktopName != "desk" {
+			t.Errorf("%s: unexpected metadata %+v", compression, metadata)
+		}
+		initMsg, err := compressed.ReadStartSession()
+		if err != nil || initMsg.FBHeight != 600 || string(initMsg.NameText) != "desk" {
+			t.Errorf("%s: unexpected session start %+v (%v)", compression, initMsg, err)
+		}
+		readMsg := make([]byte, len(msg))
+		if _, err := io.ReadFull(compressed, readMsg); err != nil || !bytes.Equal(readMsg, msg) {
+			t.Errorf("%s: the recorded message wasn't read back (%v)", compression, err)
+		}
+		compressed.Close()
+
+		//the repair tool understands the format too
+		if trimmed, err := RepairFbsFile(fileName); err != nil || trimmed != 0 {
+			t.Errorf("%s: repairing a valid file trimmed %d bytes (%v)", compression, trimmed, err)
+		}
+	}
+}
+
+func TestRecorderKeyframeIndex(t *testing.T) {
+	for _, compression := range []string{"", common.CompressionZstd} {
+		fileName := filepath.Join(t.TempDir(), "rec.rbs")
+		rec, err := NewRecorderWithConfig(fileName, RecorderConfig{
+			Compression:      compression,
+			KeyframeInterval: time.Millisecond,
+			RequestKeyframe:  func() {},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentServerInitMessage, Message: &common.ServerInit{
+			FBWidth:     800,
+			FBHeight:    600,
+			PixelFormat: *common.NewPixelFormat(32),
+			NameText:    []byte("desk"),
+		}})
+		//every other update is the requested full screen update
+		for i := 0; i < 6; i++ {
+			time.Sleep(5 * time.Millisecond)
+			rec.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageStart, UpcomingObjectType: int(common.FramebufferUpdate)})
+			rec.Consume(&common.RfbSegment{SegmentType: common.SegmentBytes, Bytes: []byte{byte(common.FramebufferUpdate), byte(i), 0, 0}})
+			rec.Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedServerMessage, Message: fullUpdate(800, 600, common.EncRaw)})
+		}
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentConnectionClosed})
+		<-rec.Done()
+
+		entries, err := common.ReadRecordingIndex(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//the first update is a keyframe, then every update following a request
+		if len(entries) != 3 {
+			t.Fatalf("%q: expected a keyframe for every other update, got %v", compression, entries)
+		}
+
+		reader, err := player.OpenRecording(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reader.ReadStartSession(); err != nil {
+			t.Fatal(err)
+		}
+		lastMessage := -1
+		for _, entry := range entries {
+			if err := reader.(player.SeekableStreamFileReader).SeekTo(entry.Time()); err != nil {
+				t.Fatalf("%q: %s", compression, err)
+			}
+			msg := make([]byte, 4)
+			if _, err := io.ReadFull(reader, msg); err != nil || msg[0] != byte(common.FramebufferUpdate) || int(msg[1]) <= lastMessage {
+				t.Errorf("%q: seeking to %v didn't start at a later update: %v (%v)", compression, entry, msg, err)
+			}
+			lastMessage = int(msg[1])
+		}
+		reader.(io.Closer).Close()
+	}
+}
+
+func TestRecorderAuditLog(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "rec.rbs")
+	rec, err := NewRecorderWithConfig(fileName, RecorderConfig{AuditLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentServerInitMessage, Message: &common.ServerInit{
+		FBWidth:     800,
+		FBHeight:    600,
+		PixelFormat: *common.NewPixelFormat(32),
+	}})
+	client := func(msg common.ClientMessage) {
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedClientMessage, Message: msg})
+	}
+	client(&wsserver.MsgKeyEvent{Down: 1, Key: 'a'})
+	client(&wsserver.MsgKeyEvent{Down: 0, Key: 0xff0d})
+	client(&wsserver.MsgPointerEvent{Mask: 0, X: 5, Y: 5})
+	client(&wsserver.MsgPointerEvent{Mask: 1, X: 10, Y: 20})
+	client(&wsserver.MsgPointerEvent{Mask: 1, X: 15, Y: 20})
+	client(&wsserver.MsgPointerEvent{Mask: 0, X: 15, Y: 20})
+	client(&wsserver.MsgClientCutText{Length: 6, Text: []byte("copied")})
+	cutText := append([]byte{byte(common.ServerCutText), 0, 0, 0, 0, 0, 0, 5}, "paste"...)
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageStart, UpcomingObjectType: int(common.ServerCutText)})
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentBytes, Bytes: cutText[:4]})
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentBytes, Bytes: cutText[4:]})
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageEnd, UpcomingObjectType: int(common.ServerCutText)})
+	rec.Close()
+
+	data, err := os.ReadFile(common.RecordingAuditFileName(fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []common.RecordingAuditEvent
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var event common.RecordingAuditEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			t.Fatal(err)
+		}
+		event.Timestamp = 0
+		events = append(events, event)
+	}
+	expected := []common.RecordingAuditEvent{
+		{Type: common.AuditKeyDown, Key: "a", Keysym: 'a'},
+		{Type: common.AuditKeyUp, Key: "Return", Keysym: 0xff0d},
+		{Type: common.AuditMouseDown, Button: 1, X: 10, Y: 20},
+		{Type: common.AuditMouseUp, Button: 1, X: 15, Y: 20},
+		{Type: common.AuditClipboard, Direction: common.AuditFromClient, Text: "copied"},
+		{Type: common.AuditClipboard, Direction: common.AuditFromServer, Text: "paste"},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %+v", len(expected), events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Errorf("event %d: expected %+v, got %+v", i, expected[i], events[i])
+		}
+	}
+}
+
+func TestRecorderKeyframeAfterResize(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "rec.rbs")
+	rec, err := NewRecorderWithConfig(fileName, RecorderConfig{
+		KeyframeInterval: time.Millisecond,
+		RequestKeyframe:  func() {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentServerInitMessage, Message: &common.ServerInit{
+		FBWidth:     800,
+		FBHeight:    600,
+		PixelFormat: *common.NewPixelFormat(32),
+		NameText:    []byte("desk"),
+	}})
+	resize := &client.MsgFramebufferUpdate{Rectangles: []common.Rectangle{
+		{Width: 1024, Height: 768, Enc: &encodings.EncDesktopSizePseudo{Width: 1024, Height: 768}},
+	}}
+	//the resize isn't a keyframe, the full screen update after it is
+	for i, update := range []*client.MsgFramebufferUpdate{resize, fullUpdate(1024, 768, common.EncRaw)} {
+		time.Sleep(5 * time.Millisecond)
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageStart, UpcomingObjectType: int(common.FramebufferUpdate)})
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentBytes, Bytes: []byte{byte(common.FramebufferUpdate), byte(i), 0, 0}})
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedServerMessage, Message: update})
+	}
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentConnectionClosed})
+	<-rec.Done()
+
+	entries, err := common.ReadRecordingIndex(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := player.OpenRecording(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.(io.Closer).Close()
+	if _, err := reader.ReadStartSession(); err != nil {
+		t.Fatal(err)
+	}
+	//the keyframe after the resize starts with the new size
+	if err := reader.(player.SeekableStreamFileReader).SeekTo(entries[len(entries)-1].Time()); err != nil {
+		t.Fatal(err)
+	}
+	desktopSize := common.DesktopSizeUpdate(1024, 768)
+	msg := make([]byte, len(desktopSize)+4)
+	if _, err := io.ReadFull(reader, msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !bytes.Equal(msg[:len(desktopSize)], desktopSize) || msg[len(desktopSize)+1] != 1 {
+		t.Errorf("the keyframe after the resize doesn't start with a DesktopSize update: %v", msg)
+	}
+}
+
+// fullUpdate is a parsed FramebufferUpdate covering a width x height screen with 4 rectangles of the encoding
+func fullUpdate(width, height uint16, enc common.EncodingType) *client.MsgFramebufferUpdate {
+	update := &client.MsgFramebufferUpdate{}
+	for i := uint16(0); i < 4; i++ {
+		update.Rectangles = append(update.Rectangles, common.Rectangle{
+			Y: i * height / 4, Width: width, Height: height/4 + height%4*(i/3), Enc: &encodings.PseudoEncoding{Typ: int32(enc)},
+		})
+	}
+	return update
+}
+
+func TestRecorderKeyframeConfirmed(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "rec.rbs")
+	requests := make(chan struct{}, 10)
+	rec, err := NewRecorderWithConfig(fileName, RecorderConfig{
+		KeyframeInterval: 20 * time.Millisecond,
+		RequestKeyframe:  func() { requests <- struct{}{} },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentServerInitMessage, Message: &common.ServerInit{
+		FBWidth:     800,
+		FBHeight:    600,
+		PixelFormat: *common.NewPixelFormat(32),
+		NameText:    []byte("desk"),
+	}})
+	incremental := &client.MsgFramebufferUpdate{Rectangles: []common.Rectangle{
+		{Width: 800, Height: 600, Enc: &encodings.PseudoEncoding{Typ: int32(common.EncCopyRect)}},
+		{Width: 10, Height: 10, Enc: &encodings.PseudoEncoding{Typ: int32(common.EncRaw)}},
+	}}
+	updates := []*client.MsgFramebufferUpdate{
+		fullUpdate(800, 600, common.EncRaw),   //the vnc-client's first request, a keyframe
+		incremental,                           //the keyframe is requested
+		incremental,                           //answered late: not a keyframe
+		fullUpdate(800, 600, common.EncTight), //the requested keyframe
+		incremental,                           //requested again
+		fullUpdate(800, 600, common.EncRaw),   //a keyframe after zlib streams were used
+	}
+	for i, update := range updates {
+		time.Sleep(25 * time.Millisecond)
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageStart, UpcomingObjectType: int(common.FramebufferUpdate)})
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentBytes, Bytes: []byte{byte(common.FramebufferUpdate), byte(i), 0, 0}})
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedServerMessage, Message: update})
+	}
+	rec.Close()
+
+	entries, err := common.ReadRecordingIndex(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].ZlibStreams || entries[1].ZlibStreams || !entries[2].ZlibStreams {
+		t.Fatalf("expected keyframes for the full screen updates only, got %+v", entries)
+	}
+
+	reader, err := player.OpenRecording(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.(io.Closer).Close()
+	if _, err := reader.ReadStartSession(); err != nil {
+		t.Fatal(err)
+	}
+	seeker := reader.(player.SeekableStreamFileReader)
+	//the first Tight update starts the zlib streams, so its keyframe can be played from
+	if err := seeker.SeekTo(entries[1].Time()); err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, 4)
+	if _, err := io.ReadFull(reader, msg); err != nil || msg[1] != 3 {
+		t.Errorf("seeking didn't start at the requested full screen update: %v (%v)", msg, err)
+	}
+	if err := seeker.SeekTo(entries[2].Time()); err != common.ErrKeyframeNeedsHistory {
+		t.Errorf("expected seeking after zlib based updates to fail, got %v", err)
+	}
+}
+
+func TestRecorderKeyframeAfterConnectionReset(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "rec.rbs")
+	rec, err := NewRecorderWithConfig(fileName, RecorderConfig{
+		KeyframeInterval: time.Hour,
+		RequestKeyframe:  func() {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentServerInitMessage, Message: &common.ServerInit{
+		FBWidth:     800,
+		FBHeight:    600,
+		PixelFormat: *common.NewPixelFormat(32),
+		NameText:    []byte("desk"),
+	}})
+	update := func(i int, update *client.MsgFramebufferUpdate) {
+		time.Sleep(5 * time.Millisecond)
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageStart, UpcomingObjectType: int(common.FramebufferUpdate)})
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentBytes, Bytes: []byte{byte(common.FramebufferUpdate), byte(i), 0, 0}})
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedServerMessage, Message: update})
+	}
+	//a Tight keyframe starts the zlib streams, the reconnected vnc-server starts new ones with its full screen update
+	update(0, fullUpdate(800, 600, common.EncTight))
+	update(1, fullUpdate(800, 600, common.EncTight))
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentConnectionReset})
+	update(2, fullUpdate(800, 600, common.EncRaw))
+	rec.Close()
+
+	entries, err := common.ReadRecordingIndex(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].ZlibStreams || entries[1].ZlibStreams {
+		t.Fatalf("expected the first update & the one after the reset to be playable keyframes, got %+v", entries)
+	}
+
+	reader, err := player.OpenRecording(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.(io.Closer).Close()
+	if _, err := reader.ReadStartSession(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.(player.SeekableStreamFileReader).SeekTo(entries[1].Time()); err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, 4)
+	if _, err := io.ReadFull(reader, msg); err != nil || msg[1] != 2 {
+		t.Errorf("seeking didn't start at the update after the reset: %v (%v)", msg, err)
+	}
+}
@@ -0,0 +1,146 @@
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/logger"
+)
+
+const fbsHeader = "FBS 001.000\n"
+
+var ErrNotFbsFile = errors.New("not an fbs file")
+
+// ScanFbsFile checks the block structure of an fbs (or compressed) recording, and returns the size of its valid part:
+// the header and all complete blocks up to the first torn or invalid one, and the number of those blocks.
+// A file is valid when validSize equals its size.
+func ScanFbsFile(r io.Reader) (validSize int64, blocks int, err error) {
+	reader := bufio.NewReader(r)
+	header := make([]byte, len(fbsHeader))
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, 0, ErrNotFbsFile
+	}
+	switch string(header) {
+	case fbsHeader:
+	case common.CompressedRecordingMagic:
+		return scanCompressedBlocks(reader)
+	default:
+		return 0, 0, ErrNotFbsFile
+	}
+	validSize = int64(len(fbsHeader))
+
+	var lastTimestamp uint32
+	for {
+		var bytesLen uint32
+		if err := binary.Read(reader, binary.BigEndian, &bytesLen); err != nil {
+			return validSize, blocks, nil
+		}
+		//the recorder never writes empty blocks, a zero length is the zero filled tail of a crashed file
+		if bytesLen == 0 || bytesLen > 0x7FFFFFFC {
+			return validSize, blocks, nil
+		}
+		paddedSize := int64((bytesLen + 3) & 0x7FFFFFFC)
+		if n, err := io.CopyN(io.Discard, reader, paddedSize); err != nil || n != paddedSize {
+			return validSize, blocks, nil
+		}
+		var timestamp uint32
+		if err := binary.Read(reader, binary.BigEndian, &timestamp); err != nil {
+			return validSize, blocks, nil
+		}
+		if timestamp < lastTimestamp {
+			return validSize, blocks, nil
+		}
+		lastTimestamp = timestamp
+		validSize += 4 + paddedSize + 4
+		blocks++
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.reader.Read(p)
+	cr.count += int64(n)
+	return n, err
+}
+
+// scanCompressedBlocks is ScanFbsFile for compressed recordings, every block is decompressed to check it
+func scanCompressedBlocks(r io.Reader) (validSize int64, blocks int, err error) {
+	reader := &countingReader{reader: r, count: int64(len(common.CompressedRecordingMagic))}
+	metadata, err := common.ReadCompressedRecordingHeader(reader)
+	if err != nil {
+		return 0, 0, err
+	}
+	validSize = reader.count
+
+	var lastTimestamp uint32
+	for {
+		_, timestamp, err := common.ReadRecordingBlock(reader, metadata.Compression)
+		if err != nil || timestamp < lastTimestamp {
+			return validSize, blocks, nil
+		}
+		lastTimestamp = timestamp
+		validSize = reader.count
+		blocks++
+	}
+}
+
+// RepairFbsFile trims the damaged tail of a recording (left by a crash or a full disk) after its last complete block,
+// so it can be replayed. It returns the number of bytes removed.
+func RepairFbsFile(fileName string) (int64, error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	validSize, blocks, err := ScanFbsFile(file)
+	if err != nil {
+		return 0, err
+	}
+	trimmed := info.Size() - validSize
+	if trimmed == 0 {
+		return 0, nil
+	}
+
+	logger.Infof("RepairFbsFile: %s has %d complete blocks, trimming %d bytes", fileName, blocks, trimmed)
+	if err := file.Truncate(validSize); err != nil {
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+	return trimmed, repairIndex(fileName, validSize)
+}
+
+// repairIndex drops the keyframes of the trimmed tail from a recording's index, if it has one
+func repairIndex(fileName string, validSize int64) error {
+	entries, err := common.ReadRecordingIndex(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	index := bytes.Buffer{}
+	for _, entry := range entries {
+		if entry.Offset < validSize {
+			common.WriteRecordingIndexEntry(&index, entry)
+		}
+	}
+	return os.WriteFile(common.RecordingIndexFileName(fileName), index.Bytes(), 0644)
+}
@@ -35,6 +35,13 @@ func (p *RfbRequester) Consume(seg *common.RfbSegment) error {
 	case common.SegmentRectSeparator:
 	case common.SegmentBytes:
 	case common.SegmentFullyParsedClientMessage:
+	case common.SegmentFullyParsedServerMessage:
+		if fbUpdate, ok := seg.Message.(*client.MsgFramebufferUpdate); ok {
+			if width, height, resized := fbUpdate.DesktopSize(); resized {
+				p.Width = width
+				p.Height = height
+			}
+		}
 	case common.SegmentMessageEnd:
 		// minTimeBetweenReq := 300 * time.Millisecond
 		// timeForNextReq := p.lastRequestTime.Unix() + minTimeBetweenReq.Nanoseconds()/1000
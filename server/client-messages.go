@@ -341,3 +341,49 @@ func (msg *MsgClientQemuExtendedKey) Write(c common.IServerConn) error {
 	}
 	return nil
 }
+
+// MsgSetDesktopSize asks the server to change the framebuffer size & screen layout (ExtendedDesktopSize extension)
+type MsgSetDesktopSize struct {
+	Width   uint16
+	Height  uint16
+	Screens []common.Screen
+}
+
+func (*MsgSetDesktopSize) Type() common.ClientMessageType {
+	return common.SetDesktopSizeMsgType
+}
+
+func (*MsgSetDesktopSize) Read(c common.IServerConn) (common.ClientMessage, error) {
+	var header struct {
+		_          [1]byte // padding
+		Width      uint16
+		Height     uint16
+		NumScreens uint8
+		_          [1]byte // padding
+	}
+	if err := binary.Read(c.(*ServerConn).c, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	screens, err := common.ReadScreens(c.(*ServerConn).c, int(header.NumScreens))
+	if err != nil {
+		return nil, err
+	}
+	return &MsgSetDesktopSize{Width: header.Width, Height: header.Height, Screens: screens}, nil
+}
+
+func (msg *MsgSetDesktopSize) Write(c common.IServerConn) error {
+	if err := binary.Write(c.(*ServerConn).c, binary.BigEndian, msg.Type()); err != nil {
+		return err
+	}
+	var pad [1]byte
+	if err := binary.Write(c.(*ServerConn).c, binary.BigEndian, &pad); err != nil {
+		return err
+	}
+	if err := binary.Write(c.(*ServerConn).c, binary.BigEndian, []uint16{msg.Width, msg.Height}); err != nil {
+		return err
+	}
+	if err := binary.Write(c.(*ServerConn).c, binary.BigEndian, []uint8{uint8(len(msg.Screens)), 0}); err != nil {
+		return err
+	}
+	return common.WriteScreens(c.(*ServerConn).c, msg.Screens)
+}
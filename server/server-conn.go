@@ -42,7 +42,9 @@ type ServerConn struct {
 	// a consumer for the parsed messages, to allow for recording and proxy
 	listeners *common.MultiListener
 
-	sessionId string
+	sessionId   string
+	accessLevel common.AccessLevel
+	log         *logger.FieldLogger
 
 	quit chan struct{}
 }
@@ -71,6 +73,7 @@ func NewServerConn(c io.ReadWriter, cfg *ServerConfig) (*ServerConn, error) {
 		fbWidth:     cfg.Width,
 		fbHeight:    cfg.Height,
 		listeners:   &common.MultiListener{},
+		log:         common.ConnLogger(logger.FieldViewer, c),
 	}, nil
 }
 
@@ -103,6 +106,23 @@ func (c *ServerConn) SessionId() string {
 	return c.sessionId
 }
 
+func (c *ServerConn) SetAccessLevel(level common.AccessLevel) {
+	c.accessLevel = level
+}
+
+func (c *ServerConn) AccessLevel() common.AccessLevel {
+	return c.accessLevel
+}
+
+// SetLogger sets the logger of the connection, with the fields of the session it joined
+func (c *ServerConn) SetLogger(log *logger.FieldLogger) {
+	c.log = log
+}
+
+func (c *ServerConn) Logger() *logger.FieldLogger {
+	return c.log
+}
+
 func (c *ServerConn) Listeners() *common.MultiListener {
 	return c.listeners
 }
@@ -192,22 +212,22 @@ func (c *ServerConn) Run() error {
 		default:
 			var messageType common.ClientMessageType
 			if err := binary.Read(c, binary.BigEndian, &messageType); err != nil {
-				logger.Errorf("ServerConn.handle error: %v", err)
+				c.log.Errorf("ServerConn.handle error: %v", err)
 				return err
 			}
-			logger.Debugf("ServerConn.handle: got messagetype, %d", messageType)
+			c.log.Debugf("ServerConn.handle: got messagetype, %d", messageType)
 			msg, ok := clientMessages[messageType]
-			logger.Debugf("ServerConn.handle: found message type, %v", ok)
+			c.log.Debugf("ServerConn.handle: found message type, %v", ok)
 			if !ok {
-				logger.Errorf("ServerConn.handle: unsupported message-type: %v", messageType)
+				c.log.Errorf("ServerConn.handle: unsupported message-type: %v", messageType)
 			}
 			parsedMsg, err := msg.Read(c)
-			logger.Debugf("ServerConn.handle: got parsed messagetype, %v", parsedMsg)
+			c.log.Debugf("ServerConn.handle: got parsed messagetype, %v", parsedMsg)
 			//update connection for pixel format / color map changes
 			switch parsedMsg.Type() {
 			case common.SetPixelFormatMsgType:
 				// update pixel format
-				logger.Debugf("ClientUpdater.Consume: updating pixel format")
+				c.log.Debugf("ClientUpdater.Consume: updating pixel format")
 				pixFmtMsg := parsedMsg.(*MsgSetPixelFormat)
 				c.SetPixelFormat(&pixFmtMsg.PF)
 				if pixFmtMsg.PF.TrueColor != 0 {
@@ -217,11 +237,11 @@ func (c *ServerConn) Run() error {
 			////////
 
 			if err != nil {
-				logger.Errorf("srv err %s", err.Error())
+				c.log.Errorf("srv err %s", err.Error())
 				return err
 			}
 
-			logger.Debugf("IServerConn.Handle got ClientMessage: %s, %v", parsedMsg.Type(), parsedMsg)
+			c.log.Debugf("IServerConn.Handle got ClientMessage: %s, %v", parsedMsg.Type(), parsedMsg)
 			//TODO: treat set encodings by allowing only supported encoding in proxy configurations
 			//// if parsedMsg.Type() == common.SetEncodingsMsgType{
 			//// 	c.cfg.Encodings
@@ -233,7 +253,7 @@ func (c *ServerConn) Run() error {
 			}
 			err = c.Listeners().Consume(seg)
 			if err != nil {
-				logger.Errorf("IServerConn.Handle: listener consume err %s", err.Error())
+				c.log.Errorf("IServerConn.Handle: listener consume err %s", err.Error())
 				return err
 			}
 		}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/amitbet/vncproxy/logger"
+)
+
+// ErrServerClosed is returned by the Serve methods after Shutdown
+var ErrServerClosed = errors.New("server: server closed")
+
+// Server accepts vnc-clients on tcp and websocket listeners, and keeps track of the listeners
+// and connections so they can all be closed by Shutdown.
+type Server struct {
+	cfg *ServerConfig
+
+	mutex       sync.Mutex
+	closed      bool
+	listeners   map[net.Listener]struct{}
+	httpServers map[*http.Server]struct{}
+	conns       map[io.Closer]struct{}
+	connsWg     sync.WaitGroup
+}
+
+func NewServer(cfg *ServerConfig) *Server {
+	return &Server{
+		cfg:         cfg,
+		listeners:   make(map[net.Listener]struct{}),
+		httpServers: make(map[*http.Server]struct{}),
+		conns:       make(map[io.Closer]struct{}),
+	}
+}
+
+// ListenAndServeTCP listens on addr (host:port) and serves vnc-clients until the listener fails or the server is shut down
+func (s *Server) ListenAndServeTCP(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTCP(ln)
+}
+
+// ListenAndServeWS listens on the host of the url (http://host:port/path) and serves websocket vnc-clients on its path
+func (s *Server) ListenAndServeWS(urlStr string) error {
+	wsURL, err := url.Parse(urlStr)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", wsURL.Host)
+	if err != nil {
+		return err
+	}
+	return s.ServeWS(ln, wsURL.Path)
+}
+
+// ServeTCP serves raw rfb vnc-clients from the listener, it always returns a non-nil error
+func (s *Server) ServeTCP(ln net.Listener) error {
+	if !s.trackListener(ln, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.serveConn(c, s.cfg, "dummySession")
+	}
+}
+
+// ServeWS serves websocket vnc-clients from the listener on the given url path, it always returns a non-nil error
+func (s *Server) ServeWS(ln net.Listener, path string) error {
+	mux := http.NewServeMux()
+	mux.Handle(websocketPath(path), websocketHandler(s.cfg, s.serveConn))
+	httpServer := &http.Server{Handler: mux}
+
+	if !s.trackHTTPServer(httpServer, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.trackHTTPServer(httpServer, false)
+
+	err := httpServer.Serve(ln)
+	if err == http.ErrServerClosed {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// serveConn runs the connection on the calling goroutine, websockets are closed when their handler returns
+func (s *Server) serveConn(c io.ReadWriter, cfg *ServerConfig, sessionId string) {
+	closer, ok := c.(io.Closer)
+	if !ok {
+		logger.Errorf("Server.serveConn: connection can't be closed")
+		return
+	}
+	if !s.trackConn(closer, true) {
+		closer.Close()
+		return
+	}
+	defer s.trackConn(closer, false)
+	defer closer.Close()
+
+	if err := attachNewServerConn(c, cfg, sessionId); err != nil {
+		logger.Errorf("Error attaching new connection. %v", err)
+	}
+}
+
+// Shutdown stops all listeners, closes all vnc-client connections and waits for their handlers to finish
+// (or for the context to end).
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.closed = true
+	listeners := make([]net.Listener, 0, len(s.listeners))
+	for ln := range s.listeners {
+		listeners = append(listeners, ln)
+	}
+	httpServers := make([]*http.Server, 0, len(s.httpServers))
+	for httpServer := range s.httpServers {
+		httpServers = append(httpServers, httpServer)
+	}
+	conns := make([]io.Closer, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mutex.Unlock()
+
+	var firstErr error
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	for _, httpServer := range httpServers {
+		if err := httpServer.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.connsWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return firstErr
+}
+
+func (s *Server) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+// the track methods register (add=true) or unregister an item, registering fails once the server is closed
+
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !add {
+		delete(s.listeners, ln)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.listeners[ln] = struct{}{}
+	return true
+}
+
+func (s *Server) trackHTTPServer(httpServer *http.Server, add bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !add {
+		delete(s.httpServers, httpServer)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.httpServers[httpServer] = struct{}{}
+	return true
+}
+
+func (s *Server) trackConn(conn io.Closer, add bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !add {
+		delete(s.conns, conn)
+		s.connsWg.Done()
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.connsWg.Add(1)
+	return true
+}
@@ -1,10 +1,7 @@
 package server
 
 import (
-	"fmt"
 	"io"
-	"log"
-	"net"
 
 	"github.com/amitbet/vncproxy/common"
 )
@@ -17,6 +14,7 @@ var DefaultClientMessages = []common.ClientMessage{
 	&MsgPointerEvent{},
 	&MsgClientCutText{},
 	&MsgClientQemuExtendedKey{},
+	&MsgSetDesktopSize{},
 }
 
 // FramebufferUpdate holds a FramebufferUpdate wire format message.
@@ -44,32 +42,14 @@ type ServerConfig struct {
 	NewConnHandler ServerHandler
 }
 
-func wsHandlerFunc(ws io.ReadWriter, cfg *ServerConfig, sessionId string) {
-	err := attachNewServerConn(ws, cfg, sessionId)
-	if err != nil {
-		log.Fatalf("Error attaching new connection. %v", err)
-	}
-}
-
+// WsServe accepts websocket vnc-clients until the listener fails, use a Server to be able to shut it down
 func WsServe(url string, cfg *ServerConfig) error {
-	server := WsServer{cfg}
-	server.Listen(url, WsHandler(wsHandlerFunc))
-	return nil
+	return NewServer(cfg).ListenAndServeWS(url)
 }
 
+// TcpServe accepts tcp vnc-clients until the listener fails, use a Server to be able to shut it down
 func TcpServe(url string, cfg *ServerConfig) error {
-	ln, err := net.Listen("tcp", url)
-	if err != nil {
-		log.Fatalf("Error listen. %v", err)
-	}
-	for {
-		c, err := ln.Accept()
-		if err != nil {
-			return err
-		}
-		go attachNewServerConn(c, cfg, "dummySession")
-	}
-	return nil
+	return NewServer(cfg).ListenAndServeTCP(url)
 }
 
 func attachNewServerConn(c io.ReadWriter, cfg *ServerConfig, sessionId string) error {
@@ -80,7 +60,6 @@ func attachNewServerConn(c io.ReadWriter, cfg *ServerConfig, sessionId string) e
 	}
 
 	if err := ServerVersionHandler(cfg, conn); err != nil {
-		fmt.Errorf("err: %v\n", err)
 		conn.Close()
 		return err
 	}
@@ -1,14 +1,18 @@
 package server
 
 import (
+	"context"
+	"io"
 	"log"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/amitbet/vncproxy/common"
 	"github.com/amitbet/vncproxy/encodings"
 )
 
-func newServerConnHandler(cfg *ServerConfig, conn *ServerConn) error {
+func newServerConnHandler(cfg *ServerConfig, conn common.IServerConn) error {
 
 	return nil
 }
@@ -21,7 +25,7 @@ func TestServer(t *testing.T) {
 
 	cfg := &ServerConfig{
 		//SecurityHandlers: []SecurityHandler{&ServerAuthNone{}, &ServerAuthVNC{}},
-		SecurityHandlers: []SecurityHandler{&ServerAuthVNC{"Ch_#!T@8"}},
+		SecurityHandlers: []SecurityHandler{&ServerAuthVNC{Pass: "Ch_#!T@8"}},
 		Encodings:        []common.IEncoding{&encodings.RawEncoding{}, &encodings.TightEncoding{}, &encodings.CopyRectEncoding{}},
 		PixelFormat:      common.NewPixelFormat(32),
 		ClientMessages:   DefaultClientMessages,
@@ -42,3 +46,48 @@ func TestServer(t *testing.T) {
 		}
 	}
 }
+
+func TestServerShutdown(t *testing.T) {
+	cfg := &ServerConfig{
+		SecurityHandlers: []SecurityHandler{&ServerAuthNone{}},
+		PixelFormat:      common.NewPixelFormat(32),
+		ClientMessages:   DefaultClientMessages,
+		NewConnHandler:   newServerConnHandler,
+	}
+	srv := NewServer(cfg)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.ServeTCP(ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//the server is now waiting for our protocol version
+	version := make([]byte, 12)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		t.Fatalf("reading server version: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %s", err)
+	}
+	if err := <-serveErr; err != ErrServerClosed {
+		t.Errorf("ServeTCP returned %v, expected ErrServerClosed", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+	if err := srv.ServeTCP(ln); err != ErrServerClosed {
+		t.Errorf("serving after Shutdown returned %v", err)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"github.com/amitbet/vncproxy/logger"
 
 	"golang.org/x/net/websocket"
 )
@@ -15,18 +14,24 @@ type WsServer struct {
 
 type WsHandler func(io.ReadWriter, *ServerConfig, string)
 
-
-func (wsServer *WsServer) Listen(urlStr string, handlerFunc WsHandler) {
-
+// Listen serves websocket vnc-clients on the url's host & path until the http server fails
+func (wsServer *WsServer) Listen(urlStr string, handlerFunc WsHandler) error {
 	if urlStr == "" {
 		urlStr = "/"
 	}
 	url, err := url.Parse(urlStr)
 	if err != nil {
-		logger.Errorf("error while parsing url: ", err)
+		return err
 	}
 
-	http.Handle(url.Path, websocket.Handler(
+	mux := http.NewServeMux()
+	mux.Handle(websocketPath(url.Path), websocketHandler(wsServer.cfg, handlerFunc))
+	return http.ListenAndServe(url.Host, mux)
+}
+
+// websocketHandler upgrades to a binary websocket, the session id is the request path
+func websocketHandler(cfg *ServerConfig, handlerFunc WsHandler) websocket.Handler {
+	return websocket.Handler(
 		func(ws *websocket.Conn) {
 			path := ws.Request().URL.Path
 			var sessionId string
@@ -35,11 +40,13 @@ func (wsServer *WsServer) Listen(urlStr string, handlerFunc WsHandler) {
 			}
 
 			ws.PayloadType = websocket.BinaryFrame
-			handlerFunc(ws, wsServer.cfg, sessionId)
-		}))
+			handlerFunc(ws, cfg, sessionId)
+		})
+}
 
-	err = http.ListenAndServe(url.Host, nil)
-	if err != nil {
-		panic("ListenAndServe: " + err.Error())
+func websocketPath(path string) string {
+	if path == "" {
+		return "/"
 	}
+	return path
 }
@@ -0,0 +1,65 @@
+package wsserver
+
+import (
+	"bytes"
+	"crypto/des"
+	"net/http"
+	"strings"
+
+	"github.com/amitbet/vncproxy/common"
+)
+
+// Credentials is what a vnc-client presented when connecting, only the fields of the method it used are set
+type Credentials struct {
+	SessionId  string
+	RemoteAddr string
+
+	// vnc authentication: the challenge sent to the client and its response, see CheckVNCResponse
+	VNCChallenge []byte
+	VNCResponse  []byte
+
+	// VeNCrypt Plain
+	Username string
+	Password string
+
+	// token sent with the websocket upgrade request
+	Token string
+}
+
+// Authenticator decides if a vnc-client may connect, an error denies the connection.
+type Authenticator interface {
+	Authenticate(creds *Credentials) (common.AccessLevel, error)
+}
+
+// CheckVNCResponse returns true if response is the vnc authentication challenge encrypted with password
+func CheckVNCResponse(password string, challenge []byte, response []byte) bool {
+	if len(challenge) != 16 || len(response) != 16 {
+		return false
+	}
+	bk, err := des.NewCipher(fixDesKey(password))
+	if err != nil {
+		return false
+	}
+	expected := make([]byte, 16)
+	bk.Encrypt(expected, challenge)         //Encrypt first 8 bytes
+	bk.Encrypt(expected[8:], challenge[8:]) // Encrypt second 8 bytes
+	return bytes.Equal(response, expected)
+}
+
+// newCredentials fills the connection details of the credentials
+func newCredentials(c common.IServerConn) *Credentials {
+	creds := &Credentials{SessionId: c.SessionId()}
+	if addrConn, ok := c.(interface{ RemoteAddr() string }); ok {
+		creds.RemoteAddr = addrConn.RemoteAddr()
+	}
+	return creds
+}
+
+// requestToken reads an authentication token from the websocket upgrade request,
+// either as a bearer token or an access_token query parameter (browsers can't set headers on websockets)
+func requestToken(r *http.Request) string {
+	if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimPrefix(authHeader, "Bearer ")
+	}
+	return r.URL.Query().Get("access_token")
+}
@@ -386,3 +386,52 @@ func (msg *MsgClientQemuExtendedKey) Write(c common.IServerConn) error {
 	c.Write(data.Bytes())
 	return nil
 }
+
+// MsgSetDesktopSize asks the server to change the framebuffer size & screen layout (ExtendedDesktopSize extension)
+type MsgSetDesktopSize struct {
+	Width   uint16
+	Height  uint16
+	Screens []common.Screen
+}
+
+func (*MsgSetDesktopSize) Type() common.ClientMessageType {
+	return common.SetDesktopSizeMsgType
+}
+
+func (*MsgSetDesktopSize) Read(c common.IServerConn) (common.ClientMessage, error) {
+	var header struct {
+		_          [1]byte // padding
+		Width      uint16
+		Height     uint16
+		NumScreens uint8
+		_          [1]byte // padding
+	}
+	r, err := c.Reader()
+	if err != nil {
+		return nil, nil
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	screens, err := common.ReadScreens(r, int(header.NumScreens))
+	if err != nil {
+		return nil, err
+	}
+	return &MsgSetDesktopSize{Width: header.Width, Height: header.Height, Screens: screens}, nil
+}
+
+func (msg *MsgSetDesktopSize) Write(c common.IServerConn) error {
+	data := bytes.Buffer{}
+	if err := binary.Write(&data, binary.BigEndian, msg.Type()); err != nil {
+		return err
+	}
+	data.WriteByte(0)
+	binary.Write(&data, binary.BigEndian, []uint16{msg.Width, msg.Height})
+	data.Write([]byte{uint8(len(msg.Screens)), 0})
+	if err := common.WriteScreens(&data, msg.Screens); err != nil {
+		return err
+	}
+	c.Write(data.Bytes())
+	return nil
+}
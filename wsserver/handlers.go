@@ -83,17 +83,32 @@ func ServerVersionHandler(cfg *ServerConfig, c common.IServerConn) error {
 }
 
 func ServerSecurityHandler(cfg *ServerConfig, c common.IServerConn) error {
+	securityHandlers := cfg.SecurityHandlers
+
+	//a valid token from the websocket upgrade replaces the rfb authentication
+	if tokenConn, ok := c.(interface{ AuthToken() string }); ok && cfg.Authenticator != nil && tokenConn.AuthToken() != "" {
+		creds := newCredentials(c)
+		creds.Token = tokenConn.AuthToken()
+		level, err := cfg.Authenticator.Authenticate(creds)
+		if err != nil {
+			logger.Warnf("ServerSecurityHandler: session %s, client %s denied: %s", creds.SessionId, creds.RemoteAddr, err)
+			writeSecurityFailure(c, "Authentication failed")
+			return err
+		}
+		c.SetAccessLevel(level)
+		securityHandlers = []SecurityHandler{&ServerAuthNone{}}
+	}
 
 	sec := bytes.Buffer{}
 
-	if err := binary.Write(&sec, binary.BigEndian, uint8(len(cfg.SecurityHandlers))); err != nil {
+	if err := binary.Write(&sec, binary.BigEndian, uint8(len(securityHandlers))); err != nil {
 		return err
 	}
 
 	c.Write(sec.Bytes())
 
 	sectypemsg := bytes.Buffer{}
-	for _, sectype := range cfg.SecurityHandlers {
+	for _, sectype := range securityHandlers {
 		if err := binary.Write(&sectypemsg, binary.BigEndian, sectype.Type()); err != nil {
 			return err
 		}
@@ -116,7 +131,7 @@ func ServerSecurityHandler(cfg *ServerConfig, c common.IServerConn) error {
 	}
 
 	secTypes := make(map[SecurityType]SecurityHandler)
-	for _, sType := range cfg.SecurityHandlers {
+	for _, sType := range securityHandlers {
 		secTypes[sType.Type()] = sType
 	}
 
@@ -144,7 +159,7 @@ func ServerSecurityHandler(cfg *ServerConfig, c common.IServerConn) error {
 
 		autherrmsg := bytes.Buffer{}
 
-		if err := binary.Write(&autherrmsg, binary.BigEndian, len(authErr.Error())); err != nil {
+		if err := binary.Write(&autherrmsg, binary.BigEndian, uint32(len(authErr.Error()))); err != nil {
 			return err
 		}
 		if err := binary.Write(&autherrmsg, binary.BigEndian, []byte(authErr.Error())); err != nil {
@@ -161,6 +176,16 @@ func ServerSecurityHandler(cfg *ServerConfig, c common.IServerConn) error {
 	return nil
 }
 
+// writeSecurityFailure refuses the connection by sending an empty list of security types and the reason. See 7.1.2
+func writeSecurityFailure(c common.IServerConn, reason string) error {
+	msg := bytes.Buffer{}
+	binary.Write(&msg, binary.BigEndian, uint8(0))
+	binary.Write(&msg, binary.BigEndian, uint32(len(reason)))
+	msg.WriteString(reason)
+	_, err := c.Write(msg.Bytes())
+	return err
+}
+
 func ServerServerInitHandler(cfg *ServerConfig, c common.IServerConn) error {
 	srvInit := &common.ServerInit{
 		FBWidth:     c.Width(),
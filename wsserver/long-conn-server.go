@@ -3,6 +3,7 @@ package wsserver
 import (
 	"net/http"
 	"net/url"
+	"sync"
 
 	"github.com/amitbet/vncproxy/logger"
 	"github.com/gorilla/websocket"
@@ -13,7 +14,13 @@ type LongConnServerConfig struct {
 }
 
 type LongConnServer struct {
-	cfg *LongConnServerConfig
+	cfg   *LongConnServerConfig
+	mutex sync.Mutex
+	conns map[*websocket.Conn]struct{}
+}
+
+func NewLongConnServer(cfg *LongConnServerConfig) *LongConnServer {
+	return &LongConnServer{cfg: cfg, conns: make(map[*websocket.Conn]struct{})}
 }
 
 type LongConn struct {
@@ -27,6 +34,7 @@ type LongConnServerHandler func(*websocket.Conn, *LongConnServerConfig, string)
 func wsLongHandlerFunc(ws *websocket.Conn, cfg *LongConnServerConfig, sessionId string) {
 
 	conn := LongConn{
+		c:    ws,
 		cfg:  cfg,
 		quit: make(chan struct{}),
 	}
@@ -38,7 +46,7 @@ func wsLongHandlerFunc(ws *websocket.Conn, cfg *LongConnServerConfig, sessionId
 		default:
 			mt, data, err := conn.c.ReadMessage()
 			if err != nil {
-				continue
+				return
 			}
 
 			logger.Debugf("%d %s", mt, string(data))
@@ -47,10 +55,23 @@ func wsLongHandlerFunc(ws *websocket.Conn, cfg *LongConnServerConfig, sessionId
 }
 
 func WsLongServer(url string, cfg *LongConnServerConfig) error {
-	server := LongConnServer{cfg}
+	server := NewLongConnServer(cfg)
 	logger.Debugf("LongConnServer")
-	server.Listen(url, LongConnServerHandler(wsLongHandlerFunc))
-	return nil
+	return server.Listen(url, LongConnServerHandler(wsLongHandlerFunc))
+}
+
+// Handler serves the long connections on the url's path, for running the server on an own listener & http.Server
+func (wsServer *LongConnServer) Handler(urlStr string) (http.Handler, error) {
+	return wsServer.handler(urlStr, LongConnServerHandler(wsLongHandlerFunc))
+}
+
+// CloseConns closes the open long connections, http.Server.Shutdown doesn't close upgraded connections
+func (wsServer *LongConnServer) CloseConns() {
+	wsServer.mutex.Lock()
+	defer wsServer.mutex.Unlock()
+	for conn := range wsServer.conns {
+		conn.Close()
+	}
 }
 
 var upgraderLong = websocket.Upgrader{
@@ -61,17 +82,27 @@ var upgraderLong = websocket.Upgrader{
 	},
 }
 
-func (wsServer *LongConnServer) Listen(urlStr string, handlerFunc LongConnServerHandler) {
+func (wsServer *LongConnServer) Listen(urlStr string, handlerFunc LongConnServerHandler) error {
+	handler, err := wsServer.handler(urlStr, handlerFunc)
+	if err != nil {
+		return err
+	}
+	url, _ := url.Parse(urlStr)
+	return http.ListenAndServe(url.Host, handler)
+}
 
+func (wsServer *LongConnServer) handler(urlStr string, handlerFunc LongConnServerHandler) (http.Handler, error) {
 	if urlStr == "" {
 		urlStr = "/"
 	}
 	url, err := url.Parse(urlStr)
 	if err != nil {
-		logger.Errorf("error while parsing url: ", err)
+		logger.Errorf("error while parsing url: %s", err)
+		return nil, err
 	}
 
-	http.HandleFunc(url.Path,
+	mux := http.NewServeMux()
+	mux.HandleFunc(url.Path,
 		func(w http.ResponseWriter, r *http.Request) {
 			path := r.URL.Path
 			var sessionId string
@@ -86,11 +117,18 @@ func (wsServer *LongConnServer) Listen(urlStr string, handlerFunc LongConnServer
 				return
 			}
 
+			wsServer.mutex.Lock()
+			wsServer.conns[conn] = struct{}{}
+			wsServer.mutex.Unlock()
+			defer func() {
+				wsServer.mutex.Lock()
+				delete(wsServer.conns, conn)
+				wsServer.mutex.Unlock()
+				conn.Close()
+			}()
+
 			handlerFunc(conn, wsServer.cfg, sessionId)
 		})
 
-	err = http.ListenAndServe(url.Host, nil)
-	if err != nil {
-		panic("ListenAndServe: " + err.Error())
-	}
+	return mux, nil
 }
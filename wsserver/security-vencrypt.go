@@ -0,0 +1,177 @@
+package wsserver
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/logger"
+)
+
+// TLSUpgrader is implemented by connections that can switch to tls in the middle of the rfb handshake
+type TLSUpgrader interface {
+	UpgradeToTLS(cfg *tls.Config) error
+}
+
+// ServerAuthVeNCrypt is the VeNCrypt (version 0.2) security type, see https://www.berrange.com/~dan/vencrypt.txt
+//
+// The TLS* sub-types are meant to use anonymous tls, which the go tls stack doesn't implement, so they are served
+// with the configured certificate as well (clients must not insist on anonymous cipher suites). X509* sub-types
+// are the same on the wire, the client is expected to verify the certificate.
+// The *VNC sub-types run VNCAuth inside the tls tunnel, the *Plain ones check a username & password against
+// the Authenticator, or PlainUsers when there is none.
+type ServerAuthVeNCrypt struct {
+	// the sub-types offered to the client, in order of preference
+	SubTypes []SecuritySubType
+	// server certificate for all TLS* & X509* sub-types
+	TLSConfig *tls.Config
+	// the password check used by TLSVNC & X509VNC
+	VNCAuth *ServerAuthVNC
+	// username -> password, used by Plain, TLSPlain & X509Plain
+	PlainUsers map[string]string
+	// replaces PlainUsers when set
+	Authenticator Authenticator
+}
+
+// NewServerAuthVeNCrypt creates a VeNCrypt handler from a PEM encoded certificate & key pair
+func NewServerAuthVeNCrypt(certFile, keyFile string, subTypes ...SecuritySubType) (*ServerAuthVeNCrypt, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &ServerAuthVeNCrypt{
+		SubTypes:  subTypes,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}, nil
+}
+
+func (*ServerAuthVeNCrypt) Type() SecurityType {
+	return SecTypeVeNCrypt
+}
+
+func (*ServerAuthVeNCrypt) SubType() SecuritySubType {
+	return SecSubTypeUnknown
+}
+
+func (auth *ServerAuthVeNCrypt) Auth(c common.IServerConn) error {
+	//version negotiation, only 0.2 is supported
+	if _, err := c.Write([]byte{0, 2}); err != nil {
+		return err
+	}
+	var version [2]uint8
+	if err := binary.Read(c, binary.BigEndian, &version); err != nil {
+		return err
+	}
+	if version[0] != 0 || version[1] != 2 {
+		c.Write([]byte{1})
+		return fmt.Errorf("unsupported VeNCrypt version %d.%d", version[0], version[1])
+	}
+	if _, err := c.Write([]byte{0}); err != nil {
+		return err
+	}
+
+	//sub-type negotiation
+	if err := binary.Write(c, binary.BigEndian, uint8(len(auth.SubTypes))); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, auth.SubTypes); err != nil {
+		return err
+	}
+	var subType SecuritySubType
+	if err := binary.Read(c, binary.BigEndian, &subType); err != nil {
+		return err
+	}
+	if !auth.offers(subType) {
+		return fmt.Errorf("VeNCrypt sub-type %d was not offered", subType)
+	}
+	logger.Debugf("ServerAuthVeNCrypt.Auth: client chose sub-type %d", subType)
+
+	switch subType {
+	case SecSubTypeVeNCrypt02TLSNone, SecSubTypeVeNCrypt02TLSVNC, SecSubTypeVeNCrypt02TLSPlain,
+		SecSubTypeVeNCrypt02X509None, SecSubTypeVeNCrypt02X509VNC, SecSubTypeVeNCrypt02X509Plain:
+		if err := auth.startTLS(c); err != nil {
+			return err
+		}
+	}
+
+	switch subType {
+	case SecSubTypeVeNCrypt02TLSNone, SecSubTypeVeNCrypt02X509None:
+		return nil
+	case SecSubTypeVeNCrypt02TLSVNC, SecSubTypeVeNCrypt02X509VNC:
+		if auth.VNCAuth == nil {
+			return errors.New("VeNCrypt: no vnc password configured")
+		}
+		return auth.VNCAuth.Auth(c)
+	case SecSubTypeVeNCrypt02Plain, SecSubTypeVeNCrypt02TLSPlain, SecSubTypeVeNCrypt02X509Plain:
+		return auth.plainAuth(c)
+	}
+	return fmt.Errorf("VeNCrypt sub-type %d not implemented", subType)
+}
+
+func (auth *ServerAuthVeNCrypt) offers(subType SecuritySubType) bool {
+	for _, st := range auth.SubTypes {
+		if st == subType {
+			return true
+		}
+	}
+	return false
+}
+
+func (auth *ServerAuthVeNCrypt) startTLS(c common.IServerConn) error {
+	upgrader, ok := c.(TLSUpgrader)
+	if !ok || auth.TLSConfig == nil {
+		c.Write([]byte{0})
+		return errors.New("VeNCrypt: tls is not available on this connection")
+	}
+	//tell the client to start the tls handshake
+	if _, err := c.Write([]byte{1}); err != nil {
+		return err
+	}
+	if err := upgrader.UpgradeToTLS(auth.TLSConfig); err != nil {
+		logger.Errorf("ServerAuthVeNCrypt: tls handshake failed: %s", err)
+		return err
+	}
+	return nil
+}
+
+func (auth *ServerAuthVeNCrypt) plainAuth(c common.IServerConn) error {
+	var lengths [2]uint32
+	if err := binary.Read(c, binary.BigEndian, &lengths); err != nil {
+		return err
+	}
+	//usernames & passwords are short, don't let a client make us allocate anything big
+	if lengths[0] > 1024 || lengths[1] > 1024 {
+		return errors.New("VeNCrypt: plain credentials too long")
+	}
+	username := make([]byte, lengths[0])
+	password := make([]byte, lengths[1])
+	if _, err := io.ReadFull(c, username); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, password); err != nil {
+		return err
+	}
+
+	if auth.Authenticator != nil {
+		creds := newCredentials(c)
+		creds.Username = string(username)
+		creds.Password = string(password)
+		level, err := auth.Authenticator.Authenticate(creds)
+		if err != nil {
+			logger.Warnf("ServerAuthVeNCrypt: session %s, user %s from %s denied: %s", creds.SessionId, creds.Username, creds.RemoteAddr, err)
+			return errors.New("Authentication failed")
+		}
+		c.SetAccessLevel(level)
+		return nil
+	}
+
+	expected, ok := auth.PlainUsers[string(username)]
+	if !ok || expected != string(password) {
+		return errors.New("Authentication failed")
+	}
+	c.SetAccessLevel(common.AccessLevelFull)
+	return nil
+}
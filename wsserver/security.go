@@ -1,13 +1,13 @@
 package wsserver
 
 import (
-	"bytes"
-	"crypto/des"
 	"crypto/rand"
 	"errors"
+	"io"
 	"log"
 
 	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/logger"
 )
 
 type SecurityType uint8
@@ -185,8 +185,13 @@ func (*ServerAuthNone) SubType() SecuritySubType {
 // }
 
 // ServerAuthVNC is the standard password authentication. See 7.2.2.
+// When ViewOnlyPass is set, vnc-clients using it are accepted with a view-only access level,
+// similar to the primary/view-only passwords of TightVNC.
+// When an Authenticator is set it decides instead of the passwords.
 type ServerAuthVNC struct {
-	Pass string
+	Pass          string
+	ViewOnlyPass  string
+	Authenticator Authenticator
 }
 
 func (*ServerAuthVNC) Type() SecurityType {
@@ -209,29 +214,49 @@ func (auth *ServerAuthVNC) Auth(c common.IServerConn) error {
 	}
 	//c.Flush()
 	buf2 := make([]byte, 16)
-	_, err2 := c.Read(buf2[:16])
+	_, err2 := io.ReadFull(c, buf2)
 	if err2 != nil {
 		log.Printf("The authentication result was not read: %s\n", err.Error())
 		return errors.New("The authentication result was not read" + err.Error())
 	}
-	AuthText := auth.Pass
-	bk, err := des.NewCipher([]byte(fixDesKey(AuthText)))
-	if err != nil {
-		log.Printf("Error generating authentication cipher: %s\n", err.Error())
-		return errors.New("Error generating authentication cipher")
+
+	level, ok := auth.check(c, buf[:16], buf2)
+	if ok {
+		c.SetAccessLevel(level)
+		return nil
+	}
+
+	// If the result does not decrypt correctly to what we sent then a problem
+	SetUint32(buf, 0, 1)
+	SetUint32(buf, 4, uint32(len([]byte(AUTH_FAIL))))
+	copy(buf[8:], []byte(AUTH_FAIL))
+	c.Write(buf)
+	//c.Flush()
+	return errors.New("Authentication failed")
+}
+
+// check returns the access level of the client's response, or false if no password matches
+func (auth *ServerAuthVNC) check(c common.IServerConn, challenge []byte, response []byte) (common.AccessLevel, bool) {
+	if auth.Authenticator != nil {
+		creds := newCredentials(c)
+		creds.VNCChallenge = append([]byte{}, challenge...)
+		creds.VNCResponse = response
+		level, err := auth.Authenticator.Authenticate(creds)
+		if err != nil {
+			logger.Warnf("ServerAuthVNC: session %s, client %s denied: %s", creds.SessionId, creds.RemoteAddr, err)
+			return level, false
+		}
+		return level, true
 	}
-	buf3 := make([]byte, 16)
-	bk.Encrypt(buf3, buf)               //Encrypt first 8 bytes
-	bk.Encrypt(buf3[8:], buf[8:])       // Encrypt second 8 bytes
-	if bytes.Compare(buf2, buf3) != 0 { // If the result does not decrypt correctly to what we sent then a problem
-		SetUint32(buf, 0, 1)
-		SetUint32(buf, 4, uint32(len([]byte(AUTH_FAIL))))
-		copy(buf[8:], []byte(AUTH_FAIL))
-		c.Write(buf)
-		//c.Flush()
-		return errors.New("Authentication failed")
+
+	//an empty password would accept the response of any vnc-client with a blank password
+	if auth.Pass != "" && CheckVNCResponse(auth.Pass, challenge, response) {
+		return common.AccessLevelFull, true
 	}
-	return nil
+	if auth.ViewOnlyPass != "" && CheckVNCResponse(auth.ViewOnlyPass, challenge, response) {
+		return common.AccessLevelViewOnly, true
+	}
+	return common.AccessLevelFull, false
 }
 
 // SetUint32 set 4 bytes at pos in buf to the val (in big endian format)
@@ -0,0 +1,139 @@
+package wsserver
+
+import (
+	"crypto/des"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/internal/testutil"
+)
+
+// answerChallenge plays the vnc-client side of the vnc authentication
+func answerChallenge(t *testing.T, nc net.Conn, password string) {
+	challenge := make([]byte, 16)
+	if _, err := io.ReadFull(nc, challenge); err != nil {
+		t.Errorf("error reading challenge: %s", err)
+		return
+	}
+	bk, _ := des.NewCipher([]byte(fixDesKey(password)))
+	response := make([]byte, 16)
+	bk.Encrypt(response, challenge)
+	bk.Encrypt(response[8:], challenge[8:])
+	nc.Write(response)
+}
+
+func TestServerAuthVNCAccessLevels(t *testing.T) {
+	auth := &ServerAuthVNC{Pass: "full", ViewOnlyPass: "viewer"}
+	cfg := &ServerConfig{ClientMessages: DefaultClientMessages}
+
+	tests := []struct {
+		password string
+		level    common.AccessLevel
+		fail     bool
+	}{
+		{"full", common.AccessLevelFull, false},
+		{"viewer", common.AccessLevelViewOnly, false},
+		{"wrong", common.AccessLevelFull, true},
+	}
+	for _, tt := range tests {
+		serverSide, clientSide := net.Pipe()
+		conn, _ := NewServerConnIO(serverSide, cfg)
+		// start from the opposite level to make sure Auth sets it
+		conn.SetAccessLevel(common.AccessLevelViewOnly)
+
+		go func() {
+			answerChallenge(t, clientSide, tt.password)
+			io.Copy(io.Discard, clientSide)
+		}()
+
+		err := auth.Auth(conn)
+		serverSide.Close()
+		clientSide.Close()
+
+		if tt.fail {
+			if err == nil {
+				t.Errorf("password %q: expected authentication to fail", tt.password)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("password %q: unexpected error: %s", tt.password, err)
+		}
+		if conn.AccessLevel() != tt.level {
+			t.Errorf("password %q: access level = %s, want %s", tt.password, conn.AccessLevel(), tt.level)
+		}
+	}
+}
+
+func TestServerAuthVNCBlankPassword(t *testing.T) {
+	//without a full-control password, a blank password mustn't give full access
+	auth := &ServerAuthVNC{ViewOnlyPass: "viewer"}
+	cfg := &ServerConfig{ClientMessages: DefaultClientMessages}
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+	conn, _ := NewServerConnIO(serverSide, cfg)
+
+	go func() {
+		answerChallenge(t, clientSide, "")
+		io.Copy(io.Discard, clientSide)
+	}()
+	if err := auth.Auth(conn); err == nil {
+		t.Errorf("a blank password was accepted with access level %s", conn.AccessLevel())
+	}
+}
+
+func TestServerAuthVeNCryptX509VNC(t *testing.T) {
+	cert, _ := testutil.SelfSignedCert(t, "vncproxy-test")
+	auth := &ServerAuthVeNCrypt{
+		SubTypes:  []SecuritySubType{SecSubTypeVeNCrypt02X509VNC, SecSubTypeVeNCrypt02X509Plain},
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		VNCAuth:   &ServerAuthVNC{Pass: "full", ViewOnlyPass: "viewer"},
+	}
+
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+	conn, _ := NewServerConnIO(serverSide, &ServerConfig{ClientMessages: DefaultClientMessages})
+
+	go func() {
+		var version [2]uint8
+		binary.Read(clientSide, binary.BigEndian, &version)
+		clientSide.Write([]byte{0, 2})
+
+		var status, count uint8
+		binary.Read(clientSide, binary.BigEndian, &status)
+		binary.Read(clientSide, binary.BigEndian, &count)
+		subTypes := make([]SecuritySubType, count)
+		binary.Read(clientSide, binary.BigEndian, subTypes)
+		if status != 0 || count != 2 || subTypes[0] != SecSubTypeVeNCrypt02X509VNC {
+			t.Errorf("unexpected negotiation: status=%d, sub-types=%v", status, subTypes)
+			return
+		}
+		binary.Write(clientSide, binary.BigEndian, SecSubTypeVeNCrypt02X509VNC)
+
+		var ack uint8
+		binary.Read(clientSide, binary.BigEndian, &ack)
+		if ack != 1 {
+			t.Errorf("server did not accept the tls sub-type")
+			return
+		}
+		tlsConn := tls.Client(clientSide, &tls.Config{InsecureSkipVerify: true})
+		answerChallenge(t, tlsConn, "viewer")
+		io.Copy(io.Discard, tlsConn)
+	}()
+
+	if err := auth.Auth(conn); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := conn.Conn().(*tls.Conn); !ok {
+		t.Error("connection was not upgraded to tls")
+	}
+	if conn.AccessLevel() != common.AccessLevelViewOnly {
+		t.Errorf("access level = %s, want viewOnly", conn.AccessLevel())
+	}
+}
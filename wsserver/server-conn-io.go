@@ -1,9 +1,12 @@
 package wsserver
 
 import (
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"sync"
 
 	"github.com/amitbet/vncproxy/common"
@@ -42,7 +45,9 @@ type ServerConnIO struct {
 	// a consumer for the parsed messages, to allow for recording and proxy
 	listeners *common.MultiListener
 
-	sessionId string
+	sessionId   string
+	accessLevel common.AccessLevel
+	log         *logger.FieldLogger
 
 	quit chan struct{}
 }
@@ -71,6 +76,7 @@ func NewServerConnIO(c io.ReadWriter, cfg *ServerConfig) (*ServerConnIO, error)
 		fbWidth:     cfg.Width,
 		fbHeight:    cfg.Height,
 		listeners:   &common.MultiListener{},
+		log:         common.ConnLogger(logger.FieldViewer, c),
 	}, nil
 }
 
@@ -78,6 +84,20 @@ func (c *ServerConnIO) Conn() io.ReadWriter {
 	return c.c
 }
 
+// UpgradeToTLS runs a server-side tls handshake on the connection, all further traffic is encrypted
+func (c *ServerConnIO) UpgradeToTLS(cfg *tls.Config) error {
+	netConn, ok := c.c.(net.Conn)
+	if !ok {
+		return errors.New("ServerConnIO.UpgradeToTLS: not a network connection")
+	}
+	tlsConn := tls.Server(netConn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.c = tlsConn
+	return nil
+}
+
 func (c *ServerConnIO) SetEncodings(encs []common.EncodingType) error {
 	encodings := make(map[int32]common.IEncoding)
 	for _, enc := range c.cfg.Encodings {
@@ -171,6 +191,30 @@ func (c *ServerConnIO) SessionId() string {
 	return c.sessionId
 }
 
+func (c *ServerConnIO) RemoteAddr() string {
+	if netConn, ok := c.c.(net.Conn); ok {
+		return netConn.RemoteAddr().String()
+	}
+	return ""
+}
+
+func (c *ServerConnIO) SetAccessLevel(level common.AccessLevel) {
+	c.accessLevel = level
+}
+
+func (c *ServerConnIO) AccessLevel() common.AccessLevel {
+	return c.accessLevel
+}
+
+// SetLogger sets the logger of the connection, with the fields of the session it joined
+func (c *ServerConnIO) SetLogger(log *logger.FieldLogger) {
+	c.log = log
+}
+
+func (c *ServerConnIO) Logger() *logger.FieldLogger {
+	return c.log
+}
+
 func (c *ServerConnIO) Run() error {
 
 	defer func() {
@@ -192,22 +236,22 @@ func (c *ServerConnIO) Run() error {
 		default:
 			var messageType common.ClientMessageType
 			if err := binary.Read(c, binary.BigEndian, &messageType); err != nil {
-				logger.Errorf("ServerConnIO.handle error: %v", err)
+				c.log.Errorf("ServerConnIO.handle error: %v", err)
 				return err
 			}
-			logger.Debugf("ServerConnIO.handle: got messagetype, %d", messageType)
+			c.log.Debugf("ServerConnIO.handle: got messagetype, %d", messageType)
 			msg, ok := clientMessages[messageType]
-			logger.Debugf("ServerConnIO.handle: found message type, %v", ok)
+			c.log.Debugf("ServerConnIO.handle: found message type, %v", ok)
 			if !ok {
-				logger.Errorf("ServerConnIO.handle: unsupported message-type: %v", messageType)
+				c.log.Errorf("ServerConnIO.handle: unsupported message-type: %v", messageType)
 			}
 			parsedMsg, err := msg.Read(c)
-			logger.Debugf("ServerConnIO.handle: got parsed messagetype, %v", parsedMsg)
+			c.log.Debugf("ServerConnIO.handle: got parsed messagetype, %v", parsedMsg)
 			//update connection for pixel format / color map changes
 			switch parsedMsg.Type() {
 			case common.SetPixelFormatMsgType:
 				// update pixel format
-				logger.Debugf("ClientUpdater.Consume: updating pixel format")
+				c.log.Debugf("ClientUpdater.Consume: updating pixel format")
 				pixFmtMsg := parsedMsg.(*MsgSetPixelFormat)
 				c.SetPixelFormat(&pixFmtMsg.PF)
 				if pixFmtMsg.PF.TrueColor != 0 {
@@ -217,11 +261,11 @@ func (c *ServerConnIO) Run() error {
 			////////
 
 			if err != nil {
-				logger.Errorf("srv err %s", err.Error())
+				c.log.Errorf("srv err %s", err.Error())
 				return err
 			}
 
-			logger.Debugf("IServerConn.Handle got ClientMessage: %s, %v", parsedMsg.Type(), parsedMsg)
+			c.log.Debugf("IServerConn.Handle got ClientMessage: %s, %v", parsedMsg.Type(), parsedMsg)
 			//TODO: treat set encodings by allowing only supported encoding in proxy configurations
 			//// if parsedMsg.Type() == common.SetEncodingsMsgType{
 			//// 	c.cfg.Encodings
@@ -233,7 +277,7 @@ func (c *ServerConnIO) Run() error {
 			}
 			err = c.Listeners().Consume(seg)
 			if err != nil {
-				logger.Errorf("IServerConn.Handle: listener consume err %s", err.Error())
+				c.log.Errorf("IServerConn.Handle: listener consume err %s", err.Error())
 				return err
 			}
 		}
@@ -48,7 +48,11 @@ type ServerConn struct {
 	// a consumer for the parsed messages, to allow for recording and proxy
 	listeners *common.MultiListener
 
-	sessionId string
+	sessionId   string
+	accessLevel common.AccessLevel
+	log         *logger.FieldLogger
+	// token from the websocket upgrade request
+	authToken string
 
 	quit chan struct{}
 
@@ -80,6 +84,7 @@ func NewServerConn(c *websocket.Conn, cfg *ServerConfig) (*ServerConn, error) {
 		fbWidth:     cfg.Width,
 		fbHeight:    cfg.Height,
 		listeners:   &common.MultiListener{},
+		log:         common.ConnLogger(logger.FieldViewer, c),
 	}, nil
 }
 
@@ -126,6 +131,32 @@ func (c *ServerConn) SessionId() string {
 	return c.sessionId
 }
 
+func (c *ServerConn) RemoteAddr() string {
+	return c.c.RemoteAddr().String()
+}
+
+// AuthToken returns the token sent with the websocket upgrade request
+func (c *ServerConn) AuthToken() string {
+	return c.authToken
+}
+
+func (c *ServerConn) SetAccessLevel(level common.AccessLevel) {
+	c.accessLevel = level
+}
+
+func (c *ServerConn) AccessLevel() common.AccessLevel {
+	return c.accessLevel
+}
+
+// SetLogger sets the logger of the connection, with the fields of the session it joined
+func (c *ServerConn) SetLogger(log *logger.FieldLogger) {
+	c.log = log
+}
+
+func (c *ServerConn) Logger() *logger.FieldLogger {
+	return c.log
+}
+
 func (c *ServerConn) Close() error {
 	return c.c.Close()
 }
@@ -217,21 +248,21 @@ func (c *ServerConn) Run() error {
 				return err
 			}
 			if err := binary.Read(r, binary.BigEndian, &messageType); err != nil {
-				logger.Errorf("ServerConn.handle error: %v", err)
+				c.log.Errorf("ServerConn.handle error: %v", err)
 				return err
 			}
 			msg, ok := clientMessages[messageType]
-			logger.Debugf("ServerConn.handle: found message type %d, %v", messageType, ok)
+			c.log.Debugf("ServerConn.handle: found message type %d, %v", messageType, ok)
 			if !ok {
-				logger.Errorf("ServerConn.handle: unsupported message-type: %v", messageType)
+				c.log.Errorf("ServerConn.handle: unsupported message-type: %v", messageType)
 			}
 			parsedMsg, err := msg.Read(c)
-			logger.Debugf("ServerConn.handle: got parsed messagetype, %v", parsedMsg)
+			c.log.Debugf("ServerConn.handle: got parsed messagetype, %v", parsedMsg)
 			//update connection for pixel format / color map changes
 			switch parsedMsg.Type() {
 			case common.SetPixelFormatMsgType:
 				// update pixel format
-				logger.Debugf("ClientUpdater.Consume: updating pixel format")
+				c.log.Debugf("ClientUpdater.Consume: updating pixel format")
 				pixFmtMsg := parsedMsg.(*MsgSetPixelFormat)
 				c.SetPixelFormat(&pixFmtMsg.PF)
 				if pixFmtMsg.PF.TrueColor != 0 {
@@ -241,11 +272,11 @@ func (c *ServerConn) Run() error {
 			////////
 
 			if err != nil {
-				logger.Errorf("srv err %s", err.Error())
+				c.log.Errorf("srv err %s", err.Error())
 				return err
 			}
 
-			logger.Debugf("IServerConn.Handle got ClientMessage: %s, %v", parsedMsg.Type(), parsedMsg)
+			c.log.Debugf("IServerConn.Handle got ClientMessage: %s, %v", parsedMsg.Type(), parsedMsg)
 			//TODO: treat set encodings by allowing only supported encoding in proxy configurations
 			//// if parsedMsg.Type() == common.SetEncodingsMsgType{
 			//// 	c.cfg.Encodings
@@ -257,7 +288,7 @@ func (c *ServerConn) Run() error {
 			}
 			err = c.Listeners().Consume(seg)
 			if err != nil {
-				logger.Errorf("IServerConn.Handle: listener consume err %s", err.Error())
+				c.log.Errorf("IServerConn.Handle: listener consume err %s", err.Error())
 				return err
 			}
 		}
@@ -1,13 +1,8 @@
 package wsserver
 
 import (
-	"fmt"
-	"log"
-	"net"
-
 	"github.com/amitbet/vncproxy/common"
-	"github.com/amitbet/vncproxy/logger"
-	"github.com/gorilla/websocket"
+	"github.com/amitbet/vncproxy/metrics"
 )
 
 var DefaultClientMessages = []common.ClientMessage{
@@ -18,6 +13,7 @@ var DefaultClientMessages = []common.ClientMessage{
 	&MsgPointerEvent{},
 	&MsgClientCutText{},
 	&MsgClientQemuExtendedKey{},
+	&MsgSetDesktopSize{},
 }
 
 // FramebufferUpdate holds a FramebufferUpdate wire format message.
@@ -31,67 +27,67 @@ type ServerHandler func(*ServerConfig, common.IServerConn) error
 
 type ServerConfig struct {
 	SecurityHandlers []SecurityHandler
-	Encodings        []common.IEncoding
-	PixelFormat      *common.PixelFormat
-	ColorMap         *common.ColorMap
-	ClientMessages   []common.ClientMessage
-	DesktopName      []byte
-	Height           uint16
-	Width            uint16
-	UseDummySession  bool
+	// offered to websocket vnc-clients, nil = SecurityHandlers without VeNCrypt (a websocket can't be upgraded to tls)
+	WSSecurityHandlers []SecurityHandler
+	Encodings          []common.IEncoding
+	PixelFormat        *common.PixelFormat
+	ColorMap           *common.ColorMap
+	ClientMessages     []common.ClientMessage
+	DesktopName        []byte
+	Height             uint16
+	Width              uint16
+	UseDummySession    bool
+
+	// checks the tokens sent on websocket upgrade requests, connections with a valid token skip the rfb authentication
+	Authenticator Authenticator
 
 	//handler to allow for registering for messages, this can't be a channel
 	//because of the websockets handler function which will kill the connection on exit if conn.handle() is run on another thread
 	NewConnHandler ServerHandler
 }
 
-func wsHandlerFunc(ws *websocket.Conn, cfg *ServerConfig, sessionId string) {
-	conn, err := NewServerConn(ws, cfg)
-	if err != nil {
-		return
-	}
-
-	err = attachNewServerConn(conn, cfg, sessionId)
-	if err != nil {
-		log.Fatalf("Error attaching new connection. %v", err)
-	}
-}
-
+// WsServe accepts websocket vnc-clients until the listener fails, use a Server to be able to shut it down
 func WsServe(url string, cfg *ServerConfig) error {
-	server := WebsocketServer{cfg}
-	logger.Errorf("WsServe")
-	server.Listen(url, WebsocketHandler(wsHandlerFunc))
-	return nil
+	return NewServer(cfg).ListenAndServeWS(url)
 }
 
+// TcpServe accepts tcp vnc-clients until the listener fails, use a Server to be able to shut it down
 func TcpServe(url string, cfg *ServerConfig) error {
-	ln, err := net.Listen("tcp", url)
-	if err != nil {
-		log.Fatalf("Error listen. %v", err)
-	}
-	for {
-		c, err := ln.Accept()
-		if err != nil {
-			return err
-		}
-		conn, err := NewServerConnIO(c, cfg)
-		if err != nil {
-			return nil
-		}
+	return NewServer(cfg).ListenAndServeTCP(url)
+}
 
-		go attachNewServerConn(conn, cfg, "dummySession")
+var handshakeFailures = metrics.NewCounterVec("vncproxy_handshake_failures_total",
+	"vnc-client connections that failed before their session started, by stage (security includes failed authentication, connect is the connection handler).", "stage")
+
+// websocketConfig returns the config of websocket connections, with their security handlers
+func (cfg *ServerConfig) websocketConfig() *ServerConfig {
+	wsCfg := *cfg
+	wsCfg.SecurityHandlers = cfg.WSSecurityHandlers
+	if wsCfg.SecurityHandlers == nil {
+		for _, handler := range cfg.SecurityHandlers {
+			if handler.Type() != SecTypeVeNCrypt {
+				wsCfg.SecurityHandlers = append(wsCfg.SecurityHandlers, handler)
+			}
+		}
 	}
-	return nil
+	return &wsCfg
 }
 
 func attachNewServerConn(conn common.IServerConn, cfg *ServerConfig, sessionId string) error {
+	//the session is needed by the authenticator and by the handler to choose the target for this connection
+	conn.SetSessionId(sessionId)
+	if cfg.UseDummySession {
+		conn.SetSessionId("dummySession")
+	}
+
 	if err := ServerVersionHandler(cfg, conn); err != nil {
-		fmt.Errorf("err: %v\n", err)
+		handshakeFailures.With("version").Inc()
 		conn.Close()
 		return err
 	}
 
 	if err := ServerSecurityHandler(cfg, conn); err != nil {
+		handshakeFailures.With("security").Inc()
 		conn.Close()
 		return err
 	}
@@ -100,25 +96,23 @@ func attachNewServerConn(conn common.IServerConn, cfg *ServerConfig, sessionId s
 	//this is done before the init sequence to allow listening to server-init messages (and maybe even interception in the future)
 	err := cfg.NewConnHandler(cfg, conn)
 	if err != nil {
+		handshakeFailures.With("connect").Inc()
 		conn.Close()
 		return err
 	}
 
 	if err := ServerClientInitHandler(cfg, conn); err != nil {
+		handshakeFailures.With("init").Inc()
 		conn.Close()
 		return err
 	}
 
 	if err := ServerServerInitHandler(cfg, conn); err != nil {
+		handshakeFailures.With("init").Inc()
 		conn.Close()
 		return err
 	}
 
-	conn.SetSessionId(sessionId)
-	if cfg.UseDummySession {
-		conn.SetSessionId("dummySession")
-	}
-
 	//go here will kill ws connections
 	conn.Run()
 
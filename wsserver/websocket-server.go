@@ -12,7 +12,8 @@ type WebsocketServer struct {
 	cfg *ServerConfig
 }
 
-type WebsocketHandler func(*websocket.Conn, *ServerConfig, string)
+// WebsocketHandler gets the upgraded connection, the session id from the url path and the upgrade request
+type WebsocketHandler func(*websocket.Conn, *ServerConfig, string, *http.Request)
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
@@ -22,36 +23,43 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-func (wsServer *WebsocketServer) Listen(urlStr string, handlerFunc WebsocketHandler) {
+// Listen serves websocket connections on the url until the http server fails
+func (wsServer *WebsocketServer) Listen(urlStr string, handlerFunc WebsocketHandler) error {
 
 	if urlStr == "" {
 		urlStr = "/"
 	}
 	url, err := url.Parse(urlStr)
 	if err != nil {
-		logger.Errorf("error while parsing url: ", err)
+		logger.Errorf("error while parsing url: %s", err)
+		return err
 	}
 
-	http.HandleFunc(url.Path,
-		func(w http.ResponseWriter, r *http.Request) {
-			path := r.URL.Path
-			var sessionId string
-			if path != "" {
-				sessionId = path[1:]
-			}
-
-			conn, err := upgrader.Upgrade(w, r, nil)
-			if err != nil {
-				// panic(err)
-				logger.Errorf("%s, error while Upgrading websocket connection\n", err.Error())
-				return
-			}
-
-			handlerFunc(conn, wsServer.cfg, sessionId)
-		})
-
-	err = http.ListenAndServe(url.Host, nil)
-	if err != nil {
-		panic("ListenAndServe: " + err.Error())
+	mux := http.NewServeMux()
+	mux.HandleFunc(url.Path, websocketHandler(wsServer.cfg, handlerFunc))
+	return http.ListenAndServe(url.Host, mux)
+}
+
+// websocketHandler upgrades requests to websockets and passes them to handlerFunc with their session id
+func websocketHandler(cfg *ServerConfig, handlerFunc WebsocketHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		var sessionId string
+		if path != "" {
+			sessionId = path[1:]
+		}
+		//websockify style token (noVNC: path=websockify?token=...)
+		if token := r.URL.Query().Get("token"); token != "" {
+			sessionId = token
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// panic(err)
+			logger.Errorf("%s, error while Upgrading websocket connection\n", err.Error())
+			return
+		}
+
+		handlerFunc(conn, cfg.websocketConfig(), sessionId, r)
 	}
 }